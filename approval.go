@@ -0,0 +1,369 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PendingChange is a change to an environment that is parked until it is
+// approved or rejected
+type PendingChange struct {
+	ID          string    `json:"id"`
+	Org         string    `json:"org"`
+	User        string    `json:"user"`
+	Method      string    `json:"method"`
+	Environment string    `json:"environment"`
+	Requested   time.Time `json:"requested"`
+
+	// State is a hash of the environment at the time the change was parked,
+	// so an approved change is never applied over changes made in between
+	State string          `json:"state"`
+	Body  json.RawMessage `json:"body,omitempty"`
+}
+
+var approvalQueue *diskQueue
+
+func initApprovals() error {
+	if getConfig().Approval.Path == "" || getConfig().Approval.Environments == "" {
+		return nil
+	}
+	if err := os.MkdirAll(getConfig().Approval.Path, 0755); err != nil {
+		return fmt.Errorf("Failed to create approval directory %s: %s", getConfig().Approval.Path, err)
+	}
+	approvalQueue = &diskQueue{dir: getConfig().Approval.Path}
+	return nil
+}
+
+// requiresApproval returns true if changes to the environment should be
+// parked until they are approved
+func requiresApproval(env string) bool {
+	if approvalQueue == nil {
+		return false
+	}
+	for _, pattern := range splitList(getConfig().Approval.Environments) {
+		if ok, _ := path.Match(pattern, env); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalEnvironment returns the name of the environment that is created,
+// updated or deleted by the request if that change should be parked until it
+// is approved, or an empty string otherwise
+func approvalEnvironment(r *http.Request, body []byte) string {
+	if approvalQueue == nil || mux.Vars(r)["type"] != "environments" {
+		return ""
+	}
+
+	env := mux.Vars(r)["name"]
+	if r.Method == "POST" {
+		n, err := unmarshalName(body)
+		if err != nil {
+			return ""
+		}
+		env = n.Name
+	}
+	if !requiresApproval(env) {
+		return ""
+	}
+	return env
+}
+
+// environmentState returns a hash of the current config of the environment,
+// or an empty string if the environment doesn't exist
+func (cg *ChefGuard) environmentState(env string) (string, error) {
+	config, err := cg.chefConfig(fmt.Sprintf("environments/%s", env))
+	if err != nil || config == nil {
+		return "", err
+	}
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// environmentACL returns the ACL object and the permission needed to make a
+// change to the environment
+func environmentACL(method, env string) (string, string) {
+	switch method {
+	case "POST":
+		return "containers/environments", "create"
+	case "DELETE":
+		return fmt.Sprintf("environments/%s", env), "delete"
+	default:
+		return fmt.Sprintf("environments/%s", env), "update"
+	}
+}
+
+// authorizeChange verifies the signature of the request and checks if the
+// user or client that signed it is allowed to make the change to the
+// environment. The signer is used as the user of the change.
+func (cg *ChefGuard) authorizeChange(r *http.Request, env string) (int, error) {
+	user, err := authenticateRequest(r, cg.ChefOrg)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Failed to authenticate request: %s", err)
+	}
+	object, perm := environmentACL(r.Method, env)
+	allowed, err := hasPermission(cg.chefClient, user, perm, object)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("Failed to check the permissions of %s: %s", user, err)
+	}
+	if !allowed {
+		return http.StatusForbidden, fmt.Errorf("%s is not allowed to %s %s", user, perm, object)
+	}
+	cg.User = user
+	return 0, nil
+}
+
+// parkChange stores the change as a pending change and notifies the
+// approvers, instead of passing it on to Chef
+func (cg *ChefGuard) parkChange(w http.ResponseWriter, method, env string, body []byte) {
+	state, err := cg.environmentState(env)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	id := fmt.Sprintf("%d-approval", time.Now().UnixNano())
+	pc := &PendingChange{
+		Org:         cg.ChefOrg,
+		User:        cg.User,
+		Method:      method,
+		Environment: env,
+		Requested:   time.Now().UTC(),
+		State:       state,
+	}
+	if method != "DELETE" {
+		pc.Body = body
+	}
+	data, err := json.Marshal(pc)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to marshal change to environment %s: %s", env, err), http.StatusInternalServerError)
+		return
+	}
+
+	approvalQueue.Lock()
+	err = approvalQueue.write(&QueueEntry{ID: id, Version: queueVersion, Kind: "approval", Payload: data})
+	approvalQueue.Unlock()
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to park change to environment %s: %s", env, err), http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(cg.ChefOrg, "approval", cg.User, cg.ClientIP, fmt.Sprintf("environments/%s", env), fmt.Sprintf("pending: %s", id))
+	cg.sendAlert(
+		fmt.Sprintf("Change to environment %s pending approval", env),
+		fmt.Sprintf("User %s changed environment %s (%s), which requires approval before it is applied.\n\n"+
+			"Approve: POST /chef-guard/approvals/%s/approve\nReject:  POST /chef-guard/approvals/%s/reject",
+			cg.User, env, method, id, id),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Chef-Guard-Warning", fmt.Sprintf("Change is pending approval (id %s)", id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"pending_approval": id,
+		"message":          fmt.Sprintf("The change to environment %s is applied once it is approved", env),
+	})
+}
+
+// approvalsHandler lists all pending changes of the organization. The request
+// must be signed by a Chef user or client of the organization.
+func approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	org := r.URL.Query().Get("org")
+	if _, err := authenticateRequest(r, org); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+		return
+	}
+
+	ids, err := approvalQueue.ids()
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to list pending changes: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	changes := []*PendingChange{}
+	for _, id := range ids {
+		pc, err := readPendingChange(id)
+		if err != nil {
+			logf(ERROR, requestID(r), "Failed to read pending change %s: %s", id, err)
+			continue
+		}
+		if pc.Org == org {
+			changes = append(changes, pc)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode pending changes: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// approvalHandler approves or rejects a pending change. The approver is the
+// Chef user that signed the request. Without a list of approvers, the approver
+// must be allowed to make the change to the environment. Approved changes are validated again
+// and applied to the Chef server and committed to Git, unless the environment
+// was changed after the change was parked.
+func approvalHandler(w http.ResponseWriter, r *http.Request) {
+	id, action := mux.Vars(r)["id"], mux.Vars(r)["action"]
+
+	pc, err := readPendingChange(id)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("No pending change found with id %s", id), http.StatusNotFound)
+		return
+	}
+
+	approver, err := authenticateRequest(r, pc.Org)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+		return
+	}
+	if approvers := splitList(getConfig().Approval.Approvers); len(approvers) > 0 {
+		if !contains(approvers, approver) {
+			errorHandler(w, fmt.Sprintf("User %s is not allowed to approve changes", approver), http.StatusForbidden)
+			return
+		}
+	} else {
+		chefClient, err := newChefClient(pc.Org)
+		if err != nil {
+			errorHandler(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		object, perm := environmentACL(pc.Method, pc.Environment)
+		allowed, err := hasPermission(chefClient, approver, perm, object)
+		if err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to check the permissions of %s: %s", approver, err), http.StatusBadGateway)
+			return
+		}
+		if !allowed {
+			errorHandler(w, fmt.Sprintf("User %s is not allowed to approve changes to environment %s", approver, pc.Environment), http.StatusForbidden)
+			return
+		}
+	}
+	if action == "approve" && approver == pc.User {
+		errorHandler(w, fmt.Sprintf("User %s cannot approve their own change", approver), http.StatusForbidden)
+		return
+	}
+
+	// Claim the change, so it cannot be approved or rejected twice
+	approvalQueue.Lock()
+	claimed := approvalQueue.claim(id)
+	approvalQueue.Unlock()
+	if !claimed {
+		errorHandler(w, fmt.Sprintf("No pending change found with id %s", id), http.StatusNotFound)
+		return
+	}
+
+	if action == "approve" {
+		if errCode, err := applyPendingChange(r, pc); err != nil {
+			approvalQueue.Lock()
+			os.Rename(filepath.Join(approvalQueue.dir, id+".claimed"), filepath.Join(approvalQueue.dir, id+".json"))
+			approvalQueue.Unlock()
+			errorHandler(w, fmt.Sprintf("Failed to apply pending change %s: %s", id, err), errCode)
+			return
+		}
+	}
+
+	approvalQueue.Lock()
+	if err := os.Remove(filepath.Join(approvalQueue.dir, id+".claimed")); err != nil {
+		logf(ERROR, requestID(r), "Failed to remove pending change %s: %s", id, err)
+	}
+	approvalQueue.Unlock()
+
+	result := "rejected"
+	if action == "approve" {
+		result = "approved"
+	}
+	recordAudit(pc.Org, "approval", approver, clientIP(r), fmt.Sprintf("environments/%s", pc.Environment),
+		fmt.Sprintf("%s: %s (requested by %s)", result, id, pc.User))
+	sendAlert(pc.Org,
+		fmt.Sprintf("Change to environment %s %s", pc.Environment, result),
+		fmt.Sprintf("The change to environment %s made by %s was %s by %s.\n\nRequest ID: %s", pc.Environment, pc.User, result, approver, requestID(r)),
+	)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyPendingChange validates an approved change again and applies it to the
+// Chef server and commits it to Git
+func applyPendingChange(r *http.Request, pc *PendingChange) (int, error) {
+	cg, err := newChefGuardForOrg(pc.User, pc.Org, false)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Failed to create a new ChefGuard structure: %s", err)
+	}
+	cg.setRequestID(requestID(r))
+	cg.EndpointType = "environments"
+
+	state, err := cg.environmentState(pc.Environment)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	if state != pc.State {
+		return http.StatusConflict, fmt.Errorf("Environment %s was changed after the change was requested, "+
+			"please reject this change and request it again", pc.Environment)
+	}
+
+	vw := &verdictWriter{header: make(http.Header)}
+	vars := map[string]string{"type": "environments", "name": pc.Environment}
+	if cg.checkChange(vw, pc.Method, vars, pc.Body) {
+		return vw.status, fmt.Errorf("%s", strings.TrimSpace(vw.body.String()))
+	}
+
+	action := "PUT"
+	if pc.Method == "DELETE" {
+		action = "DELETE"
+	}
+	endpoint := fmt.Sprintf("environments/%s", pc.Environment)
+	if err := cg.applyChange(action, endpoint, "environments", "", pc.Body); err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	if getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) && !exemptUser("ExemptCommits", cg.ChefOrg, cg.User) {
+		cg.ChangeDetails = &changeDetails{Type: "environments", Item: fmt.Sprintf("%s.json", pc.Environment)}
+		goSafe(r, func() { cg.syncedGitUpdate(pc.Method, pc.Body) })
+	}
+
+	return 0, nil
+}
+
+func readPendingChange(id string) (*PendingChange, error) {
+	e, err := approvalQueue.read(id)
+	if err != nil {
+		return nil, err
+	}
+	pc := new(PendingChange)
+	if err := json.Unmarshal(e.Payload, pc); err != nil {
+		return nil, err
+	}
+	pc.ID = e.ID
+	if pc.Method == "" {
+		pc.Method = "PUT"
+	}
+	return pc, nil
+}
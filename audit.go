@@ -0,0 +1,139 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a single entry in the audit store
+type AuditEvent struct {
+	Schema   string    `json:"schema,omitempty" desc:"Schema ID of the event (audit/v1), missing in events written before versioning"`
+	Time     time.Time `json:"time" desc:"Time of the event in UTC"`
+	Org      string    `json:"org" desc:"Chef organization, empty when not using Chef Enterprise"`
+	Type     string    `json:"type" desc:"Event type (change, rejected, forced, override, drift or scan)"`
+	User     string    `json:"user,omitempty" desc:"Chef user that caused the event"`
+	ClientIP string    `json:"client_ip,omitempty" desc:"IP address of the workstation that made the request"`
+	Item     string    `json:"item,omitempty" desc:"Item the event applies to"`
+	Details  string    `json:"details,omitempty" desc:"Additional details, e.g. the stage that rejected a request"`
+}
+
+var auditLock sync.Mutex
+
+// recordAudit appends an event to the audit store
+func recordAudit(org, eventType, user, ip, item, details string) {
+	if getConfig().Audit.Path == "" {
+		return
+	}
+
+	data, err := json.Marshal(&AuditEvent{
+		Schema:   auditSchema,
+		Time:     time.Now().UTC(),
+		Org:      org,
+		Type:     eventType,
+		User:     user,
+		ClientIP: ip,
+		Item:     item,
+		Details:  details,
+	})
+	if err != nil {
+		ERROR.Printf("Failed to marshal %s audit event: %s", eventType, err)
+		return
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.OpenFile(getConfig().Audit.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		ERROR.Printf("Failed to open audit store %s: %s", getConfig().Audit.Path, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		ERROR.Printf("Failed to write %s audit event: %s", eventType, err)
+	}
+}
+
+// readAudit returns all events recorded in the period [from, to)
+func readAudit(from, to time.Time) ([]*AuditEvent, error) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.Open(getConfig().Audit.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*AuditEvent
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		e := new(AuditEvent)
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			WARNING.Printf("Skipping invalid audit event %q: %s", s.Text(), err)
+			continue
+		}
+		if !e.Time.Before(from) && e.Time.Before(to) {
+			events = append(events, e)
+		}
+	}
+
+	return events, s.Err()
+}
+
+// auditHandler records all requests that are rejected because they didn't
+// pass one of the checks
+func auditHandler(h http.Handler) http.Handler {
+	if getConfig().Audit.Path == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aw := &accessLogWriter{ResponseWriter: w}
+		user := r.Header.Get("X-Ops-Userid")
+
+		h.ServeHTTP(aw, r)
+
+		if aw.status == http.StatusPreconditionFailed {
+			recordAudit(orgFromPath(r.URL.Path), "rejected", user, clientIP(r),
+				strings.TrimPrefix(r.URL.Path, "/"), stageFromRequest(r).get())
+		}
+	})
+}
+
+// orgFromPath returns the Chef organization of a request path
+func orgFromPath(p string) string {
+	if getConfig().Chef.Type != "enterprise" {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) > 1 && parts[0] == "organizations" {
+		return parts[1]
+	}
+	return ""
+}
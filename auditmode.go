@@ -0,0 +1,191 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var auditVerdicts = expvar.NewMap("audit_verdicts_total")
+
+// VerdictEvent is the payload posted to the verdicts webhook for every
+// cookbook upload or change validated in audit mode
+type VerdictEvent struct {
+	Schema    string    `json:"schema" desc:"Schema ID of the event (verdict/v1)"`
+	Time      time.Time `json:"time" desc:"Time of the validation in UTC"`
+	Org       string    `json:"org" desc:"Chef organization, empty when not using Chef Enterprise"`
+	User      string    `json:"user" desc:"Chef user that uploaded the cookbook or made the change"`
+	Type      string    `json:"type" desc:"Endpoint type (cookbooks, data, clients, environments, nodes or roles)"`
+	Item      string    `json:"item,omitempty" desc:"Changed item of any other type than cookbooks (e.g. web or users/alice)"`
+	Cookbook  string    `json:"cookbook,omitempty" desc:"Name of the cookbook"`
+	Version   string    `json:"version,omitempty" desc:"Version of the cookbook"`
+	Verdict   string    `json:"verdict" desc:"Verdict of the validation (passed, blocked or error)"`
+	Stage     string    `json:"stage,omitempty" desc:"Stage that would have blocked the upload"`
+	Status    int       `json:"status,omitempty" desc:"HTTP status the upload would have been answered with"`
+	Message   string    `json:"message,omitempty" desc:"Error that would have been returned to the user"`
+	RequestID string    `json:"request_id,omitempty" desc:"ID of the upload request"`
+}
+
+// verdictWriter records the response of a validation run in audit mode, so
+// it never reaches the client
+type verdictWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *verdictWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *verdictWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *verdictWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// auditMode returns true if uploads should be validated without ever being
+// blocked
+func (cg *ChefGuard) auditMode() bool {
+	return getEffectiveMode("Mode", cg.ChefOrg, "cookbooks") == "audit"
+}
+
+// auditChanges returns true if changes of the endpoint type should be
+// validated without ever being blocked
+func (cg *ChefGuard) auditChanges() bool {
+	return getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType) == "audit"
+}
+
+// checkChange validates a changed item, or only records the verdict when
+// the endpoint type is in audit mode. It returns true if the request was
+// already answered.
+func (cg *ChefGuard) checkChange(w http.ResponseWriter, method string, vars map[string]string, body []byte) bool {
+	if !cg.auditChanges() {
+		return cg.validateChange(w, method, vars, body)
+	}
+
+	vw := &verdictWriter{header: make(http.Header)}
+	answered := cg.validateChange(vw, method, vars, body)
+
+	// Warnings are still returned, as they don't block the change
+	for _, warning := range vw.header["X-Chef-Guard-Warning"] {
+		w.Header().Add("X-Chef-Guard-Warning", warning)
+	}
+
+	e := cg.newVerdict(vw, answered)
+	e.Type = vars["type"]
+	e.Item = vars["name"]
+	if vars["bag"] != "" {
+		e.Item = strings.TrimSuffix(vars["bag"]+"/"+vars["name"], "/")
+	}
+	cg.recordVerdict(e)
+
+	return false
+}
+
+// auditUpload runs all validations of a cookbook upload as if the org was
+// running in enforced mode and records the verdict, without answering the
+// request so the upload is always passed on to Chef
+func (cg *ChefGuard) auditUpload(w http.ResponseWriter, r *http.Request, body []byte) {
+	vw := &verdictWriter{header: make(http.Header)}
+
+	// Internal errors are passed through to a no-op handler, as the upload
+	// is proxied anyway once the verdict is recorded
+	noop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	answered := cg.validateUpload(vw, r, noop, body)
+
+	// Warnings are still returned, as they don't block the upload
+	for _, warning := range vw.header["X-Chef-Guard-Warning"] {
+		w.Header().Add("X-Chef-Guard-Warning", warning)
+	}
+
+	if cg.clientGone() {
+		return
+	}
+
+	e := cg.newVerdict(vw, answered)
+	e.Type = "cookbooks"
+	e.Cookbook = cg.Cookbook.Name
+	e.Version = cg.Cookbook.Version
+	cg.recordVerdict(e)
+}
+
+// newVerdict returns the verdict of a validation run, which failed if the
+// validation answered the request
+func (cg *ChefGuard) newVerdict(vw *verdictWriter, answered bool) *VerdictEvent {
+	e := &VerdictEvent{
+		Schema:    verdictSchema,
+		Time:      time.Now().UTC(),
+		Org:       cg.ChefOrg,
+		User:      cg.User,
+		Verdict:   "passed",
+		RequestID: cg.RequestID,
+	}
+	if answered {
+		e.Verdict = "error"
+		if vw.status >= 400 && vw.status < 500 {
+			e.Verdict = "blocked"
+		}
+		e.Stage = cg.stage.get()
+		e.Status = vw.status
+		e.Message = strings.TrimSpace(vw.body.String())
+	}
+	return e
+}
+
+// recordVerdict logs and counts a verdict and posts it to the verdicts
+// webhook (if configured)
+func (cg *ChefGuard) recordVerdict(e *VerdictEvent) {
+	what := fmt.Sprintf("change of %s %s", strings.TrimSuffix(e.Type, "s"), e.Item)
+	if e.Type == "cookbooks" {
+		what = fmt.Sprintf("upload of cookbook %s version %s", e.Cookbook, e.Version)
+	}
+
+	if e.Verdict == "passed" {
+		auditVerdicts.Add(e.Verdict, 1)
+		logf(INFO, cg.RequestID, "Audit mode: %s by %s passed all validations", what, e.User)
+	} else {
+		auditVerdicts.Add(fmt.Sprintf("%s:%s", e.Verdict, e.Stage), 1)
+		logf(WARNING, cg.RequestID, "Audit mode: %s by %s would have failed during stage %s (%d): %s",
+			what, e.User, e.Stage, e.Status, e.Message)
+	}
+
+	if getConfig().Webhook.VerdictsURL == "" {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to marshal verdict of %s: %s", what, err)
+		return
+	}
+
+	go postEvent(cg.RequestID, getConfig().Webhook.VerdictsURL, "verdict", data)
+}
@@ -0,0 +1,373 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/marpaia/chef-golang"
+)
+
+const (
+	// maxClockSkew is the maximum difference between the timestamp of a
+	// signed request and the current time, the same as accepted by erchef
+	maxClockSkew = 15 * time.Minute
+
+	// principalKeyTTL is the time the public key of a user or client is cached
+	principalKeyTTL = 5 * time.Minute
+)
+
+// principalName matches valid names of Chef users and clients
+var principalName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// principalKeys caches the public keys of users and clients by org and name
+var principalKeys = struct {
+	sync.Mutex
+	m map[string]*cachedKey
+}{m: make(map[string]*cachedKey)}
+
+type cachedKey struct {
+	key     *rsa.PublicKey
+	member  bool
+	client  bool
+	fetched time.Time
+}
+
+// authenticateRequest verifies the Chef authentication headers (protocol
+// versions 1.0, 1.1 and 1.3) of a request made to one of Chef-Guard's own
+// endpoints, and returns the name of the user or client that signed it. The
+// public key of the user or client is looked up in the given organization.
+func authenticateRequest(r *http.Request, org string) (string, error) {
+	user := r.Header.Get("X-Ops-Userid")
+	if !principalName.MatchString(user) {
+		return "", fmt.Errorf("Missing or invalid X-Ops-Userid header")
+	}
+
+	timestamp := r.Header.Get("X-Ops-Timestamp")
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return "", fmt.Errorf("Missing or invalid X-Ops-Timestamp header")
+	}
+	if d := time.Since(ts); d > maxClockSkew || d < -maxClockSkew {
+		return "", fmt.Errorf("The request timestamp differs more than %s from the current time", maxClockSkew)
+	}
+
+	var parts []string
+	for i := 1; r.Header.Get(fmt.Sprintf("X-Ops-Authorization-%d", i)) != ""; i++ {
+		parts = append(parts, r.Header.Get(fmt.Sprintf("X-Ops-Authorization-%d", i)))
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(parts, ""))
+	if err != nil || len(sig) == 0 {
+		return "", fmt.Errorf("Missing or invalid X-Ops-Authorization headers")
+	}
+
+	body, err := dumpBody(r)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the request body: %s", err)
+	}
+
+	key, member, err := principalKey(org, user)
+	if err != nil {
+		return "", err
+	}
+	if !member {
+		return "", fmt.Errorf("%s is not a member of organization %s", user, org)
+	}
+
+	contentHash := r.Header.Get("X-Ops-Content-Hash")
+	path := canonicalPath(r.URL.EscapedPath())
+
+	switch version := signVersion(r.Header.Get("X-Ops-Sign")); version {
+	case "1.0", "1.1":
+		if sum := sha1.Sum(body); contentHash != base64.StdEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("The X-Ops-Content-Hash header doesn't match the request body")
+		}
+		userID := user
+		if version == "1.1" {
+			sum := sha1.Sum([]byte(user))
+			userID = base64.StdEncoding.EncodeToString(sum[:])
+		}
+		pathHash := sha1.Sum([]byte(path))
+		content := fmt.Sprintf("Method:%s\nHashed Path:%s\nX-Ops-Content-Hash:%s\nX-Ops-Timestamp:%s\nX-Ops-UserId:%s",
+			r.Method, base64.StdEncoding.EncodeToString(pathHash[:]), contentHash, timestamp, userID)
+		err = rsa.VerifyPKCS1v15(key, crypto.Hash(0), []byte(content), sig)
+	case "1.3":
+		if sum := sha256.Sum256(body); contentHash != base64.StdEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("The X-Ops-Content-Hash header doesn't match the request body")
+		}
+		apiVersion := r.Header.Get("X-Ops-Server-API-Version")
+		if apiVersion == "" {
+			apiVersion = "0"
+		}
+		content := fmt.Sprintf("Method:%s\nPath:%s\nX-Ops-Content-Hash:%s\nX-Ops-Sign:version=1.3\nX-Ops-Timestamp:%s\nX-Ops-UserId:%s\nX-Ops-Server-API-Version:%s",
+			r.Method, path, contentHash, timestamp, user, apiVersion)
+		sum := sha256.Sum256([]byte(content))
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	default:
+		return "", fmt.Errorf("Unsupported signing protocol version %q", version)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Invalid signature for %s", user)
+	}
+
+	return user, nil
+}
+
+// signVersion returns the protocol version of a X-Ops-Sign header like
+// 'algorithm=sha1;version=1.0;'
+func signVersion(sign string) string {
+	for _, p := range strings.Split(sign, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && kv[0] == "version" {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// canonicalPath returns the path as used when signing a request
+func canonicalPath(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.Replace(p, "//", "/", -1)
+	}
+	if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// principal is a user or client as returned by the principals endpoint
+type principal struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"`
+	OrgMember *bool  `json:"org_member"`
+}
+
+// principalKey returns the public key of a user or client and whether it is
+// a member of the organization
+func principalKey(org, name string) (*rsa.PublicKey, bool, error) {
+	c, err := lookupPrincipal(org, name)
+	if err != nil {
+		return nil, false, err
+	}
+	return c.key, c.member, nil
+}
+
+// isClient returns true if the name only belongs to a client of the
+// organization, so a user can never pass for a client with the same name
+func isClient(org, name string) (bool, error) {
+	c, err := lookupPrincipal(org, name)
+	if err != nil {
+		return false, err
+	}
+	return c.client, nil
+}
+
+// lookupPrincipal returns the (cached) public key, membership and type of a
+// user or client
+func lookupPrincipal(org, name string) (*cachedKey, error) {
+	cacheKey := org + "/" + name
+
+	principalKeys.Lock()
+	c, ok := principalKeys.m[cacheKey]
+	principalKeys.Unlock()
+
+	if ok && time.Since(c.fetched) < principalKeyTTL {
+		return c, nil
+	}
+
+	chefClient, err := newChefClient(org)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := chefClient.Get(fmt.Sprintf("principals/%s", name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the public key of %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Unknown user or client %s", name)
+	}
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to get the public key of %s: %s", name, err)
+	}
+
+	// Depending on the API version, the principal is returned either
+	// directly or as the first entry of a list of principals
+	var p struct {
+		principal
+		Principals []principal `json:"principals"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("Failed to decode the principal of %s: %s", name, err)
+	}
+	principals := p.Principals
+	if p.PublicKey != "" {
+		principals = []principal{p.principal}
+	}
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("Unknown user or client %s", name)
+	}
+	p.principal = principals[0]
+
+	// The name only belongs to a client if none of its principals is a user
+	client := true
+	for _, pr := range principals {
+		client = client && pr.Type == "client"
+	}
+
+	key, err := parsePublicKey(p.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the public key of %s: %s", name, err)
+	}
+	// Servers without organizations don't return the membership
+	member := p.OrgMember == nil || *p.OrgMember
+
+	c = &cachedKey{key: key, member: member, client: client, fetched: time.Now()}
+	principalKeys.Lock()
+	principalKeys.m[cacheKey] = c
+	principalKeys.Unlock()
+
+	return c, nil
+}
+
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return rsaKey, nil
+}
+
+// hasPermission returns true if the user or client has the permission (e.g.
+// read or update) in the ACL of the object or container, either directly or
+// through one of its (nested) groups
+func hasPermission(chefClient *chef.Chef, name, perm, object string) (bool, error) {
+	var acl map[string]*aclMembers
+	if err := getChefJSON(chefClient, object+"/_acl", &acl); err != nil {
+		return false, err
+	}
+	ace, ok := acl[perm]
+	if !ok {
+		return false, nil
+	}
+
+	seen := make(map[string]bool)
+	var member func(m *aclMembers) (bool, error)
+	member = func(m *aclMembers) (bool, error) {
+		if m.contains(name) {
+			return true, nil
+		}
+		for _, g := range m.Groups {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+
+			group := new(aclMembers)
+			if err := getChefJSON(chefClient, "groups/"+g, group); err != nil {
+				return false, err
+			}
+			if ok, err := member(group); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	return member(ace)
+}
+
+// aclMembers holds the members of an ACE or a group. Depending on the API
+// version users and clients are returned as actors or separately.
+type aclMembers struct {
+	Actors  []string `json:"actors"`
+	Users   []string `json:"users"`
+	Clients []string `json:"clients"`
+	Groups  []string `json:"groups"`
+}
+
+func (m *aclMembers) contains(name string) bool {
+	for _, list := range [][]string{m.Actors, m.Users, m.Clients} {
+		for _, n := range list {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getChefJSON gets a Chef API endpoint and decodes the response into v
+func getChefJSON(chefClient *chef.Chef, endpoint string, v interface{}) error {
+	resp, err := chefClient.Get(endpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s from Chef: %s", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return fmt.Errorf("Failed to get %s from Chef: %s", endpoint, err)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Failed to decode %s: %s", endpoint, err)
+	}
+	return nil
+}
+
+// signedHandler only serves requests that are signed by a user or client of
+// the organization in the path or in the org query parameter (only needed
+// when using Chef Enterprise)
+func signedHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := mux.Vars(r)["org"]
+		if org == "" {
+			org = r.URL.Query().Get("org")
+		}
+		if _, err := authenticateRequest(r, org); err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
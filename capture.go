@@ -0,0 +1,203 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxCaptureBody is the maximum number of bytes of a response body that is
+// saved in a fixture
+const maxCaptureBody = 1 << 20
+
+// sensitiveFields are JSON fields that are never written to a fixture
+var sensitiveFields = []string{"private_key", "password", "secret", "token"}
+
+// Fixture holds a sanitized request, the response and the decisions made
+// by Chef-Guard while processing the request
+type Fixture struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Request  *Exchange `json:"request"`
+	Response *Exchange `json:"response"`
+}
+
+// Exchange holds either a request or a response of a fixture
+type Exchange struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Query   string            `json:"query,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// captureWriter records the response so it can be saved in a fixture
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len() < maxCaptureBody {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// captureHandler writes sanitized fixtures of the requests made to the
+// configured endpoint types, so reported issues can be easily reproduced
+func captureHandler(h http.Handler) http.Handler {
+	if getConfig().Capture.Path == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpointType := requestType(r.URL.Path)
+		if !containsType(getConfig().Capture.Types, endpointType) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := dumpBody(r)
+		if err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+			return
+		}
+
+		f := &Fixture{
+			Time: time.Now().UTC(),
+			Request: &Exchange{
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Query:   r.URL.RawQuery,
+				Headers: sanitizeHeaders(r.Header),
+				Body:    sanitizeBody(body),
+			},
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, r)
+
+		f.Stage = stageFromRequest(r).get()
+		f.Response = &Exchange{
+			Status:  cw.status,
+			Headers: sanitizeHeaders(w.Header()),
+			Body:    sanitizeBody(cw.body.Bytes()),
+		}
+
+		if err := writeFixture(endpointType, f); err != nil {
+			logf(ERROR, requestID(r), "Failed to write fixture for %s %s: %s", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// requestType returns the endpoint type (e.g. cookbooks or roles) of a path
+func requestType(p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) > 2 && parts[0] == "organizations" {
+		parts = parts[2:]
+	}
+	return parts[0]
+}
+
+func writeFixture(endpointType string, f *Fixture) error {
+	dir := path.Join(getConfig().Capture.Path, endpointType)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.json", f.Time.Format("20060102-150405.000000000"), strings.ToLower(f.Request.Method))
+	return ioutil.WriteFile(path.Join(dir, name), data, 0600)
+}
+
+func sanitizeHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string)
+	for k, v := range h {
+		if isCredentialHeader(k) || k == "Cookie" || k == "Set-Cookie" {
+			headers[k] = "REDACTED"
+			continue
+		}
+		headers[k] = strings.Join(v, ", ")
+	}
+	return headers
+}
+
+// sanitizeBody returns the body as JSON with all sensitive fields redacted.
+// Bodies that are not JSON are saved as a JSON string instead.
+func sanitizeBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		s, _ := json.Marshal(string(body))
+		return s
+	}
+
+	s, err := json.Marshal(redactFields(v))
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func redactFields(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			redacted := false
+			for _, f := range sensitiveFields {
+				if strings.Contains(strings.ToLower(k), f) {
+					t[k] = "REDACTED"
+					redacted = true
+					break
+				}
+			}
+			if !redacted {
+				t[k] = redactFields(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = redactFields(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// changelogVersion matches the version numbers mentioned in a changelog
+var changelogVersion = regexp.MustCompile(`[0-9.]+`)
+
+// checkChangelog makes sure the cookbook contains a CHANGELOG.md with an
+// entry for the version being uploaded
+func (cg *ChefGuard) checkChangelog() (int, error) {
+	content, err := ioutil.ReadFile(path.Join(cg.CookbookPath, "CHANGELOG.md"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return http.StatusInternalServerError, fmt.Errorf("Failed to read CHANGELOG.md: %s", err)
+		}
+		return http.StatusPreconditionFailed, fmt.Errorf("\n=== Changelog error found ===\n" +
+			"The cookbook does not contain a CHANGELOG.md!\n" +
+			"Please add a CHANGELOG.md describing what changed.\n" +
+			"=============================\n")
+	}
+
+	if hasChangelogEntry(string(content), cg.Cookbook.Version) {
+		return 0, nil
+	}
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Changelog error found ===\n"+
+		"CHANGELOG.md does not contain an entry for version %s!\n"+
+		"Please document what changed before bumping the version.\n"+
+		"=============================\n", cg.Cookbook.Version)
+}
+
+// hasChangelogEntry returns true if the changelog contains a (Markdown or
+// underlined) heading with the version
+func hasChangelogEntry(changelog, version string) bool {
+	lines := strings.Split(strings.Replace(changelog, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		if !contains(changelogVersion.FindAllString(line, -1), version) {
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			return true
+		}
+		if i+1 < len(lines) {
+			next := strings.TrimSpace(lines[i+1])
+			if next != "" && (strings.Trim(next, "-") == "" || strings.Trim(next, "=") == "") {
+				return true
+			}
+		}
+	}
+	return false
+}
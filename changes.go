@@ -52,10 +52,10 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 	return func(w http.ResponseWriter, r *http.Request) {
 		cg, err := newChefGuard(r)
 		if err != nil {
-			errorHandler(w, fmt.Sprintf(
-				"Failed to create a new ChefGuard structure: %s", err), http.StatusInternalServerError)
+			internalError(w, r, p, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err))
 			return
 		}
+		cg.EndpointType = mux.Vars(r)["type"]
 
 		reqBody, err := dumpBody(r)
 		if err != nil {
@@ -64,12 +64,20 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 			return
 		}
 
-		if getEffectiveConfig("ValidateChanges", cg.ChefOrg).(string) == "enforced" &&
-			r.Method != "DELETE" {
-			if errCode, err := cg.validateConstraints(reqBody); err != nil {
+		if cg.checkChange(w, r.Method, mux.Vars(r), reqBody) {
+			return
+		}
+
+		if env := approvalEnvironment(r, reqBody); env != "" {
+			cg.setStage("approval")
+			// The change is applied later with our own key, so make sure the
+			// request is signed by someone who is allowed to make it
+			if errCode, err := cg.authorizeChange(r, env); err != nil {
 				errorHandler(w, err.Error(), errCode)
 				return
 			}
+			cg.parkChange(w, r.Method, env, reqBody)
+			return
 		}
 
 		// So, this is kind of an ugly one...
@@ -77,6 +85,7 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 		// 2. If we do want to commit the changes, but we are a node updating itself also return
 		// here unless this is a client or node creation as we do want to see those ones.
 		if getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) == false ||
+			exemptUser("ExemptCommits", cg.ChefOrg, cg.User) ||
 			strings.HasPrefix(r.Header.Get("User-Agent"), "Chef Client") &&
 				r.Header.Get("X-Ops-Request-Source") != "web" &&
 				!((mux.Vars(r)["type"] == "clients" || mux.Vars(r)["type"] == "nodes") && r.Method == "POST") {
@@ -84,10 +93,14 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 			return
 		}
 
+		cg.setStage("git-check")
+		if err := cg.checkGitTarget(); err != nil {
+			w.Header().Set("X-Chef-Guard-Warning", fmt.Sprintf("Change will not be committed to Git: %s", err))
+		}
+
 		u := fmt.Sprintf(
-			"http://%s:%d%s?%s",
-			cfg.Chef.ErchefIP,
-			cfg.Chef.ErchefPort,
+			"%s%s?%s",
+			erchefURL(),
 			r.URL.Path,
 			r.URL.RawQuery,
 		)
@@ -98,7 +111,12 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 			return
 		}
 
-		resp, err := http.DefaultTransport.RoundTrip(r)
+		cg.setStage("upstream")
+		resp, err := erchefTransport.RoundTrip(r)
+		if err == errErchefUnavailable {
+			errorHandler(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			errorHandler(w, fmt.Sprintf(
 				"Call to %s failed: %s", r.URL.String(), err), http.StatusBadRequest)
@@ -129,14 +147,25 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 			return
 		}
 
+		body := reqBody
 		if r.Method == "PUT" {
-			go cg.syncedGitUpdate(r.Method, respBody)
+			body = respBody
+		}
+
+		// Commit synchronously when configured, so the user learns about failures
+		if containsType(getEffectiveConfig("SyncCommits", cg.ChefOrg).(string), mux.Vars(r)["type"]) {
+			cg.setStage("git-commit")
+			if err := cg.syncedGitUpdate(r.Method, body); err != nil {
+				w.Header().Set("X-Chef-Guard-Warning", fmt.Sprintf("Change was not committed to Git: %s", err))
+			}
+		} else if debounceCommits(cg.ChefOrg, mux.Vars(r)["type"]) {
+			cg.debouncedGitUpdate(r.Method, body)
 		} else {
-			go cg.syncedGitUpdate(r.Method, reqBody)
+			goSafe(r, func() { cg.syncedGitUpdate(r.Method, body) })
 		}
 
-		if getEffectiveConfig("ValidateChanges", cg.ChefOrg).(string) == "permissive" &&
-			r.Method != "DELETE" {
+		if getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType) == "permissive" &&
+			!exemptUser("ExemptValidation", cg.ChefOrg, cg.User) && r.Method != "DELETE" {
 			if errCode, err := cg.validateConstraints(reqBody); err != nil {
 				errorHandler(w, err.Error(), errCode)
 				return
@@ -149,9 +178,76 @@ func processChange(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Req
 	}
 }
 
+// validateChange runs all validations of a changed item. It returns true if
+// the request was already answered.
+func (cg *ChefGuard) validateChange(w http.ResponseWriter, method string, vars map[string]string, reqBody []byte) bool {
+	if vars["type"] == "data" && method != "DELETE" {
+		cg.setStage("encryption-check")
+		if errCode, err := checkEncryptedItem(vars["bag"], reqBody); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+
+	// Exempted users skip the validation stages, but their changes are still
+	// checked for unencrypted and leaked secrets and count towards the quotas
+	exempt := exemptUser("ExemptValidation", cg.ChefOrg, cg.User)
+
+	if vars["type"] == "data" && method != "DELETE" && !exempt {
+		cg.setStage("schema-check")
+		if errCode, err := cg.checkDataBagSchema(vars["bag"], reqBody); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+
+	if getEffectiveConfig("DetectSecrets", cg.ChefOrg).(string) != "" &&
+		vars["type"] != "clients" && method != "DELETE" {
+		cg.setStage("secret-scan")
+		findings, err := findJSONSecrets(reqBody)
+		if err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(reqBody), err), http.StatusBadRequest)
+			return true
+		}
+		if errCode, err := cg.checkSecrets(w, findings); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+
+	cg.setStage("validate")
+	if mode := getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType); (mode == "enforced" || mode == "audit") &&
+		method != "DELETE" && !exempt {
+		if errCode, err := cg.validateConstraints(reqBody); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+
+	if vars["type"] == "environments" && method == "POST" {
+		cg.setStage("quota-check")
+		if errCode, err := cg.checkEnvironmentQuota(w); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+	return false
+}
+
+// containsType returns true if the endpoint type is in the comma separated list
+func containsType(list, endpointType string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.TrimSpace(t) == endpointType {
+			return true
+		}
+	}
+	return false
+}
+
 type changeDetails struct {
 	Item string
 	Type string
+	Note string
 }
 
 func getChangeDetails(r *http.Request, body []byte) (*changeDetails, error) {
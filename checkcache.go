@@ -0,0 +1,142 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	checkCacheHits   = expvar.NewInt("check_cache_hits_total")
+	checkCacheMisses = expvar.NewInt("check_cache_misses_total")
+)
+
+// checkResult holds the cached result of a single check
+type checkResult struct {
+	created    time.Time
+	errCode    int
+	violations []*Violation
+	errText    string
+}
+
+// checkCache caches the results of the checks keyed by a digest of the
+// cookbook content, so re-uploads of identical content skip the checks
+var checkCache = struct {
+	sync.Mutex
+	m map[string]*checkResult
+}{m: make(map[string]*checkResult)}
+
+// cachedCheck returns the cached result of the check if there is one, or
+// runs the check and caches its result. Internal errors are never cached.
+func (cg *ChefGuard) cachedCheck(check string, run func() (int, []*Violation, error)) (int, []*Violation, error) {
+	if getConfig().Tests.CacheTTL == 0 {
+		return run()
+	}
+
+	key := cg.checkDigest(check)
+	ttl := time.Duration(getConfig().Tests.CacheTTL) * time.Second
+
+	checkCache.Lock()
+	r, ok := checkCache.m[key]
+	checkCache.Unlock()
+
+	if ok && time.Since(r.created) < ttl {
+		checkCacheHits.Add(1)
+		if r.errText == "" {
+			return r.errCode, r.violations, nil
+		}
+		return r.errCode, r.violations, errors.New(r.errText)
+	}
+	checkCacheMisses.Add(1)
+
+	errCode, violations, err := run()
+	if errCode == 0 || errCode == http.StatusPreconditionFailed {
+		r := &checkResult{created: time.Now(), errCode: errCode, violations: violations}
+		if err != nil {
+			r.errText = err.Error()
+		}
+		storeCheckResult(key, r, ttl)
+	}
+
+	return errCode, violations, err
+}
+
+// checkDigest returns a digest over everything that determines the result
+// of a check: the check itself, its org specific config, the current rules
+// and the content of all cookbook files
+func (cg *ChefGuard) checkDigest(check string) string {
+	h := sha256.New()
+
+	rules, _ := os.Readlink(getConfig().Rules.Path)
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00",
+		check,
+		getEffectiveConfig("ExcludeFCs", cg.ChefOrg),
+		getEffectiveConfig("ExcludeCops", cg.ChefOrg),
+		rules,
+	)
+
+	files := make([]string, 0, len(cg.FileHashes))
+	for f := range cg.FileHashes {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		sum := cg.FileHashes[f]
+		fmt.Fprintf(h, "%s\x00%x\x00", f, sum)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// storeCheckResult stores a result, first removing expired results and
+// (when still full) the oldest result to stay within the cache size
+func storeCheckResult(key string, r *checkResult, ttl time.Duration) {
+	checkCache.Lock()
+	defer checkCache.Unlock()
+
+	size := getConfig().Tests.CacheSize
+	if size == 0 {
+		size = 1000
+	}
+
+	if len(checkCache.m) >= size {
+		var oldest string
+		for k, v := range checkCache.m {
+			if time.Since(v.created) >= ttl {
+				delete(checkCache.m, k)
+				continue
+			}
+			if oldest == "" || v.created.Before(checkCache.m[oldest].created) {
+				oldest = k
+			}
+		}
+		if len(checkCache.m) >= size && oldest != "" {
+			delete(checkCache.m, oldest)
+		}
+	}
+
+	checkCache.m[key] = r
+}
@@ -17,70 +17,138 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 )
 
+// foodcriticLine matches a single line of Foodcritic output, for example:
+// FC001: Use strings in preference to symbols: ./recipes/default.rb:12
+var foodcriticLine = regexp.MustCompile(`^(\w+): (.*): (.+):(\d+)$`)
+
 func (cg *ChefGuard) executeChecks() (int, error) {
-	if cfg.Tests.Foodcritic != "" {
-		if errCode, err := runFoodcritic(cg.ChefOrg, cg.CookbookPath); err != nil {
+	if getConfig().Tests.Foodcritic != "" {
+		errCode, violations, err := cg.cachedCheck("foodcritic", func() (int, []*Violation, error) {
+			return runFoodcritic(cg.ctx, cg.ChefOrg, cg.CookbookPath)
+		})
+		cg.exportViolations("foodcritic", violations)
+		if err != nil {
 			if errCode == http.StatusInternalServerError || !cg.continueAfterFailedCheck("foodcritic") {
 				return errCode, err
 			}
 		}
 	}
-	if cfg.Tests.Rubocop != "" {
-		if errCode, err := runRubocop(cg.CookbookPath); err != nil {
+	if getConfig().Tests.Cookstyle != "" {
+		errCode, violations, err := cg.cachedCheck("cookstyle", func() (int, []*Violation, error) {
+			return runCookstyle(cg.ctx, cg.ChefOrg, cg.CookbookPath)
+		})
+		cg.exportViolations("cookstyle", violations)
+		if err != nil {
+			if errCode == http.StatusInternalServerError || !cg.continueAfterFailedCheck("cookstyle") {
+				return errCode, err
+			}
+		}
+	}
+	if getConfig().Tests.Rubocop != "" {
+		errCode, violations, err := cg.cachedCheck("rubocop", func() (int, []*Violation, error) {
+			return runRubocop(cg.ctx, cg.CookbookPath)
+		})
+		cg.exportViolations("rubocop", violations)
+		if err != nil {
 			if errCode == http.StatusInternalServerError || !cg.continueAfterFailedCheck("rubocop") {
 				return errCode, err
 			}
 		}
 	}
+	if getConfig().Tests.Hooks != "" {
+		for _, hook := range strings.Split(getConfig().Tests.Hooks, ",") {
+			if errCode, err := cg.runHook(hook); err != nil {
+				if errCode == http.StatusInternalServerError || !cg.continueAfterFailedCheck(path.Base(hook)) {
+					return errCode, err
+				}
+			}
+		}
+	}
 	return 0, nil
 }
 
 func (cg *ChefGuard) continueAfterFailedCheck(check string) bool {
-	WARNING.Printf("%s errors when uploading cookbook '%s' for '%s'\n", strings.Title(check), cg.Cookbook.Name, cg.User)
-	if getEffectiveConfig("Mode", cg.ChefOrg).(string) == "permissive" && cg.ForcedUpload {
+	logf(WARNING, cg.RequestID, "%s errors when uploading cookbook '%s' for '%s'\n", strings.Title(check), cg.Cookbook.Name, cg.User)
+	if getEffectiveMode("Mode", cg.ChefOrg, "cookbooks") == "permissive" && cg.ForcedUpload {
+		recordAudit(cg.ChefOrg, "forced", cg.User, cg.ClientIP, fmt.Sprintf("cookbooks/%s", cg.Cookbook.Name),
+			fmt.Sprintf("Forced upload of version %s despite %s errors", cg.Cookbook.Version, check))
 		return true
 	}
 	return false
 }
 
-func runFoodcritic(org, cookbookPath string) (int, error) {
+func runFoodcritic(ctx context.Context, org, cookbookPath string) (int, []*Violation, error) {
 	args := getFoodcriticArgs(org, cookbookPath)
-	cmd := exec.Command(cfg.Tests.Foodcritic, args...)
+	cmd := exec.Command(getConfig().Tests.Foodcritic, args...)
 
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "RUBY_THREAD_VM_STACK_SIZE=2097152")
 
-	output, err := cmd.CombinedOutput()
+	output, _, err := runCheck(ctx, cmd, cookbookPath, true)
 	if err != nil {
+		if _, ok := err.(*checkLimitError); ok {
+			return http.StatusInternalServerError, nil, err
+		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			if exitError.Sys().(syscall.WaitStatus).ExitStatus() == 3 {
-				errText := strings.TrimSpace(strings.Replace(string(output), fmt.Sprintf("%s/", cookbookPath), "", -1))
-				return http.StatusPreconditionFailed, fmt.Errorf("\n=== Foodcritic errors found ===\n%s\n===============================\n", errText)
+				return foodcriticViolations(output, cookbookPath)
 			}
 		}
 
-		return http.StatusInternalServerError, fmt.Errorf("Failed to execute \"foodcritic %s\": %s - %s", strings.Join(cmd.Args, " "), output, err)
+		return http.StatusInternalServerError, nil, fmt.Errorf("Failed to execute \"foodcritic %s\": %s - %s", strings.Join(cmd.Args, " "), output, err)
 	}
 
 	// This is still needed for Foodcritic > v9.x.x
 	if strings.TrimSpace(string(output)) != "" {
-		errText := strings.TrimSpace(strings.Replace(string(output), fmt.Sprintf("%s/", cookbookPath), "", -1))
-		return http.StatusPreconditionFailed, fmt.Errorf("\n=== Foodcritic errors found ===\n%s\n===============================\n", errText)
+		return foodcriticViolations(output, cookbookPath)
 	}
 
-	return 0, nil
+	return 0, nil, nil
+}
+
+// foodcriticViolations parses the Foodcritic output, which has no JSON
+// formatter, into structured violations
+func foodcriticViolations(output []byte, cookbookPath string) (int, []*Violation, error) {
+	errText := strings.TrimSpace(strings.Replace(string(output), fmt.Sprintf("%s/", cookbookPath), "", -1))
+
+	violations := []*Violation{}
+	for _, l := range strings.Split(errText, "\n") {
+		m := foodcriticLine.FindStringSubmatch(strings.TrimSpace(l))
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[4])
+		violations = append(violations, &Violation{
+			Check:   "foodcritic",
+			File:    strings.TrimPrefix(m[3], "./"),
+			Line:    line,
+			Rule:    m[1],
+			Message: m[2],
+		})
+	}
+
+	// Fall back to the raw output if it couldn't be parsed
+	if len(violations) == 0 {
+		return http.StatusPreconditionFailed, nil, fmt.Errorf("\n=== Foodcritic errors found ===\n%s\n===============================\n", errText)
+	}
+	return http.StatusPreconditionFailed, violations, formatViolations("Foodcritic", violations)
 }
 
 func getFoodcriticArgs(org, cookbookPath string) []string {
-	excludes := cfg.Default.ExcludeFCs
+	excludes := getConfig().Default.ExcludeFCs
 	custExcludes := getEffectiveConfig("ExcludeFCs", org)
 	if excludes != custExcludes {
 		excludes = fmt.Sprintf("%s,%s", excludes, custExcludes)
@@ -89,22 +157,141 @@ func getFoodcriticArgs(org, cookbookPath string) []string {
 	for _, exclude := range strings.Split(excludes, ",") {
 		args = append(args, "--tags", "~"+exclude)
 	}
-	if cfg.Default.IncludeFCs != "" {
-		args = append(args, "--include", cfg.Default.IncludeFCs)
+	if getConfig().Default.IncludeFCs != "" {
+		args = append(args, "--include", getConfig().Default.IncludeFCs)
 	}
 	return append(args, "--no-progress", "--cookbook-path", cookbookPath)
 }
 
-func runRubocop(cookbookPath string) (int, error) {
-	cmd := exec.Command(cfg.Tests.Rubocop, cookbookPath)
-	cmd.Env = []string{"HOME=" + cfg.Default.Tempdir}
-	output, err := cmd.CombinedOutput()
+func runRubocop(ctx context.Context, cookbookPath string) (int, []*Violation, error) {
+	cmd := exec.Command(getConfig().Tests.Rubocop, "--format", "json", cookbookPath)
+	cmd.Env = []string{"HOME=" + getConfig().Default.Tempdir}
+	output, stderr, err := runCheck(ctx, cmd, cookbookPath, false)
+	if err != nil {
+		if _, ok := err.(*checkLimitError); ok {
+			return http.StatusInternalServerError, nil, err
+		}
+		if exitError, ok := err.(*exec.ExitError); ok {
+			if exitError.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+				return rubocopViolations("rubocop", "Rubocop", output, cookbookPath)
+			}
+		}
+		return http.StatusInternalServerError, nil, fmt.Errorf("Failed to execute \"rubocop %s\": %s%s - %s", cookbookPath, output, stderr, err)
+	}
+	return 0, nil, nil
+}
+
+func runCookstyle(ctx context.Context, org, cookbookPath string) (int, []*Violation, error) {
+	args := getCookstyleArgs(org, cookbookPath)
+	cmd := exec.Command(getConfig().Tests.Cookstyle, args...)
+	cmd.Env = []string{"HOME=" + getConfig().Default.Tempdir}
+	output, stderr, err := runCheck(ctx, cmd, cookbookPath, false)
 	if err != nil {
-		if strings.Contains(string(output), "offense") {
-			errText := strings.TrimSpace(strings.Replace(string(output), fmt.Sprintf("%s/", cookbookPath), "", -1))
-			return http.StatusPreconditionFailed, fmt.Errorf("\n=== Rubocop errors found ===\n%s\n============================\n", errText)
+		if _, ok := err.(*checkLimitError); ok {
+			return http.StatusInternalServerError, nil, err
 		}
-		return http.StatusInternalServerError, fmt.Errorf("Failed to execute \"rubocop %s\": %s - %s", cookbookPath, output, err)
+		if exitError, ok := err.(*exec.ExitError); ok {
+			if exitError.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+				return rubocopViolations("cookstyle", "Cookstyle", output, cookbookPath)
+			}
+		}
+		return http.StatusInternalServerError, nil, fmt.Errorf("Failed to execute \"cookstyle %s\": %s%s - %s", strings.Join(args, " "), output, stderr, err)
+	}
+	return 0, nil, nil
+}
+
+// rubocopViolations parses the output of the RuboCop JSON formatter (which
+// is also used by Cookstyle) into structured violations
+func rubocopViolations(check, name string, output []byte, cookbookPath string) (int, []*Violation, error) {
+	var result struct {
+		Files []struct {
+			Path     string `json:"path"`
+			Offenses []struct {
+				Message  string `json:"message"`
+				CopName  string `json:"cop_name"`
+				Location struct {
+					Line int `json:"line"`
+				} `json:"location"`
+			} `json:"offenses"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return http.StatusInternalServerError, nil, fmt.Errorf("Failed to parse %s output %q: %s", name, output, err)
+	}
+
+	violations := []*Violation{}
+	for _, f := range result.Files {
+		for _, o := range f.Offenses {
+			violations = append(violations, &Violation{
+				Check:   check,
+				File:    strings.TrimPrefix(strings.TrimPrefix(f.Path, cookbookPath), "/"),
+				Line:    o.Location.Line,
+				Rule:    o.CopName,
+				Message: o.Message,
+			})
+		}
+	}
+	if len(violations) == 0 {
+		return 0, nil, nil
+	}
+	return http.StatusPreconditionFailed, violations, formatViolations(name, violations)
+}
+
+func getCookstyleArgs(org, cookbookPath string) []string {
+	excludes := getConfig().Default.ExcludeCops
+	custExcludes := getEffectiveConfig("ExcludeCops", org)
+	if excludes != custExcludes {
+		excludes = fmt.Sprintf("%s,%s", excludes, custExcludes)
+	}
+	cops := []string{}
+	for _, exclude := range strings.Split(excludes, ",") {
+		if exclude = strings.TrimSpace(exclude); exclude != "" {
+			cops = append(cops, exclude)
+		}
+	}
+	args := []string{"--format", "json"}
+	if len(cops) > 0 {
+		args = append(args, "--except", strings.Join(cops, ","))
+	}
+	return append(args, cookbookPath)
+}
+
+// runHook runs a custom check against the cookbook. An exit code of 1 means
+// the check failed, any other non-zero exit code means the hook itself failed.
+func (cg *ChefGuard) runHook(hook string) (int, error) {
+	name := path.Base(hook)
+	cmd := exec.Command(hook, cg.CookbookPath)
+	cmd.Env = []string{
+		"HOME=" + getConfig().Default.Tempdir,
+		"PATH=" + os.Getenv("PATH"),
+		"CHEF_GUARD_ORG=" + cg.ChefOrg,
+		"CHEF_GUARD_USER=" + cg.User,
+		"CHEF_GUARD_COOKBOOK=" + cg.Cookbook.Name,
+		"CHEF_GUARD_VERSION=" + cg.Cookbook.Version,
+	}
+	output, _, err := runCheck(cg.ctx, cmd, cg.CookbookPath, true)
+	if err != nil {
+		if _, ok := err.(*checkLimitError); ok {
+			return http.StatusInternalServerError, err
+		}
+		if exitError, ok := err.(*exec.ExitError); ok {
+			if exitError.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+				errText := strings.TrimSpace(strings.Replace(string(output), fmt.Sprintf("%s/", cg.CookbookPath), "", -1))
+				header := fmt.Sprintf("=== %s errors found ===", name)
+				return http.StatusPreconditionFailed, fmt.Errorf("\n%s\n%s\n%s\n", header, errText, strings.Repeat("=", len(header)))
+			}
+		}
+		return http.StatusInternalServerError, fmt.Errorf("Failed to execute \"%s %s\": %s - %s", hook, cg.CookbookPath, output, err)
 	}
 	return 0, nil
 }
+
+// formatViolations returns an error listing all violations of a check
+func formatViolations(name string, violations []*Violation) error {
+	lines := []string{}
+	for _, v := range violations {
+		lines = append(lines, fmt.Sprintf("%s: %s: %s:%d", v.Rule, v.Message, v.File, v.Line))
+	}
+	header := fmt.Sprintf("=== %s errors found ===", name)
+	return fmt.Errorf("\n%s\n%s\n%s\n", header, strings.Join(lines, "\n"), strings.Repeat("=", len(header)))
+}
@@ -0,0 +1,93 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// binarySniffLen is the number of bytes checked to detect binary content
+const binarySniffLen = 8000
+
+// isBinary returns true if the content looks like binary data instead of
+// text, using the same heuristic as Git (a NUL byte at the start)
+func isBinary(content []byte) bool {
+	if len(content) > binarySniffLen {
+		content = content[:binarySniffLen]
+	}
+	return bytes.IndexByte(content, 0) != -1
+}
+
+// contentHash returns the hash used to compare a file with its source.
+// When configured, CRLF line endings of text files are normalized first.
+func (cg *ChefGuard) contentHash(content []byte) [16]byte {
+	if getEffectiveConfig("LineEndings", cg.ChefOrg).(string) == "normalize" && !isBinary(content) {
+		content = bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	}
+	return md5.Sum(content)
+}
+
+// registerBinaryFile keeps track of large files under files/ so their
+// checksums can be verified against the allowlist
+func (cg *ChefGuard) registerBinaryFile(name string, content []byte) {
+	limit := getEffectiveConfig("MaxBinarySize", cg.ChefOrg).(int)
+	if limit == 0 || !strings.HasPrefix(name, "files/") || len(content) <= limit {
+		return
+	}
+	cg.BinaryFiles[name] = fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// checkBinaryChecksums makes sure all large files under files/ have their
+// checksum registered as an item in the checksum data bag
+func (cg *ChefGuard) checkBinaryChecksums() (int, error) {
+	if len(cg.BinaryFiles) == 0 {
+		return 0, nil
+	}
+
+	bag := getConfig().Default.ChecksumDataBag
+	if bag == "" {
+		bag = "chef_guard_checksums"
+	}
+
+	registered, _, err := cg.chefClient.GetDataByName(bag)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("Failed to get data bag %s: %s", bag, err)
+	}
+
+	unregistered := []string{}
+	for name, checksum := range cg.BinaryFiles {
+		if _, ok := registered[checksum]; !ok {
+			unregistered = append(unregistered, fmt.Sprintf("%s (sha256 %s)", name, checksum))
+		}
+	}
+	if len(unregistered) == 0 {
+		return 0, nil
+	}
+	sort.Strings(unregistered)
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Unregistered binary files found ===\n"+
+		"%s\n\n"+
+		"Large files under files/ must have their sha256\n"+
+		"checksum registered as an item in data bag %s\n"+
+		"=======================================\n", strings.Join(unregistered, "\n"), bag)
+}
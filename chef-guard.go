@@ -17,10 +17,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -28,6 +28,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -40,8 +41,6 @@ import (
 // VERSION holds the current version
 const VERSION = "0.7.3"
 
-var chefKey string
-
 var insecureTransport = &http.Transport{
 	Proxy: http.ProxyFromEnvironment,
 	Dial: (&net.Dialer{
@@ -62,63 +61,105 @@ type ChefGuard struct {
 	ChefOrg        string
 	ChefOrgID      *string
 	Cookbook       *chef.CookbookVersion
+	Metadata       *cookbookMetadata
 	CookbookPath   string
 	SourceCookbook *SourceCookbook
 	ChangeDetails  *changeDetails
+	EndpointType   string
+	RequestID      string
+	ClientIP       string
 	ForcedUpload   bool
+	Override       string
+	SourceRef      string
 	FileHashes     map[string][16]byte
+	SourceFiles    map[string][]byte
+	SourceMetadata map[string][]byte
+	InfectedFiles  map[string]string
+	UnscannedFiles []string
+	BinaryFiles    map[string]string
+	SecretFindings []string
 	GitIgnoreFile  []byte
 	ChefIgnoreFile []byte
-	TarFile        []byte
+	TarPath        string
+
+	// ctx is canceled when the client disconnects, so any work done for
+	// the request can be stopped
+	ctx   context.Context
+	stage *stageTracker
+
+	// newVersion is set when the uploaded version counts towards the daily
+	// version quota once Chef accepted it
+	newVersion bool
+
+	// generation is the config generation the clients were created with
+	generation int
 }
 
 func newChefGuard(r *http.Request) (*ChefGuard, error) {
+	cg, err := newChefGuardForOrg(r.Header.Get("X-Ops-Userid"), getChefOrgFromRequest(r), dropForce(r))
+	if err != nil {
+		return nil, err
+	}
+	cg.ctx = r.Context()
+	cg.stage = stageFromRequest(r)
+	cg.RequestID = requestID(r)
+	cg.ClientIP = clientIP(r)
+	return cg, nil
+}
+
+func newChefGuardForOrg(user, org string, forced bool) (*ChefGuard, error) {
 	cg := &ChefGuard{
-		User:         r.Header.Get("X-Ops-Userid"),
-		ChefOrg:      getChefOrgFromRequest(r),
-		ForcedUpload: dropForce(r),
+		User:         user,
+		ChefOrg:      org,
+		ForcedUpload: forced,
+		ctx:          context.Background(),
 	}
 
-	// Set the repo dependend on the Organization (could become a configurable in the future)
-	if cg.ChefOrg != "" {
+	// Set the repo dependend on the Organization, unless a specific repo is
+	// configured or all organizations are committed into a single (mono) repo
+	switch {
+	case getEffectiveConfig("GitRepo", cg.ChefOrg).(string) != "":
+		cg.Repo = getEffectiveConfig("GitRepo", cg.ChefOrg).(string)
+	case getConfig().Default.GitMonorepo != "":
+		cg.Repo = getConfig().Default.GitMonorepo
+	case cg.ChefOrg != "":
 		cg.Repo = cg.ChefOrg
-	} else {
+	default:
 		cg.Repo = "config"
 	}
 
-	// Initialize map for the file hashes
+	// Initialize maps for the file hashes, scan results and binary files
 	cg.FileHashes = map[string][16]byte{}
-
-	// Load the Chef key
-	if chefKey == "" {
-		key, err := ioutil.ReadFile(cfg.Chef.Key)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read Chef key: %s", err)
-		}
-
-		chefKey = string(key)
-	}
+	cg.InfectedFiles = map[string]string{}
+	cg.BinaryFiles = map[string]string{}
 
 	// Setup chefClient
 	var err error
-	cg.chefClient, err = chef.ConnectBuilder(cfg.Chef.Server, cfg.Chef.Port, "", cfg.Chef.User, chefKey, cg.ChefOrg)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create new Chef API connection: %s", err)
+	cg.generation = configGeneration()
+	if cg.chefClient, err = newChefClient(cg.ChefOrg); err != nil {
+		return nil, err
 	}
 
-	cg.chefClient.SSLNoVerify = cfg.Chef.SSLNoVerify
-
 	return cg, nil
 }
 
 func main() {
 	version := flag.Bool("v", false, "Show version")
+	seed := flag.String("seed", "", "Export all existing config of the given organization to Git and exit")
+	validate := flag.Bool("validate-config", false, "Validate the config and the connectivity of all configured services and exit")
 	flag.Parse()
 
 	if *version {
 		fmt.Println("Version: " + VERSION)
 		return
 	}
+	// Validate the config and exit when requested
+	if *validate {
+		if err := validateConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// Load and parse the config file
 	if err := loadConfig(); err != nil {
@@ -128,44 +169,112 @@ func main() {
 	if err := initLogging(); err != nil {
 		log.Fatal(err)
 	}
+	if err := initAccessLogging(); err != nil {
+		log.Fatal(err)
+	}
+	// Run the smoke test and exit when requested
+	if flag.Arg(0) == "smoke" {
+		if err := runSmokeTest(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Seed the Git repo and exit when requested
+	if *seed != "" {
+		if err := seedGit(*seed); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Initialize the retry queue
+	if err := initQueue(); err != nil {
+		log.Fatal(err)
+	}
+	if retryQueue != nil {
+		go retryQueue.run()
+	}
+	// Initialize the pending changes awaiting approval
+	if err := initApprovals(); err != nil {
+		log.Fatal(err)
+	}
 	// Parse the ErChef API URL
-	u, err := url.Parse(fmt.Sprintf("http://%s:%d", cfg.Chef.ErchefIP, cfg.Chef.ErchefPort))
+	u, err := url.Parse(erchefURL())
 	if err != nil {
-		log.Fatal(fmt.Errorf("Failed to parse ErChef API URL %s: %s", fmt.Sprintf("http://%s:%d", cfg.Chef.ErchefIP, cfg.Chef.ErchefPort), err))
+		log.Fatal(fmt.Errorf("Failed to parse ErChef API URL %s: %s", erchefURL(), err))
 	}
+	// Apply runtime tuning and start the management listener
+	tuneRuntime()
+	startManagementListener()
+	logMemStats()
+	startReconciler()
+	startReporter()
+	startDigester()
+	startRulesWatcher()
+	startUniverseRefresher()
+	startVaultRefresher()
 	// All critical parts are started now, so let's log a 'started' message :)
 	INFO.Println("Server started...")
 
 	// Setup the ErChef proxy
 	p := httputil.NewSingleHostReverseProxy(u)
+	p.Transport = erchefTransport
+	p.ErrorHandler = erchefErrorHandler
 
 	// Configure all needed handlers
 	rtr := mux.NewRouter()
-	if cfg.Chef.Type == "enterprise" || cfg.Chef.Version > 11 {
-		rtr.Path("/organizations/{org}/{type:data}/{bag}").HandlerFunc(processChange(p)).Methods("POST", "DELETE")
-		rtr.Path("/organizations/{org}/{type:data}/{bag}/{name}").HandlerFunc(processChange(p)).Methods("PUT", "DELETE")
-		rtr.Path("/organizations/{org}/{type:clients|environments|nodes|roles}").HandlerFunc(processChange(p)).Methods("POST")
-		rtr.Path("/organizations/{org}/{type:clients|environments|nodes|roles}/{name}").HandlerFunc(processChange(p)).Methods("PUT", "DELETE")
-		rtr.Path("/organizations/{org}/{type:cookbooks}/{name}/{version}").HandlerFunc(processCookbook(p)).Methods("PUT", "DELETE")
+	if getConfig().Chef.Type == "enterprise" || getConfig().Chef.Version > 11 {
+		rtr.Path("/organizations").HandlerFunc(failSafe(p, processOrganization(p))).Methods("POST")
+		rtr.Path("/organizations/{org}").HandlerFunc(failSafe(p, processOrganization(p))).Methods("DELETE")
+		rtr.Path("/organizations/{org}/{type:data}/{bag}").HandlerFunc(failSafe(p, processChange(p))).Methods("POST", "DELETE")
+		rtr.Path("/organizations/{org}/{type:data}/{bag}/{name}").HandlerFunc(failSafe(p, processChange(p))).Methods("PUT", "DELETE")
+		rtr.Path("/organizations/{org}/{type:clients|environments|nodes|roles}").HandlerFunc(failSafe(p, processChange(p))).Methods("POST")
+		rtr.Path("/organizations/{org}/{type:clients|environments|nodes|roles}/{name}").HandlerFunc(failSafe(p, processChange(p))).Methods("PUT", "DELETE")
+		rtr.Path("/organizations/{org}/{type:cookbooks}/{name}/{version}").HandlerFunc(failSafe(p, processCookbook(p))).Methods("PUT", "DELETE")
 	} else {
-		rtr.Path("/{type:data}/{bag}").HandlerFunc(processChange(p)).Methods("POST", "DELETE")
-		rtr.Path("/{type:data}/{bag}/{name}").HandlerFunc(processChange(p)).Methods("PUT", "DELETE")
-		rtr.Path("/{type:clients|environments|nodes|roles}").HandlerFunc(processChange(p)).Methods("POST")
-		rtr.Path("/{type:clients|environments|nodes|roles}/{name}").HandlerFunc(processChange(p)).Methods("PUT", "DELETE")
-		rtr.Path("/{type:cookbooks}/{name}/{version}").HandlerFunc(processCookbook(p)).Methods("PUT", "DELETE")
+		rtr.Path("/{type:data}/{bag}").HandlerFunc(failSafe(p, processChange(p))).Methods("POST", "DELETE")
+		rtr.Path("/{type:data}/{bag}/{name}").HandlerFunc(failSafe(p, processChange(p))).Methods("PUT", "DELETE")
+		rtr.Path("/{type:clients|environments|nodes|roles}").HandlerFunc(failSafe(p, processChange(p))).Methods("POST")
+		rtr.Path("/{type:clients|environments|nodes|roles}/{name}").HandlerFunc(failSafe(p, processChange(p))).Methods("PUT", "DELETE")
+		rtr.Path("/{type:cookbooks}/{name}/{version}").HandlerFunc(failSafe(p, processCookbook(p))).Methods("PUT", "DELETE")
 	}
 
 	// Adding some non-Chef endpoints here
 	rtr.Path("/chef-guard/time").HandlerFunc(timeHandler).Methods("GET")
-	if cfg.ChefClients.Path != "" {
+	rtr.Path("/chef-guard/reservations").HandlerFunc(reservationsHandler).Methods("GET")
+	rtr.Path("/chef-guard/schemas").HandlerFunc(schemasHandler).Methods("GET")
+	rtr.Path("/chef-guard/schemas/{id:.+}").HandlerFunc(schemasHandler).Methods("GET")
+	if getConfig().Universe.Aggregate {
+		startGitUniverseRefresher()
+		rtr.Path("/chef-guard/universe").HandlerFunc(signedHandler(universeHandler)).Methods("GET")
+		rtr.Path("/organizations/{org}/chef-guard/universe").HandlerFunc(signedHandler(universeHandler)).Methods("GET")
+		rtr.Path("/chef-guard/universe/{name}/{version}/download").HandlerFunc(universeDownloadHandler).Methods("GET")
+	}
+	if getConfig().Preview.Enabled {
+		rtr.Path("/chef-guard/preview").HandlerFunc(previewHandler).Methods("POST")
+	}
+	if getConfig().Rollback.Enabled {
+		rtr.Path("/chef-guard/rollback").HandlerFunc(rollbackHandler).Methods("POST")
+	}
+	if approvalQueue != nil {
+		rtr.Path("/chef-guard/approvals").HandlerFunc(approvalsHandler).Methods("GET")
+		rtr.Path("/chef-guard/approvals/{id:[0-9]+-approval}/{action:approve|reject}").HandlerFunc(approvalHandler).Methods("POST")
+	}
+	if getConfig().Webhook.Secret != "" {
+		rtr.Path("/chef-guard/webhook").HandlerFunc(processWebhook).Methods("POST")
+	}
+	if getConfig().ChefClients.Path != "" {
 		rtr.Path("/chef-guard/{type:metadata|download}").HandlerFunc(processDownload).Methods("GET")
+		rtr.Path("/chef-guard/{channel:stable|current|unstable}/{project:[a-z0-9_-]+}/{type:metadata|download}").HandlerFunc(processDownload).Methods("GET")
 		rtr.Path("/chef-guard/clients").Handler(http.RedirectHandler("/chef-guard/clients/", http.StatusMovedPermanently))
-		rtr.PathPrefix("/chef-guard/clients/").Handler(http.StripPrefix("/chef-guard/clients/", http.FileServer(http.Dir(cfg.ChefClients.Path))))
+		clients := http.FileServer(http.Dir(getConfig().ChefClients.Path))
+		if getConfig().Scan.Clamd != "" {
+			clients = scanClientsHandler(clients)
+		}
+		rtr.PathPrefix("/chef-guard/clients/").Handler(http.StripPrefix("/chef-guard/clients/", clients))
 	}
 
 	rtr.NotFoundHandler = p
 	rtr.MethodNotAllowedHandler = p
-	http.Handle("/", rtr)
 
 	// Start the server
 	shutdownCh := startSignalHandler()
@@ -177,11 +286,26 @@ func main() {
 		graceful.Close()
 	}()
 
-	err = graceful.ListenAndServe(fmt.Sprintf("%s:%d", cfg.Default.ListenIP, cfg.Default.ListenPort), nil)
+	// Use our own handler instead of the http.DefaultServeMux, so we don't
+	// expose any handlers registered by imported packages (e.g. expvar and pprof)
+	addr := fmt.Sprintf("%s:%d", getConfig().Default.ListenIP, getConfig().Default.ListenPort)
+	graceful.DefaultServer = graceful.NewServer(&http.Server{
+		Addr:      addr,
+		Handler:   requestIDHandler(accessLogHandler(recoverHandler(auditHandler(captureHandler(freezeHandler(rtr)))))),
+		ConnState: trackConnState,
+	})
+	if getConfig().Default.TLSCert != "" {
+		err = listenAndServeTLS(graceful.DefaultServer, addr)
+	} else {
+		err = graceful.DefaultServer.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatalf("Chef-Guard server error: %s", err)
 	}
 
+	// Commit all changes still waiting for their debounce window to pass
+	flushGitUpdates()
+
 	msg := "Server stopped..."
 	INFO.Println(msg)
 	log.Println(msg)
@@ -223,19 +347,23 @@ func startSignalHandler() chan struct{} {
 }
 
 func errorHandler(w http.ResponseWriter, err string, statusCode int) {
+	id := w.Header().Get(requestIDHeader)
 	switch statusCode {
 	case http.StatusPreconditionFailed:
 		// No need to write anything to the log for this one...
 	case http.StatusNotFound:
-		WARNING.Println(err)
+		logf(WARNING, id, "%s", err)
 	default:
-		ERROR.Println(err)
+		logf(ERROR, id, "%s", err)
+	}
+	if id != "" {
+		err = fmt.Sprintf("%s\nRequest ID: %s", strings.TrimRight(err, "\n"), id)
 	}
 	http.Error(w, err, statusCode)
 }
 
 func getChefOrgFromRequest(r *http.Request) string {
-	if cfg.Chef.Type != "enterprise" {
+	if getConfig().Chef.Type != "enterprise" {
 		return ""
 	}
 	return mux.Vars(r)["org"]
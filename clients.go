@@ -17,108 +17,485 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-// Add files type and functions for the Sort interface
-type files []string
+// clientVersionRe extracts the version and build iteration from the file
+// name of a client package (e.g. chef-12.4.1-1.el6.x86_64.rpm)
+var clientVersionRe = regexp.MustCompile(`(\d+\.\d+\.\d+)(?:[-+_](\d+))?`)
 
-func (f files) Len() int {
-	return len(f)
+// clientParamRe matches valid platform, platform version and machine values
+var clientParamRe = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+
+// machineAliases holds the different names used for the same architecture
+var machineAliases = map[string][]string{
+	"x86_64":  {"x86_64", "amd64"},
+	"amd64":   {"amd64", "x86_64"},
+	"i386":    {"i386", "i686", "i86pc"},
+	"i686":    {"i686", "i386", "i86pc"},
+	"i86pc":   {"i86pc", "i386", "i686"},
+	"aarch64": {"aarch64", "arm64"},
+	"arm64":   {"arm64", "aarch64"},
+}
+
+// clientRequest holds the omnitruck query of a metadata or download request
+type clientRequest struct {
+	Channel         string
+	Project         string
+	Platform        string
+	PlatformVersion string
+	Machine         string
+	Version         string
+}
+
+// clientPackage represents a client package found on disk
+type clientPackage struct {
+	File      string
+	Version   string
+	Iteration int
 }
 
-func (f files) Less(i, j int) bool {
-	re := regexp.MustCompile(`.*?(\d+)\.(\d+)\.(\d+)-?(\d+)?.*`)
-	parts_i := re.FindStringSubmatch(f[i])
-	parts_j := re.FindStringSubmatch(f[j])
+// clientMetadata is the metadata of a client package as returned by omnitruck
+type clientMetadata struct {
+	URL     string `json:"url"`
+	MD5     string `json:"md5,omitempty"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256"`
+	Version string `json:"version"`
+}
+
+// processDownload implements the omnitruck metadata and download API, serving
+// the client packages from disk and optionally from the public omnitruck
+// service when the requested package isn't available locally
+func processDownload(w http.ResponseWriter, r *http.Request) {
+	c, err := newClientRequest(r)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pkg, err := c.localPackage()
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	for idx := 1; idx < len(parts_i); idx++ {
-		// Convert the part to a int
-		i, err := strconv.Atoi(parts_i[idx])
+	if pkg == nil && getConfig().ChefClients.Omnitruck != "" {
+		meta, err := c.omnitruckMetadata(r.Context())
 		if err != nil {
-			return false
+			errorHandler(w, err.Error(), http.StatusBadGateway)
+			return
 		}
-		// Convert the part to a int
-		j, err := strconv.Atoi(parts_j[idx])
-		if err != nil {
-			return false
+		if meta != nil && !getConfig().ChefClients.Cache {
+			serveClientMetadata(w, r, meta)
+			return
 		}
-		// If equal, move on to the next part
-		if i == j {
-			continue
+		if meta != nil {
+			if pkg, err = c.cachePackage(r.Context(), meta); err != nil {
+				errorHandler(w, err.Error(), http.StatusBadGateway)
+				return
+			}
 		}
-		// Compare and do a descending sort
-		if i > j {
-			return true
+	}
+
+	if pkg == nil {
+		errorHandler(w, fmt.Sprintf("No %s package found for platform %s %s (%s) matching version %q",
+			c.Project, c.Platform, c.PlatformVersion, c.Machine, c.Version), http.StatusNotFound)
+		return
+	}
+
+	if getConfig().Scan.Clamd != "" {
+		if err := checkClientFile(requestID(r), pkg.File); err != nil {
+			errorHandler(w, err.Error(), http.StatusForbidden)
+			return
 		}
-		return false
 	}
-	return false
+
+	meta, err := pkg.metadata(mux.Vars(r)["type"] == "metadata")
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	serveClientMetadata(w, r, meta)
 }
 
-func (f files) Swap(i, j int) {
-	f[i], f[j] = f[j], f[i]
+func newClientRequest(r *http.Request) (*clientRequest, error) {
+	vars := mux.Vars(r)
+
+	c := &clientRequest{
+		Channel:         vars["channel"],
+		Project:         vars["project"],
+		Platform:        r.FormValue("p"),
+		PlatformVersion: r.FormValue("pv"),
+		Machine:         r.FormValue("m"),
+		Version:         strings.TrimSpace(r.FormValue("v")),
+	}
+
+	// Requests without a channel use the (older) prerelease and nightlies flags
+	if c.Channel == "" {
+		switch {
+		case r.FormValue("nightlies") == "true":
+			c.Channel = "unstable"
+		case r.FormValue("prerelease") == "true":
+			c.Channel = "current"
+		default:
+			c.Channel = "stable"
+		}
+	}
+	if c.Project == "" {
+		c.Project = "chef"
+	}
+	if c.Version == "latest" {
+		c.Version = ""
+	}
+
+	for _, p := range []string{c.Platform, c.PlatformVersion, c.Machine} {
+		if !clientParamRe.MatchString(p) || strings.Contains(p, "..") {
+			return nil, fmt.Errorf("Invalid platform, platform version or machine: %q", p)
+		}
+	}
+	if c.Platform == "" || c.PlatformVersion == "" || c.Machine == "" {
+		return nil, fmt.Errorf("The platform (p), platform version (pv) and machine (m) are required!")
+	}
+	if strings.ContainsAny(c.Version, "<>=~") {
+		if _, err := matchesConstraint("0.0.0", c.Version); err != nil {
+			return nil, fmt.Errorf("Invalid version constraint: %s", err)
+		}
+	}
+
+	return c, nil
 }
 
-func processDownload(w http.ResponseWriter, r *http.Request) {
-	path := getFilePath(r)
-	dir := filepath.Join(cfg.ChefClients.Path, path)
+// baseDir returns the directory holding the packages of the project and
+// channel. Packages of the chef project in the stable channel are stored in
+// the root of the configured path.
+func (c *clientRequest) baseDir() string {
+	dir := getConfig().ChefClients.Path
+	if c.Project != "chef" {
+		dir = filepath.Join(dir, c.Project)
+	}
+	if c.Channel != "stable" {
+		dir = filepath.Join(dir, c.Channel)
+	}
+	return dir
+}
 
-	targetfile, err := getTargetFile(dir, r.FormValue("v"))
-	if err != nil {
-		errorHandler(w, err.Error(), http.StatusBadRequest)
+// dirs returns the directories that may contain the requested package,
+// ordered from the most to the least specific match
+func (c *clientRequest) dirs() []string {
+	pvs := []string{c.PlatformVersion}
+	if major := strings.SplitN(c.PlatformVersion, ".", 2)[0]; major != c.PlatformVersion {
+		pvs = append(pvs, major)
 	}
 
-	if targetfile != "" {
-		targetpath := path + targetfile[len(dir):]
-		targeturl := getChefBaseURL() + "/chef-guard/clients/" + targetpath
+	machines, ok := machineAliases[c.Machine]
+	if !ok {
+		machines = []string{c.Machine}
+	}
 
-		// For download calls, redirect to the actuall file
-		if mux.Vars(r)["type"] == "download" {
-			http.Redirect(w, r, targeturl, http.StatusFound)
+	var dirs []string
+	for _, pv := range pvs {
+		for _, m := range machines {
+			dirs = append(dirs, filepath.Join(c.baseDir(), c.Platform, pv, m))
 		}
-		// For metadata calls, return the requested meta data
-		if mux.Vars(r)["type"] == "metadata" {
-			data, err := ioutil.ReadFile(targetfile)
-			if err != nil {
-				errorHandler(w, "Failed to read client file: %s"+err.Error(), http.StatusBadRequest)
+	}
+	return dirs
+}
+
+// localPackage returns the newest package on disk matching the request
+func (c *clientRequest) localPackage() (*clientPackage, error) {
+	for _, dir := range c.dirs() {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
 			}
+			return nil, fmt.Errorf("Failed to read clients from disk: %s", err)
+		}
 
-			targetmd5 := md5.Sum(data)
-			targetsha := sha256.Sum256(data)
+		var pkg *clientPackage
+		for _, fi := range fis {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			m := clientVersionRe.FindStringSubmatch(fi.Name())
+			if m == nil {
+				continue
+			}
+			p := &clientPackage{File: filepath.Join(dir, fi.Name()), Version: m[1]}
+			p.Iteration, _ = strconv.Atoi(m[2])
 
-			fmt.Fprintf(w, "url %s\nmd5 %x\nsha256 %x", targeturl, targetmd5, targetsha)
+			if c.matchesVersion(p) && (pkg == nil || p.newerThan(pkg)) {
+				pkg = p
+			}
+		}
+		if pkg != nil {
+			return pkg, nil
 		}
 	}
+
+	return nil, nil
 }
 
-func getFilePath(r *http.Request) string {
-	return filepath.Join(r.FormValue("p"), r.FormValue("pv"), r.FormValue("m"))
+// matchesVersion returns true if the package matches the requested version.
+// Like omnitruck, a partial version (e.g. 12 or 12.4) matches all versions
+// starting with it. Version constraints (e.g. '~> 12.4') are supported as well.
+func (c *clientRequest) matchesVersion(p *clientPackage) bool {
+	if c.Version == "" {
+		return true
+	}
+	if strings.ContainsAny(c.Version, "<>=~") {
+		ok, err := matchesConstraint(p.Version, c.Version)
+		return err == nil && ok
+	}
+
+	parts := strings.SplitN(c.Version, "-", 2)
+	if len(parts) == 2 && parts[1] != strconv.Itoa(p.Iteration) {
+		return false
+	}
+
+	vs, rs := strings.Split(p.Version, "."), strings.Split(parts[0], ".")
+	if len(rs) > len(vs) {
+		return false
+	}
+	for i := range rs {
+		if vs[i] != rs[i] {
+			return false
+		}
+	}
+	return true
 }
 
-func getTargetFile(dir, version string) (string, error) {
-	if version == "latest" {
-		version = "."
+func (p *clientPackage) newerThan(o *clientPackage) bool {
+	if cmp := compareVersions(p.Version, o.Version); cmp != 0 {
+		return cmp > 0
 	}
+	return p.Iteration > o.Iteration
+}
 
-	filelist, err := filepath.Glob(dir + "/*" + version + "*")
+// metadata returns the metadata of the package. The checksums are only
+// calculated when needed, as client packages can be quite large.
+func (p *clientPackage) metadata(checksums bool) (*clientMetadata, error) {
+	rel, err := filepath.Rel(getConfig().ChefClients.Path, p.File)
 	if err != nil {
-		return "", fmt.Errorf("Failed to read clients from disk: %s", err)
+		return nil, err
 	}
 
-	if filelist != nil {
-		sort.Sort(files(filelist))
-		return filelist[0], nil
+	meta := &clientMetadata{
+		URL:     getChefBaseURL() + "/chef-guard/clients/" + filepath.ToSlash(rel),
+		Version: p.Version,
+	}
+	if !checksums {
+		return meta, nil
+	}
+
+	f, err := os.Open(p.File)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read client file: %s", err)
+	}
+	defer f.Close()
+
+	md5sum, sha1sum, sha256sum := md5.New(), sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5sum, sha1sum, sha256sum), f); err != nil {
+		return nil, fmt.Errorf("Failed to read client file: %s", err)
+	}
+
+	meta.MD5 = hex.EncodeToString(md5sum.Sum(nil))
+	meta.SHA1 = hex.EncodeToString(sha1sum.Sum(nil))
+	meta.SHA256 = hex.EncodeToString(sha256sum.Sum(nil))
+
+	return meta, nil
+}
+
+// omnitruckMetadata returns the metadata of the requested package from the
+// configured omnitruck service, or nil if the package doesn't exist
+func (c *clientRequest) omnitruckMetadata(ctx context.Context) (*clientMetadata, error) {
+	q := url.Values{}
+	q.Set("p", c.Platform)
+	q.Set("pv", c.PlatformVersion)
+	q.Set("m", c.Machine)
+	if c.Version != "" {
+		q.Set("v", c.Version)
+	}
+	u := fmt.Sprintf("%s/%s/%s/metadata?%s",
+		strings.TrimSuffix(getConfig().ChefClients.Omnitruck, "/"), c.Channel, c.Project, q.Encode())
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create omnitruck request: %s", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := newHTTPClient(false).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get metadata from omnitruck: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to get metadata from omnitruck: %s", err)
+	}
+
+	meta := new(clientMetadata)
+	if err := json.NewDecoder(resp.Body).Decode(meta); err != nil {
+		return nil, fmt.Errorf("Failed to decode metadata from omnitruck: %s", err)
+	}
+	if meta.URL == "" {
+		return nil, fmt.Errorf("Received metadata from omnitruck without an URL")
+	}
+
+	return meta, nil
+}
+
+// cachePackage downloads the package described by the metadata into the
+// directory of the request, so it is served from disk from now on
+func (c *clientRequest) cachePackage(ctx context.Context, meta *clientMetadata) (*clientPackage, error) {
+	u, err := url.Parse(meta.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse package URL %s: %s", meta.URL, err)
+	}
+	name := path.Base(u.Path)
+	if !clientParamRe.MatchString(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("Invalid package name %q", name)
+	}
+
+	dir := filepath.Join(c.baseDir(), c.Platform, c.PlatformVersion, c.Machine)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create client directory %s: %s", dir, err)
+	}
+
+	req, err := http.NewRequest("GET", meta.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a download request: %s", err)
+	}
+	resp, err := newHTTPClient(false).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download package %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to download package %s: %s", name, err)
+	}
+
+	// Download to a temp file first so we never serve a partial package
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temp file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, sum), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download package %s: %s", name, err)
+	}
+
+	if meta.SHA256 != "" && hex.EncodeToString(sum.Sum(nil)) != meta.SHA256 {
+		return nil, fmt.Errorf("Checksum mismatch for downloaded package %s", name)
+	}
+
+	// Scan the package once before it is cached, instead of when it is served
+	file := filepath.Join(dir, name)
+	if getConfig().Scan.Clamd != "" {
+		if err := scanClientFile(requestIDFromContext(ctx), tmp.Name(), file); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return nil, fmt.Errorf("Failed to store package %s: %s", name, err)
+	}
+	logf(INFO, requestIDFromContext(ctx), "Cached %s package %s from omnitruck", c.Project, file)
+
+	pkg := &clientPackage{File: file, Version: meta.Version}
+	if m := clientVersionRe.FindStringSubmatch(name); m != nil {
+		pkg.Iteration, _ = strconv.Atoi(m[2])
+	}
+	return pkg, nil
+}
+
+// serveClientMetadata redirects download requests to the package and returns
+// the metadata (as JSON when requested) for metadata requests
+func serveClientMetadata(w http.ResponseWriter, r *http.Request, meta *clientMetadata) {
+	if mux.Vars(r)["type"] == "download" {
+		http.Redirect(w, r, meta.URL, http.StatusFound)
+		return
+	}
+
+	// The response depends on the Accept header, so make sure caches in
+	// between don't serve JSON to old bootstraps expecting plain text
+	w.Header().Add("Vary", "Accept")
+
+	if acceptsJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(meta); err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to encode metadata: %s", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "url %s\n", meta.URL)
+	if meta.MD5 != "" {
+		fmt.Fprintf(w, "md5 %s\n", meta.MD5)
+	}
+	fmt.Fprintf(w, "sha1 %s\nsha256 %s\nversion %s", meta.SHA1, meta.SHA256, meta.Version)
+}
+
+// acceptsJSON returns true if the Accept header prefers JSON over plain text.
+// Wildcards don't count as a preference for JSON, so old bootstraps sending
+// no or a generic Accept header keep getting the plain text format.
+func acceptsJSON(accept string) bool {
+	jsonQ, textQ := 0.0, 0.0
+	for _, mr := range strings.Split(accept, ",") {
+		params := strings.Split(mr, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQ = math.Max(jsonQ, q)
+		case "text/plain", "text/*":
+			textQ = math.Max(textQ, q)
+		}
 	}
-	return "", nil
+	return jsonQ > 0 && jsonQ >= textQ
 }
@@ -17,42 +17,105 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mitchellh/osext"
 	"github.com/xanzy/chef-guard/git"
 	"gopkg.in/gcfg.v1"
 )
 
+// configVersion is the highest config version supported by this release
+const configVersion = 1
+
 // Config represents the Chef-Guard configuration
 type Config struct {
 	Default struct {
+		ConfigVersion      int
 		ListenIP           string
 		ListenPort         int
+		TLSCert            string
+		TLSKey             string
 		Logfile            string
+		AccessLog          string
+		AccessLogFormat    string
+		TrustedProxies     string
+		CrashDir           string
+		DigestFile         string
 		Tempdir            string
 		Mode               string
+		TimeZone           string
+		TimeFormat         string
 		MailDomain         string
 		MailServer         string
 		MailPort           int
 		MailSendBy         string
 		MailRecipient      string
 		ValidateChanges    string
+		TypeModes          string
+		ExemptValidation   string
+		ExemptCommits      string
+		ExcludeAttributes  string
+		RedactKeys         string
+		DebounceTypes      string
+		DebounceWindow     int
+		PassthroughOnError string
 		CommitChanges      bool
+		SyncCommits        string
+		GitRetries         int
+		ReviewChanges      bool
 		MailChanges        bool
+		Digest             string
+		DigestURL          string
 		SearchGit          bool
 		PublishCookbook    bool
+		VendorRepo         string
+		UntagCookbooks     bool
+		UnshareCookbooks   bool
+		IncreasingVersions bool
+		Bookshelf          string
+		InsecureDownloads  string
+		MaxRedirects       int
+		SameHostRedirects  bool
 		Blacklist          string
+		Allowlist          string
+		ListSteps          string
+		CompareIgnore      string
+		LineEndings        string
 		DevEnvironment     string
+		ResolveConstraints bool
+		ValidateRunLists   bool
 		GitConfig          string
+		GitRepo            string
+		GitMonorepo        string
 		GitCookbookConfigs string
 		IncludeFCs         string
 		ExcludeFCs         string
+		ExcludeCops        string
+		MaxBinarySize      int
+		ChecksumDataBag    string
+		CookbookQuota      string
+		DailyVersionQuota  string
+		EnvironmentQuota   string
+		RequiredMetadata   string
+		AllowedLicenses    string
+		RequireChangelog   bool
+		CompareMetadata    bool
+		EnforceFrozen      bool
+		OverrideUsers      string
+		OverrideSecrets    string
+		UnfrozenCookbooks  string
+		DetectSecrets      string
+		SecretAllowlist    string
 	}
 	Customer map[string]*struct {
 		Mode               *string
@@ -62,14 +125,53 @@ type Config struct {
 		MailSendBy         *string
 		MailRecipient      *string
 		ValidateChanges    *string
+		TypeModes          *string
+		ExemptValidation   *string
+		ExemptCommits      *string
+		ExcludeAttributes  *string
+		RedactKeys         *string
+		DebounceTypes      *string
+		DebounceWindow     *int
+		PassthroughOnError *string
 		CommitChanges      *bool
+		SyncCommits        *string
+		ReviewChanges      *bool
 		MailChanges        *bool
+		Digest             *string
+		DigestURL          *string
 		SearchGit          *bool
 		PublishCookbook    *bool
+		VendorRepo         *string
+		UntagCookbooks     *bool
+		UnshareCookbooks   *bool
+		IncreasingVersions *bool
+		Bookshelf          *string
 		Blacklist          *string
+		Allowlist          *string
+		ListSteps          *string
+		CompareIgnore      *string
+		LineEndings        *string
 		DevEnvironment     *string
+		ResolveConstraints *bool
+		ValidateRunLists   *bool
+		GitRepo            *string
 		GitCookbookConfigs *string
 		ExcludeFCs         *string
+		ExcludeCops        *string
+		MaxBinarySize      *int
+		CookbookQuota      *string
+		DailyVersionQuota  *string
+		EnvironmentQuota   *string
+		RequiredMetadata   *string
+		AllowedLicenses    *string
+		RequireChangelog   *bool
+		CompareMetadata    *bool
+		EnforceFrozen      *bool
+		OverrideUsers      *string
+		OverrideSecrets    *string
+		UnfrozenCookbooks  *string
+		DetectSecrets      *string
+		SecretAllowlist    *string
 	}
 	Chef struct {
 		Type            string
@@ -79,13 +181,19 @@ type Config struct {
 		SSLNoVerify     bool
 		ErchefIP        string
 		ErchefPort      int
+		ErchefTimeout   int
+		ErchefFailures  int
+		ErchefCooldown  int
 		BookshelfKey    string
 		BookshelfSecret string
 		User            string
 		Key             string
+		DownloadWorkers int
 	}
 	ChefClients struct {
-		Path string
+		Path      string
+		Omnitruck string
+		Cache     bool
 	}
 	Community struct {
 		Supermarket string
@@ -97,15 +205,173 @@ type Config struct {
 		SSLNoVerify bool
 		User        string
 		Key         string
+		AutoDetect  bool
+	}
+	HTTP struct {
+		Timeout             int
+		ConnectTimeout      int
+		Retries             int
+		Backoff             int
+		MaxIdleConns        int
+		MaxIdleConnsPerHost int
+		IdleConnTimeout     int
+		TLSHandshakeTimeout int
+	}
+	Universe struct {
+		TTL       int
+		Refresh   bool
+		Aggregate bool
 	}
 	Tests struct {
 		Foodcritic string
+		Cookstyle  string
 		Rubocop    string
+		Hooks      string
+		Timeout    int
+		MaxOutput  int
+		Nice       int
+		Cgroup     string
+		Container  string
+		Image      string
+		Mounts     string
+		CacheTTL   int
+		CacheSize  int
+	}
+	Webhook struct {
+		Secret        string
+		ApplyChanges  bool
+		ViolationsURL string
+		VerdictsURL   string
+	}
+	Management struct {
+		ListenIP         string
+		ListenPort       int
+		GoMaxProcs       int
+		GCPercent        int
+		MemStatsInterval int
+	}
+	Queue struct {
+		Path        string
+		MaxItems    int
+		Interval    int
+		MaxAttempts int
+		DeadLetter  string
+	}
+	Organizations struct {
+		CreateRepos  bool
+		ArchiveRepos bool
+	}
+	Capture struct {
+		Path  string
+		Types string
+	}
+	Rules struct {
+		Repo     string
+		Path     string
+		Interval int
+	}
+	Scan struct {
+		Clamd   string
+		Timeout int
+	}
+	Audit struct {
+		Path string
+	}
+	Report struct {
+		Path   string
+		Secret string
+	}
+	Reconcile struct {
+		Interval int
+		Mode     string
+		Orgs     string
+	}
+	DataBags struct {
+		SchemaPath string
+		GitSchemas bool
+		Encrypted  string
+	}
+	Git      map[string]*git.Config
+	Cookbook map[string]*struct {
+		GitConfig     string
+		Repo          string
+		Path          string
+		TagPrefix     string
+		CompareIgnore string
+	}
+	Reservation map[string]*struct {
+		Users string
+	}
+	Rollback struct {
+		Enabled bool
 	}
-	Git map[string]*git.Config
+	Preview struct {
+		Enabled bool
+	}
+	Approval struct {
+		Path         string
+		Environments string
+		Approvers    string
+	}
+	Route map[string]*struct {
+		Orgs       string
+		Types      string
+		Pattern    string
+		Recipients string
+		URL        string
+	}
+	Freeze map[string]*struct {
+		Orgs       string
+		Types      string
+		Start      string
+		End        string
+		Schedule   string
+		Duration   string
+		BreakGlass string
+		Message    string
+
+		window *freezeWindow
+	}
+	Bookshelf map[string]*struct {
+		URL    string
+		Key    string
+		Secret string
+	}
+	Lock struct {
+		Redis    string
+		TLS      bool
+		Password string
+		Database int
+		Prefix   string
+		TTL      int
+		Timeout  int
+		Deadline int
+	}
+	Vault struct {
+		Address     string
+		Token       string
+		Namespace   string
+		SSLNoVerify bool
+		Refresh     int
+	}
+
+	// location is the parsed time zone of the default section
+	location *time.Location
 }
 
-var cfg Config
+// currentConfig holds the active *Config, which is replaced as a whole when
+// the config is (re)loaded and must never be modified after it is stored
+var currentConfig atomic.Value
+
+func init() {
+	currentConfig.Store(&Config{})
+}
+
+// getConfig returns the active config. Callers that use multiple settings
+// which belong together should call it once, so they see a single config.
+func getConfig() *Config {
+	return currentConfig.Load().(*Config)
+}
 
 func loadConfig() error {
 	exe, err := osext.Executable()
@@ -115,13 +381,102 @@ func loadConfig() error {
 
 	strings.TrimSuffix(exe, path.Ext(exe))
 	var tmpConfig Config
-	if err := gcfg.ReadFileInto(&tmpConfig, exe+".conf"); err != nil {
-		return fmt.Errorf("Failed to parse config file '%s': %s", exe+".conf", err)
+	file := configFile(exe)
+	if err := readConfigFile(&tmpConfig, file); err != nil {
+		// Unknown options are allowed in a config written for a newer version,
+		// so a shared config can be updated before all instances are upgraded
+		if gcfg.FatalOnly(err) != nil || tmpConfig.Default.ConfigVersion <= configVersion {
+			return fmt.Errorf("Failed to parse config file '%s': %s", file, err)
+		}
+		WARNING.Printf("Ignoring unknown options in config version %d (supported version is %d): %s",
+			tmpConfig.Default.ConfigVersion, configVersion, err)
 	}
 
+	lease, err := resolveConfigValues(&tmpConfig, path.Dir(exe))
+	if err != nil {
+		return err
+	}
 	if err := verifyRequiredFields(&tmpConfig); err != nil {
 		return err
 	}
+	if err := verifyAccessLogConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyTrustedProxiesConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyTLSConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyUniverseConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyChefClientsConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyDownloadConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyLineEndingsConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyHTTPConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyReconcileConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyLockConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyBookshelfConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyMetadataConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyQuotaConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyRouteConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyDigestConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyApprovalConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyFreezeConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyTypeModesConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifySecretsConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyUnfrozenCookbooksConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyAllowlistConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyRedactKeysConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyTestsConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyRulesConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyReportConfig(&tmpConfig); err != nil {
+		return err
+	}
+	if err := verifyTimeConfig(&tmpConfig); err != nil {
+		return err
+	}
 	if err := verifyChefConfig(&tmpConfig); err != nil {
 		return err
 	}
@@ -135,7 +490,16 @@ func loadConfig() error {
 		return err
 	}
 
-	cfg = tmpConfig
+	chefKey, supermarketKey, err := readClientKeys(&tmpConfig)
+	if err != nil {
+		return err
+	}
+
+	swapConfig(tmpConfig, chefKey, supermarketKey)
+
+	vaultLease.Lock()
+	vaultLease.d = lease
+	vaultLease.Unlock()
 
 	return nil
 }
@@ -198,6 +562,372 @@ func verifyRequiredFields(c *Config) error {
 	return nil
 }
 
+func verifyAccessLogConfig(c *Config) error {
+	switch c.Default.AccessLogFormat {
+	case "", "common", "combined":
+		return nil
+	default:
+		return fmt.Errorf("Invalid access log format %q! Valid formats are 'common' and 'combined'.", c.Default.AccessLogFormat)
+	}
+}
+
+func verifyTLSConfig(c *Config) error {
+	if (c.Default.TLSCert == "") != (c.Default.TLSKey == "") {
+		return fmt.Errorf("Both the TLS certificate and key need to be configured to listen on HTTPS!")
+	}
+	if c.Default.TLSCert == "" {
+		return nil
+	}
+	// Make sure a reload with an invalid certificate doesn't break the listener
+	if _, err := tls.LoadX509KeyPair(c.Default.TLSCert, c.Default.TLSKey); err != nil {
+		return fmt.Errorf("Failed to load TLS certificate %s: %s", c.Default.TLSCert, err)
+	}
+	return nil
+}
+
+func verifyTrustedProxiesConfig(c *Config) error {
+	_, err := parseTrustedProxies(c.Default.TrustedProxies)
+	return err
+}
+
+func verifyUniverseConfig(c *Config) error {
+	if c.Universe.TTL == 0 {
+		c.Universe.TTL = 300
+	}
+	return nil
+}
+
+func verifyChefClientsConfig(c *Config) error {
+	if c.ChefClients.Omnitruck == "" {
+		return nil
+	}
+	u, err := url.Parse(c.ChefClients.Omnitruck)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid omnitruck URL %q!", c.ChefClients.Omnitruck)
+	}
+	return nil
+}
+
+func verifyDownloadConfig(c *Config) error {
+	switch c.Default.InsecureDownloads {
+	case "", "allow", "upgrade", "reject":
+		return nil
+	default:
+		return fmt.Errorf("Invalid insecure downloads policy %q! Valid policies are 'allow', 'upgrade' and 'reject'.", c.Default.InsecureDownloads)
+	}
+}
+
+func verifyHTTPConfig(c *Config) error {
+	if c.HTTP.Timeout < 0 || c.HTTP.ConnectTimeout < 0 || c.HTTP.Retries < 0 || c.HTTP.Backoff < 0 ||
+		c.HTTP.MaxIdleConns < 0 || c.HTTP.MaxIdleConnsPerHost < 0 || c.HTTP.IdleConnTimeout < 0 || c.HTTP.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("The settings in the [http] section cannot be negative!")
+	}
+	if len(splitList(c.Chef.ErchefIP)) == 0 {
+		return fmt.Errorf("No erchef endpoints configured!")
+	}
+	if c.Chef.ErchefTimeout < 0 || c.Chef.ErchefFailures < 0 || c.Chef.ErchefCooldown < 0 {
+		return fmt.Errorf("The erchef timeout, failures and cooldown cannot be negative!")
+	}
+	return nil
+}
+
+func verifyLineEndingsConfig(c *Config) error {
+	modes := []string{c.Default.LineEndings}
+	for _, cust := range c.Customer {
+		if cust.LineEndings != nil {
+			modes = append(modes, *cust.LineEndings)
+		}
+	}
+	for _, mode := range modes {
+		switch mode {
+		case "", "keep", "normalize":
+		default:
+			return fmt.Errorf("Invalid line endings mode %q! Valid modes are 'keep' and 'normalize'.", mode)
+		}
+	}
+	return nil
+}
+
+func verifyReconcileConfig(c *Config) error {
+	switch c.Reconcile.Mode {
+	case "", "report", "commit":
+		return nil
+	default:
+		return fmt.Errorf("Invalid reconcile mode %q! Valid modes are 'report' and 'commit'.", c.Reconcile.Mode)
+	}
+}
+
+func verifyLockConfig(c *Config) error {
+	if c.Lock.Deadline < 0 {
+		return fmt.Errorf("The lock deadline cannot be negative!")
+	}
+	if c.Lock.Deadline == 0 {
+		c.Lock.Deadline = 600
+	}
+	if c.Lock.Redis == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Lock.Redis); err != nil {
+		return fmt.Errorf("Invalid Redis address %q! The address should be specified as host:port.", c.Lock.Redis)
+	}
+	if c.Lock.TTL < 0 || c.Lock.Timeout < 0 || c.Lock.Database < 0 {
+		return fmt.Errorf("The settings in the [lock] section cannot be negative!")
+	}
+	if c.Lock.Prefix == "" {
+		c.Lock.Prefix = "chef-guard:lock:"
+	}
+	if c.Lock.TTL == 0 {
+		c.Lock.TTL = 30
+	}
+	if c.Lock.Timeout == 0 {
+		c.Lock.Timeout = 60
+	}
+	return nil
+}
+
+func verifyBookshelfConfig(c *Config) error {
+	names := []string{c.Default.Bookshelf}
+	for _, cust := range c.Customer {
+		if cust.Bookshelf != nil {
+			names = append(names, *cust.Bookshelf)
+		}
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		b, ok := c.Bookshelf[name]
+		if !ok {
+			return fmt.Errorf("No bookshelf config specified for: %s!", name)
+		}
+		if b.Key == "" || b.Secret == "" {
+			return fmt.Errorf("Bookshelf config %s requires both a key and a secret!", name)
+		}
+	}
+	return nil
+}
+
+func verifyMetadataConfig(c *Config) error {
+	fields := []string{c.Default.RequiredMetadata}
+	for _, cust := range c.Customer {
+		if cust.RequiredMetadata != nil {
+			fields = append(fields, *cust.RequiredMetadata)
+		}
+	}
+	for _, f := range fields {
+		for _, field := range splitList(f) {
+			if !containsFold(metadataFields, field) {
+				return fmt.Errorf("Invalid required metadata field %q! Valid fields are: %s", field, strings.Join(metadataFields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func verifyQuotaConfig(c *Config) error {
+	quotas := []string{c.Default.CookbookQuota, c.Default.DailyVersionQuota, c.Default.EnvironmentQuota}
+	for _, cust := range c.Customer {
+		for _, q := range []*string{cust.CookbookQuota, cust.DailyVersionQuota, cust.EnvironmentQuota} {
+			if q != nil {
+				quotas = append(quotas, *q)
+			}
+		}
+	}
+	for _, q := range quotas {
+		if _, err := parseQuota(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyRouteConfig(c *Config) error {
+	for name, r := range c.Route {
+		if len(splitList(r.Recipients)) == 0 && r.URL == "" {
+			return fmt.Errorf("Route %s requires at least one recipient or an URL!", name)
+		}
+		for _, t := range splitList(r.Types) {
+			if !containsFold(routeTypes, t) {
+				return fmt.Errorf("Invalid type %q for route %s! Valid types are %s.", t, name, strings.Join(routeTypes, ", "))
+			}
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern %q for route %s: %s", r.Pattern, name, err)
+		}
+	}
+	return nil
+}
+
+func verifyDigestConfig(c *Config) error {
+	digests := []string{c.Default.Digest}
+	for _, cust := range c.Customer {
+		if cust.Digest != nil {
+			digests = append(digests, *cust.Digest)
+		}
+	}
+	for _, d := range digests {
+		if d != "" && d != "hourly" && d != "daily" {
+			return fmt.Errorf("Invalid digest %q! Valid options are 'hourly' and 'daily'.", d)
+		}
+	}
+	return nil
+}
+
+func verifyApprovalConfig(c *Config) error {
+	if c.Approval.Path == "" || c.Approval.Environments == "" {
+		return nil
+	}
+	if path.Clean(c.Approval.Path) == path.Clean(c.Queue.Path) {
+		return fmt.Errorf("The approval path should differ from the queue path!")
+	}
+	for _, pattern := range splitList(c.Approval.Environments) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid approval environment pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+func verifyFreezeConfig(c *Config) error {
+	for name, f := range c.Freeze {
+		w, err := parseFreezeWindow(name, c)
+		if err != nil {
+			return err
+		}
+		f.window = w
+	}
+	return nil
+}
+
+func verifyTypeModesConfig(c *Config) error {
+	typeModes := []string{c.Default.TypeModes}
+	for _, cust := range c.Customer {
+		if cust.TypeModes != nil {
+			typeModes = append(typeModes, *cust.TypeModes)
+		}
+	}
+	for _, tm := range typeModes {
+		for _, s := range splitList(tm) {
+			parts := strings.SplitN(s, ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid typemodes entry %q! Entries should be formatted as '<type>:<mode>'.", s)
+			}
+			t, m := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			switch t {
+			case "cookbooks":
+				if m != "silent" && m != "audit" && m != "permissive" && m != "enforced" {
+					return fmt.Errorf("Invalid mode %q for type %s! Valid modes are 'silent', 'audit', 'permissive' and 'enforced'.", m, t)
+				}
+			case "data", "clients", "environments", "nodes", "roles":
+				if m != "silent" && m != "audit" && m != "permissive" && m != "enforced" {
+					return fmt.Errorf("Invalid mode %q for type %s! Valid modes are 'silent', 'audit', 'permissive' and 'enforced'.", m, t)
+				}
+			default:
+				return fmt.Errorf("Invalid typemodes type %q! Valid types are cookbooks, data, clients, environments, nodes and roles.", t)
+			}
+		}
+	}
+	return nil
+}
+
+func verifySecretsConfig(c *Config) error {
+	modes := []string{c.Default.DetectSecrets}
+	allowlists := []string{c.Default.SecretAllowlist}
+	for _, cust := range c.Customer {
+		if cust.DetectSecrets != nil {
+			modes = append(modes, *cust.DetectSecrets)
+		}
+		if cust.SecretAllowlist != nil {
+			allowlists = append(allowlists, *cust.SecretAllowlist)
+		}
+	}
+	for _, m := range modes {
+		if m != "" && m != "permissive" && m != "enforced" {
+			return fmt.Errorf("Invalid detectsecrets mode %q! Valid modes are 'permissive' and 'enforced'.", m)
+		}
+	}
+	return verifyPatterns("secretallowlist", allowlists)
+}
+
+func verifyUnfrozenCookbooksConfig(c *Config) error {
+	lists := []string{c.Default.UnfrozenCookbooks}
+	for _, cust := range c.Customer {
+		if cust.UnfrozenCookbooks != nil {
+			lists = append(lists, *cust.UnfrozenCookbooks)
+		}
+	}
+	return verifyPatterns("unfrozencookbooks", lists)
+}
+
+func verifyAllowlistConfig(c *Config) error {
+	lists := []string{c.Default.Allowlist}
+	for _, cust := range c.Customer {
+		if cust.Allowlist != nil {
+			lists = append(lists, *cust.Allowlist)
+		}
+	}
+	return verifyPatterns("allowlist", lists)
+}
+
+func verifyRedactKeysConfig(c *Config) error {
+	lists := []string{c.Default.RedactKeys}
+	for _, cust := range c.Customer {
+		if cust.RedactKeys != nil {
+			lists = append(lists, *cust.RedactKeys)
+		}
+	}
+	return verifyPatterns("redactkeys", lists)
+}
+
+// verifyPatterns makes sure all regexes (divided by a ',') of the setting
+// can be compiled
+func verifyPatterns(setting string, lists []string) error {
+	for _, l := range lists {
+		for _, s := range splitList(l) {
+			if _, err := regexp.Compile(s); err != nil {
+				return fmt.Errorf("Invalid %s pattern %q: %s", setting, s, err)
+			}
+		}
+	}
+	return nil
+}
+
+func verifyTestsConfig(c *Config) error {
+	if c.Tests.Container != "" && c.Tests.Image == "" {
+		return fmt.Errorf("Running the checks in a container requires an image!")
+	}
+	return nil
+}
+
+func verifyRulesConfig(c *Config) error {
+	if c.Rules.Repo != "" && c.Rules.Path == "" {
+		return fmt.Errorf("A rules repo requires a rules path to write the rules to!")
+	}
+	return nil
+}
+
+func verifyReportConfig(c *Config) error {
+	if c.Report.Path == "" {
+		return nil
+	}
+	if c.Audit.Path == "" {
+		return fmt.Errorf("Compliance reports require an audit store! Please configure an audit path.")
+	}
+	if c.Report.Secret == "" {
+		return fmt.Errorf("Compliance reports require a secret to sign the reports with!")
+	}
+	return nil
+}
+
+func verifyTimeConfig(c *Config) error {
+	loc, err := time.LoadLocation(c.Default.TimeZone)
+	if err != nil {
+		return fmt.Errorf("Invalid time zone %q: %s", c.Default.TimeZone, err)
+	}
+	c.location = loc
+	return nil
+}
+
 func verifyChefConfig(c *Config) error {
 	switch c.Chef.Type {
 	case "enterprise", "opensource", "goiardi":
@@ -215,9 +945,27 @@ func verifyGitConfigs(c *Config) error {
 		if v.Type != "github" && v.Type != "gitlab" {
 			return fmt.Errorf("Invalid Git type %q! Valid types are 'github' and 'gitlab'.", v.Type)
 		}
-		if v.Token == "" {
+		if v.Type == "github" && strings.Contains(strings.Trim(v.Organization, "/"), "/") {
+			return fmt.Errorf("Invalid GitHub organization %q! Nested groups are only supported for 'gitlab'.", v.Organization)
+		}
+		if v.AppID != 0 {
+			if v.Type != "github" {
+				return fmt.Errorf("App authentication is not supported for %s organization %s! Only 'github' supports GitHub Apps.", v.Type, v.Organization)
+			}
+			if v.InstallationID == 0 || v.PrivateKey == "" {
+				return fmt.Errorf("GitHub App for organization %s needs both an installationid and a privatekey!", v.Organization)
+			}
+		} else if v.Token == "" {
 			return fmt.Errorf("No token found for %s organization %s! All configured organizations need to have a valid token.", v.Type, v.Organization)
 		}
+		if v.SigningKey != "" {
+			if v.Type != "github" {
+				return fmt.Errorf("Signing is not supported for %s organization %s! Only 'github' supports signed commits and tags.", v.Type, v.Organization)
+			}
+			if v.SigningFormat != "" && v.SigningFormat != "gpg" && v.SigningFormat != "ssh" {
+				return fmt.Errorf("Invalid signing format %q! Valid formats are 'gpg' and 'ssh'.", v.SigningFormat)
+			}
+		}
 	}
 	return nil
 }
@@ -246,18 +994,76 @@ func parsePaths(c *Config, ep string) error {
 	if !path.IsAbs(c.Default.Logfile) {
 		c.Default.Logfile = path.Join(ep, c.Default.Logfile)
 	}
+	if c.Default.CrashDir == "" {
+		c.Default.CrashDir = path.Join(c.Default.Tempdir, "crashes")
+	}
+	if !path.IsAbs(c.Default.CrashDir) {
+		c.Default.CrashDir = path.Join(ep, c.Default.CrashDir)
+	}
+	if c.Default.DigestFile == "" {
+		c.Default.DigestFile = path.Join(c.Default.Tempdir, "digests.json")
+	}
+	if !path.IsAbs(c.Default.DigestFile) {
+		c.Default.DigestFile = path.Join(ep, c.Default.DigestFile)
+	}
+	if c.Default.AccessLog != "" && c.Default.AccessLog != "stdout" && !path.IsAbs(c.Default.AccessLog) {
+		c.Default.AccessLog = path.Join(ep, c.Default.AccessLog)
+	}
+	for _, g := range c.Git {
+		if g.PrivateKey != "" && !path.IsAbs(g.PrivateKey) {
+			g.PrivateKey = path.Join(ep, g.PrivateKey)
+		}
+	}
+	if c.Queue.Path != "" && !path.IsAbs(c.Queue.Path) {
+		c.Queue.Path = path.Join(ep, c.Queue.Path)
+	}
+	if c.Queue.DeadLetter != "" && !path.IsAbs(c.Queue.DeadLetter) {
+		c.Queue.DeadLetter = path.Join(ep, c.Queue.DeadLetter)
+	}
+	if c.Rules.Path != "" && !path.IsAbs(c.Rules.Path) {
+		c.Rules.Path = path.Join(ep, c.Rules.Path)
+	}
+	if c.Audit.Path != "" && !path.IsAbs(c.Audit.Path) {
+		c.Audit.Path = path.Join(ep, c.Audit.Path)
+	}
+	if c.Report.Path != "" && !path.IsAbs(c.Report.Path) {
+		c.Report.Path = path.Join(ep, c.Report.Path)
+	}
+	if c.DataBags.SchemaPath != "" && !path.IsAbs(c.DataBags.SchemaPath) {
+		c.DataBags.SchemaPath = path.Join(ep, c.DataBags.SchemaPath)
+	}
+	if c.Capture.Path != "" && !path.IsAbs(c.Capture.Path) {
+		c.Capture.Path = path.Join(ep, c.Capture.Path)
+	}
 	if c.Tests.Foodcritic != "" && !path.IsAbs(c.Tests.Foodcritic) {
 		c.Tests.Foodcritic = path.Join(ep, c.Tests.Foodcritic)
 	}
+	if c.Tests.Cookstyle != "" && !path.IsAbs(c.Tests.Cookstyle) {
+		c.Tests.Cookstyle = path.Join(ep, c.Tests.Cookstyle)
+	}
 	if c.Tests.Rubocop != "" && !path.IsAbs(c.Tests.Rubocop) {
 		c.Tests.Rubocop = path.Join(ep, c.Tests.Rubocop)
 	}
+	if c.Tests.Hooks != "" {
+		hooks := []string{}
+		for _, hook := range strings.Split(c.Tests.Hooks, ",") {
+			if hook = strings.TrimSpace(hook); hook == "" {
+				continue
+			}
+			if !path.IsAbs(hook) {
+				hook = path.Join(ep, hook)
+			}
+			hooks = append(hooks, hook)
+		}
+		c.Tests.Hooks = strings.Join(hooks, ",")
+	}
 	return nil
 }
 
 func getEffectiveConfig(key, chefOrg string) interface{} {
-	if cfg.Chef.Type == "enterprise" {
-		if c, found := cfg.Customer[chefOrg]; found {
+	config := getConfig()
+	if config.Chef.Type == "enterprise" {
+		if c, found := config.Customer[chefOrg]; found {
 			conf := reflect.ValueOf(c).Elem()
 			v := conf.FieldByName(key)
 			if !v.IsNil() {
@@ -265,6 +1071,48 @@ func getEffectiveConfig(key, chefOrg string) interface{} {
 			}
 		}
 	}
-	c := reflect.ValueOf(cfg.Default)
+	c := reflect.ValueOf(config.Default)
 	return c.FieldByName(key).Interface()
 }
+
+// getEffectiveMode returns the effective Mode or ValidateChanges setting for
+// an endpoint type. A type override of the customer takes precedence over the
+// mode of the customer, which in turn takes precedence over the defaults.
+func getEffectiveMode(key, chefOrg, endpointType string) string {
+	config := getConfig()
+	if config.Chef.Type == "enterprise" {
+		if c, found := config.Customer[chefOrg]; found {
+			if c.TypeModes != nil {
+				if m, ok := typeMode(*c.TypeModes, endpointType); ok {
+					return m
+				}
+			}
+			v := reflect.ValueOf(c).Elem().FieldByName(key)
+			if !v.IsNil() {
+				return v.Elem().String()
+			}
+		}
+	}
+	if m, ok := typeMode(config.Default.TypeModes, endpointType); ok {
+		return m
+	}
+	return reflect.ValueOf(config.Default).FieldByName(key).String()
+}
+
+// exemptUser returns true if the user (matched against X-Ops-Userid) is
+// listed in the given exemption list of the organization
+func exemptUser(key, chefOrg, user string) bool {
+	return contains(splitList(getEffectiveConfig(key, chefOrg).(string)), user)
+}
+
+// typeMode returns the mode configured for an endpoint type in a list of
+// '<type>:<mode>' entries
+func typeMode(typeModes, endpointType string) (string, bool) {
+	for _, s := range splitList(typeModes) {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == endpointType {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,217 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/gcfg.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// configExtensions are the supported config file extensions in order of
+// preference. YAML and TOML files use the same structure as the INI format.
+var configExtensions = []string{".conf", ".yaml", ".yml", ".toml"}
+
+// configSection holds a single (sub)section of a config file
+type configSection struct {
+	name string
+	sub  *string
+	vars [][2]string
+}
+
+// configFile returns the config file to use, which is the first existing
+// file named base with one of the supported extensions
+func configFile(base string) string {
+	for _, ext := range configExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return base + ".conf"
+}
+
+// readConfigFile reads the config file into c. YAML and TOML files are first
+// converted to the INI format, so all values are parsed the same way.
+func readConfigFile(c *Config, file string) error {
+	var parse func([]byte) ([]*configSection, error)
+	switch path.Ext(file) {
+	case ".yaml", ".yml":
+		parse = parseYAMLConfig
+	case ".toml":
+		parse = parseTOMLConfig
+	default:
+		return gcfg.ReadFileInto(c, file)
+	}
+
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sections, err := parse(src)
+	if err != nil {
+		return err
+	}
+	return gcfg.ReadStringInto(c, formatGcfg(sections))
+}
+
+// formatGcfg returns the sections in the INI format read by gcfg
+func formatGcfg(sections []*configSection) string {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", "")
+
+	var buf bytes.Buffer
+	for _, s := range sections {
+		if s.sub != nil {
+			fmt.Fprintf(&buf, "[%s \"%s\"]\n", s.name, quote.Replace(*s.sub))
+		} else {
+			fmt.Fprintf(&buf, "[%s]\n", s.name)
+		}
+		for _, v := range s.vars {
+			fmt.Fprintf(&buf, "%s = \"%s\"\n", v[0], quote.Replace(v[1]))
+		}
+	}
+	return buf.String()
+}
+
+// parseTOMLConfig parses a TOML config, in which subsections are dotted
+// tables (e.g. [git.github])
+func parseTOMLConfig(src []byte) ([]*configSection, error) {
+	var doc map[string]interface{}
+	if err := toml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	return configSections(doc)
+}
+
+// parseYAMLConfig parses a YAML config, in which subsections are nested
+// mappings (e.g. git: github: ...)
+func parseYAMLConfig(src []byte) ([]*configSection, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	return configSections(doc)
+}
+
+// configSections converts a parsed YAML or TOML document into the sections
+// of the config. Every top level key needs to be a section, containing
+// values and optionally subsections which only contain values.
+func configSections(doc map[string]interface{}) ([]*configSection, error) {
+	var sections []*configSection
+	for _, name := range sortedKeys(doc) {
+		s, ok := configMap(doc[name])
+		if !ok {
+			return nil, fmt.Errorf("%s needs to be a section", name)
+		}
+
+		section := &configSection{name: name}
+		var subs []*configSection
+		for _, key := range sortedKeys(s) {
+			vars, ok := configMap(s[key])
+			if !ok {
+				value, err := configValue(s[key])
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value of %s.%s: %s", name, key, err)
+				}
+				section.vars = append(section.vars, [2]string{key, value})
+				continue
+			}
+
+			key := key
+			sub := &configSection{name: name, sub: &key}
+			for _, v := range sortedKeys(vars) {
+				if _, ok := configMap(vars[v]); ok {
+					return nil, fmt.Errorf("%s.%s.%s is nested too deep", name, key, v)
+				}
+				value, err := configValue(vars[v])
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value of %s.%s.%s: %s", name, key, v, err)
+				}
+				sub.vars = append(sub.vars, [2]string{v, value})
+			}
+			subs = append(subs, sub)
+		}
+		// A section only containing subsections (e.g. git) has no section of its own
+		if len(section.vars) > 0 || len(subs) == 0 {
+			sections = append(sections, section)
+		}
+		sections = append(sections, subs...)
+	}
+
+	return sections, nil
+}
+
+// configMap returns v as a map with string keys if it is a YAML mapping or
+// a TOML table
+func configMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			sm[fmt.Sprint(k)] = v
+		}
+		return sm, true
+	default:
+		return nil, false
+	}
+}
+
+// configValue returns the INI value of a scalar, or of a list of scalars
+// which are joined by a ','
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			value, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
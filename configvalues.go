@@ -0,0 +1,141 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// envReference matches a ${NAME} reference to an environment variable
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// valueResolver resolves the references in config values
+type valueResolver struct {
+	dir   string
+	vault *vaultClient
+}
+
+// resolveConfigValues resolves all ${NAME}, file:// and vault:// references
+// in the string values of the config, so secrets don't need to be stored in
+// the config file itself. Relative file paths are relative to dir. It
+// returns the shortest lease of the secrets read from Vault.
+func resolveConfigValues(c *Config, dir string) (time.Duration, error) {
+	r := &valueResolver{dir: dir}
+
+	// The Vault section itself can only reference files and environment variables
+	if err := r.resolveValues(reflect.ValueOf(&c.Vault).Elem(), "Vault"); err != nil {
+		return 0, err
+	}
+	if c.Vault.Address != "" {
+		r.vault = newVaultClient(c)
+	}
+
+	if err := r.resolveValues(reflect.ValueOf(c).Elem(), ""); err != nil {
+		return 0, err
+	}
+	if r.vault != nil {
+		return r.vault.lease, nil
+	}
+	return 0, nil
+}
+
+func (r *valueResolver) resolveValues(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return r.resolveValues(v.Elem(), name)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			field := f.Name
+			if name != "" {
+				field = name + "->" + f.Name
+			}
+			if err := r.resolveValues(v.Field(i), field); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if err := r.resolveValues(v.MapIndex(k), fmt.Sprintf("%s[%v]", name, k)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		s, err := r.resolveValue(v.String())
+		if err != nil {
+			return fmt.Errorf("Failed to resolve the value of %s: %s", name, err)
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+// resolveValue returns the contents of the file or the Vault secret when
+// the value is a file:// or vault:// reference, or else the value with all
+// environment variables expanded
+func (r *valueResolver) resolveValue(s string) (string, error) {
+	if strings.HasPrefix(s, "file://") {
+		p := strings.TrimPrefix(s, "file://")
+		if !path.IsAbs(p) {
+			p = path.Join(r.dir, p)
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if strings.HasPrefix(s, "vault://") {
+		if r.vault == nil {
+			return "", fmt.Errorf("Vault reference %q used without a Vault address", s)
+		}
+		return r.vault.resolve(s)
+	}
+
+	var err error
+	s = envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		env := envReference.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(env)
+		if !ok && err == nil {
+			err = fmt.Errorf("Environment variable %s is not set", env)
+		}
+		return value
+	})
+	return s, err
+}
+
+// readKey returns the key itself if it is a PEM encoded key (e.g. read from
+// Vault), or else the contents of the key file
+func readKey(key string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		return []byte(key), nil
+	}
+	return ioutil.ReadFile(key)
+}
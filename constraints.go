@@ -0,0 +1,140 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// constraintRe matches a single version constraint like '~> 1.2' or '>= 1.0.0'
+var constraintRe = regexp.MustCompile(`^(=|>=|>|<=|<|~>)?\s*(\d+(?:\.\d+){0,2})$`)
+
+// matchesConstraint returns true if the version satisfies all (comma
+// separated) constraints
+func matchesConstraint(version, constraint string) (bool, error) {
+	for _, c := range strings.Split(constraint, ",") {
+		m := constraintRe.FindStringSubmatch(strings.TrimSpace(c))
+		if m == nil {
+			return false, fmt.Errorf("invalid constraint '%s'", constraint)
+		}
+
+		op, v := m[1], m[2]
+		cmp := compareVersions(version, v)
+
+		var ok bool
+		switch op {
+		case "", "=":
+			ok = cmp == 0
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "~>":
+			ok = cmp >= 0 && compareVersions(version, pessimisticLimit(v)) < 0
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pessimisticLimit returns the (exclusive) upper limit of a ~> constraint,
+// so '~> 1.2' returns '2.0' and '~> 1.2.3' returns '1.3.0'
+func pessimisticLimit(v string) string {
+	parts := strings.Split(v, ".")
+	if len(parts) == 1 {
+		return strconv.Itoa(int(^uint(0)>>1)) + ".0"
+	}
+	parts = parts[:len(parts)-1]
+	last, _ := strconv.Atoi(parts[len(parts)-1])
+	parts[len(parts)-1] = strconv.Itoa(last + 1)
+	return strings.Join(parts, ".") + ".0"
+}
+
+// resolveConstraints resolves the constraints against the versions that are
+// actually on the Chef server. It returns all matching versions per cookbook
+// and a description of the constraints that could not be resolved.
+func (cg *ChefGuard) resolveConstraints(constraints map[string]string) (map[string][]string, []string, error) {
+	cbs := parseCookbookVersions(constraints)
+	errors := []string{}
+
+	for name, versions := range cbs {
+		if !strings.HasPrefix(versions[0], "BAD") || versions[0] == "BAD>= 0.0.0" {
+			continue
+		}
+		constraint := strings.TrimPrefix(versions[0], "BAD")
+
+		cb, found, err := cg.chefClient.GetCookbook(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get info for cookbook %s: %s", name, err)
+		}
+
+		matching := []string{}
+		if found {
+			for _, v := range cb.Versions {
+				ok, err := matchesConstraint(v.Version, constraint)
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("%s has an %s", name, err))
+					break
+				}
+				if ok {
+					matching = append(matching, v.Version)
+				}
+			}
+		}
+
+		delete(cbs, name)
+		if len(matching) == 0 {
+			errors = append(errors, fmt.Sprintf("no version of %s matches constraint '%s'", name, constraint))
+			continue
+		}
+		cbs[name] = matching
+	}
+
+	return cbs, errors, nil
+}
+
+// checkResolvedConstraints checks that every version matching the
+// constraints is frozen
+func (cg *ChefGuard) checkResolvedConstraints(constraints map[string]string) (int, error) {
+	cbs, errors, err := cg.resolveConstraints(constraints)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	errCode, err := cg.checkDependencies(cbs, true)
+	if err != nil {
+		if errCode != http.StatusPreconditionFailed {
+			return errCode, err
+		}
+		errors = append(errors, strings.Split(strings.TrimPrefix(err.Error(), " - "), "\n - ")...)
+	}
+
+	if len(errors) > 0 {
+		return http.StatusPreconditionFailed, fmt.Errorf(" - %s", strings.Join(errors, "\n - "))
+	}
+	return 0, nil
+}
@@ -20,8 +20,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/hmac"
-	"crypto/md5"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
@@ -36,6 +36,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -44,15 +45,31 @@ import (
 
 func processCookbook(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if getEffectiveConfig("Mode", getChefOrgFromRequest(r)).(string) == "silent" && getEffectiveConfig("CommitChanges", getChefOrgFromRequest(r)).(bool) == false {
+		org := getChefOrgFromRequest(r)
+		if getEffectiveMode("Mode", org, "cookbooks") == "silent" && getEffectiveConfig("CommitChanges", org).(bool) == false &&
+			getEffectiveConfig("CookbookQuota", org).(string) == "" && getEffectiveConfig("DailyVersionQuota", org).(string) == "" {
 			p.ServeHTTP(w, r)
 			return
 		}
 		cg, err := newChefGuard(r)
 		if err != nil {
-			errorHandler(w, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err), http.StatusInternalServerError)
+			internalError(w, r, p, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err))
 			return
 		}
+		if v := r.Header.Get(overrideHeader); v != "" {
+			r.Header.Del(overrideHeader)
+			if cg.Override = cg.parseOverride(v); cg.Override == "" {
+				w.Header().Add("X-Chef-Guard-Warning", "Ignoring invalid override")
+			}
+		}
+		if v := r.Header.Get(sourceRefHeader); v != "" {
+			r.Header.Del(sourceRefHeader)
+			if !commitSHA.MatchString(v) {
+				errorHandler(w, fmt.Sprintf("Invalid commit SHA in %s header: %s", sourceRefHeader, v), http.StatusBadRequest)
+				return
+			}
+			cg.SourceRef = v
+		}
 		if r.Method != "DELETE" {
 			body, err := dumpBody(r)
 			if err != nil {
@@ -63,42 +80,187 @@ func processCookbook(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.R
 				errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(body), err), http.StatusBadRequest)
 				return
 			}
-			if getEffectiveConfig("Mode", cg.ChefOrg).(string) != "silent" {
-				if errCode, err := cg.checkCookbookFrozen(); err != nil {
-					if strings.Contains(r.Header.Get("User-Agent"), "Ridley") {
-						errCode = http.StatusConflict
-					}
-					errorHandler(w, err.Error(), errCode)
-					return
-				}
-				if cg.Cookbook.Frozen {
-					cg.CookbookPath = path.Join(cfg.Default.Tempdir, fmt.Sprintf("%s-%s", r.Header.Get("X-Ops-Userid"), cg.Cookbook.Name))
-					if err := cg.processCookbookFiles(); err != nil {
-						errorHandler(w, err.Error(), http.StatusBadRequest)
-						return
-					}
-					defer func() {
-						if err := os.RemoveAll(cg.CookbookPath); err != nil {
-							WARNING.Printf("Failed to cleanup temp cookbook folder %s: %s", cg.CookbookPath, err)
-						}
-					}()
-					if errCode, err := cg.validateCookbookStatus(); err != nil {
-						errorHandler(w, err.Error(), errCode)
-						return
-					}
-					if errCode, err := cg.tagAndPublishCookbook(); err != nil {
-						errorHandler(w, err.Error(), errCode)
-						return
-					}
-				}
+			var cb struct {
+				Metadata *cookbookMetadata `json:"metadata"`
+			}
+			if err := json.Unmarshal(body, &cb); err != nil {
+				errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(body), err), http.StatusBadRequest)
+				return
+			}
+			cg.Metadata = cb.Metadata
+			if cg.auditMode() {
+				cg.auditUpload(w, r, body)
+			} else if cg.validateUpload(w, r, p, body) {
+				return
 			}
 		}
-		if getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) {
+		commit := getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) && !exemptUser("ExemptCommits", cg.ChefOrg, cg.User)
+		if commit && r.Method != "DELETE" {
 			details := cg.getCookbookChangeDetails(r)
-			go cg.syncedGitUpdate(r.Method, details)
+			goSafe(r, func() { cg.syncedGitUpdate(r.Method, details) })
+		}
+		cg.setStage("proxy")
+		aw := &accessLogWriter{ResponseWriter: w}
+		p.ServeHTTP(aw, r)
+
+		if cg.newVersion && aw.status >= 200 && aw.status < 300 {
+			cg.countDailyVersion()
+		}
+
+		// Only remove, untag and unshare a deleted version once Chef accepted
+		// the delete, as removing it from Git and the Supermarket cannot be
+		// undone
+		if r.Method == "DELETE" && aw.status >= 200 && aw.status < 300 {
+			name, version := mux.Vars(r)["name"], mux.Vars(r)["version"]
+			if commit {
+				details := cg.getCookbookChangeDetails(r)
+				goSafe(r, func() { cg.syncedGitUpdate(r.Method, details) })
+			}
+			unshare := getEffectiveConfig("UnshareCookbooks", cg.ChefOrg).(bool)
+			if unshare || getEffectiveConfig("UntagCookbooks", cg.ChefOrg).(bool) {
+				goSafe(r, func() { cg.untagDeletedCookbook(name, version) })
+			}
+			if unshare && getConfig().Supermarket.Server != "" {
+				goSafe(r, func() { unshareDeletedCookbook(cg.RequestID, name, version) })
+			}
+		}
+
+		// The frozen state of this version might have changed
+		cg.forgetFrozenState(mux.Vars(r)["name"], mux.Vars(r)["version"])
+	}
+}
+
+// validateUpload runs all validations of a cookbook upload. It returns true
+// if the request was already answered.
+func (cg *ChefGuard) validateUpload(w http.ResponseWriter, r *http.Request, p http.Handler, body []byte) bool {
+	cg.setStage("quota-check")
+	if errCode, err := cg.checkCookbookQuotas(w); err != nil && !cg.overrideBlock(w, errCode, err) {
+		errorHandler(w, err.Error(), errCode)
+		return true
+	}
+	if getEffectiveMode("Mode", cg.ChefOrg, "cookbooks") == "silent" {
+		return false
+	}
+	cg.setStage("reservation-check")
+	if errCode, err := cg.checkReservedName(); err != nil && !cg.overrideBlock(w, errCode, err) {
+		errorHandler(w, err.Error(), errCode)
+		return true
+	}
+	cg.setStage("frozen-check")
+	if errCode, err := cg.checkCookbookFrozen(); err != nil {
+		if strings.Contains(r.Header.Get("User-Agent"), "Ridley") {
+			errCode = http.StatusConflict
+		}
+		errorHandler(w, err.Error(), errCode)
+		return true
+	}
+	if !cg.Cookbook.Frozen && getEffectiveConfig("EnforceFrozen", cg.ChefOrg).(bool) {
+		cg.setStage("frozen-required")
+		if errCode, err := cg.checkUnfrozenAllowed(); err != nil && !cg.overrideBlock(w, errCode, err) {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+	if cg.Cookbook.Frozen {
+		validate := func(w http.ResponseWriter) bool { return cg.validateFrozenCookbook(w, r, p) }
+		if cg.dedupUpload(w, cg.uploadKey(body), validate) {
+			return true
+		}
+	} else if getConfig().Scan.Clamd != "" || getEffectiveConfig("DetectSecrets", cg.ChefOrg).(string) != "" {
+		// Unfrozen uploads are not compared with their source, but they are
+		// still scanned for malware and secrets
+		defer cg.cleanupCookbookFiles()
+		if cg.scanCookbook(w, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFrozenCookbook downloads, validates, tags and publishes a frozen
+// cookbook. It returns true if the request was already answered.
+func (cg *ChefGuard) validateFrozenCookbook(w http.ResponseWriter, r *http.Request, p http.Handler) bool {
+	defer cg.cleanupCookbookFiles()
+	if cg.scanCookbook(w, r) {
+		return true
+	}
+	// Exempted users skip the validation stages, but their uploads are still
+	// checked for quotas, reserved names, malware and secrets
+	if exemptUser("ExemptValidation", cg.ChefOrg, cg.User) {
+		logf(INFO, cg.RequestID, "Skipping validation of cookbook %s version %s uploaded by exempted user %s",
+			cg.Cookbook.Name, cg.Cookbook.Version, cg.User)
+		return false
+	}
+	cg.setStage("checksum-check")
+	if errCode, err := cg.checkBinaryChecksums(); err != nil && !cg.overrideBlock(w, errCode, err) {
+		errorHandler(w, err.Error(), errCode)
+		return true
+	}
+	errCode, err := cg.validateCookbookStatus()
+	if cg.clientGone() {
+		return true
+	}
+	if err != nil {
+		if errCode == http.StatusInternalServerError {
+			internalError(w, r, p, err.Error())
+			return true
+		}
+		if !cg.overrideBlock(w, errCode, err) {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+	}
+	// An overridden cookbook, or one uploaded in audit mode, is not tagged
+	// or published
+	if err == nil && !cg.auditMode() {
+		cg.setStage("tag-and-publish")
+		if errCode, err := cg.tagAndPublishCookbook(); err != nil {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+		if repo := getEffectiveConfig("VendorRepo", cg.ChefOrg).(string); repo != "" && cg.SourceCookbook.artifact {
+			// Open the archive now, as it is removed when the validation is done
+			archive, err := os.Open(cg.TarPath)
+			if err != nil {
+				logf(ERROR, cg.RequestID, "Failed to open the archive of cookbook %s: %s", cg.Cookbook.Name, err)
+			} else {
+				goSafe(r, func() { cg.vendorCookbook(repo, archive) })
+			}
+		}
+	}
+	return false
+}
+
+// scanCookbook downloads the files of a cookbook and scans them for malware
+// and secrets. It returns true if the request was already answered.
+func (cg *ChefGuard) scanCookbook(w http.ResponseWriter, r *http.Request) bool {
+	cg.CookbookPath = path.Join(getConfig().Default.Tempdir, fmt.Sprintf("%s-%s", r.Header.Get("X-Ops-Userid"), cg.Cookbook.Name))
+	cg.setStage("download")
+	if err := cg.processCookbookFiles(); err != nil {
+		if !cg.clientGone() {
+			errorHandler(w, err.Error(), http.StatusBadRequest)
+		}
+		return true
+	}
+	if getConfig().Scan.Clamd != "" {
+		cg.setStage("malware-scan")
+		if errCode, err := cg.checkMalware(); err != nil && !cg.overrideBlock(w, errCode, err) {
+			errorHandler(w, err.Error(), errCode)
+			return true
+		}
+		if len(cg.UnscannedFiles) > 0 {
+			w.Header().Add("X-Chef-Guard-Warning", fmt.Sprintf(
+				"Files too large to be scanned for malware: %s", strings.Join(cg.UnscannedFiles, ", ")))
+		}
+	}
+	if getEffectiveConfig("DetectSecrets", cg.ChefOrg).(string) != "" {
+		cg.setStage("secret-scan")
+		if errCode, err := cg.checkSecrets(w, cg.SecretFindings); err != nil && !cg.overrideBlock(w, errCode, err) {
+			errorHandler(w, err.Error(), errCode)
+			return true
 		}
-		p.ServeHTTP(w, r)
 	}
+	return false
 }
 
 func (cg *ChefGuard) processCookbookFiles() error {
@@ -107,21 +269,27 @@ func (cg *ChefGuard) processCookbookFiles() error {
 			return fmt.Errorf("Failed to get organization ID for %s: %s", cg.ChefOrg, err)
 		}
 	}
-	buf := new(bytes.Buffer)
-	gw := gzip.NewWriter(buf)
-	tw := tar.NewWriter(gw)
+	// The archive is written to disk, so large cookbooks are never kept in memory
+	cg.TarPath = cg.CookbookPath + ".tgz"
+	tf, err := os.Create(cg.TarPath)
+	if err != nil {
+		return fmt.Errorf("Failed to create the tar archive: %s", err)
+	}
+	defer tf.Close()
 
-	client := http.DefaultClient
+	gw := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gw)
 
-	if cfg.Chef.SSLNoVerify {
-		client = &http.Client{Transport: insecureTransport}
-	}
+	// Failed downloads are retried with a freshly signed URL, so the client
+	// itself only applies the configured timeouts
+	client := &http.Client{Transport: &requestIDTransport{base: outboundTransport(getConfig().Chef.SSLNoVerify)}}
 
 	// Let's first find and save the .gitignore and chefignore files
 	for _, f := range cg.Cookbook.RootFiles {
 		if f.Name == ".gitignore" || f.Name == "chefignore" {
-			content, err := downloadCookbookFile(client, *cg.ChefOrgID, f.Checksum)
+			content, err := downloadCookbookFileWithRetries(cg.ctx, client, cg.ChefOrg, *cg.ChefOrgID, f.Checksum)
 			if err != nil {
+				forgetOrganizationID(cg.ChefOrg)
 				return fmt.Errorf("Failed to dowload %s from the %s cookbook: %s", f.Path, cg.Cookbook.Name, err)
 			}
 			// Save .gitignore file for later use
@@ -135,26 +303,43 @@ func (cg *ChefGuard) processCookbookFiles() error {
 		}
 	}
 
+	var files []struct{ chef.CookbookItem }
+	var ignored []bool
 	for _, f := range cg.getAllCookbookFiles() {
 		ignore, err := cg.ignoreThisFile(f.Name, false)
 		if err != nil {
 			return fmt.Errorf("Ignore check failed for file %s: %s", f.Name, err)
 		}
-		if ignore {
-			continue
-		}
+		files = append(files, f)
+		ignored = append(ignored, ignore)
+	}
 
-		content, err := downloadCookbookFile(client, *cg.ChefOrgID, f.Checksum)
-		if err != nil {
-			return fmt.Errorf("Failed to dowload %s from the %s cookbook: %s", f.Path, cg.Cookbook.Name, err)
+	// Each file is processed and written to the archive as soon as it is
+	// downloaded, after which its content is no longer kept in memory
+	err = cg.downloadCookbookFiles(client, files, func(i int, content []byte) error {
+		f := files[i]
+
+		// Ignored files are still uploaded to Chef, so they are scanned and
+		// their checksums and secrets are checked as well
+		if getConfig().Scan.Clamd != "" {
+			if err := cg.scanCookbookFile(f.Path, content); err != nil {
+				return fmt.Errorf("Failed to scan %s from the %s cookbook: %s", f.Path, cg.Cookbook.Name, err)
+			}
+		}
+		cg.registerBinaryFile(f.Path, content)
+		if getEffectiveConfig("DetectSecrets", cg.ChefOrg).(string) != "" && !isBinary(content) {
+			cg.SecretFindings = append(cg.SecretFindings, findSecrets(f.Path, content)...)
+		}
+		if ignored[i] {
+			return nil
 		}
 
-		if err := writeFileToDisk(path.Join(cg.CookbookPath, f.Path), strings.NewReader(string(content))); err != nil {
+		if err := writeFileToDisk(path.Join(cg.CookbookPath, f.Path), bytes.NewReader(content)); err != nil {
 			return fmt.Errorf("Failed to write file %s to disk: %s", path.Join(cg.CookbookPath, f.Path), err)
 		}
 
 		// Save the md5 hash to the ChefGuard struct
-		cg.FileHashes[f.Path] = md5.Sum(content)
+		cg.FileHashes[f.Path] = cg.contentHash(content)
 
 		// Add the file to the tar archive
 		header := &tar.Header{
@@ -171,6 +356,10 @@ func (cg *ChefGuard) processCookbookFiles() error {
 		if _, err := tw.Write(content); err != nil {
 			return fmt.Errorf("Failed to write file %s to archive: %s", f.Name, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	if err := addMetadataJSON(tw, cg.Cookbook); err != nil {
@@ -185,8 +374,7 @@ func (cg *ChefGuard) processCookbookFiles() error {
 		return fmt.Errorf("Failed to close the gzip archive: %s", err)
 	}
 
-	cg.TarFile = buf.Bytes()
-	return nil
+	return tf.Close()
 }
 
 // Sandbox represents a Chef sandbox used for uploading cookbook files
@@ -202,7 +390,24 @@ type SandboxItem struct {
 	NeedsUpload bool   `json:"needs_upload"`
 }
 
+// orgIDs caches the resolved ID per organization, so no sandbox needs to be
+// created for every upload
+var orgIDs = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// getOrganizationID gets the ID of the organization from the bookshelf URL
+// in the reply of a (throwaway) sandbox, unless the ID is already cached
 func (cg *ChefGuard) getOrganizationID() error {
+	orgIDs.Lock()
+	id, ok := orgIDs.m[cg.ChefOrg]
+	orgIDs.Unlock()
+	if ok {
+		cg.ChefOrgID = &id
+		return nil
+	}
+
 	resp, err := cg.chefClient.Post(
 		"sandboxes",
 		"application/json",
@@ -228,11 +433,22 @@ func (cg *ChefGuard) getOrganizationID() error {
 	u := sb.Checksums["00000000000000000000000000000000"].URL
 	if res := re.FindStringSubmatch(u); res != nil {
 		cg.ChefOrgID = &res[1]
+		orgIDs.Lock()
+		orgIDs.m[cg.ChefOrg] = res[1]
+		orgIDs.Unlock()
 		return nil
 	}
 	return fmt.Errorf("Could not find an organization ID in reply: %s", string(body))
 }
 
+// forgetOrganizationID removes the cached ID of an organization, so it is
+// resolved again (e.g. after a failed download or a recreated organization)
+func forgetOrganizationID(org string) {
+	orgIDs.Lock()
+	delete(orgIDs.m, org)
+	orgIDs.Unlock()
+}
+
 func (cg *ChefGuard) getAllCookbookFiles() []struct{ chef.CookbookItem } {
 	allFiles := []struct{ chef.CookbookItem }{}
 	allFiles = append(allFiles, cg.Cookbook.Files...)
@@ -249,11 +465,12 @@ func (cg *ChefGuard) getAllCookbookFiles() []struct{ chef.CookbookItem } {
 
 func (cg *ChefGuard) tagAndPublishCookbook() (int, error) {
 	if !cg.SourceCookbook.artifact {
-		tag := fmt.Sprintf("v%s", cg.Cookbook.Version)
+		tag := cg.SourceCookbook.tag
+		tagged := cg.SourceCookbook.tagged || skipStep(cg.ChefOrg, cg.Cookbook.Name, "tag")
 
-		if !cg.SourceCookbook.tagged {
+		if !tagged {
 			mail := fmt.Sprintf("%s@%s", cg.User, getEffectiveConfig("MailDomain", cg.ChefOrg).(string))
-			err := tagCookbook(cg.SourceCookbook.gitConfig, cg.Cookbook.Name, tag, cg.User, mail)
+			err := tagCookbook(cg.SourceCookbook.gitConfig, cg.SourceCookbook.repo, tag, cg.User, mail)
 			if err != nil {
 				return http.StatusBadRequest, err
 			}
@@ -261,8 +478,8 @@ func (cg *ChefGuard) tagAndPublishCookbook() (int, error) {
 		if getEffectiveConfig("PublishCookbook", cg.ChefOrg).(bool) && cg.SourceCookbook.private {
 			if err := cg.publishCookbook(); err != nil {
 				errText := err.Error()
-				if !cg.SourceCookbook.tagged {
-					err := untagCookbook(cg.SourceCookbook.gitConfig, cg.Cookbook.Name, tag)
+				if !tagged {
+					err := untagCookbook(cg.SourceCookbook.gitConfig, cg.SourceCookbook.repo, tag)
 					if err != nil {
 						errText = fmt.Sprintf("%s - NOTE: Failed to untag the repo during cleanup!", errText)
 					}
@@ -274,6 +491,18 @@ func (cg *ChefGuard) tagAndPublishCookbook() (int, error) {
 	return 0, nil
 }
 
+// CookbookChange is the description of an uploaded cookbook version that is
+// committed to Git
+type CookbookChange struct {
+	Schema       string `json:"schema" desc:"Schema ID of the event (cookbook/v1)"`
+	Name         string `json:"name" desc:"Name of the cookbook"`
+	Version      string `json:"version" desc:"Version of the cookbook"`
+	Frozen       bool   `json:"frozen" desc:"Whether the version is frozen"`
+	ForcedUpload bool   `json:"forcedupload" desc:"Whether the upload was forced after failing checks"`
+	Source       string `json:"source" desc:"URL of the source the cookbook was verified against, N/A if none"`
+	Uploaded     string `json:"uploaded" desc:"Time of the upload, formatted with the configured time format"`
+}
+
 func (cg *ChefGuard) getCookbookChangeDetails(r *http.Request) []byte {
 	v := mux.Vars(r)
 
@@ -292,59 +521,180 @@ func (cg *ChefGuard) getCookbookChangeDetails(r *http.Request) []byte {
 		source = cg.SourceCookbook.sourceURL
 	}
 
-	details := fmt.Sprintf(
-		"{\"name\":\"%s\",\"version\":\"%s\",\"frozen\":%t,\"forcedupload\":%t,\"source\":\"%s\", \"uploaded\": \"%s\"}",
-		v["name"],
-		v["version"],
-		frozen,
-		cg.ForcedUpload,
-		source,
-		time.Now().Format("2006-01-02 15:04:05"),
-	)
+	details, _ := json.Marshal(&CookbookChange{
+		Schema:       cookbookSchema,
+		Name:         v["name"],
+		Version:      v["version"],
+		Frozen:       frozen,
+		ForcedUpload: cg.ForcedUpload,
+		Source:       source,
+		Uploaded:     formatTime(time.Now()),
+	})
+
+	return details
+}
+
+// cleanupCookbookFiles removes the downloaded cookbook files and archive
+func (cg *ChefGuard) cleanupCookbookFiles() {
+	if err := os.RemoveAll(cg.CookbookPath); err != nil {
+		logf(WARNING, cg.RequestID, "Failed to cleanup temp cookbook folder %s: %s", cg.CookbookPath, err)
+	}
+	if err := os.Remove(cg.TarPath); err != nil && !os.IsNotExist(err) {
+		logf(WARNING, cg.RequestID, "Failed to cleanup temp cookbook archive %s: %s", cg.TarPath, err)
+	}
+}
+
+// downloadCookbookFiles downloads the files from bookshelf using a pool of
+// workers, and passes their content to handle in the same order as the files.
+// Downloads never run more than a small window ahead of the file being
+// handled, so only the files within that window are kept in memory.
+func (cg *ChefGuard) downloadCookbookFiles(c *http.Client, files []struct{ chef.CookbookItem }, handle func(i int, content []byte) error) error {
+	workers := getConfig().Chef.DownloadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	type download struct {
+		content []byte
+		err     error
+	}
+	results := make([]chan download, len(files))
+	for i := range results {
+		results[i] = make(chan download, 1)
+	}
+
+	ctx, cancel := context.WithCancel(cg.ctx)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// Skip the remaining files once the request is canceled
+				if err := ctx.Err(); err != nil {
+					results[i] <- download{err: err}
+					continue
+				}
+				content, err := downloadCookbookFileWithRetries(ctx, c, cg.ChefOrg, *cg.ChefOrgID, files[i].Checksum)
+				results[i] <- download{content: content, err: err}
+			}
+		}()
+	}
+
+	// A file is only queued once there is room in the window
+	window := make(chan struct{}, 2*workers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range files {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			jobs <- i
+		}
+	}()
+
+	for i := range files {
+		d := <-results[i]
+		<-window
+		if d.err != nil {
+			// The cached organization ID might be stale, so resolve it again next time
+			forgetOrganizationID(cg.ChefOrg)
+			return fmt.Errorf("Failed to dowload %s from the %s cookbook: %s", files[i].Path, cg.Cookbook.Name, d.err)
+		}
+		if err := handle(i, d.content); err != nil {
+			return err
+		}
+	}
 
-	return []byte(details)
+	return nil
+}
+
+// downloadCookbookFileWithRetries retries downloads that failed because of
+// a connection error or a transient server error using the configured retry
+// policy, until the context is done
+func downloadCookbookFileWithRetries(ctx context.Context, c *http.Client, chefOrg, orgID, checksum string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		content, resp, err := downloadCookbookFile(ctx, c, chefOrg, orgID, checksum)
+		if err == nil || attempt >= getConfig().HTTP.Retries || !retryable(ctx, resp, err) {
+			return content, err
+		}
+		if err := waitForRetry(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
 }
 
-func downloadCookbookFile(c *http.Client, orgID, checksum string) ([]byte, error) {
+// downloadCookbookFile downloads a single file, which needs to be completed
+// within the configured timeout. The response is only returned when it has
+// an unexpected status, so the caller can tell if the failure is transient.
+func downloadCookbookFile(ctx context.Context, c *http.Client, chefOrg, orgID, checksum string) ([]byte, *http.Response, error) {
+	timeout := time.Duration(getConfig().HTTP.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	var urlStr string
 
-	if cfg.Chef.Type == "goiardi" {
+	if getConfig().Chef.Type == "goiardi" {
 		urlStr = fmt.Sprintf("%s/file_store/%s", getChefBaseURL(), checksum)
 	} else {
-		u, err := generateSignedURL(orgID, checksum)
+		u, err := generateSignedURL(chefOrg, orgID, checksum)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		urlStr = u.String()
 	}
 
-	resp, err := c.Get(urlStr)
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
-		return nil, err
+		return nil, resp, err
 	}
 
-	return ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(resp.Body)
+	return content, nil, err
 }
 
-func generateSignedURL(orgID, checksum string) (*url.URL, error) {
+func generateSignedURL(chefOrg, orgID, checksum string) (*url.URL, error) {
+	baseURL, key, secret := bookshelfConfig(chefOrg)
+
 	expires := time.Now().Unix() + 10
 	stringToSign := fmt.Sprintf("GET\n\n\n%d\n/bookshelf/organization-%s/checksum-%s", expires, orgID, checksum)
 
-	h := hmac.New(sha1.New, []byte(cfg.Chef.BookshelfSecret))
+	h := hmac.New(sha1.New, []byte(secret))
 	h.Write([]byte(stringToSign))
 	signature := url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil)))
 
 	urlStr := fmt.Sprintf(
 		"%s/bookshelf/organization-%s/checksum-%s?AWSAccessKeyId=%s&Expires=%d&Signature=%s",
-		getChefBaseURL(),
+		baseURL,
 		orgID,
 		checksum,
-		cfg.Chef.BookshelfKey,
+		key,
 		expires,
 		signature,
 	)
@@ -352,6 +702,21 @@ func generateSignedURL(orgID, checksum string) (*url.URL, error) {
 	return url.Parse(urlStr)
 }
 
+// bookshelfConfig returns the base URL and credentials of the bookshelf
+// used by the organization
+func bookshelfConfig(chefOrg string) (string, string, string) {
+	c := getConfig()
+	name := getEffectiveConfig("Bookshelf", chefOrg).(string)
+	if b, ok := c.Bookshelf[name]; ok {
+		baseURL := strings.TrimSuffix(b.URL, "/")
+		if baseURL == "" {
+			baseURL = getChefBaseURL()
+		}
+		return baseURL, b.Key, b.Secret
+	}
+	return getChefBaseURL(), c.Chef.BookshelfKey, c.Chef.BookshelfSecret
+}
+
 func writeFileToDisk(filePath string, content io.Reader) error {
 	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
 		return err
@@ -441,14 +806,15 @@ func checkHTTPResponse(resp *http.Response, allowedStates []int) error {
 }
 
 func getChefBaseURL() string {
+	c := getConfig()
 	var baseURL string
-	switch cfg.Chef.Port {
+	switch c.Chef.Port {
 	case "443":
-		baseURL = "https://" + cfg.Chef.Server
+		baseURL = "https://" + c.Chef.Server
 	case "80":
-		baseURL = "http://" + cfg.Chef.Server
+		baseURL = "http://" + c.Chef.Server
 	default:
-		baseURL = "http://" + cfg.Chef.Server + ":" + cfg.Chef.Port
+		baseURL = "http://" + c.Chef.Server + ":" + c.Chef.Port
 	}
 	return baseURL
 }
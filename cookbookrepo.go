@@ -0,0 +1,125 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sourceRefHeader is the header used to compare an upload with a specific
+// commit instead of the tagged version (e.g. to test pre-releases)
+const sourceRefHeader = "X-Chef-Guard-Source-Ref"
+
+var commitSHA = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// cookbookSource holds the location of the source of a cookbook in Git
+type cookbookSource struct {
+	gitConfigs []string
+	repo       string
+	subdir     string
+	tagPrefix  string
+}
+
+// sourceOfCookbook returns where the source of a cookbook is located, using
+// the [cookbook "<name>"] config when there is one. By default the repo has
+// the same name as the cookbook and its versions are tagged as v<version>.
+func sourceOfCookbook(chefOrg, name string) *cookbookSource {
+	s := &cookbookSource{
+		gitConfigs: cookbookGitConfigs(chefOrg),
+		repo:       name,
+		tagPrefix:  "v",
+	}
+
+	c, ok := getConfig().Cookbook[name]
+	if !ok {
+		return s
+	}
+	if c.GitConfig != "" {
+		s.gitConfigs = []string{c.GitConfig}
+	}
+	if c.Repo != "" {
+		s.repo = c.Repo
+	}
+	if c.TagPrefix != "" {
+		s.tagPrefix = c.TagPrefix
+	}
+	s.subdir = strings.Trim(c.Path, "/")
+
+	return s
+}
+
+// tag returns the Git tag of a cookbook version
+func (s *cookbookSource) tag(version string) string {
+	return fmt.Sprintf("%s%s", s.tagPrefix, version)
+}
+
+// cookbookForTag returns the cookbook and version a tag pushed to a repo
+// belongs to, or an empty name if the tag is not a cookbook version tag
+func cookbookForTag(repo, tag string) (string, string) {
+	for name, c := range getConfig().Cookbook {
+		if !strings.EqualFold(c.Repo, repo) {
+			continue
+		}
+		prefix := c.TagPrefix
+		if prefix == "" {
+			prefix = "v"
+		}
+		if strings.HasPrefix(tag, prefix) {
+			return name, strings.TrimPrefix(tag, prefix)
+		}
+	}
+	if c, ok := getConfig().Cookbook[repo]; (!ok || c.Repo == "") && strings.HasPrefix(tag, "v") {
+		return repo, strings.TrimPrefix(tag, "v")
+	}
+	return "", ""
+}
+
+// searchGitRef returns the source of a cookbook at a specific commit. The
+// commit is not tagged and the cookbook is not published.
+func searchGitRef(ctx context.Context, src *cookbookSource, ref string) (*SourceCookbook, error) {
+	for _, gitConfig := range src.gitConfigs {
+		gitConfig = strings.TrimSpace(gitConfig)
+		gitClient, err := getCustomClientContext(ctx, gitConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create custom Git client: %s", err)
+		}
+
+		link, err := gitClient.GetArchiveLink(src.repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		if link == nil {
+			continue
+		}
+		if link, err = secureURL(link); err != nil {
+			return nil, err
+		}
+
+		sc := &SourceCookbook{LocationType: "git", DownloadURL: link}
+		sc.tagged = true
+		sc.gitConfig = gitConfig
+		sc.repo = src.repo
+		sc.subdir = src.subdir
+		sc.tag = ref
+		sc.sourceURL = strings.Split(link.String(), "&")[0]
+		return sc, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debouncedUpdate holds the latest state of an item that is updated
+// multiple times within the debounce window
+type debouncedUpdate struct {
+	cg      *ChefGuard
+	update  *gitUpdate
+	pending *QueueEntry
+	users   []string
+	count   int
+}
+
+var debouncedUpdates = struct {
+	sync.Mutex
+	m map[string]*debouncedUpdate
+}{m: make(map[string]*debouncedUpdate)}
+
+// debounceCommits returns true if changes of the endpoint type should be
+// coalesced before being committed
+func debounceCommits(org, endpointType string) bool {
+	return getEffectiveConfig("DebounceWindow", org).(int) > 0 &&
+		containsType(getEffectiveConfig("DebounceTypes", org).(string), endpointType)
+}
+
+// debouncedGitUpdate coalesces all updates of an item made within the
+// debounce window into a single commit. The latest state is persisted in the
+// queue, so it is still committed when Chef-Guard is stopped within the window.
+func (cg *ChefGuard) debouncedGitUpdate(action string, body []byte) {
+	key := fmt.Sprintf("%s/%s", cg.Repo, cg.gitPath(fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item)))
+
+	gu, err := cg.newGitUpdate(action, body)
+	if err != nil {
+		return
+	}
+
+	debouncedUpdates.Lock()
+	defer debouncedUpdates.Unlock()
+
+	u, ok := debouncedUpdates.m[key]
+	if !ok {
+		u = &debouncedUpdate{}
+		debouncedUpdates.m[key] = u
+		window := time.Duration(getEffectiveConfig("DebounceWindow", cg.ChefOrg).(int)) * time.Second
+		id := cg.RequestID
+		time.AfterFunc(window, func() {
+			defer recoverPanic(backgroundRequest(id, "debounce/"+key), nil)
+			flushGitUpdate(key)
+		})
+	}
+
+	u.cg, u.update = cg, gu
+	u.count++
+	if !containsFold(u.users, cg.User) {
+		u.users = append(u.users, cg.User)
+	}
+	if u.count > 1 {
+		cg.ChangeDetails.Note = fmt.Sprintf("%d updates by %s", u.count, strings.Join(u.users, ", "))
+	}
+
+	if retryQueue == nil {
+		return
+	}
+	if u.pending == nil {
+		u.pending, err = retryQueue.pushClaimed("git", gu)
+	} else {
+		err = retryQueue.update(u.pending, gu)
+	}
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to persist git update for %s/%s: %s", cg.ChangeDetails.Type, cg.ChangeDetails.Item, err)
+	}
+}
+
+// flushGitUpdate commits the latest state of a debounced item
+func flushGitUpdate(key string) {
+	debouncedUpdates.Lock()
+	u, ok := debouncedUpdates.m[key]
+	delete(debouncedUpdates.m, key)
+	debouncedUpdates.Unlock()
+
+	if !ok {
+		return
+	}
+
+	u.cg.commitGitUpdate(u.update, u.pending)
+}
+
+// flushGitUpdates commits all debounced items, so no changes are lost when
+// shutting down
+func flushGitUpdates() {
+	debouncedUpdates.Lock()
+	keys := make([]string, 0, len(debouncedUpdates.m))
+	for key := range debouncedUpdates.m {
+		keys = append(keys, key)
+	}
+	debouncedUpdates.Unlock()
+
+	for _, key := range keys {
+		flushGitUpdate(key)
+	}
+}
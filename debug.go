@@ -0,0 +1,109 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// openConns keeps track of the number of client connections per state
+var openConns = struct {
+	sync.Mutex
+	m map[net.Conn]http.ConnState
+}{m: make(map[net.Conn]http.ConnState)}
+
+// trackConnState is used as the ConnState hook of the server, so the number
+// of open connections can be reported by the stats endpoint
+func trackConnState(c net.Conn, state http.ConnState) {
+	openConns.Lock()
+	defer openConns.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(openConns.m, c)
+	default:
+		openConns.m[c] = state
+	}
+}
+
+// Stats holds a snapshot of the runtime statistics of the process
+type Stats struct {
+	Uptime      string         `json:"uptime"`
+	Goroutines  int            `json:"goroutines"`
+	Connections map[string]int `json:"connections"`
+	Heap        struct {
+		Alloc    uint64 `json:"alloc"`
+		InUse    uint64 `json:"in_use"`
+		Idle     uint64 `json:"idle"`
+		Released uint64 `json:"released"`
+		Objects  uint64 `json:"objects"`
+	} `json:"heap"`
+	GC struct {
+		Count      uint32  `json:"count"`
+		LastRun    string  `json:"last_run,omitempty"`
+		LastPause  string  `json:"last_pause"`
+		TotalPause string  `json:"total_pause"`
+		CPUPercent float64 `json:"cpu_percent"`
+	} `json:"gc"`
+}
+
+var startTime = time.Now()
+
+// statsHandler returns a lightweight snapshot of the goroutines, heap, GC
+// and open connections of the process
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	s := &Stats{
+		Uptime:      time.Since(startTime).Round(time.Second).String(),
+		Goroutines:  runtime.NumGoroutine(),
+		Connections: map[string]int{"total": 0},
+	}
+
+	openConns.Lock()
+	for _, state := range openConns.m {
+		s.Connections["total"]++
+		s.Connections[state.String()]++
+	}
+	openConns.Unlock()
+
+	s.Heap.Alloc = m.HeapAlloc
+	s.Heap.InUse = m.HeapInuse
+	s.Heap.Idle = m.HeapIdle
+	s.Heap.Released = m.HeapReleased
+	s.Heap.Objects = m.HeapObjects
+
+	s.GC.Count = m.NumGC
+	if m.NumGC > 0 {
+		s.GC.LastRun = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339)
+	}
+	s.GC.LastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256]).String()
+	s.GC.TotalPause = time.Duration(m.PauseTotalNs).String()
+	s.GC.CPUPercent = m.GCCPUFraction * 100
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode stats: %s", err), http.StatusInternalServerError)
+	}
+}
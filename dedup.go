@@ -0,0 +1,138 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var dedupedUploads = expvar.NewInt("deduplicated_uploads_total")
+
+// uploadResult holds the outcome of validating a cookbook upload, so it can
+// be shared with identical uploads that arrive while it is being validated
+type uploadResult struct {
+	done     chan struct{}
+	shared   bool
+	status   int
+	body     []byte
+	warnings []string
+	source   string
+}
+
+// inflightUploads holds the uploads that are currently being validated
+var inflightUploads = struct {
+	sync.Mutex
+	m map[string]*uploadResult
+}{m: make(map[string]*uploadResult)}
+
+// resultWriter records an error response written during validation
+type resultWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *resultWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *resultWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// uploadKey returns the key identifying identical uploads of a cookbook
+// version, which includes everything that can influence the validation. The
+// user is part of the key, as exemptions and override permissions are per
+// user.
+func (cg *ChefGuard) uploadKey(body []byte) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%x/%t/%s/%s", cg.ChefOrg, cg.User, cg.Cookbook.Name, cg.Cookbook.Version,
+		sha256.Sum256(body), cg.ForcedUpload, cg.Override, cg.SourceRef)
+}
+
+// dedupUpload makes sure identical concurrent uploads (e.g. from CI matrix
+// jobs) are only validated once. The first upload runs the validation and
+// all others wait for, and share, its result. Like validate, it returns true
+// if the request was already answered.
+func (cg *ChefGuard) dedupUpload(w http.ResponseWriter, key string, validate func(http.ResponseWriter) bool) bool {
+	inflightUploads.Lock()
+	if res, ok := inflightUploads.m[key]; ok {
+		inflightUploads.Unlock()
+		select {
+		case <-res.done:
+		case <-cg.ctx.Done():
+			return cg.clientGone()
+		}
+		return cg.replayUploadResult(w, res, validate)
+	}
+	res := &uploadResult{done: make(chan struct{})}
+	inflightUploads.m[key] = res
+	inflightUploads.Unlock()
+
+	defer func() {
+		inflightUploads.Lock()
+		delete(inflightUploads.m, key)
+		inflightUploads.Unlock()
+		close(res.done)
+	}()
+
+	rw := &resultWriter{ResponseWriter: w}
+	answered := validate(rw)
+
+	// Internal errors and uploads passed through to Chef are not shared
+	res.shared = !answered || (rw.status >= 400 && rw.status < 500)
+	res.status = rw.status
+	res.body = rw.body.Bytes()
+	res.warnings = w.Header()["X-Chef-Guard-Warning"]
+	if cg.SourceCookbook != nil {
+		res.source = cg.SourceCookbook.sourceURL
+	}
+
+	return answered
+}
+
+// replayUploadResult answers an upload using the result of an identical
+// upload. A passed upload is not tagged or published again.
+func (cg *ChefGuard) replayUploadResult(w http.ResponseWriter, res *uploadResult, validate func(http.ResponseWriter) bool) bool {
+	if !res.shared {
+		return validate(w)
+	}
+	dedupedUploads.Add(1)
+
+	for _, warning := range res.warnings {
+		w.Header().Add("X-Chef-Guard-Warning", warning)
+	}
+	if res.status != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+		return true
+	}
+
+	cg.SourceCookbook = &SourceCookbook{tagged: true, sourceURL: res.source}
+	return false
+}
@@ -0,0 +1,210 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around a change
+	diffContext = 3
+
+	// maxDiffSize is the maximum size in bytes of the diff of a single file
+	maxDiffSize = 4096
+
+	// maxDiffCells limits the size of the table used to compute a diff
+	maxDiffCells = 4000000
+)
+
+// diffLine is a single line of a diff with its position in both files
+type diffLine struct {
+	kind byte
+	text string
+	a, b int
+}
+
+// unifiedDiff returns a unified diff between the source and the uploaded
+// version of a file, capped at maxDiffSize bytes
+func unifiedDiff(name string, source, upload []byte) string {
+	return labeledDiff(name, "source", "upload", source, upload)
+}
+
+// labeledDiff returns a unified diff between two versions of a file, using
+// the given labels as the prefix of the file names
+func labeledDiff(name, labelA, labelB string, source, upload []byte) string {
+	if bytes.Equal(source, upload) {
+		return ""
+	}
+	if isBinary(source) || isBinary(upload) {
+		return fmt.Sprintf("Binary file %s differs\n", name)
+	}
+
+	lines := diffLines(splitLines(source), splitLines(upload))
+	if lines == nil {
+		return fmt.Sprintf("File %s is too large to show a diff\n", name)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s/%s\n+++ %s/%s\n", labelA, name, labelB, name)
+
+	for i := 0; i < len(lines); {
+		if lines[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].kind != ' ' {
+				end++
+				continue
+			}
+			j := end
+			for j < len(lines) && lines[j].kind == ' ' {
+				j++
+			}
+			if j == len(lines) || j-end > 2*diffContext {
+				end += diffContext
+				if end > len(lines) {
+					end = len(lines)
+				}
+				break
+			}
+			end = j
+		}
+
+		aLen, bLen := 0, 0
+		for _, l := range lines[start:end] {
+			if l.kind != '+' {
+				aLen++
+			}
+			if l.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(lines[start].a, aLen), hunkRange(lines[start].b, bLen))
+		for _, l := range lines[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", l.kind, l.text)
+		}
+
+		i = end
+	}
+
+	if out.Len() > maxDiffSize {
+		diff := out.String()[:maxDiffSize]
+		return diff[:strings.LastIndex(diff, "\n")+1] + "... (diff truncated)\n"
+	}
+	return out.String()
+}
+
+func hunkRange(start, n int) string {
+	if n == 0 {
+		start--
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, n)
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// diffLines returns the lines of both files marked as unchanged (' '),
+// removed ('-') or added ('+'), or nil if the files are too large to diff
+func diffLines(a, b []string) []*diffLine {
+	// Skip the common prefix and suffix, which usually leaves only a few lines
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	n, m := len(x), len(y)
+	if (n+1)*(m+1) > maxDiffCells {
+		return nil
+	}
+
+	// lcs[i][j] holds the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []*diffLine{}
+	ai, bi := 1, 1
+	add := func(kind byte, text string) {
+		lines = append(lines, &diffLine{kind: kind, text: text, a: ai, b: bi})
+		if kind != '+' {
+			ai++
+		}
+		if kind != '-' {
+			bi++
+		}
+	}
+
+	for _, l := range a[:prefix] {
+		add(' ', l)
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && x[i] == y[j]:
+			add(' ', x[i])
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			add('-', x[i])
+			i++
+		default:
+			add('+', y[j])
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		add(' ', l)
+	}
+
+	return lines
+}
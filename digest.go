@@ -0,0 +1,251 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestChange is a single commit included in a digest
+type DigestChange struct {
+	Time   time.Time `json:"time" desc:"Time of the commit in UTC"`
+	User   string    `json:"user" desc:"Chef user that made the change"`
+	Item   string    `json:"item" desc:"Changed item (e.g. roles/web.json)"`
+	Action string    `json:"action" desc:"HTTP method of the change (POST, PUT or DELETE)"`
+	Repo   string    `json:"repo" desc:"Repo the change was committed to"`
+	SHA    string    `json:"sha" desc:"SHA of the commit"`
+}
+
+// DigestEvent is the payload posted to the digest webhook
+type DigestEvent struct {
+	Schema  string          `json:"schema" desc:"Schema ID of the event (digest/v1)"`
+	Time    time.Time       `json:"time" desc:"Time the digest was sent in UTC"`
+	Org     string          `json:"org" desc:"Chef organization, empty when not using Chef Enterprise"`
+	Period  string          `json:"period" desc:"Period covered by the digest (hourly or daily)"`
+	Changes []*DigestChange `json:"changes" desc:"All changes committed during the period"`
+}
+
+var digests = struct {
+	sync.Mutex
+	m map[string][]*DigestChange
+}{m: make(map[string][]*DigestChange)}
+
+// recordDigest adds a committed change to the next digest of the org
+func (cg *ChefGuard) recordDigest(action, sha string) {
+	if getEffectiveConfig("Digest", cg.ChefOrg).(string) == "" {
+		return
+	}
+
+	digests.Lock()
+	defer digests.Unlock()
+
+	digests.m[cg.ChefOrg] = append(digests.m[cg.ChefOrg], &DigestChange{
+		Time:   time.Now().UTC(),
+		User:   cg.User,
+		Item:   fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item),
+		Action: action,
+		Repo:   cg.Repo,
+		SHA:    sha,
+	})
+	saveDigests()
+}
+
+// loadDigests restores the changes of the digests that were still pending
+// when Chef-Guard was stopped
+func loadDigests() {
+	data, err := ioutil.ReadFile(getConfig().Default.DigestFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ERROR.Printf("Failed to read pending digests: %s", err)
+		}
+		return
+	}
+
+	digests.Lock()
+	defer digests.Unlock()
+
+	if err := json.Unmarshal(data, &digests.m); err != nil {
+		ERROR.Printf("Failed to unmarshal pending digests: %s", err)
+	}
+	if digests.m == nil {
+		digests.m = make(map[string][]*DigestChange)
+	}
+}
+
+// saveDigests writes the changes of all pending digests to the digest file.
+// The caller must hold the digests lock.
+func saveDigests() {
+	file := getConfig().Default.DigestFile
+	if len(digests.m) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			ERROR.Printf("Failed to remove pending digests: %s", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(digests.m)
+	if err != nil {
+		ERROR.Printf("Failed to marshal pending digests: %s", err)
+		return
+	}
+
+	// Write to a temp file first so we never end up with partial digests
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		ERROR.Printf("Failed to create the directory of the pending digests: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		ERROR.Printf("Failed to write pending digests: %s", err)
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		ERROR.Printf("Failed to write pending digests: %s", err)
+	}
+}
+
+// startDigester sends the hourly digests at the start of every hour and the
+// daily digests at midnight. It always runs, so digests enabled by a config
+// reload are sent as well and recorded changes never pile up unsent.
+func startDigester() {
+	loadDigests()
+
+	go func() {
+		for {
+			now := time.Now().In(timeZone())
+			next := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, timeZone())
+			time.Sleep(time.Until(next))
+			sendDigests(next.Hour() == 0)
+		}
+	}()
+}
+
+// sendDigests sends the hourly digests, and the daily digests if daily is true
+func sendDigests(daily bool) {
+	digests.Lock()
+	pending := make(map[string][]*DigestChange)
+	for org, changes := range digests.m {
+		period := getEffectiveConfig("Digest", org).(string)
+		if period == "hourly" || daily || period == "" {
+			pending[org] = changes
+			delete(digests.m, org)
+		}
+	}
+	if len(pending) > 0 {
+		saveDigests()
+	}
+	digests.Unlock()
+
+	for org, changes := range pending {
+		sendDigest(org, changes)
+	}
+}
+
+// sendDigest sends the changes to the recipients and webhooks of the routes
+// they match, or to the configured mail recipient and digest URL of the org
+func sendDigest(org string, changes []*DigestChange) {
+	period := getEffectiveConfig("Digest", org).(string)
+	if period == "" {
+		// The digest was disabled while changes were pending
+		period = "daily"
+	}
+
+	byRecipients := make(map[string][]*DigestChange)
+	byURL := make(map[string][]*DigestChange)
+	for _, c := range changes {
+		recipients, urls := routeTargets(org, c.Item)
+		to := strings.Join(recipients, ", ")
+		if to == "" {
+			to = getEffectiveConfig("MailRecipient", org).(string)
+		}
+		if to != "" {
+			byRecipients[to] = append(byRecipients[to], c)
+		}
+		if len(urls) == 0 {
+			urls = []string{getEffectiveConfig("DigestURL", org).(string)}
+		}
+		for _, u := range urls {
+			if u != "" {
+				byURL[u] = append(byURL[u], c)
+			}
+		}
+	}
+
+	for url, changes := range byURL {
+		data, err := json.Marshal(&DigestEvent{
+			Schema:  digestSchema,
+			Time:    time.Now().UTC(),
+			Org:     org,
+			Period:  period,
+			Changes: changes,
+		})
+		if err != nil {
+			ERROR.Printf("Failed to marshal digest of organization %q: %s", org, err)
+			continue
+		}
+		postEvent("", url, "digest", data)
+	}
+
+	if getEffectiveConfig("MailServer", org).(string) == "" {
+		return
+	}
+	for to, changes := range byRecipients {
+		mailDigest(org, period, to, changes)
+	}
+}
+
+// mailDigest mails the digest of the changes to the recipients
+func mailDigest(org, period, to string, changes []*DigestChange) {
+	from := getEffectiveConfig("MailSendBy", org).(string)
+	if from == "" {
+		from = fmt.Sprintf("%s@%s", getConfig().Chef.User, getEffectiveConfig("MailDomain", org).(string))
+	}
+
+	lines := make([]string, 0, len(changes))
+	for _, c := range changes {
+		lines = append(lines, fmt.Sprintf("%s  %-7s %s by %s (%s@%s)",
+			formatTime(c.Time), strings.ToLower(c.Action), c.Item, c.User, c.Repo, shortSHA(c.SHA)))
+	}
+
+	msg := fmt.Sprintf(`From: %s
+To: %s
+Date: %s
+Subject: [%s CHEF] %s digest: %d change(s)
+MIME-version: 1.0
+Content-Type: text/plain; charset="UTF-8"
+
+%s
+`, from, to, time.Now().Format(time.RFC1123Z),
+		strings.ToUpper(org), period, len(changes), strings.Join(lines, "\n"))
+
+	if err := mailTo(org, from, to, msg); err != nil {
+		ERROR.Printf("Failed to send %s digest of organization %q: %s", period, org, err)
+	}
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,224 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Scripts to only extend or release a lock when it is still ours
+var (
+	redisExtendScript  = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
+	redisReleaseScript = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+)
+
+// errLockTimeout is returned when a distributed lock is still held by another
+// instance after the lock timeout
+var errLockTimeout = errors.New("timed out waiting for the distributed lock")
+
+// redisPools holds a connection pool for the configured Redis server, which
+// is replaced when the Redis settings are changed by a config reload
+var redisPools = struct {
+	sync.Mutex
+	settings string
+	pool     *redis.Pool
+}{}
+
+// distributedSyncer serializes all work on a token (e.g. a Git repo) within
+// this process and, when a Redis server is configured, also across all
+// Chef-Guard instances sharing that server
+type distributedSyncer struct {
+	local *localSyncer
+	owner string
+}
+
+// distributedLock is a lock held in Redis
+type distributedLock struct {
+	key   string
+	value string
+	stop  chan struct{}
+}
+
+func newDistributedSyncer() *distributedSyncer {
+	host, _ := os.Hostname()
+	return &distributedSyncer{
+		local: newLocalSyncer(),
+		owner: host,
+	}
+}
+
+// Lock waits until the lock for the token is acquired and returns the func
+// releasing this specific acquisition of the lock again. An error is returned
+// when another instance still holds the lock after the lock timeout.
+func (s *distributedSyncer) Lock(token string) (func(), error) {
+	gen := s.local.Lock(token)
+	unlock := func() { s.local.Unlock(token, gen) }
+
+	if getConfig().Lock.Redis == "" {
+		return unlock, nil
+	}
+
+	key := getConfig().Lock.Prefix + token
+	l, err := s.acquire(key)
+	if err == errLockTimeout {
+		unlock()
+		return nil, fmt.Errorf("Failed to acquire distributed lock %s: %s", key, err)
+	}
+	if err != nil {
+		// Git rejects commits based on an outdated file, so failing open
+		// is preferred over blocking all changes when Redis is unreachable
+		ERROR.Printf("Failed to acquire distributed lock %s, only locking within this instance: %s", key, err)
+		return unlock, nil
+	}
+
+	return func() {
+		close(l.stop)
+		if _, err := redisDo(redisReleaseScript, l.key, l.value); err != nil {
+			ERROR.Printf("Failed to release distributed lock %s, it expires in %ds: %s", l.key, getConfig().Lock.TTL, err)
+		}
+		unlock()
+	}, nil
+}
+
+// acquire waits until the lock is acquired or the lock timeout passed
+func (s *distributedSyncer) acquire(key string) (*distributedLock, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	l := &distributedLock{
+		key:   key,
+		value: fmt.Sprintf("%s/%d/%s", s.owner, os.Getpid(), hex.EncodeToString(b)),
+		stop:  make(chan struct{}),
+	}
+
+	ttl := getConfig().Lock.TTL * 1000
+	deadline := time.Now().Add(time.Duration(getConfig().Lock.Timeout) * time.Second)
+	wait := 50 * time.Millisecond
+
+	for {
+		_, err := redis.String(redisDo(nil, "SET", l.key, l.value, "NX", "PX", ttl))
+		if err == nil {
+			break
+		}
+		if err != redis.ErrNil {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errLockTimeout
+		}
+		time.Sleep(wait)
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+
+	go l.keepAlive(ttl)
+
+	return l, nil
+}
+
+// keepAlive extends the lock while it is held, so long running Git updates
+// don't lose their lock. The lock is no longer extended after the deadline,
+// so a stuck update cannot block the repo for all instances.
+func (l *distributedLock) keepAlive(ttl int) {
+	t := time.NewTicker(time.Duration(getConfig().Lock.TTL) * time.Second / 3)
+	defer t.Stop()
+
+	since := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			if d := time.Duration(getConfig().Lock.Deadline) * time.Second; d > 0 && time.Since(since) > d {
+				ERROR.Printf("Stopped extending distributed lock %s held since %s", l.key, since.Format(time.RFC3339))
+				return
+			}
+			extended, err := redis.Int(redisDo(redisExtendScript, l.key, l.value, ttl))
+			if err != nil {
+				WARNING.Printf("Failed to extend distributed lock %s: %s", l.key, err)
+				continue
+			}
+			if extended != 1 {
+				WARNING.Printf("Lost distributed lock %s", l.key)
+				return
+			}
+		}
+	}
+}
+
+// redisDo runs a command (or a script when given) using a pooled connection
+// to the configured Redis server
+func redisDo(script *redis.Script, args ...interface{}) (interface{}, error) {
+	conn := redisPool().Get()
+	defer conn.Close()
+
+	if script != nil {
+		return script.Do(conn, args...)
+	}
+	return conn.Do(args[0].(string), args[1:]...)
+}
+
+// redisPool returns the connection pool for the configured Redis server
+func redisPool() *redis.Pool {
+	config := getConfig()
+	addr, password, db, useTLS := config.Lock.Redis, config.Lock.Password, config.Lock.Database, config.Lock.TLS
+	settings := fmt.Sprintf("%s/%s/%d/%t", addr, password, db, useTLS)
+
+	redisPools.Lock()
+	defer redisPools.Unlock()
+
+	if redisPools.pool != nil && redisPools.settings == settings {
+		return redisPools.pool
+	}
+	if redisPools.pool != nil {
+		redisPools.pool.Close()
+	}
+
+	redisPools.settings = settings
+	redisPools.pool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialConnectTimeout(5*time.Second),
+				redis.DialReadTimeout(10*time.Second),
+				redis.DialWriteTimeout(10*time.Second),
+				redis.DialPassword(password),
+				redis.DialDatabase(db),
+				redis.DialUseTLS(useTLS),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return redisPools.pool
+}
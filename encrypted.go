@@ -0,0 +1,70 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// checkEncryptedItem makes sure that all values of items in the data bags
+// that must be encrypted are in the encrypted data bag item format
+func checkEncryptedItem(bag string, body []byte) (int, error) {
+	if !containsFold(splitList(getConfig().DataBags.Encrypted), bag) {
+		return 0, nil
+	}
+
+	item, err := unmarshalDataBagItem(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	plaintext := []string{}
+	for k, v := range item {
+		if k != "id" && !isEncryptedValue(v) {
+			plaintext = append(plaintext, k)
+		}
+	}
+	if len(plaintext) == 0 {
+		return 0, nil
+	}
+	sort.Strings(plaintext)
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Encrypted Data Bag errors found ===\n"+
+		"Items in data bag %s must be encrypted, but the\n"+
+		"following fields are not:\n"+
+		" - %s\n\n"+
+		"Please encrypt the item (e.g. using knife --secret-file)\n"+
+		"and try again.\n"+
+		"======================================\n", bag, strings.Join(plaintext, "\n - "))
+}
+
+// isEncryptedValue returns true if the value has the encrypted_data format
+func isEncryptedValue(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, k := range []string{"encrypted_data", "iv", "cipher"} {
+		if _, ok := m[k].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
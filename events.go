@@ -0,0 +1,151 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Schema IDs of all outbound events. Schemas only evolve additively (new
+// optional fields), any breaking change requires a new version.
+const (
+	auditSchema      = "audit/v1"
+	cookbookSchema   = "cookbook/v1"
+	violationsSchema = "violations/v1"
+	verdictSchema    = "verdict/v1"
+	digestSchema     = "digest/v1"
+	tombstoneSchema  = "tombstone/v1"
+)
+
+// eventSchemas maps the schema ID of every outbound event to its payload
+var eventSchemas = map[string]interface{}{
+	auditSchema:      AuditEvent{},
+	cookbookSchema:   CookbookChange{},
+	violationsSchema: ViolationsEvent{},
+	verdictSchema:    VerdictEvent{},
+	digestSchema:     DigestEvent{},
+	tombstoneSchema:  Tombstone{},
+}
+
+// schemasHandler serves the JSON Schema of all (or a single) outbound events,
+// so consumers can validate the payloads they receive
+func schemasHandler(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+
+	if id := mux.Vars(r)["id"]; id != "" {
+		e, ok := eventSchemas[id]
+		if !ok {
+			errorHandler(w, fmt.Sprintf("Unknown event schema %q", id), http.StatusNotFound)
+			return
+		}
+		v = eventSchema(id, e)
+	} else {
+		ids := make([]string, 0, len(eventSchemas))
+		for id := range eventSchemas {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		schemas := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			schemas = append(schemas, eventSchema(id, eventSchemas[id]))
+		}
+		v = schemas
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode event schemas: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func eventSchema(id string, e interface{}) map[string]interface{} {
+	s := jsonSchema(reflect.TypeOf(e))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["$id"] = id
+
+	// Pin the schema field to the version, so payloads of another version
+	// never validate against this schema
+	if p, ok := s["properties"].(map[string]interface{})["schema"].(map[string]interface{}); ok {
+		p["const"] = id
+	}
+	return s
+}
+
+// jsonSchema returns the JSON Schema of a type, using the json tags for the
+// property names and the desc tags for their descriptions
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+
+		props := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			name := strings.Split(tag, ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			p := jsonSchema(f.Type)
+			if desc := f.Tag.Get("desc"); desc != "" {
+				p["description"] = desc
+			}
+			props[name] = p
+
+			if !strings.Contains(tag, ",omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+			"required":   required,
+		}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,307 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freezeTypes are the endpoint types that are frozen when a freeze window
+// doesn't list any specific types
+const freezeTypes = "cookbooks,data,clients,environments,nodes,roles"
+
+// freezeWindow is a parsed change freeze window
+type freezeWindow struct {
+	name       string
+	orgs       []string
+	types      string
+	start      time.Time
+	end        time.Time
+	schedule   *cronSchedule
+	duration   time.Duration
+	breakGlass []string
+	message    string
+}
+
+func parseFreezeWindow(name string, c *Config) (*freezeWindow, error) {
+	f := c.Freeze[name]
+	w := &freezeWindow{
+		name:       name,
+		orgs:       splitList(f.Orgs),
+		types:      f.Types,
+		breakGlass: splitList(f.BreakGlass),
+		message:    f.Message,
+	}
+	if w.types == "" {
+		w.types = freezeTypes
+	}
+
+	// The time zone is verified after the freeze windows
+	loc := timeZone()
+	if l, err := time.LoadLocation(c.Default.TimeZone); err == nil {
+		loc = l
+	}
+
+	var err error
+	switch {
+	case f.Schedule != "":
+		if w.schedule, err = parseCronSchedule(f.Schedule, loc); err != nil {
+			return nil, fmt.Errorf("Invalid schedule for freeze %s: %s", name, err)
+		}
+		if w.duration, err = time.ParseDuration(f.Duration); err != nil || w.duration <= 0 {
+			return nil, fmt.Errorf("Freeze %s requires a valid duration when using a schedule!", name)
+		}
+	case f.Start != "" && f.End != "":
+		if w.start, err = parseFreezeTime(f.Start, loc); err != nil {
+			return nil, fmt.Errorf("Invalid start for freeze %s: %s", name, err)
+		}
+		if w.end, err = parseFreezeTime(f.End, loc); err != nil {
+			return nil, fmt.Errorf("Invalid end for freeze %s: %s", name, err)
+		}
+		if !w.end.After(w.start) {
+			return nil, fmt.Errorf("The end of freeze %s should be after its start!", name)
+		}
+	default:
+		return nil, fmt.Errorf("Freeze %s requires either a start and end or a schedule and duration!", name)
+	}
+
+	return w, nil
+}
+
+func parseFreezeTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04", s, loc)
+}
+
+// activeUntil returns the end of the freeze window if it is in effect
+func (w *freezeWindow) activeUntil(now time.Time) (time.Time, bool) {
+	if w.schedule == nil {
+		return w.end, !now.Before(w.start) && now.Before(w.end)
+	}
+
+	// Find the last start within the duration of the window, as recurring
+	// windows may overlap
+	var end time.Time
+	for s := w.schedule.next(now.Add(-w.duration)); !s.IsZero() && !s.After(now); s = w.schedule.next(s.Add(time.Minute)) {
+		end = s.Add(w.duration)
+	}
+	return end, end.After(now)
+}
+
+// appliesTo returns true if the window freezes the request
+func (w *freezeWindow) appliesTo(org, endpointType, user string) bool {
+	if len(w.orgs) > 0 && !containsFold(w.orgs, org) {
+		return false
+	}
+	return containsType(w.types, endpointType) && !containsFold(w.breakGlass, user)
+}
+
+// activeFreeze returns the freeze window that is in effect for a request
+// and when it ends, or nil if the request is not frozen
+func activeFreeze(org, endpointType, user string, now time.Time) (*freezeWindow, time.Time) {
+	for _, f := range getConfig().Freeze {
+		w := f.window
+		if w == nil || !w.appliesTo(org, endpointType, user) {
+			continue
+		}
+		if end, ok := w.activeUntil(now); ok {
+			return w, end
+		}
+	}
+	return nil, time.Time{}
+}
+
+// freezeHandler rejects all mutating requests made during a change freeze,
+// except the ones made by break-glass users or by Chef clients updating their
+// own node. The freeze windows are checked on every request, so windows added
+// by a config reload take effect immediately.
+func freezeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("X-Ops-Userid")
+		if len(getConfig().Freeze) == 0 || r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		org := orgFromPath(r.URL.Path)
+		fw, end := activeFreeze(org, requestType(r.URL.Path), user, time.Now())
+		if fw == nil || nodeSelfUpdate(r, org, user) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		setStage(r, "change-freeze")
+		errorHandler(w, freezeMessage(fw, end), http.StatusPreconditionFailed)
+	})
+}
+
+// nodeSelfUpdate returns true if the request is made by a client updating its
+// own node object. Users are never exempted, even when they are named after
+// the node.
+func nodeSelfUpdate(r *http.Request, org, user string) bool {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 2 && parts[0] == "organizations" {
+		parts = parts[2:]
+	}
+	if len(parts) != 2 || parts[0] != "nodes" || user == "" || parts[1] != user {
+		return false
+	}
+
+	client, err := isClient(org, user)
+	if err != nil {
+		logf(WARNING, requestID(r), "Failed to check if %s is a client: %s", user, err)
+		return false
+	}
+	return client
+}
+
+// freezeMessage returns the message explaining why a change is rejected
+// during a change freeze
+func freezeMessage(fw *freezeWindow, end time.Time) string {
+	msg := fmt.Sprintf("\n=== Change freeze in effect ===\n"+
+		"Change freeze %q is in effect until %s.\n", fw.name, formatTime(end))
+	if fw.message != "" {
+		msg += fmt.Sprintf("\n%s\n", fw.message)
+	}
+	if len(fw.breakGlass) > 0 {
+		msg += fmt.Sprintf("\nOnly %s are allowed to make changes\nduring the freeze.\n", strings.Join(fw.breakGlass, ", "))
+	}
+	return msg + "===============================\n"
+}
+
+// cronSchedule is a parsed cron expression with the standard five fields,
+// evaluated in the time zone of the config it was parsed from
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+func parseCronSchedule(spec string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, found %d", len(fields))
+	}
+
+	c := &cronSchedule{domStar: fields[2] == "*", dowStar: fields[4] == "*", loc: loc}
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		bits, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, err
+		}
+		*b.bits = bits
+	}
+
+	// Sunday can be specified as both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = s, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range in %q", field)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// Like cron, a day matches either field when both are restricted
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time at or after t that matches the schedule, or
+// the zero time if there is none within the next five years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc)
+	if r := t.Truncate(time.Minute); r.Before(t) {
+		t = r.Add(time.Minute)
+	}
+
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,179 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frozenCacheTTL is the time the frozen state of a cookbook version is cached
+const frozenCacheTTL = 30 * time.Second
+
+// frozenLookupWorkers is the number of cookbook versions looked up in parallel
+const frozenLookupWorkers = 8
+
+type cachedFrozenState struct {
+	frozen  bool
+	fetched time.Time
+}
+
+// frozenCache holds the frozen state of cookbook versions per organization,
+// so it can be shared between requests validating the same pins
+var frozenCache = struct {
+	sync.Mutex
+	m map[string]*cachedFrozenState
+}{m: make(map[string]*cachedFrozenState)}
+
+// cookbookPin holds a single pinned version of a cookbook
+type cookbookPin struct {
+	name    string
+	version string
+}
+
+// isPinned returns true if the version is an exact version that needs to be
+// checked, as parsed constraints are marked with a BAD prefix
+func isPinned(version string) bool {
+	return version != "0.0.0" && !strings.HasPrefix(version, "BAD")
+}
+
+// frozenStates returns the frozen state of all pinned cookbook versions. The
+// cookbook list is fetched once, so only the versions that exist and are not
+// cached need to be looked up.
+func (cg *ChefGuard) frozenStates(constraints map[string][]string) (map[cookbookPin]bool, error) {
+	states := make(map[cookbookPin]bool)
+
+	var lookup []cookbookPin
+	frozenCache.Lock()
+	for name, versions := range constraints {
+		for _, version := range versions {
+			if !isPinned(version) {
+				continue
+			}
+			pin := cookbookPin{name: name, version: version}
+			if s, ok := frozenCache.m[cg.frozenCacheKey(pin)]; ok && time.Since(s.fetched) < frozenCacheTTL {
+				states[pin] = s.frozen
+				continue
+			}
+			lookup = append(lookup, pin)
+		}
+	}
+	frozenCache.Unlock()
+
+	if len(lookup) == 0 {
+		return states, nil
+	}
+
+	existing, err := cg.cookbookVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions that don't exist can never be frozen
+	var pending []cookbookPin
+	for _, pin := range lookup {
+		if existing[pin] {
+			pending = append(pending, pin)
+		} else {
+			states[pin] = false
+		}
+	}
+
+	frozen := make([]bool, len(pending))
+	errs := make([]error, len(pending))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < frozenLookupWorkers && w < len(pending); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				frozen[i], errs[i] = cg.cookbookFrozen(pending[i].name, pending[i].version)
+			}
+		}()
+	}
+	for i := range pending {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	frozenCache.Lock()
+	defer frozenCache.Unlock()
+	for i, pin := range pending {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		states[pin] = frozen[i]
+		frozenCache.m[cg.frozenCacheKey(pin)] = &cachedFrozenState{frozen: frozen[i], fetched: time.Now()}
+	}
+
+	return states, nil
+}
+
+// cookbookVersions returns all cookbook versions that exist on the Chef server
+func (cg *ChefGuard) cookbookVersions() (map[cookbookPin]bool, error) {
+	resp, err := cg.chefClient.GetWithParams("cookbooks", map[string]string{"num_versions": "all"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the cookbooks from Chef: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to get the cookbooks from Chef: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body of the cookbooks: %s", err)
+	}
+
+	var cookbooks map[string]struct {
+		Versions []struct {
+			Version string `json:"version"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal(body, &cookbooks); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal body %s: %s", string(body), err)
+	}
+
+	versions := make(map[cookbookPin]bool)
+	for name, cb := range cookbooks {
+		for _, v := range cb.Versions {
+			versions[cookbookPin{name: name, version: v.Version}] = true
+		}
+	}
+	return versions, nil
+}
+
+// forgetFrozenState removes the cached state of a cookbook version, which
+// is called when a new upload of the version is processed
+func (cg *ChefGuard) forgetFrozenState(name, version string) {
+	frozenCache.Lock()
+	delete(frozenCache.m, cg.frozenCacheKey(cookbookPin{name: name, version: version}))
+	frozenCache.Unlock()
+}
+
+func (cg *ChefGuard) frozenCacheKey(pin cookbookPin) string {
+	return fmt.Sprintf("%s/%s/%s", cg.ChefOrg, pin.name, pin.version)
+}
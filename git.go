@@ -17,86 +17,212 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/smtp"
 	"net/url"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xanzy/chef-guard/git"
-	"github.com/xanzy/multisyncer"
 )
 
-var ms multisyncer.MultiSyncer
+var ms = newDistributedSyncer()
+
+// gitUpdate holds all details needed to (re)play a change to git
+type gitUpdate struct {
+	User          string
+	ChefOrg       string
+	Repo          string
+	ChangeDetails *changeDetails
+	Action        string
+	Config        []byte
+	RequestID     string
+	ClientIP      string
+}
+
+func init() {
+	queueHandlers["git"] = replayGitUpdate
+}
 
-func (cg *ChefGuard) syncedGitUpdate(action string, body []byte) {
-	if ms == nil {
-		ms = multisyncer.New()
+func (cg *ChefGuard) syncedGitUpdate(action string, body []byte) error {
+	u, err := cg.newGitUpdate(action, body)
+	if err != nil {
+		return err
 	}
 
-	ms.Lock(cg.Repo)
-	defer ms.Unlock(cg.Repo)
+	// Persist the update before executing it, so it is replayed after a
+	// restart when Chef-Guard is stopped before the update is committed
+	var pending *QueueEntry
+	if retryQueue != nil {
+		if pending, err = retryQueue.pushClaimed("git", u); err != nil {
+			logf(ERROR, cg.RequestID, "Failed to persist git update for %s/%s: %s", cg.ChangeDetails.Type, cg.ChangeDetails.Item, err)
+		}
+	}
 
-	// Once we get the lock, we wait for 500ms to prevent DDOS'ing the Git backend.
-	time.Sleep(1 * time.Second)
+	return cg.commitGitUpdate(u, pending)
+}
 
-	config, err := remarshalConfig(action, body)
+// newGitUpdate returns the update committing the (remarshalled) config
+func (cg *ChefGuard) newGitUpdate(action string, body []byte) (*gitUpdate, error) {
+	config, err := remarshalConfig(cg.ChefOrg, action, body)
 	if err != nil {
-		ERROR.Printf("Failed to convert %s config for %s %s for %s: %s",
+		logf(ERROR, cg.RequestID, "Failed to convert %s config for %s %s for %s: %s",
 			strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
 			strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
 			strings.TrimSuffix(cg.ChangeDetails.Item, ".json"),
 			cg.User,
 			err,
 		)
-		return
+		return nil, err
 	}
 
-	sha, err := cg.writeConfigToGit(action, config)
+	return &gitUpdate{
+		User:          cg.User,
+		ChefOrg:       cg.ChefOrg,
+		Repo:          cg.Repo,
+		ChangeDetails: cg.ChangeDetails,
+		Action:        action,
+		Config:        config,
+		RequestID:     cg.RequestID,
+		ClientIP:      cg.ClientIP,
+	}, nil
+}
+
+// commitGitUpdate commits the update to git, queueing it to be retried when
+// it fails. The pending entry is the persisted update claimed by this
+// instance, if any.
+func (cg *ChefGuard) commitGitUpdate(u *gitUpdate, pending *QueueEntry) error {
+	unlock, err := ms.Lock(cg.Repo)
+	if err == nil {
+		defer unlock()
+
+		// Once we get the lock, we wait for 500ms to prevent DDOS'ing the Git backend.
+		time.Sleep(1 * time.Second)
+
+		err = cg.commitAndMail(u.Action, u.Config)
+	}
 	if err != nil {
-		ERROR.Printf("Failed to update %s %s for %s in git: %s",
+		logf(ERROR, cg.RequestID, "Failed to update %s %s for %s in git: %s",
 			strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
 			strings.TrimSuffix(cg.ChangeDetails.Item, ".json"),
 			cg.User,
 			err,
 		)
-		return
+
+		if retryQueue != nil {
+			var qerr error
+			if pending != nil {
+				qerr = retryQueue.retry(pending, err)
+			} else {
+				qerr = retryQueue.push("git", u, err)
+			}
+			if qerr != nil {
+				logf(ERROR, cg.RequestID, "Failed to queue git update for %s/%s: %s", cg.ChangeDetails.Type, cg.ChangeDetails.Item, qerr)
+			}
+		}
+		return err
+	}
+
+	if pending != nil {
+		if err := retryQueue.done(pending); err != nil {
+			logf(ERROR, cg.RequestID, "Failed to remove queue entry %s: %s", pending.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// commitAndMail writes the config to git (retrying failed attempts) and
+// mails the resulting diff
+func (cg *ChefGuard) commitAndMail(action string, config []byte) error {
+	if err := cg.refreshClients(); err != nil {
+		return err
+	}
+
+	var sha string
+	err := retryWithBackoff(getConfig().Default.GitRetries+1, func() (err error) {
+		sha, err = cg.writeConfigToGit(action, config)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
 	if sha != "" {
+		recordAudit(cg.ChefOrg, "change", cg.User, cg.ClientIP,
+			fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item), action)
+		cg.recordDigest(action, sha)
+
 		err := cg.mailChanges(
 			fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item), sha, action)
 		if err != nil {
-			ERROR.Printf("Failed to send git spam: %s", err)
+			logf(ERROR, cg.RequestID, "Failed to send git spam: %s", err)
 		}
 	}
+
+	return nil
+}
+
+func replayGitUpdate(e *QueueEntry) error {
+	u := new(gitUpdate)
+	if err := json.Unmarshal(e.Payload, u); err != nil {
+		return fmt.Errorf("Failed to unmarshal queue entry %s: %s", e.ID, err)
+	}
+
+	cg := &ChefGuard{
+		User:          u.User,
+		ChefOrg:       u.ChefOrg,
+		Repo:          u.Repo,
+		ChangeDetails: u.ChangeDetails,
+		RequestID:     u.RequestID,
+		ClientIP:      u.ClientIP,
+	}
+
+	unlock, err := ms.Lock(cg.Repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return cg.commitAndMail(u.Action, u.Config)
 }
 
 func (cg *ChefGuard) writeConfigToGit(action string, config []byte) (string, error) {
 	var err error
 	if cg.gitClient == nil {
-		gitConfig, ok := cfg.Git[cfg.Default.GitConfig]
+		gitConfig, ok := getConfig().Git[getConfig().Default.GitConfig]
 		if !ok {
-			return "", fmt.Errorf("No Git config specified for: %s!", cfg.Default.GitConfig)
+			return "", fmt.Errorf("No Git config specified for: %s!", getConfig().Default.GitConfig)
 		}
 
-		if cg.gitClient, err = git.NewGitClient(gitConfig); err != nil {
+		if cg.gitClient, err = git.NewGitClientContext(cg.gitContext(), gitConfig); err != nil {
 			return "", fmt.Errorf("Failed to create Git client: %s", err)
 		}
 	}
 
-	msg := fmt.Sprintf("Config for %s %s %%s by Chef-Guard",
+	msg := fmt.Sprintf("Config for %s %s %%s",
 		strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
 		strings.TrimSuffix(cg.ChangeDetails.Item, ".json"),
 	)
+	if cg.ChangeDetails.Note != "" {
+		msg += fmt.Sprintf(" (%s)", cg.ChangeDetails.Note)
+	}
+	if cg.ClientIP != "" {
+		// Escape the zone of an IPv6 address, as the message is used as a format
+		msg += fmt.Sprintf(" from %s", strings.Replace(cg.ClientIP, "%", "%%", -1))
+	}
+	msg += " by Chef-Guard"
 	user := &git.User{
 		Name: cg.User,
 		Mail: fmt.Sprintf("%s@%s", cg.User, getEffectiveConfig("MailDomain", cg.ChefOrg).(string)),
 	}
 
-	path := fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item)
+	path := cg.gitPath(fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item))
 	file, dir, err := cg.gitClient.GetContent(cg.Repo, path)
 	if err != nil {
 		return "", err
@@ -108,13 +234,35 @@ func (cg *ChefGuard) writeConfigToGit(action string, config []byte) (string, err
 		}
 
 		msg = fmt.Sprintf(msg, "created")
-		return cg.gitClient.CreateFile(cg.Repo, path, msg, user, config)
+		branch, err := cg.changeBranch()
+		if err != nil {
+			return "", err
+		}
+		sha, err := cg.gitClient.CreateFile(cg.Repo, branch, path, signCommit(msg), user, config)
+		if err != nil {
+			return "", err
+		}
+		return sha, cg.openMergeRequest(branch, msg)
 	}
 
 	if file != nil {
 		if action == "DELETE" {
 			msg = fmt.Sprintf(msg, "deleted")
-			return cg.gitClient.DeleteFile(cg.Repo, path, file.SHA, msg, user)
+			branch, err := cg.changeBranch()
+			if err != nil {
+				return "", err
+			}
+			sha, err := cg.gitClient.DeleteFile(cg.Repo, branch, path, file.SHA, signCommit(msg), user)
+			if err != nil {
+				return "", err
+			}
+			if cg.ChangeDetails.Type == "cookbooks" {
+				items := map[string]string{cg.ChangeDetails.Item: file.SHA}
+				if err := cg.writeTombstone(branch, items, user); err != nil {
+					return "", err
+				}
+			}
+			return sha, cg.openMergeRequest(branch, msg)
 		}
 
 		if file.Content == string(config) {
@@ -122,19 +270,190 @@ func (cg *ChefGuard) writeConfigToGit(action string, config []byte) (string, err
 		}
 
 		msg = fmt.Sprintf(msg, "updated")
-		return cg.gitClient.UpdateFile(cg.Repo, path, file.SHA, msg, user, config)
+		branch, err := cg.changeBranch()
+		if err != nil {
+			return "", err
+		}
+		sha, err := cg.gitClient.UpdateFile(cg.Repo, branch, path, file.SHA, signCommit(msg), user, config)
+		if err != nil {
+			return "", err
+		}
+		return sha, cg.openMergeRequest(branch, msg)
 	}
 
 	if dir != nil && action == "DELETE" {
 		msg = fmt.Sprintf("Config for %s %%s deleted by Chef-Guard",
 			strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
 		)
-		return "master", cg.gitClient.DeleteDirectory(cg.Repo, msg, dir, user)
+		branch, err := cg.changeBranch()
+		if err != nil {
+			return "", err
+		}
+		sha, err := cg.gitClient.DeleteDirectory(cg.Repo, branch, signCommit(msg), dir, user)
+		if err != nil {
+			return "", err
+		}
+		if err := cg.writeTombstone(branch, dirItems(dir), user); err != nil {
+			return "", err
+		}
+		return sha, cg.openMergeRequest(branch, fmt.Sprintf(
+			"Config for %s %s deleted by Chef-Guard", cg.ChangeDetails.Type, cg.ChangeDetails.Item))
 	}
 
 	return "", fmt.Errorf("Unknown error while updating file or directory content of %s", path)
 }
 
+// Tombstone describes a deleted item and the last SHAs of its files
+type Tombstone struct {
+	Schema    string            `json:"schema" desc:"Schema ID of the event (tombstone/v1)"`
+	Type      string            `json:"type" desc:"Type of the deleted item (e.g. roles or cookbooks)"`
+	Name      string            `json:"name" desc:"Name of the deleted item"`
+	DeletedBy string            `json:"deleted_by" desc:"Chef user that deleted the item"`
+	DeletedAt time.Time         `json:"deleted_at" desc:"Time of the deletion in UTC"`
+	Items     map[string]string `json:"items" desc:"Deleted files mapped to their last SHA"`
+}
+
+// writeTombstone commits a manifest listing all deleted files and their last
+// SHAs, so the deletion itself can be reviewed without going through the
+// history of every single file
+func (cg *ChefGuard) writeTombstone(branch string, items map[string]string, user *git.User) error {
+	t := &Tombstone{
+		Schema:    tombstoneSchema,
+		Type:      cg.ChangeDetails.Type,
+		Name:      strings.TrimSuffix(cg.ChangeDetails.Item, ".json"),
+		DeletedBy: cg.User,
+		DeletedAt: time.Now().UTC(),
+		Items:     items,
+	}
+
+	manifest, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal tombstone of %s %s: %s", t.Type, t.Name, err)
+	}
+
+	p := cg.gitPath(fmt.Sprintf(".tombstones/%s/%s/%s.json",
+		t.Type, t.Name, t.DeletedAt.Format("20060102T150405Z")))
+	msg := fmt.Sprintf("Tombstone for %s %s deleted by Chef-Guard",
+		strings.TrimSuffix(t.Type, "s"), t.Name)
+
+	_, err = cg.gitClient.CreateFile(cg.Repo, branch, p, signCommit(msg), user, append(manifest, '\n'))
+	return err
+}
+
+// dirItems returns the names of all items in a directory mapped to their SHA
+func dirItems(dir interface{}) map[string]string {
+	items := make(map[string]string)
+	for _, f := range git.DirFiles(dir) {
+		items[strings.TrimSuffix(path.Base(f.Path), ".json")] = f.SHA
+	}
+	return items
+}
+
+// gitTargets caches the result of checking if the Git repo of an org can be
+// committed to, so we don't check (and alert) on every single request
+var gitTargets = struct {
+	sync.Mutex
+	m map[string]*gitTargetStatus
+}{m: make(map[string]*gitTargetStatus)}
+
+type gitTargetStatus struct {
+	err     error
+	checked time.Time
+}
+
+const gitTargetCheckInterval = 5 * time.Minute
+
+// checkGitTarget verifies that changes can actually be committed to Git and
+// sends an alert when that is no longer the case
+func (cg *ChefGuard) checkGitTarget() error {
+	gitTargets.Lock()
+	defer gitTargets.Unlock()
+
+	s, ok := gitTargets.m[cg.Repo]
+	if ok && time.Since(s.checked) < gitTargetCheckInterval {
+		return s.err
+	}
+
+	err := cg.verifyGitTarget()
+	if err != nil && (!ok || s.err == nil) {
+		cg.sendAlert(
+			fmt.Sprintf("Changes cannot be committed to Git repo %s", cg.Repo),
+			fmt.Sprintf("%s\n\nFailed changes are queued (when a queue is configured) until this is fixed.", err),
+		)
+	}
+	gitTargets.m[cg.Repo] = &gitTargetStatus{err: err, checked: time.Now()}
+
+	return err
+}
+
+func (cg *ChefGuard) verifyGitTarget() error {
+	gitConfig, ok := getConfig().Git[getConfig().Default.GitConfig]
+	if !ok {
+		return fmt.Errorf("No Git config specified for: %s!", getConfig().Default.GitConfig)
+	}
+	if cg.gitClient == nil {
+		var err error
+		if cg.gitClient, err = git.NewGitClientContext(cg.gitContext(), gitConfig); err != nil {
+			return fmt.Errorf("Failed to create Git client: %s", err)
+		}
+	}
+
+	exists, err := cg.gitClient.RepoExists(cg.Repo)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Git repo %s does not exist in %s", cg.Repo, gitConfig.Organization)
+	}
+
+	return nil
+}
+
+// gitPath returns the path of a file in the config repo. When using a
+// monorepo, all files are stored in a directory named after the organization.
+func (cg *ChefGuard) gitPath(p string) string {
+	if getConfig().Default.GitMonorepo == cg.Repo && cg.ChefOrg != "" {
+		return fmt.Sprintf("%s/%s", cg.ChefOrg, p)
+	}
+	return p
+}
+
+// changeBranch returns the branch the change should be committed to. When
+// ReviewChanges is enabled a new branch is created for every single change,
+// otherwise the change is committed directly to the master branch.
+func (cg *ChefGuard) changeBranch() (string, error) {
+	if !getEffectiveConfig("ReviewChanges", cg.ChefOrg).(bool) {
+		return "master", nil
+	}
+
+	branch := fmt.Sprintf("chef-guard/%s/%s-%d",
+		strings.TrimSuffix(cg.ChangeDetails.Type, "s"),
+		strings.TrimSuffix(cg.ChangeDetails.Item, ".json"),
+		time.Now().UnixNano(),
+	)
+	if err := cg.gitClient.CreateBranch(cg.Repo, branch); err != nil {
+		return "", err
+	}
+
+	return branch, nil
+}
+
+func (cg *ChefGuard) openMergeRequest(branch, title string) error {
+	if branch == "master" {
+		return nil
+	}
+
+	body := fmt.Sprintf("Change made by %s through Chef-Guard and waiting for review.", cg.User)
+	link, err := cg.gitClient.CreateMergeRequest(cg.Repo, branch, title, body)
+	if err != nil {
+		return err
+	}
+
+	logf(INFO, cg.RequestID, "Opened merge request for %s/%s: %s", cg.ChangeDetails.Type, cg.ChangeDetails.Item, link)
+
+	return nil
+}
+
 func (cg *ChefGuard) mailChanges(file, sha, action string) error {
 	if getEffectiveConfig("MailChanges", cg.ChefOrg).(bool) == false {
 		return nil
@@ -155,35 +474,50 @@ func (cg *ChefGuard) mailChanges(file, sha, action string) error {
 		subject = fmt.Sprintf("[%s CHEF] deleted %s", strings.ToUpper(cg.ChefOrg), file)
 	}
 
-	msg := createMessage(cg.Repo, cg.User, diff, subject)
+	to := cg.mailRecipients()
+	msg := createMessage(to, cg.User, cg.RequestID, diff, subject)
 	mail := getEffectiveConfig("MailSendBy", cg.ChefOrg).(string)
 	if mail == "" {
 		mail = fmt.Sprintf("%s@%s", cg.User, getEffectiveConfig("MailDomain", cg.ChefOrg).(string))
 	}
 
-	return mailDiff(cg.Repo, mail, msg)
+	return mailTo(cg.Repo, mail, to, msg)
 }
 
 func (cg *ChefGuard) getDiff(sha string) (string, error) {
 	var err error
 	if cg.gitClient == nil {
-		gitConfig, ok := cfg.Git[cfg.Default.GitConfig]
+		gitConfig, ok := getConfig().Git[getConfig().Default.GitConfig]
 		if !ok {
-			return "", fmt.Errorf("No Git config specified for: %s!", cfg.Default.GitConfig)
+			return "", fmt.Errorf("No Git config specified for: %s!", getConfig().Default.GitConfig)
 		}
 
-		if cg.gitClient, err = git.NewGitClient(gitConfig); err != nil {
+		if cg.gitClient, err = git.NewGitClientContext(cg.gitContext(), gitConfig); err != nil {
 			return "", fmt.Errorf("Failed to create Git client: %s", err)
 		}
 	}
 
-	return cg.gitClient.GetDiff(cg.Repo, cg.User, sha)
+	diff, date, err := cg.gitClient.GetDiff(cg.Repo, sha)
+	if err != nil || diff == "" {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("Commit : %s\nDate   : %s\nUser   : %s\n<br />%s",
+		sha,
+		formatTime(date),
+		cg.User,
+		redactDiff(cg.ChefOrg, diff),
+	)
+
+	return msg, nil
 }
 
-func createMessage(org, user, diff, subject string) string {
+func createMessage(to, user, id, diff, subject string) string {
 	start := fmt.Sprintf(`From: %s
 To: %s
+Date: %s
 Subject: %s
+X-Request-Id: %s
 MIME-version: 1.0
 Content-Type: text/html; charset="UTF-8"
 <html>
@@ -196,7 +530,7 @@ Content-Type: text/html; charset="UTF-8"
   #context {background-color:#eeeeee;}
 --></style>
 </head>
-<body>`, user, getEffectiveConfig("MailRecipient", org).(string), subject)
+<body>`, user, to, time.Now().Format(time.RFC1123Z), subject, orDash(id))
 
 	end := fmt.Sprint(`</body>
 </html>`)
@@ -218,6 +552,12 @@ Content-Type: text/html; charset="UTF-8"
 }
 
 func mailDiff(org, from, msg string) error {
+	return mailTo(org, from, getEffectiveConfig("MailRecipient", org).(string), msg)
+}
+
+// mailTo sends the message to all recipients (divided by a ',') using the
+// mail server of the org
+func mailTo(org, from, to, msg string) error {
 	host := getEffectiveConfig("MailServer", org).(string)
 	port := getEffectiveConfig("MailPort", org).(int)
 
@@ -226,7 +566,7 @@ func mailDiff(org, from, msg string) error {
 		return err
 	}
 	defer c.Close()
-	if err = c.Hello(cfg.Chef.Server); err != nil {
+	if err = c.Hello(getConfig().Chef.Server); err != nil {
 		return err
 	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
@@ -238,8 +578,10 @@ func mailDiff(org, from, msg string) error {
 	if err = c.Mail(from); err != nil {
 		return err
 	}
-	if err = c.Rcpt(getEffectiveConfig("MailRecipient", org).(string)); err != nil {
-		return err
+	for _, rcpt := range splitList(to) {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
 	}
 	w, err := c.Data()
 	if err != nil {
@@ -256,8 +598,8 @@ func mailDiff(org, from, msg string) error {
 	return c.Quit()
 }
 
-func searchGitForCookbook(gitConfig, repo, tag string, taggedOnly bool) (*url.URL, bool, error) {
-	gitClient, err := getCustomClient(gitConfig)
+func searchGitForCookbook(ctx context.Context, gitConfig, repo, tag string, taggedOnly bool) (*url.URL, bool, error) {
+	gitClient, err := getCustomClientContext(ctx, gitConfig)
 	if err != nil {
 		return nil, false, fmt.Errorf("Failed to create custom Git client: %s", err)
 	}
@@ -273,7 +615,9 @@ func searchGitForCookbook(gitConfig, repo, tag string, taggedOnly bool) (*url.UR
 	}
 
 	if !tagged {
-		tag = "master"
+		if tag = fallbackRef(gitConfig); tag == "none" {
+			return nil, tagged, nil
+		}
 	}
 
 	// Get the archive link for the tagged version or master
@@ -285,13 +629,21 @@ func searchGitForCookbook(gitConfig, repo, tag string, taggedOnly bool) (*url.UR
 	return link, tagged, nil
 }
 
-func tagCookbook(gitConfig, cookbook, tag, user, mail string) error {
+// fallbackRef returns the ref that is used when a version is not tagged
+func fallbackRef(gitConfig string) string {
+	if gc, ok := getConfig().Git[gitConfig]; ok && gc.FallbackRef != "" {
+		return gc.FallbackRef
+	}
+	return "master"
+}
+
+func tagCookbook(gitConfig, repo, tag, user, mail string) error {
 	gitClient, err := getCustomClient(gitConfig)
 	if err != nil {
 		return fmt.Errorf("Failed to create custom Git client: %s", err)
 	}
 
-	exists, err := gitClient.TagExists(cookbook, tag)
+	exists, err := gitClient.TagExists(repo, tag)
 	if exists || err != nil {
 		return err
 	}
@@ -301,28 +653,72 @@ func tagCookbook(gitConfig, cookbook, tag, user, mail string) error {
 		Mail: mail,
 	}
 
-	return gitClient.TagRepo(cookbook, tag, usr)
+	return gitClient.TagRepo(repo, tag, fallbackRef(gitConfig), usr)
 }
 
-func untagCookbook(gitConfig, cookbook, tag string) error {
+func untagCookbook(gitConfig, repo, tag string) error {
 	gitClient, err := getCustomClient(gitConfig)
 	if err != nil {
 		return fmt.Errorf("Failed to create custom Git client: %s", err)
 	}
 
-	return gitClient.UntagRepo(cookbook, tag)
+	return gitClient.UntagRepo(repo, tag)
+}
+
+// untagDeletedCookbook removes the tag of a deleted cookbook version from
+// the Git repo of the cookbook
+func (cg *ChefGuard) untagDeletedCookbook(name, version string) {
+	src := sourceOfCookbook(cg.ChefOrg, name)
+	tag := src.tag(version)
+	for _, gitConfig := range src.gitConfigs {
+		gitConfig = strings.TrimSpace(gitConfig)
+		gitClient, err := getCustomClientContext(cg.gitContext(), gitConfig)
+		if err != nil {
+			logf(ERROR, cg.RequestID, "Failed to create custom Git client: %s", err)
+			continue
+		}
+
+		exists, err := gitClient.TagExists(src.repo, tag)
+		if err != nil {
+			logf(ERROR, cg.RequestID, "Failed to check tag %s of cookbook %s: %s", tag, name, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		if err := gitClient.UntagRepo(src.repo, tag); err != nil {
+			logf(ERROR, cg.RequestID, "Failed to remove tag %s of deleted cookbook %s: %s", tag, name, err)
+			continue
+		}
+		logf(INFO, cg.RequestID, "Removed tag %s of deleted cookbook %s from %s", tag, name, gitConfig)
+		return
+	}
 }
 
 func getCustomClient(gitConfig string) (git.Git, error) {
-	gc, ok := cfg.Git[gitConfig]
+	return getCustomClientContext(context.Background(), gitConfig)
+}
+
+// getCustomClientContext returns a Git client of which all calls are
+// canceled when the context is done
+func getCustomClientContext(ctx context.Context, gitConfig string) (git.Git, error) {
+	gc, ok := getConfig().Git[gitConfig]
 	if !ok {
 		return nil, fmt.Errorf("No Git config specified for: %s!", gitConfig)
 	}
 
-	return git.NewGitClient(gc)
+	return git.NewGitClientContext(git.WithRequestID(ctx, requestIDFromContext(ctx)), gc)
 }
 
-func remarshalConfig(action string, data []byte) ([]byte, error) {
+// gitContext returns the context used for the Git calls made for the
+// request. It is not bound to the request itself, as most Git updates are
+// done after the request is answered.
+func (cg *ChefGuard) gitContext() context.Context {
+	return withRequestID(context.Background(), cg.RequestID)
+}
+
+func remarshalConfig(org, action string, data []byte) ([]byte, error) {
 	// If the action is DELETE, there is no body to remarshal
 	if action == "DELETE" {
 		data = append(data, []byte("\n")...)
@@ -336,6 +732,12 @@ func remarshalConfig(action string, data []byte) ([]byte, error) {
 	if _, found := config["automatic"]; found {
 		delete(config, "automatic")
 	}
+	if config["chef_type"] == "node" {
+		for _, p := range splitList(getEffectiveConfig("ExcludeAttributes", org).(string)) {
+			deleteAttribute(config, strings.Split(p, "."))
+		}
+	}
+	redactValues(config, redactPatterns(org))
 	c, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return nil, err
@@ -344,6 +746,17 @@ func remarshalConfig(action string, data []byte) ([]byte, error) {
 	return decodeMarshalledJSON(c), nil
 }
 
+// deleteAttribute removes the attribute at the given path (e.g. normal.packages)
+func deleteAttribute(attrs map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(attrs, path[0])
+		return
+	}
+	if child, ok := attrs[path[0]].(map[string]interface{}); ok {
+		deleteAttribute(child, path[1:])
+	}
+}
+
 func decodeMarshalledJSON(b []byte) []byte {
 	r := strings.NewReplacer(`\u003c`, `<`, `\u003e`, `>`, `\u0026`, `&`)
 	s := r.Replace(string(b))
@@ -17,6 +17,7 @@
 package git
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -43,29 +44,54 @@ var insecureTransport = &http.Transport{
 // Git is an interface that must be implemented by any git service
 // that can be used with Chef-Guard
 type Git interface {
+	// RepoExists returns true if the repo exists
+	RepoExists(string) (bool, error)
+
+	// CreateRepo creates a new (private) repo with an initial commit
+	CreateRepo(string, *User) error
+
+	// ArchiveRepo archives a repo, making it read-only
+	ArchiveRepo(string) error
+
 	// GetContents retrieves file and/or directory contents from git
 	GetContent(string, string) (*File, interface{}, error)
 
+	// CreateBranch creates a new branch from the master branch
+	CreateBranch(string, string) error
+
 	// CreateFile creates a new repository file
-	CreateFile(string, string, string, *User, []byte) (string, error)
+	CreateFile(string, string, string, string, *User, []byte) (string, error)
 
 	// UpdateFile updates a repository file
-	UpdateFile(string, string, string, string, *User, []byte) (string, error)
+	UpdateFile(string, string, string, string, string, *User, []byte) (string, error)
 
 	// DeleteFile deletes a repository file
-	DeleteFile(string, string, string, string, *User) (string, error)
+	DeleteFile(string, string, string, string, string, *User) (string, error)
+
+	// CommitFiles creates or updates multiple files in a single commit
+	CommitFiles(string, string, string, *User, map[string][]byte) (string, error)
 
 	// DeleteDirectory deletes a repository directory including all content
-	DeleteDirectory(string, string, interface{}, *User) error
+	// and returns the SHA of the last commit
+	DeleteDirectory(string, string, string, interface{}, *User) (string, error)
+
+	// CreateMergeRequest opens a pull or merge request and returns its URL
+	CreateMergeRequest(string, string, string, string) (string, error)
 
-	// GetDiff returns the diff and committer details
-	GetDiff(string, string, string) (string, error)
+	// GetDiff returns the diff and the date of a commit
+	GetDiff(string, string) (string, time.Time, error)
 
 	// GetArchiveLink returns a download link for the repo/tag combo
 	GetArchiveLink(string, string) (*url.URL, error)
 
-	// TagRepo creates a new tag on a project
-	TagRepo(string, string, *User) error
+	// GetFileAtRef retrieves the content of a file at a specific ref
+	GetFileAtRef(string, string, string) (*File, error)
+
+	// ListTags returns the names of all tags of a repo
+	ListTags(string) ([]string, error)
+
+	// TagRepo creates a new tag on the head of a branch of a project
+	TagRepo(string, string, string, *User) error
 
 	// TagExists returns true if the tag exists
 	TagExists(string, string) (bool, error)
@@ -74,6 +100,38 @@ type Git interface {
 	UntagRepo(string, string) error
 }
 
+// Error is returned when the Git service answered a call with an error
+// response, so callers can tell permanent failures from transient ones
+type Error struct {
+	StatusCode int
+	err        error
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+// Transient returns true if the call might succeed when it is tried again
+func (e *Error) Transient() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	default:
+		return e.StatusCode >= 500
+	}
+}
+
+// IsTransient returns false if err is an error response of the Git service
+// that will be the same when the call is tried again (e.g. a 404), and true
+// for any other error (e.g. a connection error)
+func IsTransient(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Transient()
+	}
+	return true
+}
+
 // User represents the user that is making the change
 type User struct {
 	Name string
@@ -94,12 +152,24 @@ type Config struct {
 	ServerURL    string
 	SSLNoVerify  bool
 	Token        string
+
+	AppID          int64
+	InstallationID int64
+	PrivateKey     string
+
+	RateLimitReserve int
+
+	SigningKey    string
+	SigningFormat string
+
+	FallbackRef string
 }
 
 // GitHub represents a GitHub client
 type GitHub struct {
 	client *github.Client
 	org    string
+	signer *signer
 }
 
 // GitLab represents a GitLab client
@@ -109,29 +179,112 @@ type GitLab struct {
 	token  string
 }
 
+// DirFiles returns the path and SHA of all entries of a directory returned
+// by GetContent, regardless of the type of Git service
+func DirFiles(dir interface{}) []*File {
+	switch d := dir.(type) {
+	case []*github.RepositoryContent:
+		var files []*File
+		for _, c := range d {
+			files = append(files, &File{Path: c.GetPath(), SHA: c.GetSHA()})
+		}
+		return files
+	case []*File:
+		return d
+	default:
+		return nil
+	}
+}
+
+// DirEntries returns the paths of all entries of a directory returned by
+// GetContent, regardless of the type of Git service
+func DirEntries(dir interface{}) []string {
+	var paths []string
+	for _, f := range DirFiles(dir) {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
 // NewGitClient returns either a GitHub or GitLab client as Git interface
 func NewGitClient(c *Config) (Git, error) {
+	return NewGitClientContext(context.Background(), c)
+}
+
+// NewGitClientContext returns either a GitHub or GitLab client as Git
+// interface, of which all calls are canceled when the context is done
+func NewGitClientContext(ctx context.Context, c *Config) (Git, error) {
 	switch c.Type {
 	case "github":
-		return newGitHubClient(c)
+		return newGitHubClient(ctx, c)
 	case "gitlab":
-		return newGitLabClient(c)
+		return newGitLabClient(ctx, c)
 	default:
 		return nil, fmt.Errorf("Unknown Git type: %q", c.Type)
 	}
 }
 
-func newGitHubClient(c *Config) (Git, error) {
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context carrying a request ID, which
+// is forwarded as X-Request-Id header with every call to the Git server
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// contextTransport binds all requests to a context, as the Git packages
+// don't take a context for every call
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(t.ctx)
+	if id, ok := t.ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		// WithContext returns a shallow copy, so copy the headers as well
+		header := make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			header[k] = v
+		}
+		header.Set("X-Request-Id", id)
+		req.Header = header
+	}
+	return t.base.RoundTrip(req)
+}
+
+func newGitHubClient(ctx context.Context, c *Config) (Git, error) {
+	var base http.RoundTripper = http.DefaultTransport
+	if c.SSLNoVerify {
+		base = insecureTransport
+	}
+
+	source := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.Token})
+
+	// When configured, authenticate as a GitHub App instead of using a token
+	var appSource *appTokenSource
+	if c.AppID != 0 {
+		var err error
+		if appSource, err = newAppTokenSource(c, base); err != nil {
+			return nil, err
+		}
+		source = appSource
+	}
+
 	client := &http.Client{
 		Transport: &oauth2.Transport{
-			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.Token}),
+			Source: source,
+			Base:   base,
 		},
 	}
-
-	if c.SSLNoVerify {
-		client.Transport.(*oauth2.Transport).Base = insecureTransport
+	if appSource != nil {
+		client.Transport = &appAuthTransport{base: client.Transport, source: appSource}
 	}
 
+	client.Transport = newRateLimitTransport(client.Transport, c.Organization, c.RateLimitReserve)
+	client.Transport = &contextTransport{ctx: ctx, base: client.Transport}
+
 	g := new(GitHub)
 	g.client = github.NewClient(client)
 
@@ -147,16 +300,27 @@ func newGitHubClient(c *Config) (Git, error) {
 
 	g.org = c.Organization
 
+	signer, err := newSigner(c)
+	if err != nil {
+		return nil, err
+	}
+	g.signer = signer
+
 	return g, nil
 }
 
-func newGitLabClient(c *Config) (Git, error) {
-	client := http.DefaultClient
+func newGitLabClient(ctx context.Context, c *Config) (Git, error) {
+	if c.SigningKey != "" {
+		return nil, fmt.Errorf("Signing commits and tags is not supported for GitLab")
+	}
 
+	var base http.RoundTripper = http.DefaultTransport
 	if c.SSLNoVerify {
-		client = &http.Client{Transport: insecureTransport}
+		base = insecureTransport
 	}
 
+	client := &http.Client{Transport: &contextTransport{ctx: ctx, base: base}}
+
 	g := &GitLab{token: c.Token}
 	g.client = gitlab.NewClient(client, c.Token)
 
@@ -166,7 +330,7 @@ func newGitLabClient(c *Config) (Git, error) {
 		}
 	}
 
-	g.group = c.Organization
+	g.group = strings.Trim(c.Organization, "/")
 
 	return g, nil
 }
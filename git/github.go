@@ -19,11 +19,13 @@ package git
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-github/github"
 )
@@ -32,6 +34,73 @@ const (
 	invalidGitHubToken = "The token configured for GitHub organization %s is not valid!"
 )
 
+// RepoExists implements the Git interface
+func (g *GitHub) RepoExists(repo string) (bool, error) {
+	_, resp, err := g.client.Repositories.Get(context.TODO(), g.org, repo)
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound:
+				return false, nil
+			case http.StatusUnauthorized:
+				return false, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+			}
+		}
+		return false, githubError(resp, fmt.Errorf("Error retrieving repo %s: %v", repo, err))
+	}
+
+	return true, nil
+}
+
+// githubError returns err as an *Error when GitHub answered the call. An
+// exceeded rate limit is returned as a transient 429 error, as GitHub uses a
+// 403 for it.
+func githubError(resp *github.Response, err error) error {
+	if resp == nil || resp.Response == nil {
+		return err
+	}
+	code := resp.StatusCode
+	if code == http.StatusForbidden && (resp.Rate.Remaining == 0 || resp.Header.Get("Retry-After") != "") {
+		code = http.StatusTooManyRequests
+	}
+	return &Error{StatusCode: code, err: err}
+}
+
+// CreateRepo implements the Git interface
+func (g *GitHub) CreateRepo(repo string, usr *User) error {
+	r := &github.Repository{
+		Name:     github.String(repo),
+		Private:  github.Bool(true),
+		AutoInit: github.Bool(true),
+	}
+	_, resp, err := g.client.Repositories.Create(context.TODO(), g.org, r)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return githubError(resp, fmt.Errorf("Error creating repo %s: %v", repo, err))
+	}
+
+	return nil
+}
+
+// ArchiveRepo implements the Git interface
+func (g *GitHub) ArchiveRepo(repo string) error {
+	r := &github.Repository{
+		Name:     github.String(repo),
+		Archived: github.Bool(true),
+	}
+	_, resp, err := g.client.Repositories.Edit(context.TODO(), g.org, repo, r)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return githubError(resp, fmt.Errorf("Error archiving repo %s: %v", repo, err))
+	}
+
+	return nil
+}
+
 // GetContent implements the Git interface
 func (g *GitHub) GetContent(repo, path string) (*File, interface{}, error) {
 	file, dir, resp, err := g.client.Repositories.GetContents(context.TODO(), g.org, repo, path, nil)
@@ -41,10 +110,10 @@ func (g *GitHub) GetContent(repo, path string) (*File, interface{}, error) {
 			case http.StatusNotFound:
 				return nil, nil, nil
 			case http.StatusUnauthorized:
-				return nil, nil, fmt.Errorf(invalidGitHubToken, g.org)
+				return nil, nil, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 			}
 		}
-		return nil, nil, fmt.Errorf("Error retrieving file %s: %v", path, err)
+		return nil, nil, githubError(resp, fmt.Errorf("Error retrieving file %s: %v", path, err))
 	}
 
 	if dir != nil {
@@ -64,93 +133,341 @@ func (g *GitHub) GetContent(repo, path string) (*File, interface{}, error) {
 	return f, nil, nil
 }
 
+// CreateBranch implements the Git interface
+func (g *GitHub) CreateBranch(repo, branch string) error {
+	master, resp, err := g.client.Git.GetRef(context.TODO(), g.org, repo, "heads/master")
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return githubError(resp, fmt.Errorf("Error retrieving master branch of repo %s: %v", repo, err))
+	}
+
+	refBranch := fmt.Sprintf("refs/heads/%s", branch)
+	ref := &github.Reference{
+		Ref:    &refBranch,
+		Object: &github.GitObject{SHA: master.Object.SHA},
+	}
+	if _, resp, err = g.client.Git.CreateRef(context.TODO(), g.org, repo, ref); err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return githubError(resp, fmt.Errorf("Error creating branch %s for repo %s: %v", branch, repo, err))
+	}
+
+	return nil
+}
+
 // CreateFile implements the Git interface
-func (g *GitHub) CreateFile(repo, path, msg string, usr *User, content []byte) (string, error) {
+func (g *GitHub) CreateFile(repo, branch, path, msg string, usr *User, content []byte) (string, error) {
+	if g.signer != nil {
+		return g.signedCommit(repo, branch, path, msg, usr, content)
+	}
+
 	opts := &github.RepositoryContentFileOptions{}
 	opts.Committer = &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail}
 	opts.Content = content
 	opts.Message = &msg
+	opts.Branch = &branch
 
 	r, resp, err := g.client.Repositories.CreateFile(context.TODO(), g.org, repo, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitHubToken, g.org)
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return "", fmt.Errorf("Error creating file %s: %v", path, err)
+		return "", githubError(resp, fmt.Errorf("Error creating file %s: %v", path, err))
 	}
 
 	return *r.SHA, nil
 }
 
 // UpdateFile implements the Git interface
-func (g *GitHub) UpdateFile(repo, path, sha, msg string, usr *User, content []byte) (string, error) {
+func (g *GitHub) UpdateFile(repo, branch, path, sha, msg string, usr *User, content []byte) (string, error) {
+	if g.signer != nil {
+		return g.signedCommit(repo, branch, path, msg, usr, content)
+	}
+
 	opts := &github.RepositoryContentFileOptions{}
 	opts.Committer = &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail}
 	opts.Content = content
 	opts.Message = &msg
 	opts.SHA = &sha
+	opts.Branch = &branch
 
 	r, resp, err := g.client.Repositories.UpdateFile(context.TODO(), g.org, repo, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitHubToken, g.org)
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return "", fmt.Errorf("Error updating file %s: %v", path, err)
+		return "", githubError(resp, fmt.Errorf("Error updating file %s: %v", path, err))
 	}
 
 	return *r.SHA, nil
 }
 
 // DeleteFile implements the Git interface
-func (g *GitHub) DeleteFile(repo, path, sha, msg string, usr *User) (string, error) {
+func (g *GitHub) DeleteFile(repo, branch, path, sha, msg string, usr *User) (string, error) {
+	if g.signer != nil {
+		return g.signedCommit(repo, branch, path, msg, usr, nil)
+	}
+
 	opts := &github.RepositoryContentFileOptions{}
 	opts.Committer = &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail}
 	opts.Message = &msg
 	opts.SHA = &sha
+	opts.Branch = &branch
 
 	r, resp, err := g.client.Repositories.DeleteFile(context.TODO(), g.org, repo, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitHubToken, g.org)
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return "", fmt.Errorf("Error deleting file %s: %v", path, err)
+		return "", githubError(resp, fmt.Errorf("Error deleting file %s: %v", path, err))
 	}
 
 	return *r.SHA, nil
 }
 
 // DeleteDirectory implements the Git interface
-func (g *GitHub) DeleteDirectory(repo, msg string, dir interface{}, usr *User) error {
+func (g *GitHub) DeleteDirectory(repo, branch, msg string, dir interface{}, usr *User) (string, error) {
 	opts := &github.RepositoryContentFileOptions{}
 	opts.Committer = &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail}
+	opts.Branch = &branch
 
+	var sha string
 	for _, file := range dir.([]*github.RepositoryContent) {
 		// Need a special case for when deleting data bag items
-		fn := strings.TrimPrefix(*file.Path, "data_bags/")
+		fn := *file.Path
+		if i := strings.Index(fn, "data_bags/"); i >= 0 {
+			fn = fn[i+len("data_bags/"):]
+		}
 		msg := fmt.Sprintf(msg, strings.TrimSuffix(fn, ".json"))
 
 		opts.Message = &msg
 		opts.SHA = file.SHA
 
-		_, resp, err := g.client.Repositories.DeleteFile(context.TODO(), g.org, repo, *file.Path, opts)
+		if g.signer != nil {
+			var err error
+			if sha, err = g.signedCommit(repo, branch, *file.Path, msg, usr, nil); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		r, resp, err := g.client.Repositories.DeleteFile(context.TODO(), g.org, repo, *file.Path, opts)
 		if err != nil {
 			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-				return fmt.Errorf(invalidGitHubToken, g.org)
+				return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 			}
-			return fmt.Errorf("Error deleting file %s: %v", *file.Path, err)
+			return "", githubError(resp, fmt.Errorf("Error deleting file %s: %v", *file.Path, err))
 		}
+		sha = *r.SHA
 	}
 
-	return nil
+	return sha, nil
+}
+
+// signedCommit creates, updates (when content is not nil) or deletes (when
+// content is nil) a single file using the low level Git Data API, as that is
+// the only API that allows us to add a signature to the commit.
+func (g *GitHub) signedCommit(repo, branch, path, msg string, usr *User, content []byte) (string, error) {
+	ref, resp, err := g.client.Git.GetRef(context.TODO(), g.org, repo, "heads/"+branch)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return "", githubError(resp, fmt.Errorf("Error retrieving branch %s of repo %s: %v", branch, repo, err))
+	}
+	parent := ref.Object.GetSHA()
+
+	commit, _, err := g.client.Git.GetCommit(context.TODO(), g.org, repo, parent)
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving commit %s: %v", parent, err)
+	}
+
+	var tree *github.Tree
+	if content != nil {
+		entry := github.TreeEntry{
+			Path:    &path,
+			Mode:    github.String("100644"),
+			Type:    github.String("blob"),
+			Content: github.String(string(content)),
+		}
+		tree, _, err = g.client.Git.CreateTree(context.TODO(), g.org, repo, commit.Tree.GetSHA(), []github.TreeEntry{entry})
+	} else {
+		tree, err = g.deleteFromTree(repo, commit.Tree.GetSHA(), path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error creating tree for %s: %v", path, err)
+	}
+
+	return g.commitTree(repo, ref, tree.GetSHA(), msg, usr)
+}
+
+// deleteFromTree creates a new tree on top of the base tree without the file.
+// The entry of the file is removed by passing a null SHA, which cannot be
+// expressed using github.TreeEntry, so the request is build by hand.
+func (g *GitHub) deleteFromTree(repo, baseTree, path string) (*github.Tree, error) {
+	body := &struct {
+		BaseTree string                   `json:"base_tree"`
+		Entries  []map[string]interface{} `json:"tree"`
+	}{
+		BaseTree: baseTree,
+		Entries: []map[string]interface{}{{
+			"path": path,
+			"mode": "100644",
+			"type": "blob",
+			"sha":  nil,
+		}},
+	}
+
+	req, err := g.client.NewRequest("POST", fmt.Sprintf("repos/%v/%v/git/trees", g.org, repo), body)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new tree request: %v", err)
+	}
+
+	tree := new(github.Tree)
+	if _, err := g.client.Do(context.TODO(), req, tree); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// commitTree creates a (signed) commit for the tree on top of the branch ref
+// and moves the branch to the new commit
+func (g *GitHub) commitTree(repo string, ref *github.Reference, tree, msg string, usr *User) (string, error) {
+	parent := ref.Object.GetSHA()
+
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	t := time.Now().UTC().Truncate(time.Second)
+	author := &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail, Date: &t}
+
+	var c *github.Commit
+	if g.signer != nil {
+		sig, err := g.signer.signCommit(tree, parent, msg, usr, t)
+		if err != nil {
+			return "", err
+		}
+
+		body := &struct {
+			Message   string               `json:"message"`
+			Tree      string               `json:"tree"`
+			Parents   []string             `json:"parents"`
+			Author    *github.CommitAuthor `json:"author"`
+			Committer *github.CommitAuthor `json:"committer"`
+			Signature string               `json:"signature"`
+		}{msg, tree, []string{parent}, author, author, sig}
+
+		req, err := g.client.NewRequest("POST", fmt.Sprintf("repos/%v/%v/git/commits", g.org, repo), body)
+		if err != nil {
+			return "", fmt.Errorf("Error creating new commit request: %v", err)
+		}
+
+		c = new(github.Commit)
+		if _, err := g.client.Do(context.TODO(), req, c); err != nil {
+			return "", fmt.Errorf("Error creating signed commit in repo %s: %v", repo, err)
+		}
+	} else {
+		var err error
+		c, _, err = g.client.Git.CreateCommit(context.TODO(), g.org, repo, &github.Commit{
+			Message:   &msg,
+			Tree:      &github.Tree{SHA: &tree},
+			Parents:   []github.Commit{{SHA: &parent}},
+			Author:    author,
+			Committer: author,
+		})
+		if err != nil {
+			return "", fmt.Errorf("Error creating commit in repo %s: %v", repo, err)
+		}
+	}
+
+	ref.Object.SHA = c.SHA
+	if _, _, err := g.client.Git.UpdateRef(context.TODO(), g.org, repo, ref, false); err != nil {
+		return "", fmt.Errorf("Error updating ref %s of repo %s: %v", ref.GetRef(), repo, err)
+	}
+
+	return c.GetSHA(), nil
+}
+
+// CommitFiles implements the Git interface
+func (g *GitHub) CommitFiles(repo, branch, msg string, usr *User, files map[string][]byte) (string, error) {
+	ref, resp, err := g.client.Git.GetRef(context.TODO(), g.org, repo, "heads/"+branch)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return "", githubError(resp, fmt.Errorf("Error retrieving branch %s of repo %s: %v", branch, repo, err))
+	}
+
+	commit, _, err := g.client.Git.GetCommit(context.TODO(), g.org, repo, ref.Object.GetSHA())
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving commit %s: %v", ref.Object.GetSHA(), err)
+	}
+
+	var entries []github.TreeEntry
+	for path, content := range files {
+		entry := github.TreeEntry{
+			Path: github.String(path),
+			Mode: github.String("100644"),
+			Type: github.String("blob"),
+		}
+
+		// Binary files cannot be send inline, so create a blob for them first
+		if utf8.Valid(content) {
+			entry.Content = github.String(string(content))
+		} else {
+			blob, _, err := g.client.Git.CreateBlob(context.TODO(), g.org, repo, &github.Blob{
+				Content:  github.String(base64.StdEncoding.EncodeToString(content)),
+				Encoding: github.String("base64"),
+			})
+			if err != nil {
+				return "", fmt.Errorf("Error creating blob for %s: %v", path, err)
+			}
+			entry.SHA = blob.SHA
+		}
+
+		entries = append(entries, entry)
+	}
+
+	tree, _, err := g.client.Git.CreateTree(context.TODO(), g.org, repo, commit.Tree.GetSHA(), entries)
+	if err != nil {
+		return "", fmt.Errorf("Error creating tree in repo %s: %v", repo, err)
+	}
+
+	return g.commitTree(repo, ref, tree.GetSHA(), msg, usr)
+}
+
+// CreateMergeRequest implements the Git interface
+func (g *GitHub) CreateMergeRequest(repo, branch, title, body string) (string, error) {
+	pr := &github.NewPullRequest{
+		Title: &title,
+		Head:  &branch,
+		Base:  github.String("master"),
+		Body:  &body,
+	}
+
+	r, resp, err := g.client.PullRequests.Create(context.TODO(), g.org, repo, pr)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return "", githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+		}
+		return "", githubError(resp, fmt.Errorf("Error creating pull request for branch %s: %v", branch, err))
+	}
+
+	return r.GetHTMLURL(), nil
 }
 
 // GetDiff implements the Git interface
-func (g *GitHub) GetDiff(repo, user, sha string) (string, error) {
+func (g *GitHub) GetDiff(repo, sha string) (string, time.Time, error) {
 	u := fmt.Sprintf("repos/%v/%v/commits/%v", g.org, repo, sha)
 
 	req, err := g.client.NewRequest("GET", u, nil)
 	if err != nil {
-		return "", fmt.Errorf("Error creating new diff request: %v", err)
+		return "", time.Time{}, fmt.Errorf("Error creating new diff request: %v", err)
 	}
 	req.Header.Set("Accept", "application/vnd.github.V3.diff")
 
@@ -158,26 +475,21 @@ func (g *GitHub) GetDiff(repo, user, sha string) (string, error) {
 	resp, err := g.client.Do(context.TODO(), req, &diff)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitHubToken, g.org)
+			return "", time.Time{}, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return "", fmt.Errorf("Error retrieving commit %s: %v", sha, err)
+		return "", time.Time{}, githubError(resp, fmt.Errorf("Error retrieving commit %s: %v", sha, err))
 	}
 
 	if diff.Len() == 0 {
-		return "", nil
+		return "", time.Time{}, nil
 	}
 
-	const layout = "Mon Jan 2 3:04 2006"
-	t := time.Now()
-
-	msg := fmt.Sprintf("Commit : %s\nDate   : %s\nUser   : %s\n<br />%s",
-		sha,
-		t.Format(layout),
-		user,
-		diff.String(),
-	)
+	commit, _, err := g.client.Git.GetCommit(context.TODO(), g.org, repo, sha)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error retrieving commit %s: %v", sha, err)
+	}
 
-	return msg, nil
+	return diff.String(), commit.GetCommitter().GetDate(), nil
 }
 
 // GetArchiveLink implements the Git interface
@@ -190,35 +502,103 @@ func (g *GitHub) GetArchiveLink(repo, tag string) (*url.URL, error) {
 			case http.StatusNotFound:
 				return nil, nil
 			case http.StatusUnauthorized:
-				return nil, fmt.Errorf(invalidGitHubToken, g.org)
+				return nil, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 			}
 		}
-		return nil, fmt.Errorf("Error retrieving archive link of repo %s: %v", repo, err)
+		return nil, githubError(resp, fmt.Errorf("Error retrieving archive link of repo %s: %v", repo, err))
 	}
 
 	return link, nil
 }
 
+// GetFileAtRef implements the Git interface
+func (g *GitHub) GetFileAtRef(repo, path, ref string) (*File, error) {
+	file, _, resp, err := g.client.Repositories.GetContents(context.TODO(), g.org, repo, path,
+		&github.RepositoryContentGetOptions{Ref: ref})
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound:
+				return nil, nil
+			case http.StatusUnauthorized:
+				return nil, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+			}
+		}
+		return nil, githubError(resp, fmt.Errorf("Error retrieving file %s at %s: %v", path, ref, err))
+	}
+	if file == nil {
+		return nil, nil
+	}
+
+	conf, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding file %s: %v", path, err)
+	}
+
+	return &File{Content: conf, SHA: file.GetSHA()}, nil
+}
+
+// ListTags implements the Git interface
+func (g *GitHub) ListTags(repo string) ([]string, error) {
+	var tags []string
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		list, resp, err := g.client.Repositories.ListTags(context.TODO(), g.org, repo, opts)
+		if err != nil {
+			if resp != nil {
+				switch resp.StatusCode {
+				case http.StatusNotFound:
+					return nil, nil
+				case http.StatusUnauthorized:
+					return nil, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
+				}
+			}
+			return nil, githubError(resp, fmt.Errorf("Error retrieving tags of repo %s: %v", repo, err))
+		}
+		for _, t := range list {
+			tags = append(tags, t.GetName())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return tags, nil
+}
+
 // TagRepo implements the Git interface
-func (g *GitHub) TagRepo(repo, tag string, usr *User) error {
-	master, resp, err := g.client.Git.GetRef(context.TODO(), g.org, repo, "heads/master")
+func (g *GitHub) TagRepo(repo, tag, branch string, usr *User) error {
+	head, resp, err := g.client.Git.GetRef(context.TODO(), g.org, repo, "heads/"+branch)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf(invalidGitHubToken, g.org)
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return fmt.Errorf("Error retrieving tags of repo %s: %v", repo, err)
+		return githubError(resp, fmt.Errorf("Error retrieving tags of repo %s: %v", repo, err))
 	}
 
 	message := fmt.Sprint("Tagged by Chef-Guard\n")
-	ghTag := &github.Tag{Tag: &tag, Message: &message, Object: master.Object}
+	ghTag := &github.Tag{Tag: &tag, Message: &message, Object: head.Object}
 	ghTag.Tagger = &github.CommitAuthor{Name: &usr.Name, Email: &usr.Mail}
 
+	if g.signer != nil {
+		// A signed tag is a regular tag with the signature appended to the message
+		t := time.Now().UTC().Truncate(time.Second)
+		sig, err := g.signer.signTag(head.Object.GetSHA(), tag, message, usr, t)
+		if err != nil {
+			return err
+		}
+		message += sig
+		ghTag.Tagger.Date = &t
+	}
+
 	tagObject, resp, err := g.client.Git.CreateTag(context.TODO(), g.org, repo, ghTag)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf(invalidGitHubToken, g.org)
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return fmt.Errorf("Error creating tag for repo %s: %v", repo, err)
+		return githubError(resp, fmt.Errorf("Error creating tag for repo %s: %v", repo, err))
 	}
 
 	refTag := fmt.Sprintf("tags/%s", tag)
@@ -245,10 +625,10 @@ func (g *GitHub) TagExists(repo, tag string) (bool, error) {
 			case http.StatusNotFound:
 				return false, nil
 			case http.StatusUnauthorized:
-				return false, fmt.Errorf(invalidGitHubToken, g.org)
+				return false, githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 			}
 		}
-		return false, fmt.Errorf("Error retrieving tags of repo %s: %v", repo, err)
+		return false, githubError(resp, fmt.Errorf("Error retrieving tags of repo %s: %v", repo, err))
 	}
 
 	return true, nil
@@ -261,9 +641,9 @@ func (g *GitHub) UntagRepo(repo, tag string) error {
 	resp, err := g.client.Git.DeleteRef(context.TODO(), g.org, repo, ref)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf(invalidGitHubToken, g.org)
+			return githubError(resp, fmt.Errorf(invalidGitHubToken, g.org))
 		}
-		return fmt.Errorf("Error deleting tag %s: %v", tag, err)
+		return githubError(resp, fmt.Errorf("Error deleting tag %s: %v", tag, err))
 	}
 
 	return nil
@@ -0,0 +1,234 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package git
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// appTokenSources caches a token source per GitHub App installation, so
+// installation tokens are reused until they (almost) expire
+var appTokenSources = struct {
+	sync.Mutex
+	m map[string]*appTokenSource
+}{m: make(map[string]*appTokenSource)}
+
+// appTokenSource creates installation access tokens for a GitHub App and
+// caches the current token until it expires or is rejected
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	baseURL        string
+	client         *http.Client
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// appAuthTransport drops the cached installation token when it is rejected,
+// as it might have been revoked before it expired
+type appAuthTransport struct {
+	base   http.RoundTripper
+	source *appTokenSource
+}
+
+// ResetTokenSources drops all cached token sources, so new installation
+// tokens are requested with the current private keys
+func ResetTokenSources() {
+	appTokenSources.Lock()
+	appTokenSources.m = make(map[string]*appTokenSource)
+	appTokenSources.Unlock()
+}
+
+func newAppTokenSource(c *Config, base http.RoundTripper) (*appTokenSource, error) {
+	id := fmt.Sprintf("%s/%d/%d", c.ServerURL, c.AppID, c.InstallationID)
+
+	appTokenSources.Lock()
+	defer appTokenSources.Unlock()
+
+	if ts, ok := appTokenSources.m[id]; ok {
+		return ts, nil
+	}
+
+	pemKey, err := ioutil.ReadFile(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read GitHub App private key: %s", err)
+	}
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode GitHub App private key %s", c.PrivateKey)
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse GitHub App private key: %s", err)
+	}
+
+	baseURL := "https://api.github.com/"
+	if c.ServerURL != "" {
+		baseURL = strings.Trim(c.ServerURL, "/") + "/"
+	}
+
+	ts := &appTokenSource{
+		appID:          c.AppID,
+		installationID: c.InstallationID,
+		key:            key,
+		baseURL:        baseURL,
+		client:         &http.Client{Transport: base},
+	}
+	appTokenSources.m[id] = ts
+
+	return ts, nil
+}
+
+// parsePrivateKey parses a PKCS#1 or PKCS#8 encoded RSA private key
+func parsePrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Token implements the oauth2.TokenSource interface
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.Valid() {
+		return s.token, nil
+	}
+
+	t, err := s.newToken()
+	if err != nil {
+		return nil, err
+	}
+	s.token = t
+
+	return t, nil
+}
+
+// invalidate drops the cached token, so a new one is requested
+func (s *appTokenSource) invalidate() {
+	s.mu.Lock()
+	s.token = nil
+	s.mu.Unlock()
+}
+
+// newToken requests a new installation access token
+func (s *appTokenSource) newToken() (*oauth2.Token, error) {
+	jwt, err := s.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%sapp/installations/%d/access_tokens", s.baseURL, s.installationID)
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error requesting installation token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Error requesting installation token: %s - %s", resp.Status, body)
+	}
+
+	t := &struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return nil, fmt.Errorf("Error decoding installation token: %v", err)
+	}
+
+	// Refresh the token a little before it actually expires
+	return &oauth2.Token{AccessToken: t.Token, Expiry: t.ExpiresAt.Add(-time.Minute)}, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *appAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	t.source.invalidate()
+
+	// Retry once with a new token if the request body can be send again
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	retry := req.WithContext(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+
+	return t.base.RoundTrip(retry)
+}
+
+// jwt returns a signed JSON Web Token used to authenticate as the GitHub App
+func (s *appTokenSource) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"iat":%d,"exp":%d,"iss":%d}`,
+		now.Add(-time.Minute).Unix(),
+		now.Add(9*time.Minute).Unix(),
+		s.appID,
+	)))
+
+	h := sha256.Sum256([]byte(header + "." + claims))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing GitHub App JWT: %v", err)
+	}
+
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -33,9 +33,75 @@ const (
 	invalidGitLabToken = "The token configured for GitLab group %s is not valid!"
 )
 
+// gitlabError returns err as an *Error when GitLab answered the call
+func gitlabError(resp *gitlab.Response, err error) error {
+	if resp == nil || resp.Response == nil {
+		return err
+	}
+	return &Error{StatusCode: resp.StatusCode, err: err}
+}
+
+// RepoExists implements the Git interface
+func (g *GitLab) RepoExists(project string) (bool, error) {
+	ns := g.namespace(project)
+
+	_, resp, err := g.client.Projects.GetProject(ns, nil)
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound:
+				return false, nil
+			case http.StatusUnauthorized:
+				return false, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+			}
+		}
+		return false, gitlabError(resp, fmt.Errorf("Error retrieving project %s: %v", project, err))
+	}
+
+	return true, nil
+}
+
+// CreateRepo implements the Git interface
+func (g *GitLab) CreateRepo(project string, usr *User) error {
+	group, resp, err := g.client.Groups.GetGroup(g.group)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+		}
+		return gitlabError(resp, fmt.Errorf("Error retrieving group %s: %v", g.group, err))
+	}
+
+	opts := &gitlab.CreateProjectOptions{
+		Name:        gitlab.String(project),
+		NamespaceID: gitlab.Int(group.ID),
+		Visibility:  gitlab.Visibility(gitlab.PrivateVisibility),
+	}
+	if _, _, err := g.client.Projects.CreateProject(opts); err != nil {
+		return fmt.Errorf("Error creating project %s: %v", project, err)
+	}
+
+	// Make sure the master branch exists, so changes can be committed
+	_, err = g.CreateFile(project, "master", "README.md", "Initial commit by Chef-Guard",
+		usr, []byte(fmt.Sprintf("# %s\n", project)))
+	return err
+}
+
+// ArchiveRepo implements the Git interface
+func (g *GitLab) ArchiveRepo(project string) error {
+	_, resp, err := g.client.Projects.ArchiveProject(g.namespace(project))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+		}
+		return gitlabError(resp, fmt.Errorf("Error archiving project %s: %v", project, err))
+	}
+
+	return nil
+}
+
 // GetContent implements the Git interface
 func (g *GitLab) GetContent(project, path string) (*File, interface{}, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+	ns := g.namespace(project)
 
 	treeOpts := &gitlab.ListTreeOptions{
 		Path: gitlab.String(path),
@@ -47,16 +113,16 @@ func (g *GitLab) GetContent(project, path string) (*File, interface{}, error) {
 			case http.StatusNotFound:
 				return nil, nil, nil
 			case http.StatusUnauthorized:
-				return nil, nil, fmt.Errorf(invalidGitLabToken, g.group)
+				return nil, nil, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 			}
 		}
-		return nil, nil, fmt.Errorf("Error retrieving tree for %s: %v", path, err)
+		return nil, nil, gitlabError(resp, fmt.Errorf("Error retrieving tree for %s: %v", path, err))
 	}
 
 	if len(tree) > 0 {
-		var files []string
+		var files []*File
 		for _, file := range tree {
-			files = append(files, filepath.Join(path, file.Name))
+			files = append(files, &File{Path: filepath.Join(path, file.Name), SHA: file.ID})
 		}
 
 		return nil, files, nil
@@ -72,10 +138,10 @@ func (g *GitLab) GetContent(project, path string) (*File, interface{}, error) {
 			case http.StatusNotFound:
 				return nil, nil, nil
 			case http.StatusUnauthorized:
-				return nil, nil, fmt.Errorf(invalidGitLabToken, g.group)
+				return nil, nil, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 			}
 		}
-		return nil, nil, fmt.Errorf("Error retrieving file %s: %v", path, err)
+		return nil, nil, gitlabError(resp, fmt.Errorf("Error retrieving file %s: %v", path, err))
 	}
 
 	f := &File{
@@ -95,12 +161,31 @@ func (g *GitLab) GetContent(project, path string) (*File, interface{}, error) {
 	return f, nil, nil
 }
 
+// CreateBranch implements the Git interface
+func (g *GitLab) CreateBranch(project, branch string) error {
+	ns := g.namespace(project)
+
+	opts := &gitlab.CreateBranchOptions{
+		Branch: gitlab.String(branch),
+		Ref:    gitlab.String("master"),
+	}
+	_, resp, err := g.client.Branches.CreateBranch(ns, opts)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+		}
+		return gitlabError(resp, fmt.Errorf("Error creating branch %s for project %s: %v", branch, project, err))
+	}
+
+	return nil
+}
+
 // CreateFile implements the Git interface
-func (g *GitLab) CreateFile(project, path, msg string, usr *User, content []byte) (string, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) CreateFile(project, branch, path, msg string, usr *User, content []byte) (string, error) {
+	ns := g.namespace(project)
 
 	opts := &gitlab.CreateFileOptions{
-		Branch:        gitlab.String("master"),
+		Branch:        gitlab.String(branch),
 		AuthorEmail:   &usr.Mail,
 		AuthorName:    &usr.Name,
 		Content:       gitlab.String(string(content)),
@@ -109,20 +194,20 @@ func (g *GitLab) CreateFile(project, path, msg string, usr *User, content []byte
 	_, resp, err := g.client.RepositoryFiles.CreateFile(ns, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitLabToken, g.group)
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return "", fmt.Errorf("Error creating file %s: %v", path, err)
+		return "", gitlabError(resp, fmt.Errorf("Error creating file %s: %v", path, err))
 	}
 
-	return g.shaOfLatestCommit(project)
+	return g.shaOfLatestCommit(project, branch)
 }
 
 // UpdateFile implements the Git interface
-func (g *GitLab) UpdateFile(project, path, sha, msg string, usr *User, content []byte) (string, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) UpdateFile(project, branch, path, sha, msg string, usr *User, content []byte) (string, error) {
+	ns := g.namespace(project)
 
 	opts := &gitlab.UpdateFileOptions{
-		Branch:        gitlab.String("master"),
+		Branch:        gitlab.String(branch),
 		AuthorEmail:   &usr.Mail,
 		AuthorName:    &usr.Name,
 		Content:       gitlab.String(string(content)),
@@ -131,20 +216,20 @@ func (g *GitLab) UpdateFile(project, path, sha, msg string, usr *User, content [
 	_, resp, err := g.client.RepositoryFiles.UpdateFile(ns, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitLabToken, g.group)
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return "", fmt.Errorf("Error updating file %s: %v", path, err)
+		return "", gitlabError(resp, fmt.Errorf("Error updating file %s: %v", path, err))
 	}
 
-	return g.shaOfLatestCommit(project)
+	return g.shaOfLatestCommit(project, branch)
 }
 
 // DeleteFile implements the Git interface
-func (g *GitLab) DeleteFile(project, path, sha, msg string, usr *User) (string, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) DeleteFile(project, branch, path, sha, msg string, usr *User) (string, error) {
+	ns := g.namespace(project)
 
 	opts := &gitlab.DeleteFileOptions{
-		Branch:        gitlab.String("master"),
+		Branch:        gitlab.String(branch),
 		AuthorEmail:   &usr.Mail,
 		AuthorName:    &usr.Name,
 		CommitMessage: gitlab.String(msg),
@@ -152,25 +237,30 @@ func (g *GitLab) DeleteFile(project, path, sha, msg string, usr *User) (string,
 	resp, err := g.client.RepositoryFiles.DeleteFile(ns, path, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitLabToken, g.group)
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return "", fmt.Errorf("Error deleting file %s: %v", path, err)
+		return "", gitlabError(resp, fmt.Errorf("Error deleting file %s: %v", path, err))
 	}
 
-	return g.shaOfLatestCommit(project)
+	return g.shaOfLatestCommit(project, branch)
 }
 
 // DeleteDirectory implements the Git interface
-func (g *GitLab) DeleteDirectory(project, msg string, dir interface{}, usr *User) error {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) DeleteDirectory(project, branch, msg string, dir interface{}, usr *User) (string, error) {
+	ns := g.namespace(project)
+
+	for _, f := range dir.([]*File) {
+		file := f.Path
 
-	for _, file := range dir.([]string) {
 		// Need a special case for when deleting data bag items
-		fn := strings.TrimPrefix(file, "data_bags/")
+		fn := file
+		if i := strings.Index(fn, "data_bags/"); i >= 0 {
+			fn = fn[i+len("data_bags/"):]
+		}
 		msg := fmt.Sprintf(msg, strings.TrimSuffix(fn, ".json"))
 
 		opts := &gitlab.DeleteFileOptions{
-			Branch:        gitlab.String("master"),
+			Branch:        gitlab.String(branch),
 			AuthorEmail:   &usr.Mail,
 			AuthorName:    &usr.Name,
 			CommitMessage: gitlab.String(msg),
@@ -178,59 +268,138 @@ func (g *GitLab) DeleteDirectory(project, msg string, dir interface{}, usr *User
 		resp, err := g.client.RepositoryFiles.DeleteFile(ns, file, opts)
 		if err != nil {
 			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-				return fmt.Errorf(invalidGitLabToken, g.group)
+				return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 			}
-			return fmt.Errorf("Error deleting file %s: %v", file, err)
+			return "", gitlabError(resp, fmt.Errorf("Error deleting file %s: %v", file, err))
 		}
 	}
 
-	return nil
+	return g.shaOfLatestCommit(project, branch)
+}
+
+// CommitFiles implements the Git interface
+func (g *GitLab) CommitFiles(project, branch, msg string, usr *User, files map[string][]byte) (string, error) {
+	ns := g.namespace(project)
+
+	// We need to know which files already exist, as they need to be updated
+	existing := make(map[string]bool)
+	treeOpts := &gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		Ref:         gitlab.String(branch),
+		Recursive:   gitlab.Bool(true),
+	}
+	for {
+		tree, resp, err := g.client.Repositories.ListTree(ns, treeOpts)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+				return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+			}
+			return "", gitlabError(resp, fmt.Errorf("Error retrieving tree of project %s: %v", project, err))
+		}
+		for _, node := range tree {
+			existing[node.Path] = true
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		treeOpts.Page = resp.NextPage
+	}
+
+	opts := &gitlab.CreateCommitOptions{
+		Branch:        gitlab.String(branch),
+		CommitMessage: gitlab.String(msg),
+		AuthorEmail:   &usr.Mail,
+		AuthorName:    &usr.Name,
+	}
+	for path, content := range files {
+		action := gitlab.FileCreate
+		if existing[path] {
+			action = gitlab.FileUpdate
+		}
+		opts.Actions = append(opts.Actions, &gitlab.CommitAction{
+			Action:   action,
+			FilePath: path,
+			Content:  base64.StdEncoding.EncodeToString(content),
+			Encoding: "base64",
+		})
+	}
+
+	commit, resp, err := g.client.Commits.CreateCommit(ns, opts)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+		}
+		return "", gitlabError(resp, fmt.Errorf("Error creating commit for project %s: %v", project, err))
+	}
+
+	return commit.ID, nil
+}
+
+// CreateMergeRequest implements the Git interface
+func (g *GitLab) CreateMergeRequest(project, branch, title, body string) (string, error) {
+	ns := g.namespace(project)
+
+	opts := &gitlab.CreateMergeRequestOptions{
+		Title:        gitlab.String(title),
+		Description:  gitlab.String(body),
+		SourceBranch: gitlab.String(branch),
+		TargetBranch: gitlab.String("master"),
+	}
+	mr, resp, err := g.client.MergeRequests.CreateMergeRequest(ns, opts)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+		}
+		return "", gitlabError(resp, fmt.Errorf("Error creating merge request for branch %s: %v", branch, err))
+	}
+
+	return mr.WebURL, nil
 }
 
 // GetDiff implements the Git interface
-func (g *GitLab) GetDiff(project, user, sha string) (string, error) {
-	u := fmt.Sprintf("/%s/%s/commit/%s.diff", g.group, project, sha)
+func (g *GitLab) GetDiff(project, sha string) (string, time.Time, error) {
+	u := fmt.Sprintf("/%s/commit/%s.diff", g.namespace(project), sha)
 
 	req, err := g.client.NewRequest("GET", u, nil, nil)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
 	// Make sure we do not use the API path here!
 	req.URL, err = req.URL.Parse(u)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
 	var diff bytes.Buffer
 	resp, err := g.client.Do(req, &diff)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitLabToken, g.group)
+			return "", time.Time{}, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return "", fmt.Errorf("Error retrieving commit %s: %v", sha, err)
+		return "", time.Time{}, gitlabError(resp, fmt.Errorf("Error retrieving commit %s: %v", sha, err))
 	}
 
 	if diff.Len() == 0 {
-		return "", nil
+		return "", time.Time{}, nil
 	}
 
-	const layout = "Mon Jan 2 3:04 2006"
-	t := time.Now()
+	commit, _, err := g.client.Commits.GetCommit(g.namespace(project), sha)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error retrieving commit %s: %v", sha, err)
+	}
 
-	msg := fmt.Sprintf("Commit : %s\nDate   : %s\nUser   : %s\n<br />%s",
-		sha,
-		t.Format(layout),
-		user,
-		diff.String(),
-	)
+	var date time.Time
+	if commit.CommittedDate != nil {
+		date = *commit.CommittedDate
+	}
 
-	return msg, nil
+	return diff.String(), date, nil
 }
 
 // GetArchiveLink implements the Git interface
 func (g *GitLab) GetArchiveLink(project, tag string) (*url.URL, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+	ns := g.namespace(project)
 
 	_, resp, err := g.client.Projects.GetProject(ns, nil)
 	if err != nil {
@@ -239,17 +408,17 @@ func (g *GitLab) GetArchiveLink(project, tag string) (*url.URL, error) {
 			case http.StatusNotFound:
 				return nil, nil
 			case http.StatusUnauthorized:
-				return nil, fmt.Errorf(invalidGitLabToken, g.group)
+				return nil, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 			}
 		}
-		return nil, fmt.Errorf("Error retrieving archive link of project %s: %v", project, err)
+		return nil, gitlabError(resp, fmt.Errorf("Error retrieving archive link of project %s: %v", project, err))
 	}
 
 	u, err := url.Parse(
 		fmt.Sprintf("projects/%s/repository/archive.tar.gz?sha=%s&private_token=%s",
-			url.QueryEscape(ns),
-			tag,
-			g.token,
+			url.PathEscape(ns),
+			url.QueryEscape(tag),
+			url.QueryEscape(g.token),
 		),
 	)
 	if err != nil {
@@ -259,22 +428,87 @@ func (g *GitLab) GetArchiveLink(project, tag string) (*url.URL, error) {
 	return g.client.BaseURL().ResolveReference(u), nil
 }
 
+// GetFileAtRef implements the Git interface
+func (g *GitLab) GetFileAtRef(project, path, ref string) (*File, error) {
+	ns := g.namespace(project)
+
+	file, resp, err := g.client.RepositoryFiles.GetFile(ns, path, &gitlab.GetFileOptions{Ref: gitlab.String(ref)})
+	if err != nil {
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusNotFound:
+				return nil, nil
+			case http.StatusUnauthorized:
+				return nil, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+			}
+		}
+		return nil, gitlabError(resp, fmt.Errorf("Error retrieving file %s at %s: %v", path, ref, err))
+	}
+
+	f := &File{
+		Content: file.Content,
+		SHA:     file.CommitID,
+	}
+
+	if file.Encoding == "base64" {
+		content, err := base64.StdEncoding.DecodeString(file.Content)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding file %s, %v", path, err)
+		}
+		f.Content = string(content)
+	}
+
+	return f, nil
+}
+
+// ListTags implements the Git interface
+func (g *GitLab) ListTags(project string) ([]string, error) {
+	ns := g.namespace(project)
+
+	var tags []string
+
+	opts := &gitlab.ListTagsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		list, resp, err := g.client.Tags.ListTags(ns, opts)
+		if err != nil {
+			if resp != nil {
+				switch resp.StatusCode {
+				case http.StatusNotFound:
+					return nil, nil
+				case http.StatusUnauthorized:
+					return nil, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
+				}
+			}
+			return nil, gitlabError(resp, fmt.Errorf("Error retrieving tags of project %s: %v", project, err))
+		}
+		for _, t := range list {
+			tags = append(tags, t.Name)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return tags, nil
+}
+
 // TagRepo implements the Git interface
-func (g *GitLab) TagRepo(project, tag string, usr *User) error {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) TagRepo(project, tag, branch string, usr *User) error {
+	ns := g.namespace(project)
 	message := fmt.Sprint("Tagged by Chef-Guard\n")
 
 	opts := &gitlab.CreateTagOptions{
 		TagName: gitlab.String(tag),
-		Ref:     gitlab.String("master"),
+		Ref:     gitlab.String(branch),
 		Message: gitlab.String(message),
 	}
 	_, resp, err := g.client.Tags.CreateTag(ns, opts)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf(invalidGitLabToken, g.group)
+			return gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return fmt.Errorf("Error creating tag for project %s: %v", project, err)
+		return gitlabError(resp, fmt.Errorf("Error creating tag for project %s: %v", project, err))
 	}
 
 	return nil
@@ -282,7 +516,7 @@ func (g *GitLab) TagRepo(project, tag string, usr *User) error {
 
 // TagExists implements the Git interface
 func (g *GitLab) TagExists(project, tag string) (bool, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+	ns := g.namespace(project)
 
 	_, resp, err := g.client.Tags.GetTag(ns, tag)
 	if err != nil {
@@ -291,10 +525,10 @@ func (g *GitLab) TagExists(project, tag string) (bool, error) {
 			case http.StatusNotFound:
 				return false, nil
 			case http.StatusUnauthorized:
-				return false, fmt.Errorf(invalidGitLabToken, g.group)
+				return false, gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 			}
 		}
-		return false, fmt.Errorf("Error retrieving tags of project %s: %v", project, err)
+		return false, gitlabError(resp, fmt.Errorf("Error retrieving tags of project %s: %v", project, err))
 	}
 
 	return true, nil
@@ -302,29 +536,35 @@ func (g *GitLab) TagExists(project, tag string) (bool, error) {
 
 // UntagRepo implements the Git interface
 func (g *GitLab) UntagRepo(project, tag string) error {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+	ns := g.namespace(project)
 
 	resp, err := g.client.Tags.DeleteTag(ns, tag)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return fmt.Errorf(invalidGitLabToken, g.group)
+			return gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return fmt.Errorf("Error deleting tag %s: %v", tag, err)
+		return gitlabError(resp, fmt.Errorf("Error deleting tag %s: %v", tag, err))
 	}
 
 	return nil
 }
 
-func (g *GitLab) shaOfLatestCommit(project string) (string, error) {
-	ns := fmt.Sprintf("%s/%s", g.group, project)
+func (g *GitLab) shaOfLatestCommit(project, branch string) (string, error) {
+	ns := g.namespace(project)
 
-	commit, resp, err := g.client.Commits.GetCommit(ns, "master")
+	commit, resp, err := g.client.Commits.GetCommit(ns, branch)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			return "", fmt.Errorf(invalidGitLabToken, g.group)
+			return "", gitlabError(resp, fmt.Errorf(invalidGitLabToken, g.group))
 		}
-		return "", fmt.Errorf("Error retrieving SHA of latest commit: %v", err)
+		return "", gitlabError(resp, fmt.Errorf("Error retrieving SHA of latest commit: %v", err))
 	}
 
 	return commit.ID, nil
 }
+
+// namespace returns the full path of the project, which can be nested in
+// any number of subgroups (e.g. group/subgroup/project)
+func (g *GitLab) namespace(project string) string {
+	return g.group + "/" + strings.Trim(project, "/")
+}
@@ -0,0 +1,140 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package git
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitDelay caps the time we are willing to wait for a single call
+const maxRateLimitDelay = 15 * time.Minute
+
+// RateLimitRemaining exposes the remaining GitHub API calls per organization
+var RateLimitRemaining = expvar.NewMap("github_rate_limit_remaining")
+
+// rateLimits holds the last known rate limit per organization. As clients
+// are created per request, this state needs to be shared between them.
+var rateLimits = struct {
+	sync.Mutex
+	m map[string]*rateLimit
+}{m: make(map[string]*rateLimit)}
+
+type rateLimit struct {
+	sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+// rateLimitTransport delays requests when the GitHub rate limit is close to
+// being exhausted, instead of letting the requests fail.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	org     string
+	reserve int
+	limit   *rateLimit
+}
+
+func newRateLimitTransport(base http.RoundTripper, org string, reserve int) *rateLimitTransport {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+
+	limit, ok := rateLimits.m[org]
+	if !ok {
+		limit = &rateLimit{remaining: -1}
+		rateLimits.m[org] = limit
+	}
+
+	return &rateLimitTransport{
+		base:    base,
+		org:     org,
+		reserve: reserve,
+		limit:   limit,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if d := t.delay(); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	t.update(resp)
+
+	return resp, nil
+}
+
+// delay returns how long to wait before doing the next call. When the limit
+// is exhausted we wait until the reset, when we are within the reserve the
+// remaining calls are spread out evenly until the reset.
+func (t *rateLimitTransport) delay() time.Duration {
+	t.limit.Lock()
+	defer t.limit.Unlock()
+
+	if t.limit.remaining < 0 || t.limit.remaining > t.reserve {
+		return 0
+	}
+
+	untilReset := time.Until(t.limit.reset)
+	if untilReset <= 0 {
+		return 0
+	}
+
+	d := untilReset / time.Duration(t.limit.remaining+1)
+	if d > maxRateLimitDelay {
+		d = maxRateLimitDelay
+	}
+
+	return d
+}
+
+func (t *rateLimitTransport) update(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.limit.Lock()
+	t.limit.remaining = remaining
+	t.limit.reset = time.Unix(reset, 0)
+	t.limit.Unlock()
+
+	v := new(expvar.Int)
+	v.Set(int64(remaining))
+	RateLimitRemaining.Set(t.org, v)
+}
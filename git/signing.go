@@ -0,0 +1,95 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// signer signs raw git objects using either GPG or SSH
+type signer struct {
+	format string
+	key    string
+}
+
+func newSigner(c *Config) (*signer, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+
+	switch c.SigningFormat {
+	case "", "gpg":
+		return &signer{format: "gpg", key: c.SigningKey}, nil
+	case "ssh":
+		return &signer{format: "ssh", key: c.SigningKey}, nil
+	default:
+		return nil, fmt.Errorf("Unknown signing format: %q", c.SigningFormat)
+	}
+}
+
+// sign returns an armored detached signature of the given payload
+func (s *signer) sign(payload []byte) (string, error) {
+	var cmd *exec.Cmd
+	switch s.format {
+	case "gpg":
+		cmd = exec.Command("gpg", "--batch", "--yes", "--armor", "--detach-sign", "--local-user", s.key)
+	case "ssh":
+		cmd = exec.Command("ssh-keygen", "-Y", "sign", "-n", "git", "-f", s.key)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Failed to sign payload using %s: %s - %v", s.format, strings.TrimSpace(stderr.String()), err)
+	}
+
+	return stdout.String(), nil
+}
+
+// signCommit returns the signature for a commit object with the given details
+func (s *signer) signCommit(tree, parent, msg string, usr *User, t time.Time) (string, error) {
+	payload := fmt.Sprintf("tree %s\nparent %s\nauthor %s\ncommitter %s\n\n%s",
+		tree,
+		parent,
+		signature(usr, t),
+		signature(usr, t),
+		msg,
+	)
+	return s.sign([]byte(payload))
+}
+
+// signTag returns the signature for a tag object with the given details
+func (s *signer) signTag(object, tag, msg string, usr *User, t time.Time) (string, error) {
+	payload := fmt.Sprintf("object %s\ntype commit\ntag %s\ntagger %s\n\n%s",
+		object,
+		tag,
+		signature(usr, t),
+		msg,
+	)
+	return s.sign([]byte(payload))
+}
+
+func signature(usr *User, t time.Time) string {
+	return fmt.Sprintf("%s <%s> %d +0000", usr.Name, usr.Mail, t.Unix())
+}
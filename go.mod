@@ -3,6 +3,8 @@ module github.com/xanzy/chef-guard
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/gomodule/redigo v1.7.0
 	github.com/google/go-github v17.0.0+incompatible
 	github.com/gorilla/mux v1.7.2
 	github.com/icub3d/graceful v0.0.0-20150426161802-c35c02575508
@@ -10,8 +12,8 @@ require (
 	github.com/mitchellh/osext v0.0.0-20151018003038-5e2d6d41470f
 	github.com/xanzy/go-gitlab v0.18.0
 	github.com/xanzy/go-pathspec v1.0.1
-	github.com/xanzy/multisyncer v0.0.0-20151209090734-170d66c6ef90
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	gopkg.in/gcfg.v1 v1.2.3
 	gopkg.in/warnings.v0 v0.1.2 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
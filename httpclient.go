@@ -0,0 +1,160 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// outboundTransports holds the transports used for bookshelf, Supermarket
+// and source downloads, keyed by their settings so a reloaded config with
+// different timeouts gets new transports
+var outboundTransports = struct {
+	sync.Mutex
+	m map[string]*http.Transport
+}{m: make(map[string]*http.Transport)}
+
+// outboundTransport returns a transport that applies the configured timeouts
+func outboundTransport(insecure bool) *http.Transport {
+	connectTimeout := time.Duration(getConfig().HTTP.ConnectTimeout) * time.Second
+	if connectTimeout == 0 {
+		connectTimeout = 30 * time.Second
+	}
+	timeout := time.Duration(getConfig().HTTP.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 60 * time.Second
+	}
+
+	key := fmt.Sprintf("%t/%s/%s/%s", insecure, connectTimeout, timeout, connectionSettings())
+
+	outboundTransports.Lock()
+	defer outboundTransports.Unlock()
+
+	if t, ok := outboundTransports.m[key]; ok {
+		return t
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: insecure},
+		ResponseHeaderTimeout: timeout,
+	}
+	tuneConnections(t)
+	outboundTransports.m[key] = t
+
+	return t
+}
+
+// tuneConnections applies the configured connection reuse settings
+func tuneConnections(t *http.Transport) {
+	c := getConfig()
+	t.MaxIdleConns = c.HTTP.MaxIdleConns
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = 100
+	}
+	t.MaxIdleConnsPerHost = c.HTTP.MaxIdleConnsPerHost
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = 100
+	}
+	t.IdleConnTimeout = time.Duration(c.HTTP.IdleConnTimeout) * time.Second
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = 90 * time.Second
+	}
+	t.TLSHandshakeTimeout = time.Duration(c.HTTP.TLSHandshakeTimeout) * time.Second
+	if t.TLSHandshakeTimeout == 0 {
+		t.TLSHandshakeTimeout = 10 * time.Second
+	}
+}
+
+// connectionSettings returns the connection reuse settings as a key, so
+// transports can be recreated when they change
+func connectionSettings() string {
+	c := getConfig()
+	return fmt.Sprintf("%d/%d/%d/%d", c.HTTP.MaxIdleConns, c.HTTP.MaxIdleConnsPerHost,
+		c.HTTP.IdleConnTimeout, c.HTTP.TLSHandshakeTimeout)
+}
+
+// retryTransport retries idempotent requests that failed because of a
+// connection error or a transient server error
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests with a body (e.g. streamed uploads) cannot be replayed
+	if req.Method != "GET" && req.Method != "HEAD" || req.Body != nil {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= getConfig().HTTP.Retries || !retryable(req.Context(), resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := waitForRetry(req.Context(), attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable returns true if a call failed in a way that might succeed when
+// tried again, which is a connection error or a transient server error
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if resp != nil {
+		return resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+	}
+	return err != nil
+}
+
+// waitForRetry waits before the next attempt, doubling the configured
+// backoff for every attempt, until the context is done
+func waitForRetry(ctx context.Context, attempt int) error {
+	backoff := time.Duration(getConfig().HTTP.Backoff) * time.Millisecond
+	if backoff == 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	timer := time.NewTimer(backoff << uint(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// checkLimitError is returned when a check exceeded one of its limits
+type checkLimitError struct {
+	msg string
+}
+
+func (e *checkLimitError) Error() string {
+	return e.msg
+}
+
+// limitedBuffer is a buffer that calls exceeded (once) when more than max
+// bytes are written to it
+type limitedBuffer struct {
+	sync.Mutex
+	buf      bytes.Buffer
+	max      int
+	exceeded func()
+	done     bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		b.buf.Write(p[:b.max-b.buf.Len()])
+		if !b.done {
+			b.done = true
+			go b.exceeded()
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Bytes()
+}
+
+// runCheck runs the command of a check within the configured limits and
+// returns its output. When combined is true, the returned output contains
+// both stdout and stderr. The check is killed when the context is done.
+func runCheck(ctx context.Context, cmd *exec.Cmd, cookbookPath string, combined bool) ([]byte, []byte, error) {
+	var mu sync.Mutex
+	var limitErr error
+
+	name := path.Base(cmd.Path)
+
+	container, err := sandboxCheck(cmd, cookbookPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	kill := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if limitErr == nil {
+			limitErr = &checkLimitError{msg: msg}
+			// Kill the whole process group, so no child processes are left behind
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			if container != "" {
+				killSandbox(requestIDFromContext(ctx), container)
+			}
+		}
+	}
+
+	stdout := &limitedBuffer{max: getConfig().Tests.MaxOutput}
+	stdout.exceeded = func() {
+		kill(fmt.Sprintf("Check %s exceeded the max output size of %d bytes", name, getConfig().Tests.MaxOutput))
+	}
+	stderr := stdout
+	if !combined {
+		stderr = &limitedBuffer{max: getConfig().Tests.MaxOutput, exceeded: stdout.exceeded}
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	if getConfig().Tests.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, getConfig().Tests.Nice); err != nil {
+			logf(WARNING, requestIDFromContext(ctx), "Failed to set the priority of check %s: %s", name, err)
+		}
+	}
+	if getConfig().Tests.Cgroup != "" {
+		procs := path.Join(getConfig().Tests.Cgroup, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			logf(WARNING, requestIDFromContext(ctx), "Failed to add check %s to cgroup %s: %s", name, getConfig().Tests.Cgroup, err)
+		}
+	}
+
+	if getConfig().Tests.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(getConfig().Tests.Timeout)*time.Second, func() {
+			kill(fmt.Sprintf("Check %s timed out after %d seconds", name, getConfig().Tests.Timeout))
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			kill(fmt.Sprintf("Check %s was canceled: %s", name, ctx.Err()))
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if limitErr != nil {
+		return stdout.Bytes(), stderr.Bytes(), limitErr
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
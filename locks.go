@@ -0,0 +1,188 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var forcedLockReleases = expvar.NewInt("lock_forced_releases_total")
+
+const (
+	// lockCheckInterval is the interval at which waiters check if the lock
+	// they wait for should be forcibly released
+	lockCheckInterval = time.Second
+
+	// lockWaitWarning is the time after which a waiter logs who holds the lock
+	lockWaitWarning = 30 * time.Second
+
+	// lockIdleTimeout is the time after which unused locks are removed
+	lockIdleTimeout = time.Hour
+)
+
+// localSyncer serializes all work on a key within this process. Unlike
+// the multisyncer package it tracks the owner of every lock, forcibly
+// releases locks held longer than the configured deadline (so a stuck
+// update cannot block all future commits to a repo) and removes unused locks.
+type localSyncer struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+
+	// gen is incremented for every acquired lock, so each owner gets its own
+	// generation to unlock with
+	gen uint64
+}
+
+// localLock is a single lock of a localSyncer
+type localLock struct {
+	sem     chan struct{}
+	owner   string
+	since   time.Time
+	used    time.Time
+	waiters int
+
+	// gen is the generation of the current owner, so the late unlock of an
+	// owner whose lock was forcibly released is ignored
+	gen uint64
+}
+
+func newLocalSyncer() *localSyncer {
+	s := &localSyncer{locks: make(map[string]*localLock)}
+	go s.cleanup()
+	return s
+}
+
+// Lock waits until the lock is acquired and returns the generation needed to
+// unlock it again
+func (s *localSyncer) Lock(key string) uint64 {
+	owner := lockOwner()
+
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &localLock{sem: make(chan struct{}, 1)}
+		s.locks[key] = l
+	}
+	l.waiters++
+	s.mu.Unlock()
+
+	t := time.NewTicker(lockCheckInterval)
+	defer t.Stop()
+
+	start, warned := time.Now(), false
+	for {
+		select {
+		case l.sem <- struct{}{}:
+			s.mu.Lock()
+			l.waiters--
+			s.gen++
+			l.gen, l.owner, l.since, l.used = s.gen, owner, time.Now(), time.Now()
+			s.mu.Unlock()
+			return l.gen
+		case <-t.C:
+			s.mu.Lock()
+			s.releaseExpired(key, l)
+			if !warned && time.Since(start) > lockWaitWarning && !l.since.IsZero() {
+				WARNING.Printf("%s is waiting %s for lock %s held by %s since %s",
+					owner, time.Since(start).Round(time.Second), key, l.owner, l.since.Format(time.RFC3339))
+				warned = true
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Unlock releases the lock if it is still held by the owner of the given
+// generation. Late unlocks of owners whose lock was forcibly released are
+// ignored.
+func (s *localSyncer) Unlock(key string, gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.locks[key]
+	if !ok || l.gen != gen || l.since.IsZero() {
+		return
+	}
+
+	select {
+	case <-l.sem:
+	default:
+	}
+	l.owner, l.since, l.used = "", time.Time{}, time.Now()
+
+	if l.waiters == 0 {
+		delete(s.locks, key)
+	}
+}
+
+// releaseExpired forcibly releases the lock when it is held longer than the
+// configured deadline. The caller must hold the lock of the syncer.
+func (s *localSyncer) releaseExpired(key string, l *localLock) {
+	deadline := time.Duration(getConfig().Lock.Deadline) * time.Second
+	if deadline == 0 || l.since.IsZero() || time.Since(l.since) < deadline {
+		return
+	}
+
+	select {
+	case <-l.sem:
+	default:
+		return
+	}
+
+	ERROR.Printf("Forcibly released lock %s held by %s since %s", key, l.owner, l.since.Format(time.RFC3339))
+	forcedLockReleases.Add(1)
+
+	l.owner, l.since, l.used = "", time.Time{}, time.Now()
+}
+
+// cleanup periodically removes the locks that are no longer used, which
+// are left behind when a lock is forcibly released and nobody is waiting
+func (s *localSyncer) cleanup() {
+	for {
+		time.Sleep(lockIdleTimeout / 4)
+
+		s.mu.Lock()
+		for key, l := range s.locks {
+			if l.waiters == 0 && l.since.IsZero() && time.Since(l.used) > lockIdleTimeout {
+				delete(s.locks, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// lockOwner returns the location in the code that requested the lock
+func lockOwner() string {
+	pc := make([]uintptr, 10)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		f, more := frames.Next()
+		file := filepath.Base(f.File)
+		if file != "locks.go" && file != "distlock.go" {
+			return fmt.Sprintf("%s:%d (%s)", file, f.Line, f.Function[strings.LastIndex(f.Function, ".")+1:])
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
@@ -19,22 +19,117 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"time"
 )
 
 var (
 	INFO    *log.Logger
 	WARNING *log.Logger
 	ERROR   *log.Logger
+	ACCESS  *log.Logger
 )
 
 func initLogging() error {
-	l, err := os.OpenFile(cfg.Default.Logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	l, err := os.OpenFile(getConfig().Default.Logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
-		return fmt.Errorf("Failed to open log file %s: %s", cfg.Default.Logfile, err)
+		return fmt.Errorf("Failed to open log file %s: %s", getConfig().Default.Logfile, err)
 	}
 	INFO = log.New(l, "INFO:    ", log.Ldate|log.Ltime)
 	WARNING = log.New(l, "WARNING: ", log.Ldate|log.Ltime)
 	ERROR = log.New(l, "ERROR:   ", log.Ldate|log.Ltime)
 	return nil
 }
+
+func initAccessLogging() error {
+	switch getConfig().Default.AccessLog {
+	case "":
+		return nil
+	case "stdout":
+		ACCESS = log.New(os.Stdout, "", 0)
+	default:
+		l, err := os.OpenFile(getConfig().Default.AccessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return fmt.Errorf("Failed to open access log file %s: %s", getConfig().Default.AccessLog, err)
+		}
+		ACCESS = log.New(l, "", 0)
+	}
+	return nil
+}
+
+// accessLogWriter records the status code and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// accessLogHandler logs every request in the Common or Combined Log Format,
+// followed by the time it took to serve the request in microseconds and the
+// request ID.
+func accessLogHandler(h http.Handler) http.Handler {
+	if ACCESS == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w}
+
+		// Copy the values we need before the request is modified by the handlers
+		uri := r.RequestURI
+		user := r.Header.Get("X-Ops-Userid")
+
+		h.ServeHTTP(aw, r)
+
+		ACCESS.Println(formatAccessLog(r, aw, uri, user, start))
+	})
+}
+
+func formatAccessLog(r *http.Request, aw *accessLogWriter, uri, user string, start time.Time) string {
+	host := clientIP(r)
+	if user == "" {
+		user = "-"
+	}
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+
+	line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d`,
+		host,
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method,
+		uri,
+		r.Proto,
+		aw.status,
+		aw.size,
+	)
+
+	if getConfig().Default.AccessLogFormat == "combined" {
+		line = fmt.Sprintf(`%s "%s" "%s"`, line, orDash(r.Referer()), orDash(r.UserAgent()))
+	}
+
+	return fmt.Sprintf("%s %d %s", line, time.Since(start)/time.Microsecond, orDash(r.Header.Get(requestIDHeader)))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
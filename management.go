@@ -0,0 +1,83 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// tuneRuntime applies the configured runtime settings
+func tuneRuntime() {
+	if getConfig().Management.GoMaxProcs > 0 {
+		runtime.GOMAXPROCS(getConfig().Management.GoMaxProcs)
+	}
+	if getConfig().Management.GCPercent > 0 {
+		debug.SetGCPercent(getConfig().Management.GCPercent)
+	}
+}
+
+// startManagementListener starts a separate listener serving the profiling,
+// metrics and stats endpoints, so they are never exposed on the proxy listener
+func startManagementListener() {
+	if getConfig().Management.ListenPort == 0 {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/stats", statsHandler)
+
+	addr := fmt.Sprintf("%s:%d", getConfig().Management.ListenIP, getConfig().Management.ListenPort)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			ERROR.Printf("Management listener error: %s", err)
+		}
+	}()
+}
+
+// logMemStats periodically logs the most important memory statistics
+func logMemStats() {
+	if getConfig().Management.MemStatsInterval == 0 {
+		return
+	}
+
+	go func() {
+		var m runtime.MemStats
+		for {
+			time.Sleep(time.Duration(getConfig().Management.MemStatsInterval) * time.Second)
+			runtime.ReadMemStats(&m)
+			INFO.Printf("Memory stats: alloc=%dKB sys=%dKB heap_objects=%d num_gc=%d goroutines=%d",
+				m.Alloc/1024,
+				m.Sys/1024,
+				m.HeapObjects,
+				m.NumGC,
+				runtime.NumGoroutine(),
+			)
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// metadataFields are the metadata fields that can be made mandatory
+var metadataFields = []string{"maintainer", "maintainer_email", "license", "issues_url", "source_url"}
+
+// cookbookMetadata holds the metadata fields checked by the metadata policy
+type cookbookMetadata struct {
+	Maintainer      string `json:"maintainer"`
+	MaintainerEmail string `json:"maintainer_email"`
+	License         string `json:"license"`
+	IssuesURL       string `json:"issues_url"`
+	SourceURL       string `json:"source_url"`
+}
+
+// checkMetadata enforces the required metadata fields of the organization
+func (cg *ChefGuard) checkMetadata() (int, error) {
+	required := splitList(getEffectiveConfig("RequiredMetadata", cg.ChefOrg).(string))
+	if len(required) == 0 || cg.Metadata == nil {
+		return 0, nil
+	}
+
+	values := map[string]string{
+		"maintainer":       cg.Metadata.Maintainer,
+		"maintainer_email": cg.Metadata.MaintainerEmail,
+		"license":          cg.Metadata.License,
+		"issues_url":       cg.Metadata.IssuesURL,
+		"source_url":       cg.Metadata.SourceURL,
+	}
+
+	errors := []string{}
+	for _, field := range required {
+		value := strings.TrimSpace(values[field])
+		if value == "" {
+			errors = append(errors, fmt.Sprintf("Required field %s is missing", field))
+			continue
+		}
+
+		switch field {
+		case "maintainer_email":
+			domain := getEffectiveConfig("MailDomain", cg.ChefOrg).(string)
+			if !strings.HasSuffix(strings.ToLower(value), "@"+strings.ToLower(domain)) {
+				errors = append(errors, fmt.Sprintf("Field maintainer_email (%s) is not an @%s address", value, domain))
+			}
+		case "license":
+			allowed := splitList(getEffectiveConfig("AllowedLicenses", cg.ChefOrg).(string))
+			if len(allowed) > 0 && !containsFold(allowed, value) {
+				errors = append(errors, fmt.Sprintf("License %q is not one of: %s", value, strings.Join(allowed, ", ")))
+			}
+		}
+	}
+
+	if len(errors) == 0 {
+		return 0, nil
+	}
+	sort.Strings(errors)
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Metadata errors found ===\n%s\n=============================\n", strings.Join(errors, "\n"))
+}
+
+// splitList splits a comma separated config value into its trimmed parts
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	metadataName    = regexp.MustCompile(`(?m)^\s*name\s*\(?\s*['"]([^'"]+)['"]`)
+	metadataVersion = regexp.MustCompile(`(?m)^\s*version\s*\(?\s*['"]([^'"]+)['"]`)
+	constraintParts = regexp.MustCompile(`^(~>|>=|<=|>|<|=)?\s*(\S+)$`)
+)
+
+// semanticMetadata holds the metadata fields that are compared semantically
+type semanticMetadata struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Dependencies map[string]string `json:"dependencies"`
+	Platforms    map[string]string `json:"platforms"`
+}
+
+// compareMetadata compares the metadata of the upload with the metadata of
+// the source, as metadata files are excluded from the file compare
+func (cg *ChefGuard) compareMetadata() (int, error) {
+	var source *semanticMetadata
+	switch {
+	case cg.SourceMetadata["metadata.json"] != nil:
+		source = new(semanticMetadata)
+		if err := json.Unmarshal(cg.SourceMetadata["metadata.json"], source); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Failed to unmarshal the metadata.json of the source: %s", err)
+		}
+	case cg.SourceMetadata["metadata.rb"] != nil:
+		// The dependencies and platforms of a metadata.rb can be computed (e.g.
+		// in a loop), so without a metadata.json only the name and version
+		// are compared
+		source = parseMetadataRB(cg.SourceMetadata["metadata.rb"])
+	default:
+		return 0, nil
+	}
+
+	upload := &semanticMetadata{
+		Name:         cg.Cookbook.Metadata.Name,
+		Version:      cg.Cookbook.Metadata.Version,
+		Dependencies: cg.Cookbook.Metadata.Dependencies,
+		Platforms:    cg.Cookbook.Metadata.Platforms,
+	}
+
+	errors := []string{}
+	// Values computed in metadata.rb cannot be evaluated, so they are skipped
+	if source.Name != "" && source.Name != upload.Name {
+		errors = append(errors, fmt.Sprintf("Name %q differs from the source (%q)", upload.Name, source.Name))
+	}
+	if source.Version != "" && normalizeVersion(source.Version) != normalizeVersion(upload.Version) {
+		errors = append(errors, fmt.Sprintf("Version %q differs from the source (%q)", upload.Version, source.Version))
+	}
+	if cg.SourceMetadata["metadata.json"] != nil {
+		errors = append(errors, compareConstraints("Dependency", upload.Dependencies, source.Dependencies)...)
+		errors = append(errors, compareConstraints("Platform", upload.Platforms, source.Platforms)...)
+	}
+
+	if len(errors) == 0 {
+		return 0, nil
+	}
+	sort.Strings(errors)
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Metadata Compare errors found ===\n%s\n=====================================\n", strings.Join(errors, "\n"))
+}
+
+// parseMetadataRB extracts the name and version from a metadata.rb file. As
+// the file is not evaluated, only literal values are found.
+func parseMetadataRB(content []byte) *semanticMetadata {
+	md := &semanticMetadata{}
+	if m := metadataName.FindSubmatch(content); m != nil {
+		md.Name = string(m[1])
+	}
+	if m := metadataVersion.FindSubmatch(content); m != nil {
+		md.Version = string(m[1])
+	}
+	return md
+}
+
+func compareConstraints(kind string, upload, source map[string]string) []string {
+	errors := []string{}
+	for name, constraint := range source {
+		c, ok := upload[name]
+		if !ok {
+			errors = append(errors, fmt.Sprintf("%s %s (%s) of the source is missing", kind, name, constraint))
+			continue
+		}
+		if normalizeConstraint(c) != normalizeConstraint(constraint) {
+			errors = append(errors, fmt.Sprintf("%s %s (%s) differs from the source (%s)", kind, name, c, constraint))
+		}
+	}
+	for name, constraint := range upload {
+		if _, ok := source[name]; !ok {
+			errors = append(errors, fmt.Sprintf("%s %s (%s) is not in the source", kind, name, constraint))
+		}
+	}
+	return errors
+}
+
+// normalizeConstraint returns a constraint in the form Chef stores it, so
+// e.g. '1.0' and '= 1.0.0' are considered equal
+func normalizeConstraint(c string) string {
+	c = strings.TrimSpace(c)
+	if c == "" {
+		return ">= 0.0.0"
+	}
+	m := constraintParts.FindStringSubmatch(c)
+	if m == nil {
+		return c
+	}
+	op := m[1]
+	if op == "" {
+		op = "="
+	}
+	// The number of parts is significant for a pessimistic constraint
+	if op == "~>" {
+		return fmt.Sprintf("%s %s", op, m[2])
+	}
+	return fmt.Sprintf("%s %s", op, normalizeVersion(m[2]))
+}
+
+// normalizeVersion pads a version to three parts
+func normalizeVersion(v string) string {
+	v = strings.TrimSpace(v)
+	for strings.Count(v, ".") < 2 {
+		v += ".0"
+	}
+	return v
+}
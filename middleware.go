@@ -0,0 +1,251 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var panicsTotal = expvar.NewInt("panics_total")
+
+type stageKey struct{}
+
+// stageTracker records the processing stage a request is in, so we know
+// where we were when something goes wrong
+type stageTracker struct {
+	sync.Mutex
+	stage string
+}
+
+func (s *stageTracker) set(stage string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.stage = stage
+	s.Unlock()
+}
+
+func (s *stageTracker) get() string {
+	if s == nil {
+		return "unknown"
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.stage
+}
+
+func stageFromRequest(r *http.Request) *stageTracker {
+	st, _ := r.Context().Value(stageKey{}).(*stageTracker)
+	return st
+}
+
+// setStage updates the processing stage of the request
+func setStage(r *http.Request, stage string) {
+	stageFromRequest(r).set(stage)
+}
+
+func (cg *ChefGuard) setStage(stage string) {
+	cg.stage.set(stage)
+}
+
+// clientGone returns true if the client disconnected, in which case there
+// is no one left to answer and any remaining work can be skipped
+func (cg *ChefGuard) clientGone() bool {
+	if cg.ctx.Err() == nil {
+		return false
+	}
+	logf(INFO, cg.RequestID, "Stopped processing the request of %s during stage %s: the client disconnected", cg.User, cg.stage.get())
+	return true
+}
+
+// recoverHandler recovers from any panic in the wrapped handler, writes a
+// crash report and returns a clean 500 to the client
+func recoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), stageKey{}, &stageTracker{stage: "routing"}))
+
+		fw := &failSafeWriter{ResponseWriter: w}
+		defer recoverPanic(r, func(rec interface{}, report string) {
+			if !fw.written {
+				errorHandler(fw, fmt.Sprintf("Internal Chef-Guard error (crash report %s)", report), http.StatusInternalServerError)
+			}
+		})
+
+		h.ServeHTTP(fw, r)
+	})
+}
+
+// goSafe runs f in a new goroutine started by the request, recovering from
+// any panic so background work can never take down the whole process
+func goSafe(r *http.Request, f func()) {
+	go func() {
+		defer recoverPanic(r, nil)
+		f()
+	}()
+}
+
+// recoverPanic recovers from a panic, writes a crash report and calls handle
+// (if set) with the name of the report, so the caller can still answer the
+// request. It must be deferred directly. Handlers pass on http.ErrAbortHandler,
+// as the server uses it to abort a response.
+func recoverPanic(r *http.Request, handle func(rec interface{}, report string)) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler && handle != nil {
+		panic(rec)
+	}
+	report := reportCrash(r, rec, debug.Stack())
+	if handle != nil {
+		handle(rec, report)
+	}
+}
+
+// backgroundRequest returns the request recorded in the crash reports of
+// work that outlives the request that started it
+func backgroundRequest(id, what string) *http.Request {
+	r := &http.Request{Method: "-", URL: &url.URL{Path: what}, Header: make(http.Header)}
+	return r.WithContext(withRequestID(context.Background(), id))
+}
+
+// reportCrash logs the panic, writes a crash report to disk and returns the
+// name of the written report
+func reportCrash(r *http.Request, rec interface{}, stack []byte) string {
+	panicsTotal.Add(1)
+
+	name := fmt.Sprintf("crash-%s.txt", time.Now().Format("20060102-150405.000000000"))
+
+	headers := []string{}
+	for k, v := range r.Header {
+		// Never write any credentials to disk
+		if isCredentialHeader(k) {
+			continue
+		}
+		headers = append(headers, fmt.Sprintf("  %s: %s", k, strings.Join(v, ", ")))
+	}
+	sort.Strings(headers)
+
+	report := fmt.Sprintf("Time:    %s\nRequest: %s\nMethod:  %s\nURL:     %s\nUser:    %s\nRemote:  %s\nStage:   %s\nPanic:   %v\n\nHeaders:\n%s\n\nStack:\n%s",
+		time.Now().Format(time.RFC3339),
+		requestID(r),
+		r.Method,
+		r.URL.String(),
+		r.Header.Get("X-Ops-Userid"),
+		clientIP(r),
+		stageFromRequest(r).get(),
+		rec,
+		strings.Join(headers, "\n"),
+		stack,
+	)
+
+	logf(ERROR, requestID(r), "Panic while processing %s %s in stage %s: %v (crash report %s)",
+		r.Method, r.URL.Path, stageFromRequest(r).get(), rec, name)
+
+	if err := os.MkdirAll(getConfig().Default.CrashDir, 0755); err != nil {
+		logf(ERROR, requestID(r), "Failed to create crash report directory %s: %s", getConfig().Default.CrashDir, err)
+		return name
+	}
+	if err := ioutil.WriteFile(path.Join(getConfig().Default.CrashDir, name), []byte(report), 0600); err != nil {
+		logf(ERROR, requestID(r), "Failed to write crash report %s: %s", name, err)
+	}
+
+	return name
+}
+
+// isCredentialHeader returns true if the header contains credentials
+func isCredentialHeader(k string) bool {
+	return strings.HasPrefix(k, "X-Ops-Authorization") || k == "Authorization" || k == "X-Ops-Content-Hash"
+}
+
+// failSafeWriter keeps track of whether a response was already started
+type failSafeWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *failSafeWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *failSafeWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// failSafe recovers from panics in the wrapped handler and handles them as
+// internal errors, so depending on the config the request is either rejected
+// or passed through to the Chef server.
+func failSafe(p http.Handler, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := dumpBody(r)
+		if err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+			return
+		}
+
+		fw := &failSafeWriter{ResponseWriter: w}
+		defer recoverPanic(r, func(rec interface{}, report string) {
+			if fw.written {
+				return
+			}
+			msg := fmt.Sprintf("Panic while processing %s %s: %v (crash report %s)", r.Method, r.URL.Path, rec, report)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			internalError(fw, r, p, msg)
+		})
+
+		h(fw, r)
+	}
+}
+
+// internalError handles failures within Chef-Guard itself. Depending on the
+// config the request is rejected or transparently passed through to the
+// Chef server while sending an alert.
+func internalError(w http.ResponseWriter, r *http.Request, p http.Handler, msg string) {
+	org := getChefOrgFromRequest(r)
+	if !passthroughOnError(org, mux.Vars(r)["type"]) {
+		errorHandler(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	alert(requestID(r), org,
+		fmt.Sprintf("Internal error, passing %s %s through to Chef", r.Method, r.URL.Path),
+		fmt.Sprintf("User: %s\nClient IP: %s\nRequest ID: %s\n\n%s", r.Header.Get("X-Ops-Userid"), clientIP(r), requestID(r), msg),
+	)
+	p.ServeHTTP(w, r)
+}
+
+func passthroughOnError(org, endpointType string) bool {
+	return containsType(getEffectiveConfig("PassthroughOnError", org).(string), endpointType)
+}
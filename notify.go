@@ -0,0 +1,74 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sendAlert sends an alert for the organization of the request, adding the
+// request ID so the alert can be correlated with the logs
+func (cg *ChefGuard) sendAlert(subject, body string) {
+	if cg.RequestID != "" {
+		body = fmt.Sprintf("%s\n\nRequest ID: %s", body, cg.RequestID)
+	}
+	alert(cg.RequestID, cg.ChefOrg, subject, body)
+}
+
+// sendAlert logs the alert and, when mail is configured for the org, also
+// mails the alert to the configured recipient.
+func sendAlert(org, subject, body string) {
+	alert("", org, subject, body)
+}
+
+// alert logs and mails the alert, prefixing the log lines with the ID of the
+// request that caused the alert (if any)
+func alert(id, org, subject, body string) {
+	logf(WARNING, id, "%s: %s", subject, body)
+
+	if err := mailAlert(org, subject, body); err != nil {
+		logf(ERROR, id, "Failed to send alert %q: %s", subject, err)
+	}
+}
+
+// mailAlert mails the alert to the configured recipient, if mail is
+// configured for the org
+func mailAlert(org, subject, body string) error {
+	if getEffectiveConfig("MailServer", org).(string) == "" ||
+		getEffectiveConfig("MailRecipient", org).(string) == "" {
+		return nil
+	}
+
+	from := getEffectiveConfig("MailSendBy", org).(string)
+	if from == "" {
+		from = fmt.Sprintf("%s@%s", getConfig().Chef.User, getEffectiveConfig("MailDomain", org).(string))
+	}
+
+	msg := fmt.Sprintf(`From: %s
+To: %s
+Date: %s
+Subject: [%s CHEF-GUARD] %s
+MIME-version: 1.0
+Content-Type: text/plain; charset="UTF-8"
+
+%s
+`, from, getEffectiveConfig("MailRecipient", org).(string), time.Now().Format(time.RFC1123Z), strings.ToUpper(org), subject, body)
+
+	return mailDiff(org, from, msg)
+}
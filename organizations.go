@@ -0,0 +1,169 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/gorilla/mux"
+	"github.com/xanzy/chef-guard/git"
+)
+
+// processOrganization intercepts the creation and deletion of organizations,
+// so the Git repo of the organization can be provisioned or archived
+func processOrganization(p *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := mux.Vars(r)["org"]
+		if r.Method == "POST" {
+			body, err := dumpBody(r)
+			if err != nil {
+				errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+				return
+			}
+			n, err := unmarshalName(body)
+			if err != nil {
+				errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(body), err), http.StatusBadRequest)
+				return
+			}
+			org = n.Name
+		}
+
+		aw := &accessLogWriter{ResponseWriter: w}
+		p.ServeHTTP(aw, r)
+
+		if aw.status != http.StatusOK && aw.status != http.StatusCreated {
+			return
+		}
+
+		user := r.Header.Get("X-Ops-Userid")
+		if r.Method == "POST" {
+			goSafe(r, func() { provisionOrganization(requestID(r), org, user) })
+		} else {
+			goSafe(r, func() { archiveOrganization(requestID(r), org, user) })
+		}
+	}
+}
+
+// provisionOrganization creates the Git repo for a new organization
+func provisionOrganization(id, org, user string) {
+	cg, err := newChefGuardForOrg(user, org, false)
+	if err != nil {
+		logf(ERROR, id, "Failed to create a new ChefGuard structure: %s", err)
+		return
+	}
+	cg.setRequestID(id)
+
+	repo := "not created"
+	if getConfig().Organizations.CreateRepos && getEffectiveConfig("CommitChanges", org).(bool) && cg.Repo == org {
+		if err := cg.createOrgRepo(); err != nil {
+			cg.sendAlert(
+				fmt.Sprintf("Failed to create Git repo for new organization %s", org),
+				fmt.Sprintf("Organization %s was created by %s, but creating repo %s failed: %s", org, user, cg.Repo, err),
+			)
+			return
+		}
+		repo = cg.Repo
+	}
+
+	policy := "the default policies"
+	if _, ok := getConfig().Customer[org]; ok {
+		policy = fmt.Sprintf("the policies of [customer %q]", org)
+	}
+
+	cg.sendAlert(
+		fmt.Sprintf("Organization %s created", org),
+		fmt.Sprintf("Organization %s was created by %s.\n\nGit repo: %s\nPolicies: %s", org, user, repo, policy),
+	)
+}
+
+func (cg *ChefGuard) createOrgRepo() error {
+	gitClient, err := getCustomClient(getConfig().Default.GitConfig)
+	if err != nil {
+		return err
+	}
+
+	exists, err := gitClient.RepoExists(cg.Repo)
+	if err != nil || exists {
+		return err
+	}
+
+	usr := &git.User{
+		Name: getConfig().Chef.User,
+		Mail: fmt.Sprintf("%s@%s", getConfig().Chef.User, getEffectiveConfig("MailDomain", cg.ChefOrg).(string)),
+	}
+	if err := gitClient.CreateRepo(cg.Repo, usr); err != nil {
+		return err
+	}
+
+	gitTargets.Lock()
+	delete(gitTargets.m, cg.Repo)
+	gitTargets.Unlock()
+
+	return nil
+}
+
+func (cg *ChefGuard) archiveOrgRepo() (bool, error) {
+	gitClient, err := getCustomClient(getConfig().Default.GitConfig)
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := gitClient.RepoExists(cg.Repo)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	return true, gitClient.ArchiveRepo(cg.Repo)
+}
+
+// archiveOrganization archives the Git repo of a deleted organization
+func archiveOrganization(id, org, user string) {
+	cg, err := newChefGuardForOrg(user, org, false)
+	if err != nil {
+		logf(ERROR, id, "Failed to create a new ChefGuard structure: %s", err)
+		return
+	}
+	cg.setRequestID(id)
+
+	repo := "not archived"
+	if getConfig().Organizations.ArchiveRepos && cg.Repo == org {
+		archived, err := cg.archiveOrgRepo()
+		if err != nil {
+			cg.sendAlert(
+				fmt.Sprintf("Failed to archive Git repo of deleted organization %s", org),
+				fmt.Sprintf("Organization %s was deleted by %s, but archiving repo %s failed: %s", org, user, cg.Repo, err),
+			)
+			return
+		}
+		if archived {
+			repo = fmt.Sprintf("%s (archived)", cg.Repo)
+		}
+	}
+
+	gitTargets.Lock()
+	delete(gitTargets.m, cg.Repo)
+	gitTargets.Unlock()
+
+	forgetOrganizationID(org)
+
+	cg.sendAlert(
+		fmt.Sprintf("Organization %s deleted", org),
+		fmt.Sprintf("Organization %s was deleted by %s.\n\nGit repo: %s", org, user, repo),
+	)
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// overrideHeader is the header used to override a blocked upload. Its value
+// is '<secret> <justification>', admin users can omit the secret.
+const overrideHeader = "X-Chef-Guard-Override"
+
+// parseOverride validates the override and returns the justification, or
+// an empty string if the override is not valid
+func (cg *ChefGuard) parseOverride(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+
+	if containsFold(splitList(getEffectiveConfig("OverrideUsers", cg.ChefOrg).(string)), cg.User) {
+		return value
+	}
+
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return ""
+	}
+	for _, secret := range splitList(getEffectiveConfig("OverrideSecrets", cg.ChefOrg).(string)) {
+		if subtle.ConstantTimeCompare([]byte(parts[0]), []byte(secret)) == 1 {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// overrideBlock returns true if a blocked upload may proceed because of a
+// valid override, in which case the override is audited and notified
+func (cg *ChefGuard) overrideBlock(w http.ResponseWriter, errCode int, err error) bool {
+	if errCode != http.StatusPreconditionFailed || cg.Override == "" {
+		return false
+	}
+
+	stage := cg.stage.get()
+	item := fmt.Sprintf("cookbooks/%s/%s", cg.Cookbook.Name, cg.Cookbook.Version)
+
+	recordAudit(cg.ChefOrg, "override", cg.User, cg.ClientIP, item, fmt.Sprintf("%s: %s", stage, cg.Override))
+	cg.sendAlert(
+		fmt.Sprintf("Blocked upload of cookbook %s version %s overridden by %s", cg.Cookbook.Name, cg.Cookbook.Version, cg.User),
+		fmt.Sprintf("The upload was blocked during stage %s, but %s overrode the block.\n\nJustification: %s\n\n%s",
+			stage, cg.User, cg.Override, err),
+	)
+
+	w.Header().Add("X-Chef-Guard-Warning", fmt.Sprintf("Block during stage %s was overridden", stage))
+	return true
+}
@@ -0,0 +1,186 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// previewRequest holds a proposed change to a role, environment, node,
+// client or data bag item
+type previewRequest struct {
+	Org  string          `json:"org"`
+	Type string          `json:"type"`
+	Bag  string          `json:"bag"`
+	Name string          `json:"name"`
+	Body json.RawMessage `json:"body"`
+}
+
+// PreviewResult holds the diffs and the validation verdict of a proposed
+// change
+type PreviewResult struct {
+	Verdict  string   `json:"verdict"`
+	Status   int      `json:"status,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	ChefDiff string   `json:"chef_diff"`
+	GitDiff  string   `json:"git_diff,omitempty"`
+}
+
+// previewHandler returns the diff of a proposed change versus the current
+// config in Chef and Git and the verdict of the validations, without
+// applying anything. The request must be signed by a Chef user or client,
+// which needs read permissions on the object (or its container when the
+// object doesn't exist yet).
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := dumpBody(r)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+		return
+	}
+	req := new(previewRequest)
+	if err := json.Unmarshal(body, req); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to unmarshal preview request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Body) == 0 {
+		errorHandler(w, "A preview request requires a name and body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := authenticateRequest(r, req.Org)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+		return
+	}
+
+	var endpoint, gitPath string
+	switch req.Type {
+	case "data":
+		if req.Bag == "" {
+			errorHandler(w, "Previewing a data bag item requires a bag", http.StatusBadRequest)
+			return
+		}
+		endpoint = fmt.Sprintf("data/%s/%s", req.Bag, req.Name)
+		gitPath = fmt.Sprintf("data_bags/%s/%s.json", req.Bag, req.Name)
+	case "clients", "environments", "nodes", "roles":
+		endpoint = fmt.Sprintf("%s/%s", req.Type, req.Name)
+		gitPath = fmt.Sprintf("%s/%s.json", req.Type, req.Name)
+	default:
+		errorHandler(w, fmt.Sprintf("Invalid type %q! Valid types are data, clients, environments, nodes and roles.", req.Type), http.StatusBadRequest)
+		return
+	}
+
+	cg, err := newChefGuardForOrg(user, req.Org, false)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err), http.StatusInternalServerError)
+		return
+	}
+	cg.ctx = r.Context()
+	cg.RequestID = requestID(r)
+	cg.EndpointType = req.Type
+
+	proposed, err := remarshalConfig(cg.ChefOrg, "PUT", req.Body)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(req.Body), err), http.StatusBadRequest)
+		return
+	}
+
+	current, err := cg.chefConfig(endpoint)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// The current config is read with our own key, so make sure the user is
+	// allowed to read it before returning anything
+	object := endpoint
+	if req.Type == "data" {
+		object = fmt.Sprintf("data/%s", req.Bag)
+	}
+	if current == nil {
+		object = fmt.Sprintf("containers/%s", req.Type)
+	}
+	allowed, err := hasPermission(cg.chefClient, user, "read", object)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to check the permissions of %s: %s", user, err), http.StatusBadGateway)
+		return
+	}
+	if !allowed {
+		errorHandler(w, fmt.Sprintf("%s is not allowed to read %s", user, endpoint), http.StatusForbidden)
+		return
+	}
+	res := &PreviewResult{ChefDiff: labeledDiff(gitPath, "chef", "proposed", current, proposed)}
+
+	if getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) {
+		if cg.gitClient, err = getCustomClientContext(cg.gitContext(), getConfig().Default.GitConfig); err != nil {
+			errorHandler(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		file, _, err := cg.gitClient.GetContent(cg.Repo, cg.gitPath(gitPath))
+		if err != nil {
+			errorHandler(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var content []byte
+		if file != nil {
+			content = []byte(file.Content)
+		}
+		res.GitDiff = labeledDiff(gitPath, "git", "proposed", content, proposed)
+	}
+
+	cg.previewVerdict(res, current == nil, req.Bag, req.Body)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode preview: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// previewVerdict runs the same validations as a real change would and
+// records the verdict in the result
+func (cg *ChefGuard) previewVerdict(res *PreviewResult, create bool, bag string, body []byte) {
+	method := "PUT"
+	if create {
+		method = "POST"
+	}
+	vars := map[string]string{"type": cg.EndpointType, "bag": bag}
+
+	vw := &verdictWriter{header: make(http.Header)}
+	res.Verdict = "passed"
+	if cg.validateChange(vw, method, vars, body) {
+		res.Verdict = "blocked"
+		// Audit mode never blocks a change, it only records the verdict
+		if cg.auditChanges() {
+			res.Verdict = "warning"
+		}
+	} else if exemptUser("ExemptValidation", cg.ChefOrg, cg.User) {
+		res.Verdict = "exempt"
+	} else if getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType) == "permissive" {
+		// Permissive mode saves the change, but still returns the errors
+		if errCode, err := cg.validateConstraints(body); err != nil {
+			res.Verdict = "warning"
+			errorHandler(vw, err.Error(), errCode)
+		}
+	}
+	res.Status = vw.status
+	res.Message = strings.TrimSpace(vw.body.String())
+	res.Warnings = vw.header["X-Chef-Guard-Warning"]
+}
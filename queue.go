@@ -0,0 +1,479 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanzy/chef-guard/git"
+)
+
+// queueVersion is the format version of queue entries written by this release.
+// Entries with a higher version are left for an instance that supports them.
+const queueVersion = 1
+
+// staleClaim is the time after which a claimed entry is assumed to belong to
+// an instance that died while replaying it
+const staleClaim = time.Hour
+
+// QueueEntry represents a single failed operation that needs to be retried
+type QueueEntry struct {
+	ID          string          `json:"id"`
+	Version     int             `json:"version,omitempty"`
+	Kind        string          `json:"kind"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+	Owner       string          `json:"owner,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// diskQueue is a bounded queue which persists every entry as a JSON file
+type diskQueue struct {
+	sync.Mutex
+	dir string
+	max int
+}
+
+var retryQueue *diskQueue
+
+// queueOwner identifies this instance in the entries it persists before
+// executing them
+var queueOwner, _ = os.Hostname()
+
+// queueHandlers maps the kind of a queue entry to the function replaying it
+var queueHandlers = map[string]func(*QueueEntry) error{}
+
+func initQueue() error {
+	if getConfig().Queue.Path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(getConfig().Queue.Path, 0755); err != nil {
+		return fmt.Errorf("Failed to create queue directory %s: %s", getConfig().Queue.Path, err)
+	}
+	retryQueue = &diskQueue{dir: getConfig().Queue.Path, max: getConfig().Queue.MaxItems}
+	retryQueue.recoverInterrupted()
+	return nil
+}
+
+func newQueueEntry(kind string, payload interface{}) (*QueueEntry, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueueEntry{
+		ID:          fmt.Sprintf("%d-%s", time.Now().UnixNano(), kind),
+		Version:     queueVersion,
+		Kind:        kind,
+		NextAttempt: time.Now().Add(backoff(0)),
+		Payload:     data,
+	}, nil
+}
+
+// push adds a new entry to the queue, dropping the oldest entry if the queue is full
+func (q *diskQueue) push(kind string, payload interface{}, lastErr error) error {
+	e, err := newQueueEntry(kind, payload)
+	if err != nil {
+		return err
+	}
+	if lastErr != nil {
+		e.LastError = lastErr.Error()
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if err := q.makeRoom(); err != nil {
+		return err
+	}
+
+	return q.write(e)
+}
+
+// pushClaimed persists an operation before it is executed. The entry is
+// claimed by this instance right away, so it is only replayed when the
+// operation fails (see retry) or when the instance dies while executing it.
+func (q *diskQueue) pushClaimed(kind string, payload interface{}) (*QueueEntry, error) {
+	e, err := newQueueEntry(kind, payload)
+	if err != nil {
+		return nil, err
+	}
+	e.Owner = queueOwner
+
+	q.Lock()
+	defer q.Unlock()
+
+	if err := q.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	return e, q.writeFile(e, ".claimed")
+}
+
+// update replaces the payload of an entry claimed by pushClaimed, for
+// operations that change before they are executed (e.g. debounced updates)
+func (q *diskQueue) update(e *QueueEntry, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	e.Payload = data
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.writeFile(e, ".claimed")
+}
+
+// retry releases a claimed entry of which the operation failed, so it is
+// replayed by the next queue run after the backoff
+func (q *diskQueue) retry(e *QueueEntry, lastErr error) error {
+	e.Owner = ""
+	e.LastError = lastErr.Error()
+	e.NextAttempt = time.Now().Add(backoff(e.Attempts))
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.release(e)
+}
+
+// done removes a claimed entry of which the operation succeeded
+func (q *diskQueue) done(e *QueueEntry) error {
+	q.Lock()
+	defer q.Unlock()
+
+	return os.Remove(filepath.Join(q.dir, e.ID+".claimed"))
+}
+
+// makeRoom drops the oldest entries until there is room for a new entry
+func (q *diskQueue) makeRoom() error {
+	if q.max <= 0 {
+		return nil
+	}
+
+	ids, err := q.ids()
+	if err != nil {
+		return err
+	}
+	for len(ids) >= q.max {
+		ERROR.Printf("Queue is full, dropping entry %s", ids[0])
+		os.Remove(filepath.Join(q.dir, ids[0]+".json"))
+		ids = ids[1:]
+	}
+
+	return nil
+}
+
+func (q *diskQueue) write(e *QueueEntry) error {
+	return q.writeFile(e, ".json")
+}
+
+func (q *diskQueue) writeFile(e *QueueEntry, ext string) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so we never end up with a partial entry
+	tmp := filepath.Join(q.dir, e.ID+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, e.ID+ext))
+}
+
+// ids returns the IDs of all queued entries ordered from old to new
+func (q *diskQueue) ids() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(f), ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (q *diskQueue) read(id string) (*QueueEntry, error) {
+	return readQueueEntry(filepath.Join(q.dir, id+".json"))
+}
+
+func readQueueEntry(file string) (*QueueEntry, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	e := new(QueueEntry)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	if e.Version == 0 {
+		e.Version = 1
+	}
+	return e, nil
+}
+
+// claim atomically renames an entry, so other instances sharing the queue
+// directory will not replay the same entry at the same time. A rename keeps
+// the modification time of the entry, so it is updated to mark when the
+// entry was claimed (see recoverClaims).
+func (q *diskQueue) claim(id string) bool {
+	claimed := filepath.Join(q.dir, id+".claimed")
+	if err := os.Rename(filepath.Join(q.dir, id+".json"), claimed); err != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(claimed, now, now)
+	return true
+}
+
+// release makes a claimed entry available again after updating it
+func (q *diskQueue) release(e *QueueEntry) error {
+	if err := q.write(e); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(q.dir, e.ID+".claimed"))
+}
+
+// recoverClaims releases the entries claimed by instances that died while
+// replaying them, which is detected by the time since they were claimed. The
+// entries this instance persisted before executing them are still in flight
+// (e.g. waiting for a lock or a debounce window), so instead of releasing
+// them their claim is refreshed for the other instances sharing the queue.
+func (q *diskQueue) recoverClaims() {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.claimed"))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, f := range files {
+		if e, err := readQueueEntry(f); err == nil && e.Owner != "" && e.Owner == queueOwner {
+			os.Chtimes(f, now, now)
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil || time.Since(fi.ModTime()) < staleClaim {
+			continue
+		}
+		WARNING.Printf("Releasing stale claim on queue entry %s", filepath.Base(f))
+		os.Rename(f, strings.TrimSuffix(f, ".claimed")+".json")
+	}
+}
+
+// recoverInterrupted releases the entries this instance persisted before
+// executing them, but that were never finished because it was stopped or
+// crashed. They are replayed by the first queue run after starting.
+func (q *diskQueue) recoverInterrupted() {
+	q.Lock()
+	defer q.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.claimed"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		e, err := readQueueEntry(f)
+		if err != nil || e.Owner == "" || e.Owner != queueOwner {
+			continue
+		}
+		INFO.Printf("Replaying queue entry %s that was interrupted by a restart", e.ID)
+		e.Owner = ""
+		e.NextAttempt = time.Now()
+		if err := q.release(e); err != nil {
+			ERROR.Printf("Failed to release queue entry %s: %s", e.ID, err)
+		}
+	}
+}
+
+// process replays all entries that are due
+func (q *diskQueue) process() {
+	q.Lock()
+	q.recoverClaims()
+	ids, err := q.ids()
+	q.Unlock()
+	if err != nil {
+		ERROR.Printf("Failed to read queue %s: %s", q.dir, err)
+		return
+	}
+
+	for _, id := range ids {
+		e, err := q.read(id)
+		if err != nil {
+			ERROR.Printf("Failed to read queue entry %s: %s", id, err)
+			continue
+		}
+		if time.Now().Before(e.NextAttempt) {
+			continue
+		}
+
+		// Entries written by a newer release (e.g. during a rolling upgrade)
+		// are left for an instance that knows how to replay them
+		if e.Version > queueVersion {
+			continue
+		}
+		handler, ok := queueHandlers[e.Kind]
+		if !ok {
+			ERROR.Printf("Unknown queue entry kind %q for entry %s", e.Kind, e.ID)
+			continue
+		}
+
+		q.Lock()
+		claimed := q.claim(id)
+		q.Unlock()
+		if !claimed {
+			continue
+		}
+
+		if err := handler(e); err != nil {
+			e.Attempts++
+			e.LastError = err.Error()
+			e.NextAttempt = time.Now().Add(backoff(e.Attempts))
+			WARNING.Printf("Retry %d of queue entry %s failed: %s", e.Attempts, e.ID, err)
+
+			// Entries that failed permanently are dead-lettered right away
+			if !transient(err) || getConfig().Queue.MaxAttempts > 0 && e.Attempts >= getConfig().Queue.MaxAttempts {
+				q.Lock()
+				q.deadLetter(e)
+				q.Unlock()
+				continue
+			}
+
+			q.Lock()
+			if err := q.release(e); err != nil {
+				ERROR.Printf("Failed to update queue entry %s: %s", e.ID, err)
+			}
+			q.Unlock()
+			continue
+		}
+
+		q.Lock()
+		if err := os.Remove(filepath.Join(q.dir, e.ID+".claimed")); err != nil {
+			ERROR.Printf("Failed to remove queue entry %s: %s", e.ID, err)
+		}
+		q.Unlock()
+	}
+}
+
+// deadLetter moves a claimed entry that failed too many times to the dead
+// letter log and sends an alert
+func (q *diskQueue) deadLetter(e *QueueEntry) {
+	logFile := getConfig().Queue.DeadLetter
+	if logFile == "" {
+		logFile = filepath.Join(q.dir, "dead-letter.log")
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		ERROR.Printf("Failed to marshal queue entry %s: %s", e.ID, err)
+		return
+	}
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		ERROR.Printf("Failed to open dead letter log %s: %s", logFile, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		ERROR.Printf("Failed to write queue entry %s to the dead letter log: %s", e.ID, err)
+		return
+	}
+	if err := os.Remove(filepath.Join(q.dir, e.ID+".claimed")); err != nil {
+		ERROR.Printf("Failed to remove queue entry %s: %s", e.ID, err)
+	}
+
+	sendAlert("",
+		fmt.Sprintf("Giving up on queued %s operation after %d attempts", e.Kind, e.Attempts),
+		fmt.Sprintf("Queue entry %s failed %d times and is moved to %s.\n\nLast error: %s",
+			e.ID, e.Attempts, logFile, e.LastError),
+	)
+}
+
+func (q *diskQueue) run() {
+	interval := time.Duration(getConfig().Queue.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+	for {
+		q.process()
+		time.Sleep(interval)
+	}
+}
+
+// retryWithBackoff calls fn until it succeeds, fails permanently or the
+// number of attempts is reached
+func retryWithBackoff(attempts int, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil || !transient(err) {
+			return err
+		}
+		if i < attempts-1 {
+			time.Sleep(backoff(i))
+		}
+	}
+	return err
+}
+
+// statusError is returned when a call was answered with an unexpected
+// status, so permanent failures can be told apart from transient ones
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+// transient returns false if err is an error response that will be the same
+// when the call is tried again, like a 4xx response of the Supermarket,
+// GitHub or GitLab
+func transient(err error) bool {
+	if e, ok := err.(*statusError); ok {
+		return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+	}
+	return git.IsTransient(err)
+}
+
+// backoff returns an exponential backoff duration (capped at one hour) with
+// a random jitter of up to 50%
+func backoff(attempt int) time.Duration {
+	if attempt > 12 {
+		attempt = 12
+	}
+	d := time.Second << uint(attempt)
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
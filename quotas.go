@@ -0,0 +1,160 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quota holds the soft (warning) and hard (blocking) limit of a quota
+type quota struct {
+	soft int
+	hard int
+}
+
+// dailyVersions counts the new cookbook versions accepted per organization
+// today. The counters are kept in memory per instance, so they are reset on
+// a restart and each instance behind a load balancer counts its own uploads.
+var dailyVersions = struct {
+	sync.Mutex
+	day string
+	m   map[string]int
+}{m: make(map[string]int)}
+
+// parseQuota parses a quota in the form 'soft,hard', where a limit of 0
+// means that limit is disabled
+func parseQuota(s string) (*quota, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid quota %q! Quotas should be configured as 'soft,hard'.", s)
+	}
+	soft, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid soft limit in quota %q: %s", s, err)
+	}
+	hard, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hard limit in quota %q: %s", s, err)
+	}
+	return &quota{soft: soft, hard: hard}, nil
+}
+
+// checkQuota returns an error when the usage exceeds the hard limit, and
+// sets a warning header when it exceeds the soft limit
+func (cg *ChefGuard) checkQuota(w http.ResponseWriter, name string, usage int) (int, error) {
+	q, err := parseQuota(getEffectiveConfig(name, cg.ChefOrg).(string))
+	if err != nil || q == nil {
+		return 0, err
+	}
+
+	description := map[string]string{
+		"CookbookQuota":     "cookbooks",
+		"DailyVersionQuota": "new cookbook versions per day",
+		"EnvironmentQuota":  "environments",
+	}[name]
+
+	if q.hard > 0 && usage > q.hard {
+		return http.StatusPreconditionFailed, fmt.Errorf("\n=== Quota exceeded ===\n"+
+			"This change would exceed the quota of %d %s!\n"+
+			"Please contact the platform team to raise the quota.\n"+
+			"======================\n", q.hard, description)
+	}
+	if q.soft > 0 && usage > q.soft {
+		msg := fmt.Sprintf("Using %d of %d %s (hard limit %d)", usage, q.soft, description, q.hard)
+		logf(WARNING, cg.RequestID, "Quota warning for organization %q: %s", cg.ChefOrg, msg)
+		w.Header().Add("X-Chef-Guard-Warning", msg)
+	}
+	return 0, nil
+}
+
+// checkCookbookQuotas checks the total cookbook and daily version quotas
+func (cg *ChefGuard) checkCookbookQuotas(w http.ResponseWriter) (int, error) {
+	if getEffectiveConfig("CookbookQuota", cg.ChefOrg).(string) != "" {
+		cookbooks, err := cg.chefClient.GetCookbooks()
+		if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("Failed to get cookbooks: %s", err)
+		}
+		if _, exists := cookbooks[cg.Cookbook.Name]; !exists {
+			if errCode, err := cg.checkQuota(w, "CookbookQuota", len(cookbooks)+1); err != nil {
+				return errCode, err
+			}
+		}
+	}
+
+	if getEffectiveConfig("DailyVersionQuota", cg.ChefOrg).(string) != "" {
+		_, exists, err := cg.chefClient.GetCookbookVersion(cg.Cookbook.Name, cg.Cookbook.Version)
+		if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("Failed to get cookbook %s version %s: %s", cg.Cookbook.Name, cg.Cookbook.Version, err)
+		}
+		if exists {
+			return 0, nil
+		}
+
+		dailyVersions.Lock()
+		defer dailyVersions.Unlock()
+
+		// Uploads in audit mode are only validated, so they don't count
+		cg.newVersion = !cg.auditMode()
+
+		resetDailyVersions()
+		if errCode, err := cg.checkQuota(w, "DailyVersionQuota", dailyVersions.m[cg.ChefOrg]+1); err != nil {
+			return errCode, err
+		}
+	}
+
+	return 0, nil
+}
+
+// countDailyVersion counts a new cookbook version once Chef accepted it, so
+// rejected uploads don't use up the daily version quota
+func (cg *ChefGuard) countDailyVersion() {
+	dailyVersions.Lock()
+	defer dailyVersions.Unlock()
+
+	resetDailyVersions()
+	dailyVersions.m[cg.ChefOrg]++
+}
+
+// resetDailyVersions resets the counters when a new day started. The caller
+// must hold the dailyVersions lock.
+func resetDailyVersions() {
+	if today := time.Now().In(timeZone()).Format("2006-01-02"); dailyVersions.day != today {
+		dailyVersions.day = today
+		dailyVersions.m = make(map[string]int)
+	}
+}
+
+// checkEnvironmentQuota checks the environment quota when creating a new
+// environment
+func (cg *ChefGuard) checkEnvironmentQuota(w http.ResponseWriter) (int, error) {
+	if getEffectiveConfig("EnvironmentQuota", cg.ChefOrg).(string) == "" {
+		return 0, nil
+	}
+	envs, err := cg.chefClient.GetEnvironments()
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("Failed to get environments: %s", err)
+	}
+	return cg.checkQuota(w, "EnvironmentQuota", len(envs)+1)
+}
@@ -0,0 +1,347 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xanzy/chef-guard/git"
+)
+
+// unverifiedCookbooks holds the number of cookbook versions per organization
+// that were never uploaded through Chef-Guard, as counted by the last reconcile
+var unverifiedCookbooks = expvar.NewMap("unverified_cookbooks")
+
+// startReconciler periodically compares the config on the Chef server with
+// the config in Git, to catch changes that bypassed Chef-Guard or that were
+// lost because a Git update failed
+func startReconciler() {
+	if getConfig().Reconcile.Interval == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(getConfig().Reconcile.Interval) * time.Second)
+			reconcile()
+		}
+	}()
+}
+
+func reconcile() {
+	for _, org := range reconcileOrgs() {
+		if !getEffectiveConfig("CommitChanges", org).(bool) {
+			continue
+		}
+
+		cg, err := newChefGuardForOrg(getConfig().Chef.User, org, false)
+		if err != nil {
+			ERROR.Printf("Failed to create a new ChefGuard structure: %s", err)
+			continue
+		}
+
+		drift, err := cg.reconcile()
+		if err != nil {
+			ERROR.Printf("Failed to reconcile the config of organization %q: %s", org, err)
+			continue
+		}
+		if err := cg.countUnverifiedCookbooks(); err != nil {
+			ERROR.Printf("Failed to count the unverified cookbooks of organization %q: %s", org, err)
+		}
+		if len(drift) == 0 {
+			continue
+		}
+
+		action := "Found"
+		if getConfig().Reconcile.Mode == "commit" {
+			action = "Committed"
+		}
+		sendAlert(org,
+			fmt.Sprintf("%s drift between Chef and Git for %d item(s)", action, len(drift)),
+			fmt.Sprintf("The following items differ between the Chef server and repo %s:\n\n%s",
+				cg.Repo, strings.Join(drift, "\n")),
+		)
+	}
+}
+
+// reconcileOrgs returns the organizations that should be reconciled
+func reconcileOrgs() []string {
+	if getConfig().Reconcile.Orgs != "" {
+		var orgs []string
+		for _, org := range strings.Split(getConfig().Reconcile.Orgs, ",") {
+			orgs = append(orgs, strings.TrimSpace(org))
+		}
+		return orgs
+	}
+	if getConfig().Chef.Type != "enterprise" {
+		return []string{""}
+	}
+
+	var orgs []string
+	for org := range getConfig().Customer {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+// reconcile compares all roles, environments, data bags and nodes with the
+// files in Git and returns a description of the items that drifted
+func (cg *ChefGuard) reconcile() ([]string, error) {
+	gitConfig, ok := getConfig().Git[getConfig().Default.GitConfig]
+	if !ok {
+		return nil, fmt.Errorf("No Git config specified for: %s!", getConfig().Default.GitConfig)
+	}
+	var err error
+	if cg.gitClient, err = git.NewGitClient(gitConfig); err != nil {
+		return nil, fmt.Errorf("Failed to create Git client: %s", err)
+	}
+
+	items, err := cg.chefItems()
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []string
+
+	// Check for items that are missing or differ in Git
+	paths := make([]string, 0, len(items))
+	for p := range items {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		config, err := cg.chefConfig(items[p])
+		if err != nil {
+			return drift, err
+		}
+		if config == nil {
+			// The item was deleted while reconciling
+			continue
+		}
+		file, _, err := cg.gitClient.GetContent(cg.Repo, cg.gitPath(p))
+		if err != nil {
+			return drift, err
+		}
+		if file != nil && file.Content == string(config) {
+			continue
+		}
+
+		drift = append(drift, fmt.Sprintf(" - %s (changed)", p))
+		recordAudit(cg.ChefOrg, "drift", "", "", p, "changed")
+		if err := cg.commitDrift(p, "PUT", config); err != nil {
+			return drift, err
+		}
+	}
+
+	// Check for items that only exist in Git
+	gitFiles, err := cg.gitFiles()
+	if err != nil {
+		return drift, err
+	}
+	for _, p := range gitFiles {
+		if _, ok := items[p]; ok {
+			continue
+		}
+
+		drift = append(drift, fmt.Sprintf(" - %s (deleted)", p))
+		recordAudit(cg.ChefOrg, "drift", "", "", p, "deleted")
+		if err := cg.commitDrift(p, "DELETE", []byte("\n")); err != nil {
+			return drift, err
+		}
+	}
+
+	return drift, nil
+}
+
+// countUnverifiedCookbooks counts the (legacy) cookbook versions on the Chef
+// server that were never committed to Git, as every upload that passes
+// Chef-Guard is committed
+func (cg *ChefGuard) countUnverifiedCookbooks() error {
+	versions, err := cg.cookbookVersions()
+	if err != nil {
+		return err
+	}
+
+	_, entries, err := cg.gitClient.GetContent(cg.Repo, cg.gitPath("cookbooks"))
+	if err != nil {
+		return err
+	}
+	committed := make(map[string]bool)
+	for _, e := range git.DirEntries(entries) {
+		committed[path.Base(e)] = true
+	}
+
+	unverified := new(expvar.Int)
+	for pin := range versions {
+		if !committed[fmt.Sprintf("%s-%s.json", pin.name, pin.version)] {
+			unverified.Add(1)
+		}
+	}
+	unverifiedCookbooks.Set(orgLabel(cg.ChefOrg), unverified)
+
+	return nil
+}
+
+// chefItems returns the Git paths of all items on the Chef server mapped to
+// their Chef API endpoint
+func (cg *ChefGuard) chefItems() (map[string]string, error) {
+	items := make(map[string]string)
+
+	add := func(t string, list map[string]string, err error) error {
+		if err != nil {
+			return fmt.Errorf("Failed to get %s from Chef: %s", t, err)
+		}
+		for name := range list {
+			items[fmt.Sprintf("%s/%s.json", t, name)] = fmt.Sprintf("%s/%s", t, name)
+		}
+		return nil
+	}
+
+	roles, err := cg.chefClient.GetRoles()
+	if err := add("roles", roles, err); err != nil {
+		return nil, err
+	}
+	envs, err := cg.chefClient.GetEnvironments()
+	if err := add("environments", envs, err); err != nil {
+		return nil, err
+	}
+	nodes, err := cg.chefClient.GetNodes()
+	if err := add("nodes", nodes, err); err != nil {
+		return nil, err
+	}
+
+	bags, err := cg.chefClient.GetData()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get data bags from Chef: %s", err)
+	}
+	for bag := range bags {
+		bagItems, _, err := cg.chefClient.GetDataByName(bag)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get items of data bag %s from Chef: %s", bag, err)
+		}
+		for item := range bagItems {
+			items[fmt.Sprintf("data_bags/%s/%s.json", bag, item)] = fmt.Sprintf("data/%s/%s", bag, item)
+		}
+	}
+
+	return items, nil
+}
+
+// chefConfig returns the config of an item as it would be committed to Git,
+// or nil if the item doesn't exist
+func (cg *ChefGuard) chefConfig(endpoint string) ([]byte, error) {
+	resp, err := cg.chefClient.Get(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s from Chef: %s", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to get %s from Chef: %s", endpoint, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body of %s: %s", endpoint, err)
+	}
+
+	return remarshalConfig(cg.ChefOrg, "PUT", body)
+}
+
+// gitFiles returns the paths (without any monorepo prefix) of all config
+// files that are stored in Git
+func (cg *ChefGuard) gitFiles() ([]string, error) {
+	var files []string
+
+	list := func(dir string) ([]string, error) {
+		_, entries, err := cg.gitClient.GetContent(cg.Repo, cg.gitPath(dir))
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, e := range git.DirEntries(entries) {
+			paths = append(paths, path.Join(dir, path.Base(e)))
+		}
+		return paths, nil
+	}
+
+	for _, t := range []string{"roles", "environments", "nodes"} {
+		paths, err := list(t)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			if strings.HasSuffix(p, ".json") {
+				files = append(files, p)
+			}
+		}
+	}
+
+	bags, err := list("data_bags")
+	if err != nil {
+		return nil, err
+	}
+	for _, bag := range bags {
+		paths, err := list(bag)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			if strings.HasSuffix(p, ".json") {
+				files = append(files, p)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// commitDrift commits a drifted item to Git when running in commit mode
+func (cg *ChefGuard) commitDrift(p, action string, config []byte) error {
+	if getConfig().Reconcile.Mode != "commit" {
+		return nil
+	}
+
+	cg.ChangeDetails = changeDetailsFromPath(p)
+
+	unlock, err := ms.Lock(cg.Repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return cg.commitAndMail(action, config)
+}
+
+// changeDetailsFromPath returns the change details of a path in the repo
+func changeDetailsFromPath(p string) *changeDetails {
+	parts := strings.SplitN(p, "/", 2)
+	return &changeDetails{Type: parts[0], Item: parts[1]}
+}
@@ -0,0 +1,135 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces the values of all redacted keys
+const redactedValue = "REDACTED"
+
+// diffValue matches a single "key": value line of a JSON diff
+var diffValue = regexp.MustCompile(`^([-+ ]\s*"([^"]+)"\s*:\s*)(.*?)(,?)$`)
+
+// redactPatterns returns the compiled key patterns of an organization whose
+// values are redacted before being committed or mailed
+func redactPatterns(org string) []*regexp.Regexp {
+	return compilePatterns(getEffectiveConfig("RedactKeys", org).(string))
+}
+
+// redactValues replaces the values of all keys matching one of the patterns
+func redactValues(v interface{}, patterns []*regexp.Regexp) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if matchesAny(patterns, strings.ToLower(k)) {
+				t[k] = redactedValue
+				continue
+			}
+			redactValues(val, patterns)
+		}
+	case []interface{}:
+		for _, val := range t {
+			redactValues(val, patterns)
+		}
+	}
+}
+
+// redactDiff redacts the values of matching keys in a diff, which could still
+// contain secrets committed before redaction was enabled
+func redactDiff(org, diff string) string {
+	patterns := redactPatterns(org)
+	if len(patterns) == 0 {
+		return diff
+	}
+
+	lines := strings.Split(diff, "\n")
+	for i, l := range lines {
+		m := diffValue.FindStringSubmatch(l)
+		if m == nil || !matchesAny(patterns, strings.ToLower(m[2])) {
+			continue
+		}
+		// Values of nested objects and arrays are redacted line by line
+		if strings.HasPrefix(m[3], "{") || strings.HasPrefix(m[3], "[") {
+			continue
+		}
+		lines[i] = fmt.Sprintf("%s%q%s", m[1], redactedValue, m[4])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// restoreRedacted replaces all redacted values in the content with the
+// current values of the item on the Chef server, so applying config from
+// Git never overwrites the real values
+func (cg *ChefGuard) restoreRedacted(endpoint string, content []byte) ([]byte, error) {
+	if !bytes.Contains(content, []byte(fmt.Sprintf("%q", redactedValue))) {
+		return content, nil
+	}
+
+	resp, err := cg.chefClient.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Cannot restore the redacted values of %s, as it doesn't exist", endpoint)
+	}
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, err
+	}
+
+	var current, config interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(restoreValues(config, current))
+}
+
+func restoreValues(v, current interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if t == redactedValue && current != nil {
+			return current
+		}
+	case map[string]interface{}:
+		c, _ := current.(map[string]interface{})
+		for k, val := range t {
+			t[k] = restoreValues(val, c[k])
+		}
+	case []interface{}:
+		c, _ := current.([]interface{})
+		for i, val := range t {
+			var cv interface{}
+			if i < len(c) {
+				cv = c[i]
+			}
+			t[i] = restoreValues(val, cv)
+		}
+	}
+	return v
+}
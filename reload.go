@@ -0,0 +1,136 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/marpaia/chef-golang"
+	"github.com/xanzy/chef-guard/git"
+)
+
+// clientState holds the state derived from the config that is needed to
+// create the Chef and Supermarket clients. It is swapped as a whole when the
+// config is (re)loaded, so rotated keys are used by all new clients at once.
+var clientState = struct {
+	sync.RWMutex
+	generation     int
+	chefKey        string
+	supermarketKey string
+}{}
+
+// readClientKeys reads the Chef and Supermarket keys of the config, so a
+// reload with an unreadable key fails before anything is swapped
+func readClientKeys(c *Config) (chefKey, supermarketKey string, err error) {
+	key, err := readKey(c.Chef.Key)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read Chef key: %s", err)
+	}
+	chefKey = string(key)
+
+	if c.Supermarket.Server != "" && c.Supermarket.Key != "" {
+		key, err := readKey(c.Supermarket.Key)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read Supermarket key: %s", err)
+		}
+		supermarketKey = string(key)
+	}
+
+	return chefKey, supermarketKey, nil
+}
+
+// swapConfig activates a verified config together with its keys and drops
+// all cached state that was derived from the previous config. The config is
+// published through getConfig, so readers see either the old or the new one.
+//
+// Settings that are only used at startup still need a restart to be changed:
+// the listeners (listenip, listenport, TLS on or off and [management]), the
+// logging, the optional routes ([preview], [rollback], [approval], [webhook],
+// [chefclients] and the aggregated [universe]) and the background workers
+// (the retry queue, reconciler, reporter, rules watcher, universe refresher
+// and Vault refresher).
+func swapConfig(c Config, chefKey, supermarketKey string) {
+	clientState.Lock()
+	currentConfig.Store(&c)
+	clientState.generation++
+	clientState.chefKey = chefKey
+	clientState.supermarketKey = supermarketKey
+	clientState.Unlock()
+
+	// Check the Git targets again, as a rotated token might fix (or break) them
+	gitTargets.Lock()
+	gitTargets.m = make(map[string]*gitTargetStatus)
+	gitTargets.Unlock()
+
+	// Make sure new GitHub App installation tokens are requested with the
+	// (possibly rotated) private key
+	git.ResetTokenSources()
+
+	// Check if the certificate of the TLS listener was rotated
+	reloadListenerCert()
+
+	// Detect the universe endpoint again, as the Chef server might be changed
+	chefUniverse.Lock()
+	chefUniverse.checked = time.Time{}
+	chefUniverse.Unlock()
+}
+
+// configGeneration returns the number of times the config was loaded
+func configGeneration() int {
+	clientState.RLock()
+	defer clientState.RUnlock()
+	return clientState.generation
+}
+
+// newChefClient returns a Chef API client for the org using the current key
+func newChefClient(org string) (*chef.Chef, error) {
+	clientState.RLock()
+	key := clientState.chefKey
+	config := getConfig()
+	clientState.RUnlock()
+
+	c, err := chef.ConnectBuilder(config.Chef.Server, config.Chef.Port, "", config.Chef.User, key, org)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new Chef API connection: %s", err)
+	}
+	c.SSLNoVerify = config.Chef.SSLNoVerify
+
+	return c, nil
+}
+
+// refreshClients recreates the clients of a ChefGuard structure that was
+// created before the config was reloaded, e.g. for a debounced commit, so
+// it doesn't keep using stale credentials
+func (cg *ChefGuard) refreshClients() error {
+	if cg.generation == configGeneration() {
+		return nil
+	}
+
+	chefClient, err := newChefClient(cg.ChefOrg)
+	if err != nil {
+		return err
+	}
+
+	cg.chefClient = chefClient
+	cg.smClient = nil
+	cg.gitClient = nil
+	cg.generation = configGeneration()
+
+	return nil
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// complianceReport holds the summary of a single organization for a quarter
+type complianceReport struct {
+	Org       string
+	Period    string
+	From      string
+	To        string
+	Generated string
+	Changes   int
+	Rejected  int
+	Forced    int
+	Drift     int
+	Events    []*AuditEvent
+
+	// Unverified is the number of unverified cookbook versions counted by
+	// the last reconcile, or "unknown" when not reconciling
+	Unverified string
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"formatTime": formatTime}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>Chef-Guard compliance report {{.Org}} {{.Period}}</title>
+</head>
+<body>
+<h1>Chef-Guard compliance report</h1>
+<p>Organization: {{.Org}}<br>
+Period: {{.Period}} ({{.From}} - {{.To}})<br>
+Generated: {{.Generated}}</p>
+<table>
+<tr><td>Committed changes</td><td>{{.Changes}}</td></tr>
+<tr><td>Rejected requests</td><td>{{.Rejected}}</td></tr>
+<tr><td>Forced uploads (break-glass)</td><td>{{.Forced}}</td></tr>
+<tr><td>Drift incidents</td><td>{{.Drift}}</td></tr>
+<tr><td>Unverified legacy cookbooks remaining</td><td>{{.Unverified}}</td></tr>
+</table>
+<h2>Rejected requests, forced uploads and drift incidents</h2>
+<table>
+<tr><th>Time</th><th>Type</th><th>User</th><th>Item</th><th>Details</th></tr>
+{{range .Events}}<tr><td>{{formatTime .Time}}</td><td>{{.Type}}</td><td>{{.User}}</td><td>{{.Item}}</td><td>{{.Details}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// startReporter generates the compliance reports of the previous quarter
+// at the start of every quarter
+func startReporter() {
+	if getConfig().Report.Path == "" {
+		return
+	}
+
+	go func() {
+		for {
+			_, next := quarter(time.Now().In(timeZone()))
+			time.Sleep(time.Until(next))
+			generateReports(quarter(next.AddDate(0, 0, -1)))
+		}
+	}()
+}
+
+// quarter returns the start and end of the quarter t is in
+func quarter(t time.Time) (time.Time, time.Time) {
+	month := time.Month((int(t.Month())-1)/3*3 + 1)
+	from := time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location())
+	return from, from.AddDate(0, 3, 0)
+}
+
+// generateReports writes, signs and sends the compliance reports of all
+// organizations that have events in the audit store for the given period
+func generateReports(from, to time.Time) {
+	events, err := readAudit(from, to)
+	if err != nil {
+		ERROR.Printf("Failed to read audit store %s: %s", getConfig().Audit.Path, err)
+		return
+	}
+
+	reports := make(map[string]*complianceReport)
+	for _, e := range events {
+		r, ok := reports[e.Org]
+		if !ok {
+			r = &complianceReport{
+				Org:       orgLabel(e.Org),
+				Period:    fmt.Sprintf("%d-Q%d", from.Year(), (int(from.Month())-1)/3+1),
+				From:      formatTime(from),
+				To:        formatTime(to),
+				Generated: formatTime(time.Now()),
+
+				Unverified: "unknown",
+			}
+			if v := unverifiedCookbooks.Get(orgLabel(e.Org)); v != nil {
+				r.Unverified = v.String()
+			}
+			reports[e.Org] = r
+		}
+
+		switch e.Type {
+		case "change":
+			r.Changes++
+			continue
+		case "rejected":
+			r.Rejected++
+		case "forced", "override":
+			r.Forced++
+		case "drift":
+			r.Drift++
+		}
+		r.Events = append(r.Events, e)
+	}
+
+	orgs := make([]string, 0, len(reports))
+	for org := range reports {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+
+	for _, org := range orgs {
+		if err := sendReport(org, reports[org]); err != nil {
+			sendAlert(org,
+				fmt.Sprintf("Failed to generate compliance report %s", reports[org].Period),
+				fmt.Sprintf("Generating the compliance report for %s failed: %s", reports[org].Org, err),
+			)
+		}
+	}
+}
+
+// sendReport writes the report and its signature to disk and sends a
+// summary using the configured notification settings
+func sendReport(org string, r *complianceReport) error {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, r); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(getConfig().Report.Secret))
+	mac.Write(buf.Bytes())
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if err := os.MkdirAll(getConfig().Report.Path, 0755); err != nil {
+		return err
+	}
+	file := path.Join(getConfig().Report.Path, fmt.Sprintf("%s-%s.html", r.Org, r.Period))
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file+".sig", []byte(signature+"\n"), 0644); err != nil {
+		return err
+	}
+
+	sendAlert(org,
+		fmt.Sprintf("Compliance report %s", r.Period),
+		fmt.Sprintf("Compliance report of %s for %s (%s - %s):\n\n"+
+			"Committed changes:            %d\n"+
+			"Rejected requests:            %d\n"+
+			"Forced uploads (break-glass): %d\n"+
+			"Drift incidents:              %d\n"+
+			"Unverified legacy cookbooks:  %s\n\n"+
+			"Report:    %s\n"+
+			"Signature: %s (HMAC-SHA256)",
+			r.Org, r.Period, r.From, r.To, r.Changes, r.Rejected, r.Forced, r.Drift, r.Unverified, file, signature),
+	)
+
+	return nil
+}
+
+// orgLabel returns a printable name for an organization
+func orgLabel(org string) string {
+	if org == "" {
+		return "default"
+	}
+	return org
+}
@@ -0,0 +1,116 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// requestIDHeader is the header used to correlate a request across the logs
+// of Chef-Guard and the systems it calls
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID matches the request IDs we accept from a client
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDHandler makes sure every request has a request ID. An ID sent by
+// the client is reused, so the request can be traced through the systems in
+// front of Chef-Guard as well. The ID is forwarded to erchef together with
+// the request and returned to the client in the response.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		h.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the request ID of the request
+func requestID(r *http.Request) string {
+	return requestIDFromContext(r.Context())
+}
+
+// logf logs the message prefixed with the request ID (if any), so all log
+// lines of a single request can be correlated
+func logf(l *log.Logger, id, format string, v ...interface{}) {
+	if id != "" {
+		format = "[" + id + "] " + format
+	}
+	l.Printf(format, v...)
+}
+
+// setRequestID binds a ChefGuard structure that was not created from the
+// intercepted request itself to the ID of the request it serves
+func (cg *ChefGuard) setRequestID(id string) {
+	cg.RequestID = id
+	cg.ctx = withRequestID(cg.ctx, id)
+}
+
+// requestIDTransport forwards the request ID stored in the context of an
+// outbound request, so the call can be correlated with the request that
+// triggered it
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestIDFromContext(req.Context())
+	if id == "" || req.Header.Get(requestIDHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper should not modify the request, so set it on a copy
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set(requestIDHeader, id)
+
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,90 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Reservation represents a reserved cookbook name prefix
+type Reservation struct {
+	Prefix string   `json:"prefix"`
+	Users  []string `json:"users"`
+}
+
+// checkReservedName makes sure that new cookbooks with a reserved name prefix
+// can only be created by one of the designated users
+func (cg *ChefGuard) checkReservedName() (int, error) {
+	r := findReservation(cg.Cookbook.Name)
+	if r == nil {
+		return 0, nil
+	}
+	for _, u := range r.Users {
+		if u == cg.User {
+			return 0, nil
+		}
+	}
+
+	_, found, err := cg.chefClient.GetCookbook(cg.Cookbook.Name)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Failed to get info for cookbook %s: %s", cg.Cookbook.Name, err)
+	}
+	if found {
+		return 0, nil
+	}
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Cookbook Namespace error found ===\n"+
+		"Cookbook names starting with '%s' are reserved!\n"+
+		"Only %s are allowed to create new\n"+
+		"cookbooks using this prefix.\n"+
+		"======================================\n", r.Prefix, strings.Join(r.Users, ", "))
+}
+
+// findReservation returns the reservation with the longest matching prefix
+func findReservation(name string) *Reservation {
+	var r *Reservation
+	for prefix, v := range getConfig().Reservation {
+		if strings.HasPrefix(name, prefix) && (r == nil || len(prefix) > len(r.Prefix)) {
+			r = &Reservation{Prefix: prefix}
+			for _, u := range strings.Split(v.Users, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					r.Users = append(r.Users, u)
+				}
+			}
+		}
+	}
+	return r
+}
+
+func reservationsHandler(w http.ResponseWriter, r *http.Request) {
+	reservations := []*Reservation{}
+	for prefix := range getConfig().Reservation {
+		reservations = append(reservations, findReservation(prefix))
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Prefix < reservations[j].Prefix
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reservations); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode reservations: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,277 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// commitTrailer is the trailer that marks the commits made by Chef-Guard, so
+// they are not applied back to the Chef server when they are pushed
+const commitTrailer = "Chef-Guard-Signature"
+
+// gitChange holds the resulting action for a single file changed by a push
+type gitChange struct {
+	path   string
+	action string
+}
+
+// isConfigRepoOwner returns true if the pushed repo is owned by the
+// organization Chef-Guard commits the config changes to
+func isConfigRepoOwner(gitType, owner string) bool {
+	gc, ok := getConfig().Git[getConfig().Default.GitConfig]
+	return ok && gc.Type == gitType && strings.EqualFold(gc.Organization, owner)
+}
+
+// configChanges returns all files changed by the pushed commits, skipping
+// the commits that were made by Chef-Guard itself
+func configChanges(e *WebhookEvent) []*gitChange {
+	changes := []*gitChange{}
+	index := make(map[string]*gitChange)
+
+	set := func(files []string, action string) {
+		for _, f := range files {
+			if c, ok := index[f]; ok {
+				c.action = action
+				continue
+			}
+			c := &gitChange{path: f, action: action}
+			index[f] = c
+			changes = append(changes, c)
+		}
+	}
+
+	for _, c := range e.Commits {
+		if isChefGuardCommit(c.Message) {
+			continue
+		}
+		set(c.Added, "PUT")
+		set(c.Modified, "PUT")
+		set(c.Removed, "DELETE")
+	}
+
+	return changes
+}
+
+// signCommit adds a trailer to the commit message with a signature of its
+// subject, using the webhook secret so the trailer cannot be forged
+func signCommit(msg string) string {
+	if !getConfig().Webhook.ApplyChanges {
+		return msg
+	}
+	return fmt.Sprintf("%s\n\n%s: %s", msg, commitTrailer, commitSignature(msg))
+}
+
+// commitSignature returns the HMAC of the subject of a commit message
+func commitSignature(msg string) string {
+	mac := hmac.New(sha256.New, []byte(getConfig().Webhook.Secret))
+	mac.Write([]byte(strings.SplitN(msg, "\n", 2)[0]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isChefGuardCommit returns true if the commit message ends with a valid
+// Chef-Guard trailer
+func isChefGuardCommit(msg string) bool {
+	lines := strings.Split(strings.TrimSpace(msg), "\n")
+	sig := strings.TrimPrefix(strings.TrimSpace(lines[len(lines)-1]), commitTrailer+": ")
+	if sig == lines[len(lines)-1] {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(commitSignature(msg)))
+}
+
+// orgForRepo returns the Chef organization the config repo belongs to
+func orgForRepo(repo string) string {
+	for org, c := range getConfig().Customer {
+		if c.GitRepo != nil && strings.EqualFold(*c.GitRepo, repo) {
+			return org
+		}
+	}
+	if strings.EqualFold(repo, getConfig().Default.GitRepo) || repo == "config" {
+		return ""
+	}
+	return repo
+}
+
+// applyGitChanges applies the roles, environments and data bag items that
+// were changed in Git back to the Chef server
+func applyGitChanges(id, repo string, changes []*gitChange) {
+	gitClient, err := getCustomClientContext(withRequestID(context.Background(), id), getConfig().Default.GitConfig)
+	if err != nil {
+		logf(ERROR, id, "Failed to create Git client: %s", err)
+		return
+	}
+
+	for _, c := range changes {
+		org, p := orgForRepo(repo), c.path
+		if strings.EqualFold(repo, getConfig().Default.GitMonorepo) {
+			parts := strings.SplitN(p, "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			org, p = parts[0], parts[1]
+		}
+
+		endpoint, collection, bag := chefEndpoint(p)
+		if endpoint == "" {
+			continue
+		}
+
+		var content []byte
+		if c.action == "PUT" {
+			file, _, err := gitClient.GetContent(repo, c.path)
+			if err != nil || file == nil {
+				logf(ERROR, id, "Failed to get content of %s from repo %s: %v", c.path, repo, err)
+				continue
+			}
+			content = []byte(file.Content)
+		}
+
+		cg, err := newChefGuardForOrg(getConfig().Chef.User, org, false)
+		if err != nil {
+			logf(ERROR, id, "Failed to create a new ChefGuard structure: %s", err)
+			continue
+		}
+		cg.setRequestID(id)
+		cg.EndpointType = strings.SplitN(collection, "/", 2)[0]
+
+		// Pushed changes pass the same checks, freezes and approvals as changes
+		// made through the API, so a push is never a way around them
+		vw := &verdictWriter{header: make(http.Header)}
+		vars := map[string]string{"type": cg.EndpointType, "bag": bag, "name": path.Base(endpoint)}
+		if cg.checkChange(vw, c.action, vars, content) {
+			cg.sendAlert(fmt.Sprintf("Invalid %s pushed to Git", c.path), fmt.Sprintf(
+				"Not applying the change to %s pushed to repo %s, as it failed validation: %s",
+				c.path, repo, strings.TrimSpace(vw.body.String())))
+			continue
+		}
+
+		// Permissive mode applies the change, but still alerts the errors
+		if getEffectiveMode("ValidateChanges", org, cg.EndpointType) == "permissive" &&
+			!exemptUser("ExemptValidation", org, cg.User) && c.action == "PUT" {
+			if _, err := cg.validateConstraints(content); err != nil {
+				cg.sendAlert(fmt.Sprintf("Invalid %s pushed to Git", c.path), fmt.Sprintf(
+					"Applying the change to %s pushed to repo %s, although it failed validation: %s", c.path, repo, err))
+			}
+		}
+
+		if fw, end := activeFreeze(org, cg.EndpointType, cg.User, time.Now()); fw != nil {
+			cg.setStage("change-freeze")
+			cg.sendAlert(fmt.Sprintf("Change to %s pushed to Git during a change freeze", c.path), fmt.Sprintf(
+				"Not applying the change to %s pushed to repo %s: %s", c.path, repo, freezeMessage(fw, end)))
+			continue
+		}
+
+		if collection == "environments" && requiresApproval(vars["name"]) {
+			cg.setStage("approval")
+			cg.parkChange(vw, c.action, vars["name"], content)
+			if vw.status != http.StatusAccepted {
+				cg.sendAlert(fmt.Sprintf("Failed to park %s pushed to Git", c.path), fmt.Sprintf(
+					"Parking the change to %s pushed to repo %s for approval failed: %s",
+					c.path, repo, strings.TrimSpace(vw.body.String())))
+				continue
+			}
+			logf(INFO, id, "Parked %s of %s from repo %s for approval", c.action, c.path, repo)
+			continue
+		}
+
+		if err := cg.applyChange(c.action, endpoint, collection, bag, content); err != nil {
+			cg.sendAlert(
+				fmt.Sprintf("Failed to apply %s from Git to Chef", c.path),
+				fmt.Sprintf("Applying the change to %s pushed to repo %s failed: %s", c.path, repo, err),
+			)
+			continue
+		}
+
+		logf(INFO, id, "Applied %s of %s from repo %s to Chef", c.action, c.path, repo)
+	}
+}
+
+// chefEndpoint returns the Chef API endpoint and collection for a config
+// file, or empty strings if the file should not be applied
+func chefEndpoint(p string) (endpoint, collection, bag string) {
+	if !strings.HasSuffix(p, ".json") {
+		return "", "", ""
+	}
+	parts := strings.Split(strings.TrimSuffix(p, ".json"), "/")
+
+	switch {
+	case len(parts) == 2 && (parts[0] == "roles" || parts[0] == "environments"):
+		return strings.Join(parts, "/"), parts[0], ""
+	case len(parts) == 3 && parts[0] == "data_bags":
+		collection = fmt.Sprintf("data/%s", parts[1])
+		return fmt.Sprintf("%s/%s", collection, parts[2]), collection, parts[1]
+	}
+
+	return "", "", ""
+}
+
+func (cg *ChefGuard) applyChange(action, endpoint, collection, bag string, content []byte) error {
+	if action == "DELETE" {
+		resp, err := cg.chefClient.Delete(endpoint, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return checkHTTPResponse(resp, []int{http.StatusOK, http.StatusNotFound})
+	}
+
+	content, err := cg.restoreRedacted(endpoint, content)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cg.chefClient.Put(endpoint, nil, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		return checkHTTPResponse(resp, []int{http.StatusOK})
+	}
+
+	// The item doesn't exist yet, so it needs to be created instead
+	if bag != "" {
+		body := fmt.Sprintf(`{"name":%q}`, bag)
+		resp, err := cg.chefClient.Post("data", "application/json", nil, strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkHTTPResponse(resp, []int{http.StatusCreated, http.StatusConflict}); err != nil {
+			return err
+		}
+	}
+
+	resp, err = cg.chefClient.Post(collection, "application/json", nil, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkHTTPResponse(resp, []int{http.StatusOK, http.StatusCreated})
+}
@@ -0,0 +1,152 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// rollbackRequest holds the item and the commit a rollback restores
+type rollbackRequest struct {
+	Org  string `json:"org"`
+	Path string `json:"path"`
+	SHA  string `json:"sha"`
+}
+
+// rollbackHandler re-applies the content of a role, environment or data bag
+// item at a given commit to the Chef server and commits the rollback to Git.
+// The request must be signed by a Chef user or client with update permissions
+// on the item, and the rollback is validated, frozen and parked for approval
+// just like a normal change.
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := dumpBody(r)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+		return
+	}
+	req := new(rollbackRequest)
+	if err := json.Unmarshal(body, req); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to unmarshal rollback request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !commitSHA.MatchString(req.SHA) {
+		errorHandler(w, fmt.Sprintf("Invalid commit SHA: %s", req.SHA), http.StatusBadRequest)
+		return
+	}
+	endpoint, collection, bag := chefEndpoint(req.Path)
+	if endpoint == "" {
+		errorHandler(w, fmt.Sprintf("Cannot roll back %s, only roles, environments and data bag items can be rolled back", req.Path), http.StatusBadRequest)
+		return
+	}
+
+	user, err := authenticateRequest(r, req.Org)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+		return
+	}
+
+	cg, err := newChefGuardForOrg(user, req.Org, false)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err), http.StatusInternalServerError)
+		return
+	}
+	cg.setRequestID(requestID(r))
+	cg.ClientIP = clientIP(r)
+	cg.EndpointType = collection
+	if bag != "" {
+		cg.EndpointType = "data"
+	}
+
+	// The rollback is applied with our own key, so make sure the user is
+	// allowed to update the item
+	current, err := cg.chefConfig(endpoint)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	object := endpoint
+	if bag != "" {
+		object = collection
+	}
+	if current == nil {
+		object = fmt.Sprintf("containers/%s", cg.EndpointType)
+	}
+	allowed, err := hasPermission(cg.chefClient, user, "update", object)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to check the permissions of %s: %s", user, err), http.StatusBadGateway)
+		return
+	}
+	if !allowed {
+		errorHandler(w, fmt.Sprintf("%s is not allowed to update %s", user, endpoint), http.StatusForbidden)
+		return
+	}
+
+	if fw, end := activeFreeze(cg.ChefOrg, cg.EndpointType, user, time.Now()); fw != nil {
+		cg.setStage("change-freeze")
+		errorHandler(w, freezeMessage(fw, end), http.StatusPreconditionFailed)
+		return
+	}
+
+	if cg.gitClient, err = getCustomClientContext(cg.gitContext(), getConfig().Default.GitConfig); err != nil {
+		errorHandler(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := cg.gitClient.GetFileAtRef(cg.Repo, cg.gitPath(req.Path), req.SHA)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if file == nil {
+		errorHandler(w, fmt.Sprintf("File %s not found in repo %s at %s", req.Path, cg.Repo, req.SHA), http.StatusNotFound)
+		return
+	}
+	content := []byte(file.Content)
+
+	vars := map[string]string{"type": cg.EndpointType, "bag": bag, "name": path.Base(endpoint)}
+	if cg.checkChange(w, "PUT", vars, content) {
+		return
+	}
+
+	if collection == "environments" && requiresApproval(vars["name"]) {
+		cg.setStage("approval")
+		cg.parkChange(w, "PUT", vars["name"], content)
+		return
+	}
+
+	if err := cg.applyChange("PUT", endpoint, collection, bag, content); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to roll back %s to %s: %s", req.Path, req.SHA, err), http.StatusBadGateway)
+		return
+	}
+
+	recordAudit(cg.ChefOrg, "rollback", cg.User, cg.ClientIP, req.Path, req.SHA)
+	logf(INFO, cg.RequestID, "Rolled back %s to %s for %s", req.Path, req.SHA, cg.User)
+
+	if getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) {
+		cg.ChangeDetails = changeDetailsFromPath(req.Path)
+		cg.ChangeDetails.Note = fmt.Sprintf("rolled back to %s", req.SHA)
+		if err := cg.syncedGitUpdate("PUT", content); err != nil {
+			w.Header().Set("X-Chef-Guard-Warning", fmt.Sprintf("Rollback was not committed to Git: %s", err))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// routeTypes are the endpoint types that can be used in a notification route
+var routeTypes = []string{"cookbooks", "data", "clients", "environments", "nodes", "roles"}
+
+// routeMatches returns true if a change of the item (e.g. a role name or a
+// data bag item as <bag>/<item>) should be sent using the route
+func routeMatches(name, org, endpointType, item string) bool {
+	r := getConfig().Route[name]
+	if orgs := splitList(r.Orgs); len(orgs) > 0 && !containsFold(orgs, org) {
+		return false
+	}
+	if r.Types != "" && !containsType(r.Types, endpointType) {
+		return false
+	}
+	if r.Pattern != "" {
+		if ok, _ := path.Match(r.Pattern, item); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// routeTargets returns the mail recipients and webhook URLs of all routes
+// matching the change (e.g. roles/web.json or data_bags/secrets/db.json)
+func routeTargets(org, change string) (recipients, urls []string) {
+	parts := strings.SplitN(change, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	endpointType, item := parts[0], strings.TrimSuffix(parts[1], ".json")
+	if endpointType == "data_bags" {
+		endpointType = "data"
+	}
+
+	names := make([]string, 0, len(getConfig().Route))
+	for name := range getConfig().Route {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !routeMatches(name, org, endpointType, item) {
+			continue
+		}
+		for _, r := range splitList(getConfig().Route[name].Recipients) {
+			if !containsFold(recipients, r) {
+				recipients = append(recipients, r)
+			}
+		}
+		if u := getConfig().Route[name].URL; u != "" && !contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return recipients, urls
+}
+
+// mailRecipients returns the recipients of all routes matching the change,
+// or the configured MailRecipient if no route matches
+func (cg *ChefGuard) mailRecipients() string {
+	recipients, _ := routeTargets(cg.ChefOrg, fmt.Sprintf("%s/%s", cg.ChangeDetails.Type, cg.ChangeDetails.Item))
+	if len(recipients) == 0 {
+		return getEffectiveConfig("MailRecipient", cg.Repo).(string)
+	}
+	return strings.Join(recipients, ", ")
+}
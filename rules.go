@@ -0,0 +1,169 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rulesDir matches the suffix of the version directories created by
+// updateRules
+var rulesDir = regexp.MustCompile(`^\.cg-[0-9a-f]{12}$`)
+
+// rulesLock makes sure only one rules update runs at the same time
+var rulesLock sync.Mutex
+
+// startRulesWatcher periodically pulls the rules repo, so updated rule
+// files and policies are applied without touching the Chef-Guard host
+func startRulesWatcher() {
+	if getConfig().Rules.Repo == "" {
+		return
+	}
+
+	go func() {
+		for {
+			if err := updateRules(); err != nil {
+				ERROR.Printf("Failed to update rules from repo %s: %s", getConfig().Rules.Repo, err)
+			}
+			if getConfig().Rules.Interval == 0 {
+				return
+			}
+			time.Sleep(time.Duration(getConfig().Rules.Interval) * time.Second)
+		}
+	}()
+}
+
+// isRulesRepo returns true if the pushed repo is the rules repo
+func isRulesRepo(gitType, owner, repo string) bool {
+	return getConfig().Rules.Repo != "" && strings.EqualFold(repo, getConfig().Rules.Repo) && isConfigRepoOwner(gitType, owner)
+}
+
+// updateRules downloads the master branch of the rules repo and, if
+// anything changed, atomically switches the rules path to the new version
+func updateRules() error {
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+
+	gitClient, err := getCustomClient(getConfig().Default.GitConfig)
+	if err != nil {
+		return err
+	}
+
+	link, err := gitClient.GetArchiveLink(getConfig().Rules.Repo, "master")
+	if err != nil {
+		return err
+	}
+	if link == nil {
+		return fmt.Errorf("Repo %s not found", getConfig().Rules.Repo)
+	}
+
+	client := newHTTPClient(getConfig().Git[getConfig().Default.GitConfig].SSLNoVerify)
+	resp, err := client.Get(link.String())
+	if err != nil {
+		return fmt.Errorf("Failed to download the rules: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return fmt.Errorf("Failed to download the rules: %s", err)
+	}
+
+	files, err := untarCookbook(resp.Body, ".")
+	if err != nil {
+		return err
+	}
+
+	version := rulesVersion(files)
+	dir := fmt.Sprintf("%s.cg-%s", getConfig().Rules.Path, version)
+	if current, _ := os.Readlink(getConfig().Rules.Path); current == dir {
+		return nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err := writeFileToDisk(path.Join(dir, name), strings.NewReader(string(content))); err != nil {
+			return fmt.Errorf("Failed to write rules file %s: %s", name, err)
+		}
+	}
+
+	// Replacing a symlink using a rename is atomic, so checks will either
+	// see the old or the new rules, but never a mix of both
+	tmp := getConfig().Rules.Path + ".cg-tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(dir, tmp); err != nil {
+		return fmt.Errorf("Failed to create symlink to the new rules: %s", err)
+	}
+	previous, _ := os.Readlink(getConfig().Rules.Path)
+	if err := os.Rename(tmp, getConfig().Rules.Path); err != nil {
+		return fmt.Errorf("Failed to switch to the new rules: %s", err)
+	}
+
+	INFO.Printf("Updated rules from repo %s to version %s", getConfig().Rules.Repo, version)
+
+	cleanupRules(dir, previous)
+
+	return nil
+}
+
+// rulesVersion returns a hash of all rule files and their content
+func rulesVersion(files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(files[name]))
+		h.Write(files[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
+
+// cleanupRules removes all old versions of the rules, except for the
+// previous one which might still be in use by a running check. Only the
+// version directories created by updateRules are removed.
+func cleanupRules(current, previous string) {
+	dirs, err := filepath.Glob(getConfig().Rules.Path + ".cg-*")
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if dir == current || dir == previous || !rulesDir.MatchString(strings.TrimPrefix(dir, getConfig().Rules.Path)) {
+			continue
+		}
+		if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			WARNING.Printf("Failed to cleanup old rules %s: %s", dir, err)
+		}
+	}
+}
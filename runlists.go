@@ -0,0 +1,136 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// runListEntry matches role[name], recipe[cookbook::recipe@version] and the
+// short cookbook::recipe form of a run_list entry
+var runListEntry = regexp.MustCompile(`^(?:(role|recipe)\[([^\]]+)\]|([^\[\]]+))$`)
+
+// checkRunListEntries makes sure all roles and recipes referenced in a
+// run_list exist on the Chef server
+func (cg *ChefGuard) checkRunListEntries(runList []string) (int, error) {
+	roles := make(map[string]bool)
+	recipes := make(map[string]map[string]bool)
+	unknown := []string{}
+	seen := make(map[string]bool)
+
+	for _, entry := range runList {
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+
+		res := runListEntry.FindStringSubmatch(entry)
+		if res == nil {
+			unknown = append(unknown, fmt.Sprintf("%s (invalid entry)", entry))
+			continue
+		}
+
+		if res[1] == "role" {
+			found, ok := roles[res[2]]
+			if !ok {
+				_, exists, err := cg.chefClient.GetRole(res[2])
+				if err != nil {
+					return http.StatusBadRequest, fmt.Errorf("Failed to get info for role %s: %s", res[2], err)
+				}
+				roles[res[2]], found = exists, exists
+			}
+			if !found {
+				unknown = append(unknown, fmt.Sprintf("%s (unknown role)", entry))
+			}
+			continue
+		}
+
+		name := res[2] + res[3]
+		version := ""
+		if i := strings.Index(name, "@"); i > 0 {
+			name, version = name[:i], name[i+1:]
+		}
+		cookbook, recipe := name, "default"
+		if i := strings.Index(name, "::"); i > 0 {
+			cookbook, recipe = name[:i], name[i+2:]
+		}
+
+		key := cookbook + "@" + version
+		available, ok := recipes[key]
+		if !ok {
+			var err error
+			if available, err = cg.cookbookRecipes(cookbook, version); err != nil {
+				return http.StatusBadRequest, err
+			}
+			recipes[key] = available
+		}
+
+		switch {
+		case available == nil:
+			unknown = append(unknown, fmt.Sprintf("%s (unknown cookbook or version)", entry))
+		case !available[recipe]:
+			unknown = append(unknown, fmt.Sprintf("%s (unknown recipe)", entry))
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return http.StatusPreconditionFailed, fmt.Errorf(" - %s", strings.Join(unknown, "\n - "))
+	}
+	return 0, nil
+}
+
+// cookbookRecipes returns the recipes of a cookbook version, or of the
+// highest version if no version is given. It returns nil if the cookbook
+// or version doesn't exist.
+func (cg *ChefGuard) cookbookRecipes(name, version string) (map[string]bool, error) {
+	if version == "" {
+		cb, found, err := cg.chefClient.GetCookbook(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get info for cookbook %s: %s", name, err)
+		}
+		if !found || cb == nil {
+			return nil, nil
+		}
+		for _, v := range cb.Versions {
+			if version == "" || compareVersions(v.Version, version) > 0 {
+				version = v.Version
+			}
+		}
+		if version == "" {
+			return nil, nil
+		}
+	}
+
+	cb, found, err := cg.chefClient.GetCookbookVersion(name, version)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get info for cookbook %s version %s: %s", name, version, err)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	recipes := make(map[string]bool)
+	for _, r := range cb.Recipes {
+		recipes[strings.TrimSuffix(r.Name, ".rb")] = true
+	}
+	return recipes, nil
+}
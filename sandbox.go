@@ -0,0 +1,97 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// sandboxCheck rewrites the command of a check so it is executed inside a
+// short-lived container with the cookbook mounted read-only. It returns the
+// name of the container, or an empty string when no sandbox is configured.
+func sandboxCheck(cmd *exec.Cmd, cookbookPath string) (string, error) {
+	if getConfig().Tests.Container == "" {
+		return "", nil
+	}
+
+	runtime, err := exec.LookPath(getConfig().Tests.Container)
+	if err != nil {
+		return "", fmt.Errorf("Failed to find container runtime %s: %s", getConfig().Tests.Container, err)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Failed to generate container name: %s", err)
+	}
+	name := fmt.Sprintf("chef-guard-%s-%x", path.Base(cmd.Path), b)
+
+	args := []string{
+		runtime, "run", "--rm", "--name", name,
+		"--network", "none",
+		"--read-only", "--tmpfs", "/tmp",
+		"--env", "HOME=/tmp",
+		"--volume", fmt.Sprintf("%s:%s:ro", cookbookPath, cookbookPath),
+	}
+
+	for _, mount := range sandboxMounts() {
+		args = append(args, "--volume", fmt.Sprintf("%s:%s:ro", mount, mount))
+	}
+
+	// Only pass the variables needed by the checks, not the environment of
+	// the Chef-Guard process itself
+	for _, env := range cmd.Env {
+		if strings.HasPrefix(env, "RUBY_") || strings.HasPrefix(env, "CHEF_GUARD_") {
+			args = append(args, "--env", env)
+		}
+	}
+
+	// The check is expected to be available at the same path inside the image
+	cmd.Args = append(append(args, getConfig().Tests.Image), cmd.Args...)
+	cmd.Path = runtime
+
+	return name, nil
+}
+
+// sandboxMounts returns the additional paths that need to be available
+// (read-only) inside the container
+func sandboxMounts() []string {
+	c := getConfig()
+	mounts := []string{}
+	if c.Default.IncludeFCs != "" {
+		mounts = append(mounts, c.Default.IncludeFCs)
+	}
+	if c.Rules.Path != "" {
+		mounts = append(mounts, c.Rules.Path)
+	}
+	for _, mount := range strings.Split(c.Tests.Mounts, ",") {
+		if mount = strings.TrimSpace(mount); mount != "" {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts
+}
+
+// killSandbox makes sure the container of a check is stopped
+func killSandbox(id, name string) {
+	if out, err := exec.Command(getConfig().Tests.Container, "kill", name).CombinedOutput(); err != nil {
+		logf(WARNING, id, "Failed to kill container %s: %s - %s", name, out, err)
+	}
+}
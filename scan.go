@@ -0,0 +1,229 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd
+const clamdChunkSize = 64 * 1024
+
+// errScanSizeLimit is returned when the content is larger than the
+// StreamMaxLength of clamd, so it could not be scanned
+var errScanSizeLimit = errors.New("Content exceeds the StreamMaxLength of clamd")
+
+// scannedClients caches the scan results of the files in the client mirror
+var scannedClients = struct {
+	sync.Mutex
+	m map[string]*clientScan
+}{m: make(map[string]*clientScan)}
+
+type clientScan struct {
+	modTime time.Time
+	size    int64
+	result  string
+}
+
+// scanContent streams the content to clamd and returns the name of the
+// signature that matched, or an empty string if the content is clean
+func scanContent(content io.Reader) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(getConfig().Scan.Clamd, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, getConfig().Scan.Clamd, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("Failed to connect to clamd: %s", err)
+	}
+	defer conn.Close()
+
+	if getConfig().Scan.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(getConfig().Scan.Timeout) * time.Second))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("Failed to start clamd scan: %s", err)
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+				return "", streamError(conn, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to read content to scan: %s", err)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", streamError(conn, err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Failed to read clamd response: %s", err)
+	}
+	resp = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(resp, "stream:"), "\x00"))
+
+	switch {
+	case resp == "OK":
+		return "", nil
+	case strings.HasSuffix(resp, " FOUND"):
+		return strings.TrimSuffix(resp, " FOUND"), nil
+	case strings.Contains(resp, "size limit exceeded"):
+		return "", errScanSizeLimit
+	default:
+		return "", fmt.Errorf("Unexpected clamd response: %s", resp)
+	}
+}
+
+// streamError returns errScanSizeLimit if clamd stopped the stream because
+// the content exceeds its StreamMaxLength, as clamd then replies with an
+// error and closes the connection while we are still streaming
+func streamError(conn net.Conn, err error) error {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, _ := bufio.NewReader(conn).ReadString(0); strings.Contains(resp, "size limit exceeded") {
+		return errScanSizeLimit
+	}
+	return fmt.Errorf("Failed to stream content to clamd: %s", err)
+}
+
+// scanCookbookFile scans a single cookbook file and records any infection.
+// Files exceeding the StreamMaxLength of clamd are recorded as unscanned.
+func (cg *ChefGuard) scanCookbookFile(name string, content []byte) error {
+	signature, err := scanContent(bytes.NewReader(content))
+	if err == errScanSizeLimit {
+		cg.UnscannedFiles = append(cg.UnscannedFiles, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if signature != "" {
+		cg.InfectedFiles[name] = signature
+	}
+	return nil
+}
+
+// checkMalware rejects the cookbook if any of its files are infected
+func (cg *ChefGuard) checkMalware() (int, error) {
+	item := fmt.Sprintf("cookbooks/%s/%s", cg.Cookbook.Name, cg.Cookbook.Version)
+	if len(cg.InfectedFiles) == 0 {
+		details := "clean"
+		if len(cg.UnscannedFiles) > 0 {
+			details = fmt.Sprintf("clean, too large to scan: %s", strings.Join(cg.UnscannedFiles, ", "))
+		}
+		recordAudit(cg.ChefOrg, "scan", cg.User, cg.ClientIP, item, details)
+		return 0, nil
+	}
+
+	infected := []string{}
+	for name, signature := range cg.InfectedFiles {
+		infected = append(infected, fmt.Sprintf("%s: %s", name, signature))
+	}
+	sort.Strings(infected)
+
+	recordAudit(cg.ChefOrg, "scan", cg.User, cg.ClientIP, item, strings.Join(infected, ", "))
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Malware found ===\n%s\n=====================\n", strings.Join(infected, "\n"))
+}
+
+// checkClientFile scans a file in the client mirror before it is served,
+// unless it was already scanned when it was cached
+func checkClientFile(id, file string) error {
+	return scanClientFile(id, file, file)
+}
+
+// scanClientFile scans a client file and caches the result for the file it
+// is served as, so a package that is scanned before it is moved into the
+// cache is not scanned again when it is served
+func scanClientFile(id, file, served string) error {
+	fi, err := os.Stat(file)
+	if err != nil || fi.IsDir() {
+		return nil
+	}
+
+	scannedClients.Lock()
+	s, ok := scannedClients.m[served]
+	scannedClients.Unlock()
+
+	if !ok || !s.modTime.Equal(fi.ModTime()) || s.size != fi.Size() {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("Failed to open client file: %s", err)
+		}
+		signature, err := scanContent(f)
+		f.Close()
+
+		details := "clean"
+		switch {
+		case err == errScanSizeLimit:
+			logf(WARNING, id, "Client file %s is too large to be scanned by clamd", filepath.Base(served))
+			details = "too large to scan"
+		case err != nil:
+			return err
+		case signature != "":
+			details = signature
+		}
+
+		s = &clientScan{modTime: fi.ModTime(), size: fi.Size(), result: signature}
+		scannedClients.Lock()
+		scannedClients.m[served] = s
+		scannedClients.Unlock()
+
+		recordAudit("", "scan", "", "", filepath.Base(served), details)
+	}
+
+	if s.result != "" {
+		return fmt.Errorf("Client file %s is infected with %s", filepath.Base(served), s.result)
+	}
+	return nil
+}
+
+// scanClientsHandler makes sure only clean files are served from the mirror
+func scanClientsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := filepath.Join(getConfig().ChefClients.Path, filepath.FromSlash(filepath.Clean("/"+r.URL.Path)))
+		if err := checkClientFile(requestID(r), file); err != nil {
+			errorHandler(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
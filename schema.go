@@ -0,0 +1,282 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schemaCacheTTL is the time schemas read from Git are cached
+const schemaCacheTTL = 5 * time.Minute
+
+type cachedSchema struct {
+	schema  map[string]interface{}
+	fetched time.Time
+}
+
+var schemaCache = struct {
+	sync.Mutex
+	m map[string]*cachedSchema
+}{m: make(map[string]*cachedSchema)}
+
+// unmarshalDataBagItem unmarshals the body of a data bag item. Some clients
+// wrap the item in a Chef::DataBagItem, in which case the raw data is returned.
+func unmarshalDataBagItem(body []byte) (map[string]interface{}, error) {
+	var item map[string]interface{}
+	if err := json.Unmarshal(body, &item); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal body %s: %s", string(body), err)
+	}
+	if raw, ok := item["raw_data"].(map[string]interface{}); ok {
+		item = raw
+	}
+	return item, nil
+}
+
+// checkDataBagSchema validates a data bag item against the JSON Schema of
+// its data bag (if any)
+func (cg *ChefGuard) checkDataBagSchema(bag string, body []byte) (int, error) {
+	schema, err := cg.dataBagSchema(bag)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("Failed to get the schema of data bag %s: %s", bag, err)
+	}
+	if schema == nil {
+		return 0, nil
+	}
+
+	item, err := unmarshalDataBagItem(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	errors := validateSchema(schema, item, "")
+	if len(errors) == 0 {
+		return 0, nil
+	}
+
+	sort.Strings(errors)
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Data Bag Schema errors found ===\n"+
+		"The item does not match the schema of data bag %s:\n"+
+		" - %s\n"+
+		"====================================\n", bag, strings.Join(errors, "\n - "))
+}
+
+// dataBagSchema returns the schema of a data bag from the local schema
+// directory or, when enabled, from the config repo. It returns nil if the
+// data bag has no schema.
+func (cg *ChefGuard) dataBagSchema(bag string) (map[string]interface{}, error) {
+	name := bag + ".json"
+
+	if getConfig().DataBags.SchemaPath != "" {
+		data, err := ioutil.ReadFile(path.Join(getConfig().DataBags.SchemaPath, name))
+		if err == nil {
+			return parseSchema(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if !getConfig().DataBags.GitSchemas {
+		return nil, nil
+	}
+
+	p := cg.gitPath(path.Join("schemas", "data_bags", name))
+	key := cg.Repo + "/" + p
+
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+
+	if s, ok := schemaCache.m[key]; ok && time.Since(s.fetched) < schemaCacheTTL {
+		return s.schema, nil
+	}
+
+	gitClient, err := getCustomClient(getConfig().Default.GitConfig)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := gitClient.GetContent(cg.Repo, p)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema map[string]interface{}
+	if file != nil {
+		if schema, err = parseSchema([]byte(file.Content)); err != nil {
+			return nil, err
+		}
+	}
+	schemaCache.m[key] = &cachedSchema{schema: schema, fetched: time.Now()}
+
+	return schema, nil
+}
+
+func parseSchema(data []byte) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("Invalid schema: %s", err)
+	}
+	return schema, nil
+}
+
+// validateSchema validates a value against a JSON Schema and returns all
+// errors found. Only the commonly used validation keywords are supported.
+func validateSchema(schema map[string]interface{}, v interface{}, p string) []string {
+	field := p
+	if field == "" {
+		field = "/"
+	}
+	errors := []string{}
+	fail := func(format string, a ...interface{}) {
+		errors = append(errors, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, a...)))
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, v) {
+		fail("expected %s, got %s", typeList(t), jsonType(v))
+		return errors
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value %v is not one of %v", v, enum)
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if _, ok := t[fmt.Sprint(r)]; !ok {
+					fail("missing required field %q", r)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, val := range t {
+			if s, ok := props[k].(map[string]interface{}); ok {
+				errors = append(errors, validateSchema(s, val, p+"/"+k)...)
+				continue
+			}
+			switch a := schema["additionalProperties"].(type) {
+			case bool:
+				if !a {
+					fail("unexpected field %q", k)
+				}
+			case map[string]interface{}:
+				errors = append(errors, validateSchema(a, val, p+"/"+k)...)
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(t)) < n {
+			fail("expected at least %v items, got %d", n, len(t))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(t)) > n {
+			fail("expected at most %v items, got %d", n, len(t))
+		}
+		if s, ok := schema["items"].(map[string]interface{}); ok {
+			for i, val := range t {
+				errors = append(errors, validateSchema(s, val, fmt.Sprintf("%s/%d", p, i))...)
+			}
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && float64(len(t)) < n {
+			fail("expected at least %v characters", n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len(t)) > n {
+			fail("expected at most %v characters", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("invalid pattern %q in schema: %s", pattern, err)
+			} else if !re.MatchString(t) {
+				fail("value %q does not match pattern %q", t, pattern)
+			}
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && t < n {
+			fail("value %v is less than the minimum of %v", t, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && t > n {
+			fail("value %v is greater than the maximum of %v", t, n)
+		}
+	}
+
+	return errors
+}
+
+// matchesType returns true if the value matches one of the schema types
+func matchesType(t, v interface{}) bool {
+	types, ok := t.([]interface{})
+	if !ok {
+		types = []interface{}{t}
+	}
+	for _, t := range types {
+		switch jt := jsonType(v); {
+		case t == jt:
+			return true
+		case t == "integer" && jt == "number" && v.(float64) == math.Trunc(v.(float64)):
+			return true
+		}
+	}
+	return false
+}
+
+func typeList(t interface{}) string {
+	if types, ok := t.([]interface{}); ok {
+		s := make([]string, 0, len(types))
+		for _, t := range types {
+			s = append(s, fmt.Sprint(t))
+		}
+		return strings.Join(s, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// minSecretEntropy is the minimum Shannon entropy (in bits per character) of
+// a token before it is considered to be a secret
+const minSecretEntropy = 4.5
+
+var secretPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+}
+
+// secretToken matches the tokens that are checked for a high entropy
+var secretToken = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{20,}`)
+
+// findSecrets returns the plaintext secrets found in the content
+func findSecrets(location string, content []byte) []string {
+	findings := []string{}
+	multiline := bytes.Contains(content, []byte("\n"))
+	inPEM := false
+
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		loc := location
+		if multiline {
+			loc = fmt.Sprintf("%s:%d", location, i+1)
+		}
+		for _, p := range secretPatterns {
+			if p.re.Match(line) {
+				findings = append(findings, fmt.Sprintf("%s: %s", loc, p.kind))
+			}
+		}
+
+		// The base64 encoded body of PEM blocks (e.g. certificates) is skipped
+		switch {
+		case bytes.Contains(line, []byte("-----BEGIN ")):
+			inPEM = true
+		case bytes.Contains(line, []byte("-----END ")):
+			inPEM = false
+		}
+		if inPEM {
+			continue
+		}
+
+		for _, token := range secretToken.FindAll(line, -1) {
+			if isHighEntropy(string(token)) {
+				findings = append(findings, fmt.Sprintf("%s: high entropy string %s", loc, redactSecret(string(token))))
+			}
+		}
+	}
+	return findings
+}
+
+// isHighEntropy returns true if the token looks like a random secret. Tokens
+// that don't mix upper case, lower case and digits (e.g. checksums) are ignored.
+func isHighEntropy(token string) bool {
+	var upper, lower, digit bool
+	freq := make(map[rune]float64)
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		freq[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	entropy := 0.0
+	for _, n := range freq {
+		p := n / float64(len(token))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= minSecretEntropy
+}
+
+// redactSecret returns a recognizable but unusable version of a secret
+func redactSecret(s string) string {
+	return s[:4] + strings.Repeat("*", 8)
+}
+
+// findJSONSecrets returns the plaintext secrets found in the values of a JSON
+// body, skipping encrypted data bag values and automatic node attributes
+func findJSONSecrets(body []byte) ([]string, error) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+
+	findings := []string{}
+	var walk func(string, interface{})
+	walk = func(p string, v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if _, ok := t["encrypted_data"]; ok {
+				return
+			}
+			for k, val := range t {
+				if p == "" && k == "automatic" {
+					continue
+				}
+				walk(p+"/"+k, val)
+			}
+		case []interface{}:
+			for i, val := range t {
+				walk(fmt.Sprintf("%s/%d", p, i), val)
+			}
+		case string:
+			findings = append(findings, findSecrets(p, []byte(t))...)
+		}
+	}
+	walk("", v)
+
+	return findings, nil
+}
+
+// checkSecrets rejects the request when (not allowed) secrets are found, or
+// only adds a warning header when running in permissive mode
+func (cg *ChefGuard) checkSecrets(w http.ResponseWriter, findings []string) (int, error) {
+	allowed := allowedSecrets(cg.ChefOrg)
+
+	secrets := []string{}
+	for _, f := range findings {
+		if !matchesAny(allowed, f) {
+			secrets = append(secrets, f)
+		}
+	}
+	if len(secrets) == 0 {
+		return 0, nil
+	}
+	sort.Strings(secrets)
+
+	logf(WARNING, cg.RequestID, "Plaintext secrets found in a change by %s: %s", cg.User, strings.Join(secrets, ", "))
+
+	if getEffectiveConfig("DetectSecrets", cg.ChefOrg).(string) == "permissive" {
+		w.Header().Add("X-Chef-Guard-Warning", fmt.Sprintf("Plaintext secrets found: %s", strings.Join(secrets, ", ")))
+		return 0, nil
+	}
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Plaintext secrets found ===\n"+
+		"%s\n\n"+
+		"Please remove the secrets (or use encrypted data bags)\n"+
+		"and try again.\n"+
+		"===============================\n", strings.Join(secrets, "\n"))
+}
+
+// allowedSecrets returns the compiled allow-list of an organization
+func allowedSecrets(org string) []*regexp.Regexp {
+	return compilePatterns(getEffectiveConfig("SecretAllowlist", org).(string))
+}
+
+// compilePatterns compiles a list of regexes divided by a ','. The patterns
+// are verified when loading the config, so invalid patterns are skipped.
+func compilePatterns(list string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, s := range splitList(list) {
+		if re, err := regexp.Compile(s); err == nil {
+			res = append(res, re)
+		}
+	}
+	return res
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// seedGit exports all roles, environments, nodes, clients and data bags of
+// an organization to Git, so new installs start with a complete baseline
+// instead of only capturing future changes
+func seedGit(org string) error {
+	if getConfig().Chef.Type != "enterprise" {
+		org = ""
+	}
+
+	cg, err := newChefGuardForOrg(getConfig().Chef.User, org, false)
+	if err != nil {
+		return fmt.Errorf("Failed to create a new ChefGuard structure: %s", err)
+	}
+	if err := cg.verifyGitTarget(); err != nil {
+		return err
+	}
+
+	items, err := cg.chefItems()
+	if err != nil {
+		return err
+	}
+	clients, err := cg.chefClient.GetClients()
+	if err != nil {
+		return fmt.Errorf("Failed to get clients from Chef: %s", err)
+	}
+	for name := range clients {
+		items[fmt.Sprintf("clients/%s.json", name)] = fmt.Sprintf("clients/%s", name)
+	}
+
+	paths := make([]string, 0, len(items))
+	for p := range items {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var committed int
+	for _, p := range paths {
+		config, err := cg.chefConfig(items[p])
+		if err != nil {
+			return err
+		}
+
+		cg.ChangeDetails = changeDetailsFromPath(p)
+		sha, err := cg.writeConfigToGit("PUT", config)
+		if err != nil {
+			return fmt.Errorf("Failed to commit %s: %s", p, err)
+		}
+		if sha != "" {
+			committed++
+			fmt.Printf("Committed %s\n", p)
+		}
+	}
+
+	fmt.Printf("Seeded repo %s with %d of %d items\n", cg.Repo, committed, len(paths))
+
+	return nil
+}
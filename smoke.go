@@ -0,0 +1,218 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// smokeCookbook is the name of the disposable cookbook used by the smoke test
+const smokeCookbook = "chef-guard-smoke"
+
+// runSmokeTest uploads a disposable cookbook through Chef-Guard to verify
+// the complete stack is working and cleans up again afterwards
+func runSmokeTest(org string) error {
+	if getConfig().Chef.Type != "enterprise" {
+		org = ""
+	}
+
+	cg, err := newChefGuardForOrg(getConfig().Chef.User, org, false)
+	if err != nil {
+		return fmt.Errorf("Failed to create a new ChefGuard structure: %s", err)
+	}
+
+	version := fmt.Sprintf("0.0.%d", time.Now().Unix())
+	failed := false
+	step := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("[FAIL] %s: %s\n", name, err)
+			return
+		}
+		fmt.Printf("[ OK ] %s\n", name)
+	}
+
+	verifyCommits := getEffectiveConfig("CommitChanges", cg.ChefOrg).(bool) &&
+		!getEffectiveConfig("ReviewChanges", cg.ChefOrg).(bool)
+
+	uploadErr := cg.uploadSmokeCookbook(version)
+	step(fmt.Sprintf("Upload cookbook %s version %s", smokeCookbook, version), uploadErr)
+
+	if uploadErr == nil {
+		if verifyCommits {
+			step(fmt.Sprintf("Commit upload to repo %s", cg.Repo), cg.waitForSmokeCommit(version, true))
+		}
+
+		step("Delete cookbook", cg.deleteSmokeCookbook(version))
+		if verifyCommits {
+			step(fmt.Sprintf("Commit delete to repo %s", cg.Repo), cg.waitForSmokeCommit(version, false))
+		}
+	}
+
+	result := "succeeded"
+	if failed {
+		result = "failed"
+	}
+	// The notification is only verified to be accepted by the mail server
+	if getEffectiveConfig("MailServer", cg.ChefOrg).(string) != "" &&
+		getEffectiveConfig("MailRecipient", cg.ChefOrg).(string) != "" {
+		step("Send notification", mailAlert(cg.ChefOrg,
+			fmt.Sprintf("Smoke test %s", result),
+			fmt.Sprintf("The smoke test using cookbook %s version %s %s.", smokeCookbook, version, result),
+		))
+	}
+
+	if failed {
+		return fmt.Errorf("Smoke test failed")
+	}
+	return nil
+}
+
+// uploadSmokeCookbook uploads the disposable cookbook using the same API
+// calls knife uses, so the upload is processed by Chef-Guard
+func (cg *ChefGuard) uploadSmokeCookbook(version string) error {
+	content := []byte(fmt.Sprintf("name '%s'\nversion '%s'\n", smokeCookbook, version))
+	sum := md5.Sum(content)
+	checksum := fmt.Sprintf("%x", sum)
+
+	// Create a sandbox and upload the file if needed
+	var sandbox struct {
+		ID        string `json:"sandbox_id"`
+		Checksums map[string]struct {
+			URL         string `json:"url"`
+			NeedsUpload bool   `json:"needs_upload"`
+		} `json:"checksums"`
+	}
+	body := fmt.Sprintf(`{"checksums":{%q:null}}`, checksum)
+	if err := cg.smokeRequest("POST", "sandboxes", []byte(body), &sandbox); err != nil {
+		return err
+	}
+
+	if c := sandbox.Checksums[checksum]; c.NeedsUpload {
+		req, err := http.NewRequest("PUT", c.URL, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-binary")
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+		client := http.DefaultClient
+		if getConfig().Chef.SSLNoVerify {
+			client = &http.Client{Transport: insecureTransport}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("Failed to upload metadata.rb: %s", err)
+		}
+		defer resp.Body.Close()
+		if err := checkHTTPResponse(resp, []int{http.StatusOK, http.StatusCreated, http.StatusNoContent}); err != nil {
+			return fmt.Errorf("Failed to upload metadata.rb: %s", err)
+		}
+	}
+
+	if err := cg.smokeRequest("PUT", "sandboxes/"+sandbox.ID, []byte(`{"is_completed":true}`), nil); err != nil {
+		return err
+	}
+
+	cookbook, err := json.Marshal(map[string]interface{}{
+		"name":          fmt.Sprintf("%s-%s", smokeCookbook, version),
+		"cookbook_name": smokeCookbook,
+		"version":       version,
+		"json_class":    "Chef::CookbookVersion",
+		"chef_type":     "cookbook_version",
+		"frozen?":       false,
+		"metadata": map[string]interface{}{
+			"name":         smokeCookbook,
+			"version":      version,
+			"description":  "Disposable cookbook used by the Chef-Guard smoke test",
+			"dependencies": map[string]string{},
+		},
+		"root_files": []map[string]string{{
+			"name":        "metadata.rb",
+			"path":        "metadata.rb",
+			"checksum":    checksum,
+			"specificity": "default",
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return cg.smokeRequest("PUT", fmt.Sprintf("cookbooks/%s/%s", smokeCookbook, version), cookbook, nil)
+}
+
+func (cg *ChefGuard) deleteSmokeCookbook(version string) error {
+	return cg.smokeRequest("DELETE", fmt.Sprintf("cookbooks/%s/%s", smokeCookbook, version), nil, nil)
+}
+
+// smokeRequest makes a signed request and unmarshals the response into v
+func (cg *ChefGuard) smokeRequest(method, endpoint string, body []byte, v interface{}) error {
+	var resp *http.Response
+	var err error
+
+	switch method {
+	case "POST":
+		resp, err = cg.chefClient.Post(endpoint, "application/json", nil, bytes.NewReader(body))
+	case "PUT":
+		resp, err = cg.chefClient.Put(endpoint, nil, bytes.NewReader(body))
+	case "DELETE":
+		resp, err = cg.chefClient.Delete(endpoint, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s", method, endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK, http.StatusCreated}); err != nil {
+		return fmt.Errorf("%s %s failed: %s", method, endpoint, err)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// waitForSmokeCommit waits until the (async) commit of the upload or delete
+// of the disposable cookbook is visible in Git
+func (cg *ChefGuard) waitForSmokeCommit(version string, exists bool) error {
+	if cg.gitClient == nil {
+		if err := cg.verifyGitTarget(); err != nil {
+			return err
+		}
+	}
+
+	p := cg.gitPath(fmt.Sprintf("cookbooks/%s-%s.json", smokeCookbook, version))
+	for i := 0; i < 30; i++ {
+		file, _, err := cg.gitClient.GetContent(cg.Repo, p)
+		if err != nil {
+			return err
+		}
+		if (file != nil) == exists {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	return fmt.Errorf("Timed out waiting for %s in repo %s", p, cg.Repo)
+}
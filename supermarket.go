@@ -17,41 +17,58 @@
 package main
 
 import (
-	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"mime/multipart"
 	"net/http"
-	"regexp"
-	"strings"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/marpaia/chef-golang"
 )
 
-var supermarketKey string
-
 func setupSMClient() (*chef.Chef, error) {
-	if supermarketKey == "" {
-		key, err := ioutil.ReadFile(cfg.Supermarket.Key)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read Chef key: %s", err)
-		}
-
-		supermarketKey = string(key)
-	}
+	clientState.RLock()
+	key := clientState.supermarketKey
+	c := getConfig()
+	clientState.RUnlock()
 
-	smClient, err := chef.ConnectBuilder(cfg.Supermarket.Server, cfg.Supermarket.Port, "", cfg.Supermarket.User, supermarketKey, "")
+	smClient, err := chef.ConnectBuilder(c.Supermarket.Server, c.Supermarket.Port, "", c.Supermarket.User, key, "")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create new Supermarket API connection: %s", err)
 	}
 
-	smClient.SSLNoVerify = cfg.Supermarket.SSLNoVerify
+	smClient.SSLNoVerify = c.Supermarket.SSLNoVerify
 
 	return smClient, nil
 }
 
+// publishRequest holds all details needed to (re)play a Supermarket upload
+type publishRequest struct {
+	ChefOrg   string
+	User      string
+	Cookbook  string
+	Version   string
+	Tarball   string
+	RequestID string
+}
+
+func init() {
+	queueHandlers["publish"] = replayPublish
+}
+
+// publishCookbook uploads the cookbook to the Supermarket. When a queue is
+// configured a failed upload is queued, so the cookbook upload itself can
+// still succeed while the Supermarket is unavailable.
 func (cg *ChefGuard) publishCookbook() error {
-	if blackListed(cg.ChefOrg, cg.Cookbook.Name) {
+	if skipStep(cg.ChefOrg, cg.Cookbook.Name, "publish") {
 		return nil
 	}
 
@@ -62,15 +79,130 @@ func (cg *ChefGuard) publishCookbook() error {
 		}
 	}
 
-	buf := new(bytes.Buffer)
-	mw := multipart.NewWriter(buf)
+	// Uploads the Supermarket rejected (e.g. with a 4xx) are not queued, as
+	// they would be rejected again
+	err := uploadToSupermarket(cg.smClient, cg.RequestID, cg.Cookbook.Name, cg.TarPath)
+	if err == nil || retryQueue == nil || !transient(err) {
+		return err
+	}
+
+	logf(WARNING, cg.RequestID, "Queueing the Supermarket upload of %s version %s: %s", cg.Cookbook.Name, cg.Cookbook.Version, err)
+
+	tarball, qErr := cg.queueTarball()
+	if qErr != nil {
+		return fmt.Errorf("Failed to queue the Supermarket upload of %s: %s", cg.Cookbook.Name, qErr)
+	}
+
+	p := &publishRequest{
+		ChefOrg:   cg.ChefOrg,
+		User:      cg.User,
+		Cookbook:  cg.Cookbook.Name,
+		Version:   cg.Cookbook.Version,
+		Tarball:   tarball,
+		RequestID: cg.RequestID,
+	}
+	if err := retryQueue.push("publish", p, err); err != nil {
+		os.Remove(tarball)
+		return fmt.Errorf("Failed to queue the Supermarket upload of %s: %s", cg.Cookbook.Name, err)
+	}
+
+	return nil
+}
+
+// queueTarball copies the cookbook archive into the queue, as the archive
+// itself is removed when the request is done
+func (cg *ChefGuard) queueTarball() (string, error) {
+	archive, err := os.Open(cg.TarPath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	tarball := filepath.Join(retryQueue.dir,
+		fmt.Sprintf("%s-%s-%d.tgz", cg.Cookbook.Name, cg.Cookbook.Version, time.Now().UnixNano()))
+	return tarball, writeFileToDisk(tarball, archive)
+}
+
+func replayPublish(e *QueueEntry) error {
+	p := new(publishRequest)
+	if err := json.Unmarshal(e.Payload, p); err != nil {
+		return fmt.Errorf("Failed to unmarshal queue entry %s: %s", e.ID, err)
+	}
+
+	smClient, err := setupSMClient()
+	if err != nil {
+		return err
+	}
+
+	if err := uploadToSupermarket(smClient, p.RequestID, p.Cookbook, p.Tarball); err != nil {
+		return err
+	}
+	if err := os.Remove(p.Tarball); err != nil {
+		WARNING.Printf("Failed to remove queued archive %s: %s", p.Tarball, err)
+	}
+
+	INFO.Printf("Published queued version %s of cookbook %s to the Supermarket", p.Version, p.Cookbook)
+	return nil
+}
+
+// uploadToSupermarket streams the cookbook archive to the Supermarket. The
+// request is signed here, as the Chef client reads the complete body into
+// memory to calculate its hash.
+func uploadToSupermarket(smClient *chef.Chef, id, name, tarball string) error {
+	hash, err := fileHash(tarball)
+	if err != nil {
+		return fmt.Errorf("Failed to hash the tar archive: %s", err)
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeSupermarketForm(mw, name, tarball))
+	}()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/cookbooks", smClient.Url), pr)
+	if err != nil {
+		return fmt.Errorf("Failed to create the Supermarket request: %s", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if err := signRequest(smClient, req, hash); err != nil {
+		return fmt.Errorf("Failed to sign the Supermarket request: %s", err)
+	}
+
+	resp, err := newHTTPClient(smClient.SSLNoVerify).Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s to the Supermarket: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusCreated}); err != nil {
+		return &statusError{
+			code: resp.StatusCode,
+			err:  fmt.Errorf("Failed to upload %s to the Supermarket: %s", name, err),
+		}
+	}
+
+	return nil
+}
 
-	fw, err := mw.CreateFormFile("tarball", fmt.Sprintf("%s.tgz", cg.Cookbook.Name))
+func writeSupermarketForm(mw *multipart.Writer, name, tarball string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return fmt.Errorf("Failed to open the tar archive: %s", err)
+	}
+	defer f.Close()
+
+	fw, err := mw.CreateFormFile("tarball", fmt.Sprintf("%s.tgz", name))
 	if err != nil {
 		return fmt.Errorf("Failed to create form file: %s", err)
 	}
 
-	if _, err = fw.Write(cg.TarFile); err != nil {
+	if _, err = io.Copy(fw, f); err != nil {
 		return fmt.Errorf("Failed to add tar archive to the request: %s", err)
 	}
 
@@ -86,34 +218,114 @@ func (cg *ChefGuard) publishCookbook() error {
 		return fmt.Errorf("Failed to close the Supermarket tarball: %s", err)
 	}
 
-	resp, err := cg.smClient.Post("api/v1/cookbooks", mw.FormDataContentType(), nil, buf)
+	return nil
+}
+
+// fileHash returns the base64 encoded SHA1 hash of a file, which for a
+// multipart upload is the content hash Chef expects
+func fileHash(name string) (string, error) {
+	f, err := os.Open(name)
 	if err != nil {
-		return fmt.Errorf("Failed to upload %s to the Supermarket: %s", cg.Cookbook.Name, err)
+		return "", err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	if err := checkHTTPResponse(resp, []int{http.StatusCreated}); err != nil {
-		return fmt.Errorf("Failed to upload %s to the Supermarket: %s", cg.Cookbook.Name, err)
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// signRequest adds the Chef authentication headers (version 1.0) to the
+// request, using the given content hash
+func signRequest(c *chef.Chef, req *http.Request, hash string) error {
+	req.URL.Path = path.Clean(req.URL.Path)
+	pathHash := sha1.Sum([]byte(req.URL.Path))
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Chef-Version", c.Version)
+	req.Header.Set("X-Ops-Timestamp", timestamp)
+	req.Header.Set("X-Ops-Userid", c.UserId)
+	req.Header.Set("X-Ops-Sign", "version=1.0")
+	req.Header.Set("X-Ops-Content-Hash", hash)
+
+	content := fmt.Sprintf("Method:%s\nHashed Path:%s\nX-Ops-Content-Hash:%s\nX-Ops-Timestamp:%s\nX-Ops-UserId:%s",
+		req.Method, base64.StdEncoding.EncodeToString(pathHash[:]), hash, timestamp, c.UserId)
+	sig, err := rsa.SignPKCS1v15(nil, c.Key, crypto.Hash(0), []byte(content))
+	if err != nil {
+		return err
+	}
+
+	enc := base64.StdEncoding.EncodeToString(sig)
+	for i := 0; len(enc) > 0; i++ {
+		n := 60
+		if len(enc) < n {
+			n = len(enc)
+		}
+		req.Header.Set(fmt.Sprintf("X-Ops-Authorization-%d", i+1), enc[:n])
+		enc = enc[n:]
 	}
 
 	return nil
 }
 
 func blackListed(org, cookbook string) bool {
-	blacklist := cfg.Default.Blacklist
+	blacklist := getConfig().Default.Blacklist
 	custBL := getEffectiveConfig("Blacklist", org)
 	if blacklist != custBL {
 		blacklist = fmt.Sprintf("%s,%s", blacklist, custBL)
 	}
-	if blacklist == "" {
+	return matchesAny(compilePatterns(blacklist), cookbook)
+}
+
+// allowListed returns true if there is no allowlist or if the cookbook
+// matches one of the allowlist regexes
+func allowListed(org, cookbook string) bool {
+	allowlist := getConfig().Default.Allowlist
+	custAL := getEffectiveConfig("Allowlist", org)
+	if allowlist != custAL {
+		allowlist = fmt.Sprintf("%s,%s", allowlist, custAL)
+	}
+	patterns := compilePatterns(allowlist)
+	return len(patterns) == 0 || matchesAny(patterns, cookbook)
+}
+
+// skipStep returns true if a step (publish, compare or tag) is skipped for
+// the cookbook, because it is blacklisted or not on the allowlist
+func skipStep(org, cookbook, step string) bool {
+	steps := getEffectiveConfig("ListSteps", org).(string)
+	if steps == "" {
+		steps = "publish"
+	}
+	if !containsType(steps, step) {
 		return false
 	}
-	rgx := strings.Split(blacklist, ",")
-	for _, r := range rgx {
-		re, _ := regexp.Compile(strings.TrimSpace(r))
-		if re.MatchString(cookbook) {
-			return true
-		}
+	return blackListed(org, cookbook) || !allowListed(org, cookbook)
+}
+
+// unshareDeletedCookbook removes a deleted cookbook version from the Supermarket
+func unshareDeletedCookbook(id, name, version string) {
+	smClient, err := setupSMClient()
+	if err != nil {
+		logf(ERROR, id, "Failed to unshare version %s of cookbook %s: %s", version, name, err)
+		return
+	}
+
+	resp, err := smClient.Delete(fmt.Sprintf("api/v1/cookbooks/%s/versions/%s", name, version), nil)
+	if err != nil {
+		logf(ERROR, id, "Failed to unshare version %s of cookbook %s: %s", version, name, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK, http.StatusNotFound}); err != nil {
+		logf(ERROR, id, "Failed to unshare version %s of cookbook %s: %s", version, name, err)
+		return
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		logf(INFO, id, "Unshared deleted version %s of cookbook %s from the Supermarket", version, name)
 	}
-	return false
 }
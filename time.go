@@ -22,6 +22,23 @@ import (
 	"time"
 )
 
+// timeZone returns the location used to render timestamps
+func timeZone() *time.Location {
+	if loc := getConfig().location; loc != nil {
+		return loc
+	}
+	return time.Local
+}
+
+// formatTime renders a timestamp in the configured zone and format
+func formatTime(t time.Time) string {
+	format := getConfig().Default.TimeFormat
+	if format == "" {
+		format = "Mon Jan 2 15:04:05 2006 -0700"
+	}
+	return t.In(timeZone()).Format(format)
+}
+
 func timeHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.FormValue("p") {
 	case "el":
@@ -0,0 +1,128 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/icub3d/graceful"
+)
+
+// certCheckInterval is the interval at which the certificate files of the
+// listener are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// listenerCert holds the certificate served by the TLS listener. It is
+// reloaded when the certificate or key file changes or when the config is
+// reloaded, so certificates can be rotated without restarting Chef-Guard.
+var listenerCert = struct {
+	sync.Mutex
+	cert    *tls.Certificate
+	files   string
+	modTime time.Time
+	checked time.Time
+}{}
+
+// getListenerCert implements the GetCertificate callback of the listener
+func getListenerCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	listenerCert.Lock()
+	defer listenerCert.Unlock()
+
+	if listenerCert.cert != nil && time.Since(listenerCert.checked) < certCheckInterval {
+		return listenerCert.cert, nil
+	}
+	listenerCert.checked = time.Now()
+
+	certFile, keyFile := getConfig().Default.TLSCert, getConfig().Default.TLSKey
+	files := certFile + "\x00" + keyFile
+	modTime, err := certModTime(certFile, keyFile)
+	if err != nil {
+		if listenerCert.cert == nil {
+			return nil, err
+		}
+		ERROR.Printf("Failed to check TLS certificate %s, keeping the current one: %s", certFile, err)
+		return listenerCert.cert, nil
+	}
+	if listenerCert.cert != nil && files == listenerCert.files && modTime.Equal(listenerCert.modTime) {
+		return listenerCert.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if listenerCert.cert == nil {
+			return nil, err
+		}
+		// The files might be halfway through being rotated, so keep using
+		// the current certificate and try again at the next check
+		ERROR.Printf("Failed to reload TLS certificate %s, keeping the current one: %s", certFile, err)
+		return listenerCert.cert, nil
+	}
+
+	if listenerCert.cert != nil {
+		INFO.Printf("Reloaded TLS certificate %s", certFile)
+	}
+	listenerCert.cert = &cert
+	listenerCert.files = files
+	listenerCert.modTime = modTime
+
+	return listenerCert.cert, nil
+}
+
+// certModTime returns the latest modification time of the files
+func certModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reloadListenerCert makes sure the certificate files are checked at the
+// next handshake
+func reloadListenerCert() {
+	listenerCert.Lock()
+	listenerCert.checked = time.Time{}
+	listenerCert.Unlock()
+}
+
+// listenAndServeTLS serves HTTPS using the certificate of the config
+func listenAndServeTLS(s *graceful.Server, addr string) error {
+	// Load the certificate now, so we fail at startup when it is invalid
+	if _, err := getListenerCert(nil); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(tls.NewListener(l, &tls.Config{
+		GetCertificate: getListenerCert,
+		NextProtos:     []string{"http/1.1"},
+	}))
+}
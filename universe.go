@@ -0,0 +1,254 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Universe holds all cookbook versions listed by a universe endpoint
+type Universe map[string]map[string]*UniverseEntry
+
+// UniverseEntry represents a single cookbook version in a universe
+type UniverseEntry struct {
+	LocationType string            `json:"location_type"`
+	LocationPath string            `json:"location_path"`
+	DownloadURL  string            `json:"download_url"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// cachedUniverse holds a downloaded universe and the validators needed to
+// revalidate it
+type cachedUniverse struct {
+	sync.Mutex
+	universe     Universe
+	etag         string
+	lastModified string
+	fetched      time.Time
+}
+
+// universes caches the downloaded universes by URL
+var universes = struct {
+	sync.Mutex
+	m map[string]*cachedUniverse
+}{m: make(map[string]*cachedUniverse)}
+
+// universeRecheck is the interval at which the universe endpoint of the
+// Chef server is detected again
+const universeRecheck = 10 * time.Minute
+
+// chefUniverse caches the result of detecting the universe endpoint
+var chefUniverse = struct {
+	sync.Mutex
+	checked time.Time
+	url     string
+}{}
+
+// detectChefUniverse returns the base URL of the universe (Berkshelf API)
+// endpoint exposed by the Chef server, or an empty string if there is none
+func detectChefUniverse() string {
+	chefUniverse.Lock()
+	defer chefUniverse.Unlock()
+
+	if !chefUniverse.checked.IsZero() && time.Since(chefUniverse.checked) < universeRecheck {
+		return chefUniverse.url
+	}
+	chefUniverse.checked = time.Now()
+
+	baseURL := getChefBaseURL()
+	found := probeUniverse(baseURL + "/universe")
+	if found && chefUniverse.url == "" {
+		INFO.Printf("Detected universe endpoint on Chef server %s", baseURL)
+	}
+	if !found {
+		baseURL = ""
+	}
+	chefUniverse.url = baseURL
+
+	return chefUniverse.url
+}
+
+// probeUniverse returns true if the URL returns a valid universe
+func probeUniverse(u string) bool {
+	resp, err := getSignedUniverse(u)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+	var universe Universe
+	return json.Unmarshal(body, &universe) == nil
+}
+
+// getSignedUniverse gets the universe endpoint of the Chef server, which
+// only serves requests signed by a user or client
+func getSignedUniverse(u string) (*http.Response, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	chefClient, err := newChefClient("")
+	if err != nil {
+		return nil, err
+	}
+	return chefClient.Get(strings.TrimPrefix(p.Path, "/"))
+}
+
+// getUniverse returns the universe served by the URL. When caching is
+// enabled, the universe is only downloaded again when it is older than the
+// TTL and the server indicates that it was modified.
+func getUniverse(u string) (Universe, error) {
+	if getConfig().Universe.TTL <= 0 {
+		c := &cachedUniverse{}
+		if err := c.fetch(u); err != nil {
+			return nil, err
+		}
+		return c.universe, nil
+	}
+
+	universes.Lock()
+	c, ok := universes.m[u]
+	if !ok {
+		c = &cachedUniverse{}
+		universes.m[u] = c
+	}
+	universes.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.universe != nil && time.Since(c.fetched) < time.Duration(getConfig().Universe.TTL)*time.Second {
+		return c.universe, nil
+	}
+	if err := c.fetch(u); err != nil {
+		if c.universe == nil {
+			return nil, err
+		}
+		WARNING.Printf("Using cached universe of %s: %s", u, err)
+	}
+	return c.universe, nil
+}
+
+// fetch downloads the universe, or only marks it as fresh when the server
+// responds that the cached universe is not modified. The caller must hold
+// the lock of the cached universe.
+func (c *cachedUniverse) fetch(u string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create request for %s: %s", u, err)
+	}
+	if c.universe != nil {
+		if c.etag != "" {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		if c.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.lastModified)
+		}
+	}
+
+	var resp *http.Response
+	if req.URL.Hostname() == getConfig().Chef.Server {
+		resp, err = getSignedUniverse(u)
+	} else {
+		resp, err = newHTTPClient(false).Do(req)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to get cookbook list from %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && c.universe != nil {
+		c.fetched = time.Now()
+		return nil
+	}
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return fmt.Errorf("Failed to get cookbook list from %s: %s", u, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read the response body from %v: %s", resp, err)
+	}
+	universe := make(Universe)
+	if err := json.Unmarshal(body, &universe); err != nil {
+		return fmt.Errorf("Failed to unmarshal body %s: %s", string(body), err)
+	}
+
+	c.universe = universe
+	c.etag = resp.Header.Get("ETag")
+	c.lastModified = resp.Header.Get("Last-Modified")
+	c.fetched = time.Now()
+
+	return nil
+}
+
+// startUniverseRefresher periodically revalidates all cached universes, so
+// cookbook uploads don't have to wait for a universe to be downloaded
+func startUniverseRefresher() {
+	if getConfig().Universe.TTL <= 0 || !getConfig().Universe.Refresh {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(getConfig().Universe.TTL) * time.Second / 2)
+			refreshUniverses()
+		}
+	}()
+}
+
+func refreshUniverses() {
+	universes.Lock()
+	cached := make(map[string]*cachedUniverse, len(universes.m))
+	for u, c := range universes.m {
+		cached[u] = c
+	}
+	universes.Unlock()
+
+	for u, c := range cached {
+		c.Lock()
+		if err := c.fetch(u); err != nil {
+			WARNING.Printf("Failed to refresh the universe of %s: %s", u, err)
+		}
+		c.Unlock()
+	}
+}
+
+// supermarketUniverse returns the universe of a Supermarket
+func supermarketUniverse(supermarket string) (Universe, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s", supermarket, "universe"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the community cookbooks URL %s: %s", supermarket, err)
+	}
+	if u, err = secureURL(u); err != nil {
+		return nil, err
+	}
+	return getUniverse(u.String())
+}
@@ -0,0 +1,327 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xanzy/chef-guard/git"
+)
+
+var (
+	cookbookVersion = regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)
+	metadataDepends = regexp.MustCompile(`(?m)^\s*depends\s*\(?\s*['"]([^'"]+)['"](?:\s*,\s*['"]([^'"]+)['"])?`)
+)
+
+// downloadTokenTTL is the time a download URL served in the universe is valid
+const downloadTokenTTL = time.Hour
+
+// gitUniverse caches the cookbook versions tagged in Git. The cached entries
+// don't contain any URLs, as those depend on the request.
+var gitUniverse = struct {
+	sync.Mutex
+	universe Universe
+	fetched  time.Time
+}{}
+
+// universeHandler serves a single universe that merges the public
+// Supermarket, the cookbooks tagged in Git and the private Supermarket.
+// When a version exists in multiple sources, the private Supermarket takes
+// precedence over Git, which takes precedence over the public Supermarket.
+// The request must be signed by a Chef user or client, as the Git versions
+// can be downloaded without any Git credentials.
+func universeHandler(w http.ResponseWriter, r *http.Request) {
+	feed := make(Universe)
+	merge := func(u Universe) {
+		for name, versions := range u {
+			if feed[name] == nil {
+				feed[name] = make(map[string]*UniverseEntry)
+			}
+			for version, e := range versions {
+				feed[name][version] = e
+			}
+		}
+	}
+
+	if getConfig().Community.Supermarket != "" {
+		u, err := supermarketUniverse(getConfig().Community.Supermarket)
+		if err != nil {
+			errorHandler(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		merge(u)
+	}
+
+	baseURL := chefGuardURL(r)
+	expires := time.Now().Add(downloadTokenTTL).Unix()
+	for name, versions := range gitCookbooks() {
+		entries := make(map[string]*UniverseEntry, len(versions))
+		for version, e := range versions {
+			entry := *e
+			entry.LocationPath = baseURL
+			entry.DownloadURL = fmt.Sprintf("%s/chef-guard/universe/%s/%s/download?expires=%d&token=%s",
+				baseURL, name, version, expires, downloadToken(name, version, expires))
+			entries[version] = &entry
+		}
+		merge(Universe{name: entries})
+	}
+
+	if supermarket := privateSupermarketURL(); supermarket != "" {
+		u, err := supermarketUniverse(supermarket)
+		if err != nil {
+			errorHandler(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		merge(u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(feed); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to encode universe: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// chefGuardURL returns the base URL clients used to reach Chef-Guard
+func chefGuardURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// downloadToken returns the token that authorizes downloading a cookbook
+// version from the universe until the given time. The token is derived from
+// the Chef key, so it is valid on all instances sharing the same config.
+func downloadToken(name, version string, expires int64) string {
+	clientState.RLock()
+	key := sha256.Sum256([]byte(clientState.chefKey))
+	clientState.RUnlock()
+
+	mac := hmac.New(sha256.New, key[:])
+	fmt.Fprintf(mac, "%s/%s/%d", name, version, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validDownloadToken returns true if the request contains a valid and not
+// yet expired download token for the cookbook version
+func validDownloadToken(r *http.Request, name, version string) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	return hmac.Equal([]byte(token), []byte(downloadToken(name, version, expires)))
+}
+
+// startGitUniverseRefresher keeps the universe of the cookbooks tagged in Git
+// up-to-date in the background, so requests never have to wait for it
+func startGitUniverseRefresher() {
+	if getConfig().Universe.TTL <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			refreshGitUniverse()
+			time.Sleep(time.Duration(getConfig().Universe.TTL) * time.Second / 2)
+		}
+	}()
+}
+
+// gitCookbooks returns the universe of all versions tagged in the repos of
+// the cookbooks that have a [cookbook "<name>"] config. The universe is only
+// build while handling the request if it isn't cached (yet).
+func gitCookbooks() Universe {
+	gitUniverse.Lock()
+	universe, fetched := gitUniverse.universe, gitUniverse.fetched
+	gitUniverse.Unlock()
+
+	if universe != nil && getConfig().Universe.TTL > 0 && time.Since(fetched) < time.Duration(getConfig().Universe.TTL)*time.Second {
+		return universe
+	}
+	return refreshGitUniverse()
+}
+
+// refreshGitUniverse builds the universe of all versions tagged in Git.
+// Cookbooks located in a subdirectory are skipped, as their archive is not
+// a valid cookbook.
+func refreshGitUniverse() Universe {
+	universe := make(Universe)
+	for name := range getConfig().Cookbook {
+		src := sourceOfCookbook("", name)
+		if src.subdir != "" {
+			continue
+		}
+		versions, err := gitCookbookVersions(name, src)
+		if err != nil {
+			WARNING.Printf("Failed to get the tagged versions of cookbook %s: %s", name, err)
+			continue
+		}
+		if len(versions) > 0 {
+			universe[name] = versions
+		}
+	}
+
+	gitUniverse.Lock()
+	gitUniverse.universe = universe
+	gitUniverse.fetched = time.Now()
+	gitUniverse.Unlock()
+
+	return universe
+}
+
+func gitCookbookVersions(name string, src *cookbookSource) (map[string]*UniverseEntry, error) {
+	for _, gitConfig := range src.gitConfigs {
+		gitClient, err := getCustomClient(strings.TrimSpace(gitConfig))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create custom Git client: %s", err)
+		}
+		tags, err := gitClient.ListTags(src.repo)
+		if err != nil {
+			return nil, err
+		}
+		if tags == nil {
+			continue
+		}
+
+		versions := make(map[string]*UniverseEntry)
+		for _, tag := range tags {
+			version := strings.TrimPrefix(tag, src.tagPrefix)
+			if !strings.HasPrefix(tag, src.tagPrefix) || !cookbookVersion.MatchString(version) {
+				continue
+			}
+			deps, err := cookbookDependencies(gitClient, src, tag)
+			if err != nil {
+				return nil, err
+			}
+			versions[version] = &UniverseEntry{
+				LocationType: "uri",
+				Dependencies: deps,
+			}
+		}
+		return versions, nil
+	}
+	return nil, nil
+}
+
+// cookbookDependencies returns the dependencies of a tagged cookbook version,
+// read from its metadata.json or else from its metadata.rb
+func cookbookDependencies(gitClient git.Git, src *cookbookSource, tag string) (map[string]string, error) {
+	deps := make(map[string]string)
+
+	file, err := gitClient.GetFileAtRef(src.repo, "metadata.json", tag)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		var md struct {
+			Dependencies map[string]string `json:"dependencies"`
+		}
+		if err := json.Unmarshal([]byte(file.Content), &md); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal the metadata.json of %s: %s", tag, err)
+		}
+		for name, constraint := range md.Dependencies {
+			deps[name] = constraint
+		}
+		return deps, nil
+	}
+
+	file, err = gitClient.GetFileAtRef(src.repo, "metadata.rb", tag)
+	if err != nil || file == nil {
+		return deps, err
+	}
+	for _, m := range metadataDepends.FindAllStringSubmatch(file.Content, -1) {
+		constraint := m[2]
+		if constraint == "" {
+			constraint = ">= 0.0.0"
+		}
+		deps[m[1]] = constraint
+	}
+	return deps, nil
+}
+
+// universeDownloadHandler streams the archive of a cookbook version tagged
+// in Git, so clients don't need any Git credentials. The request must either
+// use a download URL served by the (authenticated) universe, or be signed by
+// a Chef user or client.
+func universeDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, version := vars["name"], vars["version"]
+
+	if !validDownloadToken(r, name, version) {
+		if _, err := authenticateRequest(r, r.URL.Query().Get("org")); err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to authenticate request: %s", err), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if _, ok := getConfig().Cookbook[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	src := sourceOfCookbook("", name)
+	sc, err := searchGit(r.Context(), src.gitConfigs, src, version, true)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if sc == nil || src.subdir != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	client, err := newDownloadClient(sc)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequest("GET", sc.DownloadURL.String(), nil)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to create a download request: %s", err), http.StatusInternalServerError)
+		return
+	}
+	resp, err := client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to download cookbook %s version %s: %s", name, version, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to download cookbook %s version %s: %s", name, version, err), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.tar.gz", name, version))
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logf(ERROR, requestID(r), "Failed to stream cookbook %s version %s: %s", name, version, err)
+	}
+}
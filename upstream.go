@@ -0,0 +1,225 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errErchefUnavailable is returned when the circuits of all erchef
+	// upstreams are open
+	errErchefUnavailable = errors.New("All erchef upstreams are unavailable")
+
+	erchefCircuitOpens = expvar.NewMap("erchef_circuit_opens_total")
+)
+
+// upstream tracks the health of a single erchef endpoint
+type upstream struct {
+	host      string
+	failures  int
+	openUntil time.Time
+}
+
+// upstreamPool holds all erchef endpoints in order of preference
+type upstreamPool struct {
+	sync.Mutex
+	key       string
+	upstreams []*upstream
+}
+
+var erchefPool = &upstreamPool{}
+
+// erchefHosts returns all configured erchef endpoints as host:port
+func erchefHosts() []string {
+	var hosts []string
+	for _, h := range splitList(getConfig().Chef.ErchefIP) {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, fmt.Sprint(getConfig().Chef.ErchefPort))
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// erchefURL returns the URL of the preferred erchef endpoint
+func erchefURL() string {
+	return fmt.Sprintf("http://%s", erchefHosts()[0])
+}
+
+// available returns all upstreams that currently accept requests, in order
+// of preference. Upstreams with an open circuit accept requests again once
+// the cooldown passed, so they can recover.
+func (p *upstreamPool) available() []*upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	// Rebuild the pool when the config is reloaded with other endpoints
+	if key := strings.Join(erchefHosts(), ","); key != p.key {
+		p.key, p.upstreams = key, nil
+		for _, h := range erchefHosts() {
+			p.upstreams = append(p.upstreams, &upstream{host: h})
+		}
+	}
+
+	now := time.Now()
+	var res []*upstream
+	for _, u := range p.upstreams {
+		if !now.Before(u.openUntil) {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// report records the result of a call to an upstream, opening its circuit
+// after too many consecutive failures
+func (p *upstreamPool) report(u *upstream, failed bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !failed {
+		if u.failures >= erchefFailures() {
+			INFO.Printf("Erchef upstream %s recovered, closing circuit", u.host)
+		}
+		u.failures = 0
+		return
+	}
+
+	u.failures++
+	if u.failures >= erchefFailures() {
+		cooldown := time.Duration(getConfig().Chef.ErchefCooldown) * time.Second
+		if cooldown == 0 {
+			cooldown = 30 * time.Second
+		}
+		u.openUntil = time.Now().Add(cooldown)
+		erchefCircuitOpens.Add(u.host, 1)
+		WARNING.Printf("Erchef upstream %s failed %d times in a row, opening circuit for %s", u.host, u.failures, cooldown)
+	}
+}
+
+func erchefFailures() int {
+	if getConfig().Chef.ErchefFailures == 0 {
+		return 5
+	}
+	return getConfig().Chef.ErchefFailures
+}
+
+// failoverTransport sends requests to the first available erchef upstream,
+// failing over to the next one when a connection cannot be made
+type failoverTransport struct {
+	sync.Mutex
+	key  string
+	base *http.Transport
+}
+
+var erchefTransport = &failoverTransport{}
+
+// transport returns the base transport, which is recreated when the config
+// is reloaded with other timeouts or connection settings
+func (t *failoverTransport) transport() *http.Transport {
+	timeout := time.Duration(getConfig().Chef.ErchefTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 120 * time.Second
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if key := fmt.Sprintf("%s/%s", timeout, connectionSettings()); key != t.key || t.base == nil {
+		t.key = key
+		t.base = &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			ResponseHeaderTimeout: timeout,
+		}
+		tuneConnections(t.base)
+	}
+	return t.base
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstreams := erchefPool.available()
+	if len(upstreams) == 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errErchefUnavailable
+	}
+
+	// Buffer the body, so the request can be sent to another upstream
+	var body []byte
+	if req.Body != nil && len(upstreams) > 1 {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	base := t.transport()
+	for i, u := range upstreams {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		req.URL.Host = u.host
+
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			erchefPool.report(u, true)
+
+			// Only requests that never reached the upstream are sent to
+			// the next one, as other requests might have been applied
+			if oe, ok := err.(*net.OpError); ok && oe.Op == "dial" && i < len(upstreams)-1 {
+				logf(WARNING, requestID(req), "Failed to connect to erchef upstream %s, failing over: %s", u.host, err)
+				continue
+			}
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			erchefPool.report(u, true)
+		default:
+			erchefPool.report(u, false)
+		}
+		return resp, nil
+	}
+
+	return nil, errErchefUnavailable
+}
+
+// erchefErrorHandler answers proxied requests that failed to reach erchef
+func erchefErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errErchefUnavailable {
+		errorHandler(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	errorHandler(w, fmt.Sprintf("Call to erchef failed: %s", err), http.StatusBadGateway)
+}
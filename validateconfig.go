@@ -0,0 +1,181 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// validateTimeout is the time every connectivity check is allowed to take
+const validateTimeout = 10 * time.Second
+
+// validateConfig loads the config and checks if all configured services can
+// be reached with the configured credentials, printing a report of all checks
+func validateConfig() error {
+	failed := false
+	step := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("[FAIL] %s: %s\n", name, err)
+			return
+		}
+		fmt.Printf("[ OK ] %s\n", name)
+	}
+
+	if err := loadConfig(); err != nil {
+		step("Load config", err)
+		return fmt.Errorf("Config validation failed")
+	}
+	step("Load config", nil)
+
+	step(fmt.Sprintf("Chef API authentication as %s", getConfig().Chef.User), validateChefAPI())
+
+	var gitConfigs []string
+	for name := range getConfig().Git {
+		gitConfigs = append(gitConfigs, name)
+	}
+	sort.Strings(gitConfigs)
+	for _, name := range gitConfigs {
+		step(fmt.Sprintf("Git token of config %s", name), validateGitConfig(name))
+	}
+
+	if getConfig().Community.Supermarket != "" {
+		step(fmt.Sprintf("Supermarket %s reachable", getConfig().Community.Supermarket),
+			validateReachable(getConfig().Community.Supermarket, false))
+	}
+	if getConfig().Supermarket.Server != "" {
+		u := privateSupermarketURL()
+		step(fmt.Sprintf("Supermarket %s reachable", u), validateReachable(u, getConfig().Supermarket.SSLNoVerify))
+	}
+
+	if getConfig().Lock.Redis != "" {
+		step(fmt.Sprintf("Redis lock server %s reachable", getConfig().Lock.Redis), validateRedis())
+	}
+
+	for _, server := range mailServers() {
+		step(fmt.Sprintf("SMTP banner of %s", server), validateSMTPBanner(server))
+	}
+
+	if failed {
+		return fmt.Errorf("Config validation failed")
+	}
+	return nil
+}
+
+func validateChefAPI() error {
+	cg, err := newChefGuardForOrg(getConfig().Chef.User, "", false)
+	if err != nil {
+		return err
+	}
+	resp, err := cg.chefClient.Get("users/" + getConfig().Chef.User)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkHTTPResponse(resp, []int{http.StatusOK})
+}
+
+// validateGitConfig checks the token by looking up the default repo, which
+// fails when the token is not valid
+func validateGitConfig(name string) error {
+	gitClient, err := getCustomClient(name)
+	if err != nil {
+		return err
+	}
+	repo := getConfig().Default.GitRepo
+	if repo == "" {
+		repo = "config"
+	}
+	_, err = gitClient.RepoExists(repo)
+	return err
+}
+
+// validateReachable checks if a URL returns any response other than a
+// server error
+func validateReachable(u string, insecure bool) error {
+	client := newHTTPClient(insecure)
+	client.Timeout = validateTimeout
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// mailServers returns all unique mail servers of all organizations
+func mailServers() []string {
+	servers := make(map[string]bool)
+	add := func(org string) {
+		if host := getEffectiveConfig("MailServer", org).(string); host != "" {
+			servers[fmt.Sprintf("%s:%d", host, getEffectiveConfig("MailPort", org).(int))] = true
+		}
+	}
+	add("")
+	for org := range getConfig().Customer {
+		add(org)
+	}
+
+	var list []string
+	for s := range servers {
+		list = append(list, s)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func validateSMTPBanner(server string) error {
+	conn, err := net.DialTimeout("tcp", server, validateTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(validateTimeout))
+
+	_, msg, err := textproto.NewConn(conn).ReadResponse(220)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(msg) == "" {
+		return fmt.Errorf("Empty SMTP banner")
+	}
+	return nil
+}
+
+func validateRedis() error {
+	reply, err := redis.String(redisDo(nil, "PING"))
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("Unexpected reply to PING: %q", reply)
+	}
+	return nil
+}
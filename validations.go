@@ -20,15 +20,17 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/xanzy/go-pathspec"
@@ -40,6 +42,9 @@ type SourceCookbook struct {
 	private   bool
 	tagged    bool
 	gitConfig string
+	repo      string
+	subdir    string
+	tag       string
 	sourceURL string
 
 	File         string   `json:"file,omitempty"`
@@ -83,7 +88,44 @@ func (cg *ChefGuard) checkCookbookFrozen() (int, error) {
 	return 0, nil
 }
 
+// checkUnfrozenAllowed rejects unfrozen uploads of cookbooks that are not
+// allowed to be uploaded without being frozen
+func (cg *ChefGuard) checkUnfrozenAllowed() (int, error) {
+	if matchesAny(compilePatterns(getEffectiveConfig("UnfrozenCookbooks", cg.ChefOrg).(string)), cg.Cookbook.Name) {
+		return 0, nil
+	}
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Cookbook Upload error found ===\n" +
+		"Cookbooks need to be frozen when uploaded, so\n" +
+		"please upload the cookbook using --freeze.\n" +
+		"===================================\n")
+}
+
+// validateCookbookStatus runs all validations of a frozen cookbook. When the
+// upload carries an override, failed validations don't stop the validation,
+// so all failures are reported (and audited) at once instead of the override
+// silently skipping all remaining stages.
 func (cg *ChefGuard) validateCookbookStatus() (int, error) {
+	var stages, failures []string
+	failed := func(errCode int, err error) bool {
+		if errCode != http.StatusPreconditionFailed || cg.Override == "" {
+			return true
+		}
+		stages = append(stages, cg.stage.get())
+		failures = append(failures, err.Error())
+		return false
+	}
+
+	if getEffectiveConfig("IncreasingVersions", cg.ChefOrg).(bool) {
+		cg.setStage("version-check")
+		if errCode, err := cg.checkVersionIncreased(); err != nil {
+			if errCode != http.StatusPreconditionFailed || !cg.continueAfterFailedCheck("version") {
+				if failed(errCode, err) {
+					return errCode, err
+				}
+			}
+		}
+	}
+	cg.setStage("dependencies")
 	if cg.Cookbook.Metadata.Dependencies != nil {
 		errCode, err := cg.checkDependencies(parseCookbookVersions(cg.Cookbook.Metadata.Dependencies), false)
 		if err != nil {
@@ -92,48 +134,91 @@ func (cg *ChefGuard) validateCookbookStatus() (int, error) {
 					"%s\n"+
 					"=================================\n", err)
 			}
-			return errCode, err
+			if failed(errCode, err) {
+				return errCode, err
+			}
 		}
 	}
-	errCode, err := cg.searchSourceCookbook()
-	if err != nil {
-		if errCode == http.StatusPreconditionFailed {
-			err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
-				"%s\n"+
-				"=====================================\n", err)
+	// Without a source there is nothing to compare, tag or publish
+	compare := !skipStep(cg.ChefOrg, cg.Cookbook.Name, "compare")
+	if compare {
+		cg.setStage("source-search")
+		errCode, err := cg.searchSourceCookbook()
+		if err != nil {
+			if errCode == http.StatusPreconditionFailed {
+				err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
+					"%s\n"+
+					"=====================================\n", err)
+			}
+			if failed(errCode, err) {
+				return errCode, err
+			}
+			compare = false
+		}
+	}
+	if !compare {
+		cg.SourceCookbook = &SourceCookbook{tagged: true, sourceURL: "N/A"}
+	}
+	if cg.SourceCookbook.LocationType != "supermarket" {
+		cg.setStage("metadata")
+		if errCode, err := cg.checkMetadata(); err != nil && failed(errCode, err) {
+			return errCode, err
+		}
+		if getEffectiveConfig("RequireChangelog", cg.ChefOrg).(bool) {
+			cg.setStage("changelog")
+			if errCode, err := cg.checkChangelog(); err != nil && failed(errCode, err) {
+				return errCode, err
+			}
 		}
-		return errCode, err
 	}
 	if !cg.SourceCookbook.artifact {
-		if errCode, err := cg.executeChecks(); err != nil {
+		cg.setStage("checks")
+		if errCode, err := cg.executeChecks(); err != nil && failed(errCode, err) {
 			return errCode, err
 		}
 	}
-	if errCode, err := cg.compareCookbooks(); err != nil {
-		if errCode == http.StatusPreconditionFailed {
-			switch cg.SourceCookbook.LocationType {
-			case "supermarket":
-				err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
-					"%s\n\nSource: %s\n\n"+
-					"Make sure you are using an unchanged community version\n"+
-					"or, if you really need to change something, make a fork and\n"+
-					"and create a pull request back to the community cookbook\n"+
-					"before trying to upload the cookbook again.\n"+
-					"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
-			case "git":
-				err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
-					"%s\n\nSource: %s\n\n"+
-					"Make sure all your changes are merged into the central\n"+
-					"repositories before trying to upload the cookbook again.\n\n"+
-					"HINT: Also double check your line endings (CRLF vs LF)!\n"+
-					"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
-			default:
-				err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
-					"%s\n\nSource: %s\n"+
-					"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
+	if compare {
+		cg.setStage("compare")
+		if errCode, err := cg.compareCookbooks(); err != nil {
+			if errCode == http.StatusPreconditionFailed {
+				switch cg.SourceCookbook.LocationType {
+				case "supermarket":
+					err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
+						"%s\n\nSource: %s\n\n"+
+						"Make sure you are using an unchanged community version\n"+
+						"or, if you really need to change something, make a fork and\n"+
+						"and create a pull request back to the community cookbook\n"+
+						"before trying to upload the cookbook again.\n"+
+						"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
+				case "git":
+					err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
+						"%s\n\nSource: %s\n\n"+
+						"Make sure all your changes are merged into the central\n"+
+						"repositories before trying to upload the cookbook again.\n\n"+
+						"HINT: Also double check your line endings (CRLF vs LF)!\n"+
+						"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
+				default:
+					err = fmt.Errorf("\n=== Cookbook Compare errors found ===\n"+
+						"%s\n\nSource: %s\n"+
+						"=====================================\n", err, strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0])
+				}
+			}
+			if failed(errCode, err) {
+				return errCode, err
 			}
 		}
-		return errCode, err
+		if getEffectiveConfig("CompareMetadata", cg.ChefOrg).(bool) {
+			cg.setStage("metadata-compare")
+			if errCode, err := cg.compareMetadata(); err != nil && failed(errCode, err) {
+				return errCode, err
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		// Report the stages of all failures, so the override audits them all
+		cg.setStage(strings.Join(stages, ","))
+		return http.StatusPreconditionFailed, fmt.Errorf("%s", strings.Join(failures, "\n"))
 	}
 	return 0, nil
 }
@@ -146,7 +231,13 @@ func (cg *ChefGuard) validateConstraints(body []byte) (int, error) {
 
 	devEnv := getEffectiveConfig("DevEnvironment", cg.ChefOrg).(string)
 	if c.CookbookVersions != nil && (c.ChefType == "environment" && c.Environment != devEnv) {
-		errCode, err := cg.checkDependencies(parseCookbookVersions(c.CookbookVersions), true)
+		var errCode int
+		var err error
+		if getEffectiveConfig("ResolveConstraints", cg.ChefOrg).(bool) {
+			errCode, err = cg.checkResolvedConstraints(c.CookbookVersions)
+		} else {
+			errCode, err = cg.checkDependencies(parseCookbookVersions(c.CookbookVersions), true)
+		}
 		if err != nil {
 			if errCode == http.StatusPreconditionFailed {
 				err = cg.formatConstraintsError(err)
@@ -161,12 +252,32 @@ func (cg *ChefGuard) validateConstraints(body []byte) (int, error) {
 			}
 			return errCode, err
 		}
+		if getEffectiveConfig("ValidateRunLists", cg.ChefOrg).(bool) {
+			if errCode, err := cg.checkRunListEntries(c.RunList); err != nil {
+				if errCode == http.StatusPreconditionFailed {
+					err = cg.formatRunListError(err)
+				}
+				return errCode, err
+			}
+		}
 	}
 	return 0, nil
 }
 
+func (cg *ChefGuard) formatRunListError(err error) error {
+	if getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType) == "permissive" {
+		return fmt.Errorf("\n==== Run List errors found ====\n"+
+			"RUNNING PERMISSIVE MODE: CHANGES ARE SAVED\n"+
+			"\n%s\n"+
+			"===============================\n", err)
+	}
+	return fmt.Errorf("\n=== Run List errors found ===\n"+
+		"%s\n"+
+		"=============================\n", err)
+}
+
 func (cg *ChefGuard) formatConstraintsError(err error) error {
-	if getEffectiveConfig("ValidateChanges", cg.ChefOrg).(string) == "permissive" {
+	if getEffectiveMode("ValidateChanges", cg.ChefOrg, cg.EndpointType) == "permissive" {
 		return fmt.Errorf("\n==== Cookbook Constraints errors found ====\n"+
 			"RUNNNING PERMISSIVE MODE: CHANGES ARE SAVED\n"+
 			"\n%s\n"+
@@ -178,6 +289,10 @@ func (cg *ChefGuard) formatConstraintsError(err error) error {
 }
 
 func (cg *ChefGuard) checkDependencies(constraints map[string][]string, validateConstraints bool) (int, error) {
+	states, err := cg.frozenStates(constraints)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
 	errors := []string{}
 	for name, versions := range constraints {
 		for _, version := range versions {
@@ -191,11 +306,7 @@ func (cg *ChefGuard) checkDependencies(constraints map[string][]string, validate
 				}
 				continue
 			}
-			frozen, err := cg.cookbookFrozen(name, version)
-			if err != nil {
-				return http.StatusBadRequest, err
-			}
-			if !frozen {
+			if !states[cookbookPin{name: name, version: version}] {
 				errors = append(errors, fmt.Sprintf("%s version %s needs to be frozen", name, version))
 			}
 		}
@@ -206,6 +317,60 @@ func (cg *ChefGuard) checkDependencies(constraints map[string][]string, validate
 	return 0, nil
 }
 
+// checkVersionIncreased makes sure a new version is not lower than the
+// highest version already on the Chef server
+func (cg *ChefGuard) checkVersionIncreased() (int, error) {
+	cb, found, err := cg.chefClient.GetCookbook(cg.Cookbook.Name)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Failed to get info for cookbook %s: %s", cg.Cookbook.Name, err)
+	}
+	if !found {
+		return 0, nil
+	}
+
+	highest := ""
+	for _, v := range cb.Versions {
+		// Uploading an existing version again is not a new version, so the
+		// frozen checks decide if it is allowed
+		if v.Version == cg.Cookbook.Version {
+			return 0, nil
+		}
+		if highest == "" || compareVersions(v.Version, highest) > 0 {
+			highest = v.Version
+		}
+	}
+	if highest == "" || compareVersions(cg.Cookbook.Version, highest) >= 0 {
+		return 0, nil
+	}
+
+	return http.StatusPreconditionFailed, fmt.Errorf("\n=== Cookbook Version error found ===\n"+
+		"Version %s is lower than the highest version (%s)\n"+
+		"of cookbook %s already on the Chef server,\n"+
+		"so please bump the version and try again.\n"+
+		"====================================\n", cg.Cookbook.Version, highest, cg.Cookbook.Name)
+}
+
+// compareVersions compares two x.y.z versions and returns -1, 0 or 1
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
 func (cg *ChefGuard) cookbookFrozen(name, version string) (bool, error) {
 	cb, found, err := cg.chefClient.GetCookbookVersion(name, version)
 	if err != nil {
@@ -232,7 +397,13 @@ func (cg *ChefGuard) compareCookbooks() (int, error) {
 		if sHash, exists := sh[file]; exists {
 			if fHash == sHash {
 				delete(sh, file)
-			} else {
+				continue
+			}
+			ignore, err := cg.compareIgnored(file)
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			if !ignore {
 				changed = append(changed, file)
 			}
 		} else {
@@ -247,8 +418,16 @@ func (cg *ChefGuard) compareCookbooks() (int, error) {
 	}
 	if len(changed) > 0 {
 		sort.StringSlice(changed).Sort()
-		return http.StatusPreconditionFailed, fmt.Errorf(
-			"The following file(s) are changed:\n - %s", strings.Join(changed, "\n - "))
+		err := fmt.Errorf(
+			"The following file(s) are changed:\n - %s\n\n%s", strings.Join(changed, "\n - "), cg.diffChangedFiles(changed))
+		// An override is notified (including the diff) when it is applied
+		if cg.Override == "" && !cg.auditMode() {
+			cg.sendAlert(
+				fmt.Sprintf("Blocked upload of cookbook %s version %s by %s", cg.Cookbook.Name, cg.Cookbook.Version, cg.User),
+				fmt.Sprintf("The upload differs from its source %s.\n\n%s", cg.SourceCookbook.sourceURL, err),
+			)
+		}
+		return http.StatusPreconditionFailed, err
 	}
 	if len(missing) > 0 {
 		sort.StringSlice(missing).Sort()
@@ -274,15 +453,41 @@ func (cg *ChefGuard) compareCookbooks() (int, error) {
 	return 0, nil
 }
 
+// diffChangedFiles returns the diffs between the source and the uploaded
+// version of all changed files
+func (cg *ChefGuard) diffChangedFiles(changed []string) string {
+	diffs := []string{}
+	for _, file := range changed {
+		upload, err := ioutil.ReadFile(path.Join(cg.CookbookPath, file))
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("Failed to read uploaded file %s: %s\n", file, err))
+			continue
+		}
+		diffs = append(diffs, unifiedDiff(file, cg.SourceFiles[file], upload))
+	}
+	return strings.TrimSuffix(strings.Join(diffs, "\n"), "\n")
+}
+
 func (cg *ChefGuard) searchSourceCookbook() (errCode int, err error) {
-	cg.SourceCookbook, errCode, err = searchCommunityCookbooks(cg.Cookbook.Name, cg.Cookbook.Version)
+	if cg.SourceRef != "" {
+		cg.SourceCookbook, err = searchGitRef(cg.ctx, sourceOfCookbook(cg.ChefOrg, cg.Cookbook.Name), cg.SourceRef)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if cg.SourceCookbook != nil {
+			return 0, nil
+		}
+		return http.StatusPreconditionFailed, fmt.Errorf(
+			"Failed to locate commit %s of the %s cookbook!", cg.SourceRef, cg.Cookbook.Name)
+	}
+	cg.SourceCookbook, errCode, err = searchCommunityCookbooks(cg.ctx, cg.Cookbook.Name, cg.Cookbook.Version)
 	if err != nil {
 		return errCode, err
 	}
 	if cg.SourceCookbook != nil {
 		return 0, nil
 	}
-	cg.SourceCookbook, errCode, err = searchPrivateCookbooks(cg.ChefOrg, cg.Cookbook.Name, cg.Cookbook.Version)
+	cg.SourceCookbook, errCode, err = searchPrivateCookbooks(cg.ctx, cg.ChefOrg, cg.Cookbook.Name, cg.Cookbook.Version)
 	if err != nil {
 		return errCode, err
 	}
@@ -298,6 +503,10 @@ func (cg *ChefGuard) ignoreThisFile(file string, ignoreDefaultFiles bool) (ignor
 		if file == "metadata.rb" || file == "metadata.json" || strings.HasPrefix(file, "spec/") || strings.HasPrefix(file, "test/") {
 			return true, nil
 		}
+		ignore, err = cg.compareIgnored(file)
+		if ignore || err != nil {
+			return ignore, err
+		}
 	}
 	ignore, err = pathspec.GitIgnore(bytes.NewReader(cg.GitIgnoreFile), file)
 	if ignore || err != nil {
@@ -310,13 +519,41 @@ func (cg *ChefGuard) ignoreThisFile(file string, ignoreDefaultFiles bool) (ignor
 	return false, nil
 }
 
+// compareIgnored returns true if the file matches one of the configured
+// patterns of files that are ignored when comparing the cookbook
+func (cg *ChefGuard) compareIgnored(file string) (bool, error) {
+	return pathspec.GitIgnore(strings.NewReader(cg.compareIgnorePatterns()), file)
+}
+
+func (cg *ChefGuard) compareIgnorePatterns() string {
+	patterns := getConfig().Default.CompareIgnore
+	if custPatterns := getEffectiveConfig("CompareIgnore", cg.ChefOrg).(string); custPatterns != patterns {
+		patterns = fmt.Sprintf("%s,%s", patterns, custPatterns)
+	}
+	if c, ok := getConfig().Cookbook[cg.Cookbook.Name]; ok && c.CompareIgnore != "" {
+		patterns = fmt.Sprintf("%s,%s", patterns, c.CompareIgnore)
+	}
+
+	var lines []string
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			lines = append(lines, p)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (cg *ChefGuard) getSourceFileHashes() (map[string][16]byte, error) {
 	client, err := newDownloadClient(cg.SourceCookbook)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create a new download client: %s", err)
 	}
 
-	resp, err := client.Get(cg.SourceCookbook.DownloadURL.String())
+	req, err := http.NewRequest("GET", cg.SourceCookbook.DownloadURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a download request: %s", err)
+	}
+	resp, err := client.Do(req.WithContext(cg.ctx))
 	if err != nil {
 		return nil, fmt.Errorf(
 			"Failed to download the cookbook from %s: %s", strings.Split(cg.SourceCookbook.DownloadURL.String(), "&")[0], err)
@@ -356,25 +593,55 @@ func (cg *ChefGuard) getSourceFileHashes() (map[string][16]byte, error) {
 
 			file := strings.SplitN(header.Name, "/", 2)[1]
 
-			// The source version should be leading, so save .gitignore file if we find one
-			if file == ".gitignore" {
-				cg.GitIgnoreFile = content
-			}
-
-			// The source version should be leading, so save chefignore file if we find one
-			if file == "chefignore" {
-				cg.ChefIgnoreFile = content
+			// Only use the files in the subdirectory of the cookbook (if any)
+			if cg.SourceCookbook.subdir != "" {
+				if !strings.HasPrefix(file, cg.SourceCookbook.subdir+"/") {
+					continue
+				}
+				file = strings.TrimPrefix(file, cg.SourceCookbook.subdir+"/")
 			}
 
-			files[file] = md5.Sum(content)
+			cg.addSourceFile(files, file, content)
 		}
 	}
 
 	return files, nil
 }
 
-func searchCommunityCookbooks(name, version string) (*SourceCookbook, int, error) {
-	sc, errCode, err := searchSupermarket(cfg.Community.Supermarket, name, version)
+// addSourceFile adds the hash of a file of the source cookbook and keeps the
+// content of the files needed to validate or explain the upload
+func (cg *ChefGuard) addSourceFile(files map[string][16]byte, file string, content []byte) {
+	// The source version should be leading, so save .gitignore file if we find one
+	if file == ".gitignore" {
+		cg.GitIgnoreFile = content
+	}
+
+	// The source version should be leading, so save chefignore file if we find one
+	if file == "chefignore" {
+		cg.ChefIgnoreFile = content
+	}
+
+	// Save the metadata of the source, so it can be compared with the upload
+	if file == "metadata.json" || file == "metadata.rb" {
+		if cg.SourceMetadata == nil {
+			cg.SourceMetadata = make(map[string][]byte)
+		}
+		cg.SourceMetadata[file] = content
+	}
+
+	files[file] = cg.contentHash(content)
+
+	// Keep the source of changed files, so we can show what changed
+	if h, ok := cg.FileHashes[file]; ok && h != files[file] {
+		if cg.SourceFiles == nil {
+			cg.SourceFiles = make(map[string][]byte)
+		}
+		cg.SourceFiles[file] = content
+	}
+}
+
+func searchCommunityCookbooks(ctx context.Context, name, version string) (*SourceCookbook, int, error) {
+	sc, errCode, err := searchSupermarket(ctx, getConfig().Community.Supermarket, name, version)
 	if err != nil {
 		return nil, errCode, err
 	}
@@ -383,8 +650,9 @@ func searchCommunityCookbooks(name, version string) (*SourceCookbook, int, error
 		return sc, 0, nil
 	}
 	if errCode == 1 {
-		if cfg.Community.Forks != "" {
-			sc, err = searchGit(strings.Split(cfg.Community.Forks, ","), name, version, true)
+		if getConfig().Community.Forks != "" {
+			src := &cookbookSource{repo: name, tagPrefix: "v"}
+			sc, err = searchGit(ctx, strings.Split(getConfig().Community.Forks, ","), src, version, true)
 			if err != nil {
 				return nil, http.StatusBadRequest, err
 			}
@@ -402,18 +670,9 @@ func searchCommunityCookbooks(name, version string) (*SourceCookbook, int, error
 	return nil, 0, nil
 }
 
-func searchPrivateCookbooks(chefOrg, name, version string) (*SourceCookbook, int, error) {
-	if cfg.Supermarket.Server != "" {
-		var u string
-		switch cfg.Supermarket.Port {
-		case "80":
-			u = fmt.Sprintf("http://%s", cfg.Supermarket.Server)
-		case "443":
-			u = fmt.Sprintf("https://%s", cfg.Supermarket.Server)
-		default:
-			u = fmt.Sprintf("http://%s:%s", cfg.Supermarket.Server, cfg.Supermarket.Port)
-		}
-		sc, errCode, err := searchSupermarket(u, name, version)
+func searchPrivateCookbooks(ctx context.Context, chefOrg, name, version string) (*SourceCookbook, int, error) {
+	if u := privateSupermarketURL(); u != "" {
+		sc, errCode, err := searchSupermarket(ctx, u, name, version)
 		if err != nil {
 			return nil, errCode, err
 		}
@@ -423,12 +682,8 @@ func searchPrivateCookbooks(chefOrg, name, version string) (*SourceCookbook, int
 		}
 	}
 	if getEffectiveConfig("SearchGit", chefOrg).(bool) {
-		gitConfigs := cfg.Default.GitCookbookConfigs
-		custGitConfigs := getEffectiveConfig("GitCookbookConfigs", chefOrg)
-		if gitConfigs != custGitConfigs {
-			gitConfigs = fmt.Sprintf("%s,%s", gitConfigs, custGitConfigs)
-		}
-		sc, err := searchGit(strings.Split(gitConfigs, ","), name, version, false)
+		src := sourceOfCookbook(chefOrg, name)
+		sc, err := searchGit(ctx, src.gitConfigs, src, version, false)
 		if err != nil {
 			return nil, http.StatusBadRequest, err
 		}
@@ -440,36 +695,58 @@ func searchPrivateCookbooks(chefOrg, name, version string) (*SourceCookbook, int
 	return nil, 0, nil
 }
 
-func searchSupermarket(supermarket, name, version string) (*SourceCookbook, int, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/%s", supermarket, "universe"))
-	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf(
-			"Failed to parse the community cookbooks URL %s: %s", supermarket, err)
-	}
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf(
-			"Failed to get cookbook list from %s: %s", u.String(), err)
+// privateSupermarketURL returns the base URL of the private Supermarket (or
+// the detected universe endpoint of the Chef server) if there is one
+func privateSupermarketURL() string {
+	c := getConfig()
+	if c.Supermarket.Server == "" {
+		if c.Supermarket.AutoDetect {
+			return detectChefUniverse()
+		}
+		return ""
+	}
+
+	switch c.Supermarket.Port {
+	case "80":
+		return fmt.Sprintf("http://%s", c.Supermarket.Server)
+	case "443":
+		return fmt.Sprintf("https://%s", c.Supermarket.Server)
+	default:
+		scheme := "http"
+		if requireHTTPS() {
+			scheme = "https"
+		}
+		return fmt.Sprintf("%s://%s:%s", scheme, c.Supermarket.Server, c.Supermarket.Port)
 	}
-	defer resp.Body.Close()
-	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf(
-			"Failed to get cookbook list from %s: %s", u.String(), err)
+}
+
+// cookbookGitConfigs returns the Git configs to search for cookbooks, with
+// the default configs searched first
+func cookbookGitConfigs(chefOrg string) []string {
+	gitConfigs := getConfig().Default.GitCookbookConfigs
+	custGitConfigs := getEffectiveConfig("GitCookbookConfigs", chefOrg)
+	if gitConfigs != custGitConfigs {
+		gitConfigs = fmt.Sprintf("%s,%s", gitConfigs, custGitConfigs)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	return strings.Split(gitConfigs, ",")
+}
+
+// searchSupermarket searches the universe of a Supermarket for the cookbook.
+// The universe is cached and shared between requests, so only the lookup of
+// the download URL is bound to the context.
+func searchSupermarket(ctx context.Context, supermarket, name, version string) (*SourceCookbook, int, error) {
+	results, err := supermarketUniverse(supermarket)
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf(
-			"Failed to read the response body from %v: %s", resp, err)
-	}
-	results := make(map[string]map[string]*SourceCookbook)
-	if err := json.Unmarshal(body, &results); err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf(
-			"Failed to unmarshal body %s: %s", string(body), err)
+		return nil, http.StatusBadRequest, err
 	}
 	if cb, exists := results[name]; exists {
-		if sc, exists := cb[version]; exists {
+		// Cookbooks served by a Chef server cannot be downloaded as an archive,
+		// and the Chef server the cookbook is uploaded to is never a trusted
+		// source as every version on it would validate against itself
+		if e, exists := cb[version]; exists && e.LocationType != "chef_server" {
+			sc := &SourceCookbook{LocationType: e.LocationType, LocationPath: e.LocationPath}
 			sc.artifact = true
-			u, err := communityDownloadURL(sc.LocationPath, name, version)
+			u, err := communityDownloadURL(ctx, sc.LocationPath, name, version)
 			if err != nil {
 				return nil, http.StatusBadRequest, err
 			}
@@ -484,14 +761,21 @@ func searchSupermarket(supermarket, name, version string) (*SourceCookbook, int,
 	return nil, 0, nil
 }
 
-func communityDownloadURL(path, name, version string) (*url.URL, error) {
+func communityDownloadURL(ctx context.Context, path, name, version string) (*url.URL, error) {
 	u, err := url.Parse(fmt.Sprintf(
 		"%s/cookbooks/%s/versions/%s", path, name, strings.Replace(version, ".", "_", -1)))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse the cookbook URL %s: %s", fmt.Sprintf("%s/cookbooks/%s/versions/%s",
 			path, name, strings.Replace(version, ".", "_", -1)), err)
 	}
-	resp, err := http.Get(u.String())
+	if u, err = secureURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a request for %s: %s", u.String(), err)
+	}
+	resp, err := newHTTPClient(false).Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get cookbook info from %s: %s", u.String(), err)
 	}
@@ -511,13 +795,13 @@ func communityDownloadURL(path, name, version string) (*url.URL, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse the cookbook download URL %s: %s", sc.File, err)
 	}
-	return u, nil
+	return secureURL(u)
 }
 
-func searchGit(gitConfigs []string, name, version string, tagsOnly bool) (*SourceCookbook, error) {
+func searchGit(ctx context.Context, gitConfigs []string, src *cookbookSource, version string, tagsOnly bool) (*SourceCookbook, error) {
 	for _, gitConfig := range gitConfigs {
 		gitConfig = strings.TrimSpace(gitConfig)
-		link, tagged, err := searchGitForCookbook(gitConfig, name, fmt.Sprintf("v%s", version), tagsOnly)
+		link, tagged, err := searchGitForCookbook(ctx, gitConfig, src.repo, src.tag(version), tagsOnly)
 		if err != nil {
 			return nil, err
 		}
@@ -526,6 +810,12 @@ func searchGit(gitConfigs []string, name, version string, tagsOnly bool) (*Sourc
 			sc.artifact = false
 			sc.tagged = tagged
 			sc.gitConfig = gitConfig
+			sc.repo = src.repo
+			sc.subdir = src.subdir
+			sc.tag = src.tag(version)
+			if link, err = secureURL(link); err != nil {
+				return nil, err
+			}
 			sc.DownloadURL = link
 			sc.sourceURL = strings.Split(link.String(), "&")[0]
 			return sc, nil
@@ -536,26 +826,77 @@ func searchGit(gitConfigs []string, name, version string, tagsOnly bool) (*Sourc
 
 func newDownloadClient(sc *SourceCookbook) (*http.Client, error) {
 	if sc.LocationType != "git" {
-		return http.DefaultClient, nil
+		return newHTTPClient(false), nil
 	}
-	if _, ok := cfg.Git[sc.gitConfig]; !ok {
+	gitConfig, ok := getConfig().Git[sc.gitConfig]
+	if !ok {
 		return nil, fmt.Errorf("No Git config specified for: %s!", sc.gitConfig)
 	}
+	return newHTTPClient(gitConfig.SSLNoVerify), nil
+}
 
-	client := http.DefaultClient
+// newHTTPClient returns a client for outbound downloads that applies the
+// configured redirect policy, timeouts and retries
+func newHTTPClient(insecure bool) *http.Client {
+	return &http.Client{
+		Transport:     &requestIDTransport{base: &retryTransport{base: outboundTransport(insecure)}},
+		CheckRedirect: checkRedirect,
+	}
+}
 
-	if gitConfig, ok := cfg.Git[sc.gitConfig]; ok && gitConfig.SSLNoVerify {
-		client = &http.Client{Transport: insecureTransport}
+// checkRedirect limits the number of redirects, refuses redirects to plain
+// HTTP when HTTPS is required and makes sure no credentials are send to a
+// different host than the one we originally connected to
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	maxRedirects := getConfig().Default.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = 10
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+	}
+	if requireHTTPS() && req.URL.Scheme != "https" {
+		return fmt.Errorf("Refusing to follow a redirect from %s to insecure URL %s",
+			via[len(via)-1].URL.Host, strings.Split(req.URL.String(), "?")[0])
+	}
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		if getConfig().Default.SameHostRedirects {
+			return fmt.Errorf("Refusing to follow a redirect from %s to different host %s",
+				via[0].URL.Host, req.URL.Host)
+		}
+		req.Header.Del("Authorization")
+		req.Header.Del("Private-Token")
+		req.Header.Del("Cookie")
 	}
+	return nil
+}
 
-	return client, nil
+// secureURL applies the configured insecure downloads policy to u
+func secureURL(u *url.URL) (*url.URL, error) {
+	if !requireHTTPS() || u.Scheme == "https" {
+		return u, nil
+	}
+	if getConfig().Default.InsecureDownloads == "reject" || u.Scheme != "http" {
+		return nil, fmt.Errorf("Refusing to download from insecure URL %s", strings.Split(u.String(), "?")[0])
+	}
+	su := *u
+	su.Scheme = "https"
+	return &su, nil
 }
 
+func requireHTTPS() bool {
+	return getConfig().Default.InsecureDownloads == "upgrade" || getConfig().Default.InsecureDownloads == "reject"
+}
+
+var (
+	pinnedVersion  = regexp.MustCompile(`^(?:= )?(\d+\.\d+\.\d+)$`)
+	runlistVersion = regexp.MustCompile(`^.*\[(\w+).*@(\d+\.\d+\.\d+)\]$`)
+)
+
 func parseCookbookVersions(constraints map[string]string) map[string][]string {
-	re := regexp.MustCompile(`^(?:= )?(\d+\.\d+\.\d+)$`)
 	cbs := make(map[string][]string)
 	for name, constraint := range constraints {
-		if res := re.FindStringSubmatch(constraint); res != nil {
+		if res := pinnedVersion.FindStringSubmatch(constraint); res != nil {
 			version := res[1]
 			cbs[name] = []string{version}
 		} else {
@@ -566,10 +907,9 @@ func parseCookbookVersions(constraints map[string]string) map[string][]string {
 }
 
 func parseRunlists(runlists []string) map[string][]string {
-	re := regexp.MustCompile(`^.*\[(\w+).*@(\d+\.\d+\.\d+)\]$`)
 	cbs := make(map[string][]string)
 	for _, constraint := range runlists {
-		if res := re.FindStringSubmatch(constraint); res != nil {
+		if res := runlistVersion.FindStringSubmatch(constraint); res != nil {
 			name := res[1]
 			version := res[2]
 			if !contains(cbs[name], version) {
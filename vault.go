@@ -0,0 +1,218 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultLease holds the time after which the secrets read from Vault need to
+// be read again, as determined by the last successfully loaded config, and
+// the remaining TTL of the Vault token as returned by its last renewal
+var vaultLease = struct {
+	sync.Mutex
+	d     time.Duration
+	token time.Duration
+}{}
+
+// vaultClient reads secrets from the KV secrets engine of Vault. Every path
+// is only read once while resolving the values of a config.
+type vaultClient struct {
+	address   string
+	token     string
+	namespace string
+	client    *http.Client
+	secrets   map[string]map[string]interface{}
+	lease     time.Duration
+}
+
+func newVaultClient(c *Config) *vaultClient {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if c.Vault.SSLNoVerify {
+		client.Transport = insecureTransport
+	}
+	return &vaultClient{
+		address:   strings.TrimRight(c.Vault.Address, "/"),
+		token:     c.Vault.Token,
+		namespace: c.Vault.Namespace,
+		client:    client,
+		secrets:   make(map[string]map[string]interface{}),
+	}
+}
+
+// resolve returns the value of a vault://<path>#<field> reference
+func (v *vaultClient) resolve(ref string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(ref, "vault://"), "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Invalid Vault reference %q, expected vault://<path>#<field>", ref)
+	}
+
+	secret, ok := v.secrets[parts[0]]
+	if !ok {
+		var err error
+		if secret, err = v.read(parts[0]); err != nil {
+			return "", err
+		}
+		v.secrets[parts[0]] = secret
+	}
+
+	value, ok := secret[parts[1]].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string field %s", parts[0], parts[1])
+	}
+	return value, nil
+}
+
+func (v *vaultClient) read(p string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s", v.address, strings.Trim(p, "/")), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request for Vault secret %s: %s", p, err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read Vault secret %s: %s", p, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return nil, fmt.Errorf("Failed to read Vault secret %s: %s", p, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body of Vault secret %s: %s", p, err)
+	}
+
+	var secret struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal Vault secret %s: %s", p, err)
+	}
+
+	if lease := time.Duration(secret.LeaseDuration) * time.Second; lease > 0 && (v.lease == 0 || lease < v.lease) {
+		v.lease = lease
+	}
+
+	// Version 2 of the KV secrets engine wraps the data with its metadata
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return data, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+// renewToken renews the Vault token and returns its new TTL, which is zero
+// for tokens that never expire
+func (v *vaultClient) renewToken() (time.Duration, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/auth/token/renew-self", v.address), nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create request to renew the Vault token: %s", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to renew the Vault token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK}); err != nil {
+		return 0, fmt.Errorf("Failed to renew the Vault token: %s", err)
+	}
+
+	var renewal struct {
+		Auth struct {
+			LeaseDuration int `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&renewal); err != nil {
+		return 0, fmt.Errorf("Failed to unmarshal the Vault token renewal: %s", err)
+	}
+
+	return time.Duration(renewal.Auth.LeaseDuration) * time.Second, nil
+}
+
+// renewVaultToken renews the Vault token of the active config, so it doesn't
+// expire before the secrets are refreshed with it
+func renewVaultToken() {
+	ttl, err := newVaultClient(getConfig()).renewToken()
+	if err != nil {
+		ERROR.Println(err)
+		return
+	}
+
+	vaultLease.Lock()
+	vaultLease.token = ttl
+	vaultLease.Unlock()
+}
+
+// startVaultRefresher periodically renews the Vault token and reloads the
+// config, so secrets read from Vault are refreshed before their lease expires
+// and rotated credentials are picked up without editing the config file
+func startVaultRefresher() {
+	if getConfig().Vault.Address == "" {
+		return
+	}
+
+	go func() {
+		for {
+			renewVaultToken()
+			time.Sleep(vaultRefreshInterval())
+			if err := loadConfig(); err != nil {
+				ERROR.Printf("Failed to refresh the secrets from Vault: %s", err)
+				continue
+			}
+			INFO.Println("Refreshed the secrets from Vault")
+		}
+	}()
+}
+
+// vaultRefreshInterval returns the time until the secrets need to be read
+// again, which is well before the shortest lease or the token expires
+func vaultRefreshInterval() time.Duration {
+	vaultLease.Lock()
+	lease := vaultLease.d
+	if token := vaultLease.token; token > 0 && (lease == 0 || token < lease) {
+		lease = token
+	}
+	vaultLease.Unlock()
+
+	if lease > 0 {
+		return lease * 2 / 3
+	}
+	if getConfig().Vault.Refresh > 0 {
+		return time.Duration(getConfig().Vault.Refresh) * time.Second
+	}
+	return 5 * time.Minute
+}
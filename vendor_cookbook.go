@@ -0,0 +1,107 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/xanzy/chef-guard/git"
+)
+
+// vendorCookbook commits the complete source of the uploaded cookbook version
+// into the vendor repo, giving a reviewable copy of everything deployed
+func (cg *ChefGuard) vendorCookbook(repo string, archive io.ReadCloser) {
+	defer archive.Close()
+
+	name, version := cg.Cookbook.Name, cg.Cookbook.Version
+
+	files, err := untarCookbook(archive, fmt.Sprintf("%s/%s", name, version))
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to unpack cookbook %s version %s: %s", name, version, err)
+		return
+	}
+
+	gitClient, err := getCustomClientContext(cg.gitContext(), getConfig().Default.GitConfig)
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to create Git client: %s", err)
+		return
+	}
+
+	msg := fmt.Sprintf("Cookbook %s version %s vendored by Chef-Guard", name, version)
+	user := &git.User{
+		Name: cg.User,
+		Mail: fmt.Sprintf("%s@%s", cg.User, getEffectiveConfig("MailDomain", cg.ChefOrg).(string)),
+	}
+
+	unlock, err := ms.Lock(repo)
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to vendor cookbook %s version %s: %s", name, version, err)
+		return
+	}
+	defer unlock()
+
+	sha, err := gitClient.CommitFiles(repo, "master", msg, user, files)
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to vendor cookbook %s version %s: %s", name, version, err)
+		return
+	}
+
+	logf(INFO, cg.RequestID, "Vendored cookbook %s version %s into repo %s (%s)", name, version, repo, sha)
+}
+
+// untarCookbook returns the content of all files in the cookbook archive,
+// with the cookbook name in their paths replaced by the prefix
+func untarCookbook(archive io.Reader, prefix string) (map[string][]byte, error) {
+	gr, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a new gzipReader: %s", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("Failed to process all files: %s", err)
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s", header.Name, err)
+		}
+
+		parts := strings.SplitN(header.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		files[fmt.Sprintf("%s/%s", prefix, parts[1])] = content
+	}
+
+	return files, nil
+}
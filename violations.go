@@ -0,0 +1,99 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var checkViolations = expvar.NewMap("check_violations_total")
+
+// Violation is a single structured violation found by one of the checks
+type Violation struct {
+	Check   string `json:"check" desc:"Check that found the violation (foodcritic, cookstyle or rubocop)"`
+	File    string `json:"file" desc:"File relative to the cookbook root"`
+	Line    int    `json:"line" desc:"Line number, 0 if unknown"`
+	Rule    string `json:"rule" desc:"Rule or cop that was violated"`
+	Message string `json:"message" desc:"Description of the violation"`
+}
+
+// ViolationsEvent is the payload posted to the violations webhook
+type ViolationsEvent struct {
+	Schema     string       `json:"schema" desc:"Schema ID of the event (violations/v1)"`
+	Time       time.Time    `json:"time" desc:"Time of the check in UTC"`
+	Org        string       `json:"org" desc:"Chef organization, empty when not using Chef Enterprise"`
+	User       string       `json:"user" desc:"Chef user that uploaded the cookbook"`
+	Cookbook   string       `json:"cookbook" desc:"Name of the cookbook"`
+	Version    string       `json:"version" desc:"Version of the cookbook"`
+	Check      string       `json:"check" desc:"Check that found the violations"`
+	Violations []*Violation `json:"violations" desc:"All violations found by the check"`
+	RequestID  string       `json:"request_id,omitempty" desc:"ID of the upload request the check was part of"`
+}
+
+// exportViolations counts the violations per rule and posts them to the
+// violations webhook (if configured)
+func (cg *ChefGuard) exportViolations(check string, violations []*Violation) {
+	if len(violations) == 0 {
+		return
+	}
+
+	for _, v := range violations {
+		checkViolations.Add(fmt.Sprintf("%s:%s", check, v.Rule), 1)
+	}
+
+	if getConfig().Webhook.ViolationsURL == "" {
+		return
+	}
+
+	data, err := json.Marshal(&ViolationsEvent{
+		Schema:     violationsSchema,
+		Time:       time.Now().UTC(),
+		Org:        cg.ChefOrg,
+		User:       cg.User,
+		Cookbook:   cg.Cookbook.Name,
+		Version:    cg.Cookbook.Version,
+		Check:      check,
+		Violations: violations,
+		RequestID:  cg.RequestID,
+	})
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to marshal %s violations: %s", check, err)
+		return
+	}
+
+	go postEvent(cg.RequestID, getConfig().Webhook.ViolationsURL, fmt.Sprintf("%s violations", check), data)
+}
+
+// postEvent posts a marshalled event to a webhook, logging any failure with
+// the ID of the request that caused the event (if any)
+func postEvent(id, url, what string, data []byte) {
+	resp, err := newHTTPClient(false).Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		logf(ERROR, id, "Failed to post %s: %s", what, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := checkHTTPResponse(resp, []int{http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent}); err != nil {
+		logf(ERROR, id, "Failed to post %s: %s", what, err)
+	}
+}
@@ -0,0 +1,244 @@
+//
+// Copyright 2015, Sander van Harmelen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WebhookEvent holds the fields we need from both GitHub and GitLab push events
+type WebhookEvent struct {
+	Ref        string `json:"ref"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+			Name  string `json:"name"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	After   string `json:"after"`
+	Commits []struct {
+		Message  string   `json:"message"`
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+func processWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := dumpBody(r)
+	if err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to get body from call to %s: %s", r.URL.String(), err), http.StatusBadRequest)
+		return
+	}
+
+	gitType, err := verifyWebhook(r, body)
+	if err != nil {
+		errorHandler(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	e := new(WebhookEvent)
+	if err := json.Unmarshal(body, e); err != nil {
+		errorHandler(w, fmt.Sprintf("Failed to unmarshal body %s: %s", string(body), err), http.StatusBadRequest)
+		return
+	}
+
+	owner, repo := e.Repository.Owner.Login, e.Repository.Name
+	if owner == "" {
+		owner = e.Repository.Owner.Name
+	}
+	if gitType == "gitlab" {
+		owner, repo = path.Split(e.Project.PathWithNamespace)
+		owner = strings.TrimSuffix(owner, "/")
+	}
+
+	// Update the rules when the rules repo is changed
+	if e.Ref == "refs/heads/master" && isRulesRepo(gitType, owner, repo) {
+		goSafe(r, func() {
+			if err := updateRules(); err != nil {
+				logf(ERROR, requestID(r), "Failed to update rules from repo %s: %s", getConfig().Rules.Repo, err)
+			}
+		})
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Apply changes pushed to the config repo back to the Chef server
+	if getConfig().Webhook.ApplyChanges && e.Ref == "refs/heads/master" && isConfigRepoOwner(gitType, owner) {
+		changes := configChanges(e)
+		goSafe(r, func() { applyGitChanges(requestID(r), repo, changes) })
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	name, version := cookbookForTag(repo, strings.TrimPrefix(e.Ref, "refs/tags/"))
+	if !strings.HasPrefix(e.Ref, "refs/tags/") || name == "" || e.Deleted || e.After == "0000000000000000000000000000000000000000" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	gitConfig := findGitConfig(gitType, owner)
+	if gitConfig == "" {
+		errorHandler(w, fmt.Sprintf("No Git config found for %s organization %s", gitType, owner), http.StatusNotFound)
+		return
+	}
+
+	// The cookbook is verified in every org that searches the Git config the
+	// tag was pushed to, as the webhook itself doesn't tell us the org
+	orgs := orgsForGitConfig(gitConfig)
+	if len(orgs) == 0 {
+		errorHandler(w, fmt.Sprintf("No organization searches Git config %s for cookbooks", gitConfig), http.StatusNotFound)
+		return
+	}
+
+	for _, org := range orgs {
+		cg, err := newChefGuardForOrg(getConfig().Chef.User, org, false)
+		if err != nil {
+			errorHandler(w, fmt.Sprintf("Failed to create a new ChefGuard structure: %s", err), http.StatusInternalServerError)
+			return
+		}
+		cg.setRequestID(requestID(r))
+
+		// Verifying a cookbook can take quite some time, so do it in the background
+		goSafe(r, func() { cg.reverifyCookbook(gitConfig, name, version) })
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// orgsForGitConfig returns the organizations (with "" being the default org)
+// that search the Git config for cookbooks
+func orgsForGitConfig(gitConfig string) []string {
+	orgs := []string{}
+	if containsType(getConfig().Default.GitCookbookConfigs, gitConfig) {
+		orgs = append(orgs, "")
+	}
+	for org := range getConfig().Customer {
+		if containsType(strings.Join(cookbookGitConfigs(org), ","), gitConfig) {
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+// verifyWebhook validates the signature (GitHub) or token (GitLab) of the
+// request and returns the type of Git service that send the request.
+func verifyWebhook(r *http.Request, body []byte) (string, error) {
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(getConfig().Webhook.Secret)) != 1 {
+			return "", fmt.Errorf("Invalid webhook token")
+		}
+		return "gitlab", nil
+	}
+
+	var h func() hash.Hash
+	sig := r.Header.Get("X-Hub-Signature-256")
+	switch {
+	case strings.HasPrefix(sig, "sha256="):
+		h = sha256.New
+	case strings.HasPrefix(r.Header.Get("X-Hub-Signature"), "sha1="):
+		sig = r.Header.Get("X-Hub-Signature")
+		h = sha1.New
+	default:
+		return "", fmt.Errorf("Missing webhook signature")
+	}
+
+	mac := hmac.New(h, []byte(getConfig().Webhook.Secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(sig[strings.Index(sig, "=")+1:]), []byte(expected)) {
+		return "", fmt.Errorf("Invalid webhook signature")
+	}
+
+	return "github", nil
+}
+
+func findGitConfig(gitType, owner string) string {
+	for name, gc := range getConfig().Git {
+		if gc.Type == gitType && strings.EqualFold(gc.Organization, owner) {
+			return name
+		}
+	}
+	return ""
+}
+
+// reverifyCookbook compares the tagged source with the cookbook version that
+// is already on the Chef server and sends an alert when they differ.
+func (cg *ChefGuard) reverifyCookbook(gitConfig, name, version string) {
+	cb, found, err := cg.chefClient.GetCookbookVersion(name, version)
+	if err != nil {
+		logf(ERROR, cg.RequestID, "Failed to get info for cookbook %s version %s: %s", name, version, err)
+		return
+	}
+	if !found {
+		return
+	}
+
+	cg.Cookbook = cb
+	cg.CookbookPath = path.Join(getConfig().Default.Tempdir, fmt.Sprintf("webhook-%s-%s", name, version))
+	defer cg.cleanupCookbookFiles()
+
+	if err := cg.processCookbookFiles(); err != nil {
+		logf(ERROR, cg.RequestID, "Failed to process files of cookbook %s version %s: %s", name, version, err)
+		return
+	}
+
+	src := sourceOfCookbook(cg.ChefOrg, name)
+	link, _, err := searchGitForCookbook(cg.ctx, gitConfig, src.repo, src.tag(version), true)
+	if err != nil || link == nil {
+		logf(ERROR, cg.RequestID, "Failed to get the archive link of cookbook %s version %s: %v", name, version, err)
+		return
+	}
+
+	cg.SourceCookbook = &SourceCookbook{LocationType: "git"}
+	cg.SourceCookbook.gitConfig = gitConfig
+	cg.SourceCookbook.repo = src.repo
+	cg.SourceCookbook.subdir = src.subdir
+	cg.SourceCookbook.tag = src.tag(version)
+	cg.SourceCookbook.DownloadURL = link
+	cg.SourceCookbook.sourceURL = strings.Split(link.String(), "&")[0]
+
+	if errCode, err := cg.compareCookbooks(); err != nil {
+		if errCode != http.StatusPreconditionFailed {
+			logf(ERROR, cg.RequestID, "Failed to compare cookbook %s version %s: %s", name, version, err)
+			return
+		}
+		cg.sendAlert(
+			fmt.Sprintf("Tag %s of cookbook %s differs from the uploaded version", src.tag(version), name),
+			fmt.Sprintf("The tag was pushed after the cookbook was uploaded to the Chef server.\n\n%s\n\nSource: %s",
+				err, cg.SourceCookbook.sourceURL),
+		)
+	}
+}